@@ -0,0 +1,195 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	provider "github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/git-ops/git-deployer/providers"
+)
+
+// Username GitHub expects when cloning and pushing with a GitHub App installation token.
+const gitHubAppUser = "x-access-token"
+
+// Names of the files written to the temporary SSH directory when authenticating over SSH.
+const (
+	sshKeyFileName        = "id_git"
+	sshKnownHostsFileName = "known_hosts"
+)
+
+// gitAuth provides the credentials used for the git operations and the Git provider API calls.
+type gitAuth struct {
+	// The username used in the URL of the remote.
+	user string
+	// The token used when authenticating with a personal access token.
+	token string
+	// Mints short-lived installation tokens when authenticating as a GitHub App.
+	tokenSource *provider.GitHubAppTokenSource
+	// The temporary directory holding the private key and known hosts files when authenticating over SSH.
+	sshDir string
+	// The GIT_SSH_COMMAND used for the git operations when authenticating over SSH.
+	sshCommand string
+}
+
+// newGitAuth returns the gitAuth for the secret based on the gitAuthType parameter. The knownHosts and
+// acceptNewHostKey are only used when authenticating over SSH.
+func newGitAuth(authType string, secret []byte, hostname, owner, knownHosts string, acceptNewHostKey bool) (*gitAuth, error) {
+	switch authType {
+	case authTypeSSH:
+		return newSSHGitAuth(secret, knownHosts, acceptNewHostKey)
+	case authTypeGitHubApp:
+	default:
+		user := owner
+		if hostname == "bitbucket.org" {
+			user = provider.BitbucketTokenUser
+		}
+		return &gitAuth{user: user, token: string(secret)}, nil
+	}
+	c, err := provider.ParseGitHubAppConfig(secret)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := provider.NewGitHubAppTokenSource(c)
+	if err != nil {
+		return nil, err
+	}
+	return &gitAuth{user: gitHubAppUser, tokenSource: ts}, nil
+}
+
+// newSSHGitAuth returns the gitAuth for authenticating over SSH with the private key. The key is written
+// with 0600 permissions to a temporary directory, which must be removed with cleanup. The host key of the
+// Git server must match one of the knownHosts entries or, if knownHosts is empty, one of the system's known
+// hosts, e.g. /etc/ssh/ssh_known_hosts. If acceptNewHostKey is true then a host key that isn't known is
+// accepted without verification instead.
+func newSSHGitAuth(key []byte, knownHosts string, acceptNewHostKey bool) (*gitAuth, error) {
+	if !bytes.Contains(key, []byte("PRIVATE KEY-----")) {
+		return nil, fmt.Errorf("secret does not contain a PEM or OpenSSH encoded private key")
+	}
+	dir, err := os.MkdirTemp("", "git-ssh-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary SSH directory: %v", err)
+	}
+	a := &gitAuth{sshDir: dir}
+
+	// ssh fails to load a key that doesn't end with a newline.
+	if !bytes.HasSuffix(key, []byte("\n")) {
+		key = append(key[:len(key):len(key)], '\n')
+	}
+	keyPath := filepath.Join(dir, sshKeyFileName)
+	if err := os.WriteFile(keyPath, key, 0600); err != nil {
+		a.cleanup()
+		return nil, fmt.Errorf("unable to write SSH private key: %v", err)
+	}
+	a.sshCommand = fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes", shellQuote(keyPath))
+	// The known hosts file in the temporary directory holds the provided entries, and the accepted host key
+	// so that it isn't written to the user's known hosts. Otherwise ssh uses the system's known hosts.
+	if len(knownHosts) != 0 || acceptNewHostKey {
+		knownHostsPath := filepath.Join(dir, sshKnownHostsFileName)
+		if len(knownHosts) != 0 {
+			if err := os.WriteFile(knownHostsPath, []byte(strings.TrimSpace(knownHosts)+"\n"), 0600); err != nil {
+				a.cleanup()
+				return nil, fmt.Errorf("unable to write SSH known hosts: %v", err)
+			}
+		}
+		a.sshCommand += fmt.Sprintf(" -o UserKnownHostsFile=%s", shellQuote(knownHostsPath))
+	}
+	hostKeyChecking := "yes"
+	if acceptNewHostKey {
+		hostKeyChecking = "accept-new"
+	}
+	a.sshCommand += fmt.Sprintf(" -o StrictHostKeyChecking=%s", hostKeyChecking)
+	return a, nil
+}
+
+// shellQuote quotes the string for the shell that git runs GIT_SSH_COMMAND with.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// cleanup removes the SSH private key and known hosts files. It's a no-op for the other authentication types.
+func (a *gitAuth) cleanup() error {
+	if len(a.sshDir) == 0 {
+		return nil
+	}
+	if err := os.RemoveAll(a.sshDir); err != nil {
+		return fmt.Errorf("unable to remove temporary SSH directory %s: %v", a.sshDir, err)
+	}
+	return nil
+}
+
+// env returns the environment variables to set for the git operations.
+func (a *gitAuth) env() []string {
+	if len(a.sshCommand) == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("GIT_SSH_COMMAND=%s", a.sshCommand)}
+}
+
+// remoteURL returns the URL of the remote of the Git repository, with the credentials embedded unless
+// authenticating over SSH.
+func (a *gitAuth) remoteURL(gitRepo *gitRepository) (string, error) {
+	if len(a.sshCommand) != 0 {
+		return gitRepo.sshRemoteURL(), nil
+	}
+	s, err := a.secret()
+	if err != nil {
+		return "", err
+	}
+	return gitRepo.remoteURL(a.user, s), nil
+}
+
+// secret returns the secret used for the git operations. When authenticating as a GitHub App the
+// cached installation token is returned, or a new one is minted if it's about to expire.
+func (a *gitAuth) secret() (string, error) {
+	if a.tokenSource == nil {
+		return a.token, nil
+	}
+	t, err := a.tokenSource.Token()
+	if err != nil {
+		return "", fmt.Errorf("unable to mint GitHub App installation token: %v", err)
+	}
+	return t, nil
+}
+
+// refreshRemote updates the credentials of the remote of the Git repository with a valid installation
+// token, since the token used for cloning may have expired. It's a no-op for static tokens.
+func (a *gitAuth) refreshRemote(gitRepo *gitRepository) error {
+	if a.tokenSource == nil {
+		return nil
+	}
+	s, err := a.secret()
+	if err != nil {
+		return err
+	}
+	if _, err := gitRepo.setRemoteCredentials(a.user, s); err != nil {
+		return fmt.Errorf("unable to update remote credentials: %v", err)
+	}
+	return nil
+}
+
+// gitProvider returns the GitProvider for the Git repository using the credentials.
+func (a *gitAuth) gitProvider(gitRepo *gitRepository) (provider.GitProvider, error) {
+	if len(a.sshCommand) != 0 {
+		return nil, fmt.Errorf("the git provider API is not supported when authenticating over SSH")
+	}
+	if a.tokenSource != nil {
+		return provider.CreateGitHubAppProvider(gitRepo.hostname, gitRepo.repoName, gitRepo.owner, a.tokenSource)
+	}
+	return provider.CreateProvider(gitRepo.hostname, gitRepo.repoName, gitRepo.owner, a.token)
+}
@@ -57,11 +57,20 @@ func queryPath(rt, rn, ns, path string) ([]byte, error) {
 // runCmd starts and waits for the provided command with args to complete. If the command
 // succeeds it returns the stdout of the command.
 func runCmd(binPath string, args []string, dir string, logCmd bool) ([]byte, error) {
+	return runCmdWithEnv(binPath, args, dir, nil, logCmd)
+}
+
+// runCmdWithEnv is runCmd with the provided environment variables, in the form "key=value", set for the
+// command in addition to the environment of the process.
+func runCmdWithEnv(binPath string, args []string, dir string, env []string, logCmd bool) ([]byte, error) {
 	if logCmd {
 		fmt.Printf("Running the following command: %s %s\n", binPath, args)
 	}
 	cmd := exec.Command(binPath, args...)
 	cmd.Dir = dir
+	if len(env) != 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 
 	var stderr bytes.Buffer
 	errWriter := io.MultiWriter(&stderr, os.Stderr)
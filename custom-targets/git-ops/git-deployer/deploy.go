@@ -16,20 +16,21 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
-	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
 	"cloud.google.com/go/storage"
 	provider "github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/git-ops/git-deployer/providers"
 	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
@@ -39,8 +40,17 @@ const (
 	argoSyncedStatus = "Synced"
 	// Argo sync interval is how often to poll the Argo Application for the sync status.
 	argoSyncInterval = 15 * time.Second
+	// Name of the deploy record file written next to the manifest when gitWriteDeployRecord is enabled.
+	deployRecordFileName = "deploy-record.json"
+	// Commit message used when one isn't provided via the gitCommitMessage parameter.
+	defaultCommitMessage = "Delivery Pipeline: {pipeline} Release: {release} Rollout: {rollout}"
+	// Maximum length of a pull request comment, GitHub rejects comments longer than 65536 characters.
+	maxCommentLength = 65536
 )
 
+// commitMessagePlaceholderRegex matches the placeholders in a commit message template, e.g. {release}.
+var commitMessagePlaceholderRegex = regexp.MustCompile(`\{([^{}]*)\}`)
+
 // deployer implements the requestHandler interface for deploy requests.
 type deployer struct {
 	req       *clouddeploy.DeployRequest
@@ -91,21 +101,35 @@ func (d *deployer) process(ctx context.Context) error {
 //     b. If Argo sync polling is enabled then merge the pull request and poll the Argo application
 //     until the status is Synced.
 func (d *deployer) deploy(ctx context.Context) (*clouddeploy.DeployResult, error) {
+	commitMsg, err := commitMessage(d.params.gitCommitMessage, d.req)
+	if err != nil {
+		return nil, fmt.Errorf("invalid commit message: %v", err)
+	}
+
 	fmt.Printf("Accessing SecretVersion %s\n", d.params.gitSecret)
-	s, err := d.accessSecretVersion(ctx, d.params.gitSecret)
+	s, err := clouddeploy.AccessSecretVersion(ctx, d.smClient, d.params.gitSecret)
 	if err != nil {
 		return nil, fmt.Errorf("unable to access git secret: %v", err)
 	}
 	fmt.Printf("Accessed SecretVersion %s\n", d.params.gitSecret)
-	secret := string(s)
 
 	repoParts := strings.Split(d.params.gitRepo, "/")
 	if len(repoParts) != 3 {
 		return nil, fmt.Errorf("invalid git repository reference: %q", d.params.gitRepo)
 	}
 	hostname, owner, repoName := repoParts[0], repoParts[1], repoParts[2]
+	auth, err := newGitAuth(d.params.gitAuthType, s, hostname, owner, d.params.gitKnownHosts, d.params.gitSSHAcceptNewHostKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up git authentication: %v", err)
+	}
+	// Removes the SSH private key regardless of the outcome of the deploy.
+	defer func() {
+		if err := auth.cleanup(); err != nil {
+			fmt.Printf("Unable to clean up git authentication: %v\n", err)
+		}
+	}()
 	gitRepo := newGitRepository(hostname, owner, repoName, d.params.gitEmail, d.params.gitUsername)
-	if err := d.setupGitWorkspace(ctx, secret, gitRepo); err != nil {
+	if err := d.setupGitWorkspace(ctx, auth, gitRepo); err != nil {
 		return nil, fmt.Errorf("unable to set up git workspace: %v", err)
 	}
 
@@ -129,25 +153,34 @@ func (d *deployer) deploy(ctx context.Context) (*clouddeploy.DeployResult, error
 	if len(op) == 0 {
 		return nil, fmt.Errorf("no diff detected between the rendered manifest and the manifest on branch %s", d.params.gitSourceBranch)
 	}
+	artifacts := []deployArtifact{{name: "manifest.yaml", localPath: gitManifestPath}}
+	// The deploy record is written after the diff check since it always differs from the previous commit.
+	if d.params.gitWriteDeployRecord {
+		recordPath, err := writeDeployRecord(newDeployRecord(d.req, time.Now()), filepath.Dir(gitManifestPath))
+		if err != nil {
+			return nil, fmt.Errorf("unable to write deploy record: %v", err)
+		}
+		fmt.Printf("Wrote deploy record to %s\n", recordPath)
+		artifacts = append(artifacts, deployArtifact{name: deployRecordFileName, localPath: recordPath})
+	}
 	fmt.Printf("Committing and pushing changes to branch %s\n", d.params.gitSourceBranch)
-	if err := d.commitPushGitWorkspace(ctx, gitRepo); err != nil {
+	if err := d.commitPushGitWorkspace(ctx, auth, gitRepo, commitMsg); err != nil {
 		return nil, fmt.Errorf("unable to commit and push changes: %v", err)
 	}
 
-	if err := d.handleDestinationBranch(ctx, gitRepo, secret); err != nil {
+	if err := d.handleDestinationBranch(ctx, gitRepo, auth); err != nil {
 		return nil, err
 	}
 
-	fmt.Println("Uploading rendered manifest as a deploy artifact")
-	dURI, err := d.req.UploadArtifact(ctx, d.gcsClient, "manifest.yaml", &clouddeploy.GCSUploadContent{LocalPath: gitManifestPath})
+	fmt.Printf("Uploading %d deploy artifacts\n", len(artifacts))
+	uris, err := uploadArtifacts(ctx, d.req, d.gcsClient, artifacts, d.params.gitArtifactUploadConcurrency)
 	if err != nil {
-		return nil, fmt.Errorf("error uploading deploy artifact: %v", err)
+		return nil, fmt.Errorf("error uploading deploy artifacts: %v", err)
 	}
-	fmt.Printf("Uploaded deploy artifact to %s\n", dURI)
 
 	return &clouddeploy.DeployResult{
 		ResultStatus:  clouddeploy.DeploySucceeded,
-		ArtifactFiles: []string{dURI},
+		ArtifactFiles: uris,
 		Metadata: map[string]string{
 			clouddeploy.CustomTargetSourceMetadataKey:    gitDeployerSampleName,
 			clouddeploy.CustomTargetSourceSHAMetadataKey: clouddeploy.GitCommit,
@@ -155,28 +188,48 @@ func (d *deployer) deploy(ctx context.Context) (*clouddeploy.DeployResult, error
 	}, nil
 }
 
-// accessSecretVersion downloads the Secret Manager SecretVersion, verifies the data checksum and
-// provides the data payload.
-func (d *deployer) accessSecretVersion(ctx context.Context, svName string) ([]byte, error) {
-	res, err := d.smClient.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
-		Name: svName,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to access secret version %s: %v", svName, err)
-	}
+// deployArtifact is a local file uploaded as a deploy artifact.
+type deployArtifact struct {
+	// The object suffix of the artifact in the deploy output Cloud Storage path.
+	name string
+	// The path of the local file.
+	localPath string
+}
 
-	crc32c := crc32.MakeTable(crc32.Castagnoli)
-	checksum := int64(crc32.Checksum(res.Payload.Data, crc32c))
-	if checksum != *res.Payload.DataCrc32C {
-		return nil, fmt.Errorf("data corruption detected with secret version")
+// uploadArtifacts uploads the files as deploy artifacts, with at most concurrency uploads in progress at
+// the same time. Returns the URIs of the uploaded artifacts in the same order as the provided artifacts,
+// regardless of the order the uploads complete in.
+func uploadArtifacts(ctx context.Context, req *clouddeploy.DeployRequest, gcsClient *storage.Client, artifacts []deployArtifact, concurrency int) ([]string, error) {
+	uris := make([]string, len(artifacts))
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for i, a := range artifacts {
+		i, a := i, a
+		g.Go(func() error {
+			uri, err := req.UploadArtifact(ctx, gcsClient, a.name, &clouddeploy.GCSUploadContent{LocalPath: a.localPath})
+			if err != nil {
+				return fmt.Errorf("unable to upload %s: %v", a.localPath, err)
+			}
+			fmt.Printf("Uploaded deploy artifact to %s\n", uri)
+			uris[i] = uri
+			return nil
+		})
 	}
-	return res.Payload.Data, nil
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return uris, nil
 }
 
 // setupGitWorkspace clones the Git repository and checks out the configured source branch.
-func (d *deployer) setupGitWorkspace(ctx context.Context, secret string, gitRepo *gitRepository) error {
+func (d *deployer) setupGitWorkspace(ctx context.Context, auth *gitAuth, gitRepo *gitRepository) error {
+	u, err := auth.remoteURL(gitRepo)
+	if err != nil {
+		return err
+	}
+	gitRepo.env = auth.env()
 	fmt.Printf("Cloning Git repository %s\n", d.params.gitRepo)
-	if _, err := gitRepo.cloneRepo(secret); err != nil {
+	if _, err := gitRepo.cloneRepo(u); err != nil {
 		return fmt.Errorf("failed to clone git repository %s: %v", d.params.gitRepo, err)
 	}
 	if err := gitRepo.config(); err != nil {
@@ -199,27 +252,56 @@ func (d *deployer) setupGitWorkspace(ctx context.Context, secret string, gitRepo
 }
 
 // commitPushGitWorkspace commits and pushes changes in the local Git workspace to the source branch.
-func (d *deployer) commitPushGitWorkspace(ctx context.Context, gitRepo *gitRepository) error {
+func (d *deployer) commitPushGitWorkspace(ctx context.Context, auth *gitAuth, gitRepo *gitRepository, commitMsg string) error {
 	if _, err := gitRepo.add(); err != nil {
 		return fmt.Errorf("unable to git add changes: %v", err)
 	}
-	commitMsg := d.params.gitCommitMessage
-	if len(commitMsg) == 0 {
-		commitMsg = fmt.Sprintf("Delivery Pipeline: %s Release: %s Rollout: %s", d.req.Pipeline, d.req.Release, d.req.Rollout)
-	}
 	if _, err := gitRepo.commit(commitMsg); err != nil {
 		return fmt.Errorf("unable to git commit changes: %v", err)
 	}
+	if err := auth.refreshRemote(gitRepo); err != nil {
+		return err
+	}
 	if _, err := gitRepo.push(d.params.gitSourceBranch); err != nil {
 		return fmt.Errorf("unable to git push changes to branch %s: %v", d.params.gitSourceBranch, err)
 	}
 	return nil
 }
 
+// commitMessage expands the placeholders in the commit message template with the values from the deploy
+// request. Supported placeholders are {pipeline}, {release}, {rollout}, {target} and {phase}. If the
+// template is empty then the default commit message is used.
+func commitMessage(tmpl string, req *clouddeploy.DeployRequest) (string, error) {
+	if len(tmpl) == 0 {
+		tmpl = defaultCommitMessage
+	}
+	values := map[string]string{
+		"pipeline": req.Pipeline,
+		"release":  req.Release,
+		"rollout":  req.Rollout,
+		"target":   req.Target,
+		"phase":    req.Phase,
+	}
+	var unknown []string
+	msg := commitMessagePlaceholderRegex.ReplaceAllStringFunc(tmpl, func(m string) string {
+		name := m[1 : len(m)-1]
+		v, ok := values[name]
+		if !ok {
+			unknown = append(unknown, m)
+			return m
+		}
+		return v
+	})
+	if len(unknown) != 0 {
+		return "", fmt.Errorf("unknown placeholders %s in %q, supported placeholders are {pipeline}, {release}, {rollout}, {target} and {phase}", strings.Join(unknown, ", "), tmpl)
+	}
+	return msg, nil
+}
+
 // handleDestinationBranch opens a pull request on the destination branch if provided and will optionally
 // merge the PR if configured. Additionally, if Argo sync polling is enabled then the status of the Argo
 // Application is polled until it's synced.
-func (d *deployer) handleDestinationBranch(ctx context.Context, gitRepo *gitRepository, secret string) error {
+func (d *deployer) handleDestinationBranch(ctx context.Context, gitRepo *gitRepository, auth *gitAuth) error {
 	// If no destination branch is provided then there is no need to open a pull request.
 	if len(d.params.gitDestinationBranch) == 0 {
 		return nil
@@ -241,14 +323,20 @@ func (d *deployer) handleDestinationBranch(ctx context.Context, gitRepo *gitRepo
 		)
 	}
 
-	gitProvider, err := provider.CreateProvider(gitRepo.hostname, gitRepo.repoName, gitRepo.owner, secret)
+	gitProvider, err := auth.gitProvider(gitRepo)
 	if err != nil {
 		return fmt.Errorf("unable to create git provider: %v", err)
 	}
-	fmt.Printf("Opening pull request from %s to %s\n", d.params.gitSourceBranch, d.params.gitDestinationBranch)
-	pr, err := gitProvider.OpenPullRequest(d.params.gitSourceBranch, d.params.gitDestinationBranch, title, body)
+	pr, err := openPullRequest(gitProvider, d.params, title, body)
 	if err != nil {
-		return fmt.Errorf("unable to open pull request from %s to %s: %v", d.params.gitSourceBranch, d.params.gitDestinationBranch, err)
+		return err
+	}
+
+	// The comment is only informational for reviewers, so failing to post it doesn't fail the deploy.
+	if len(d.params.gitPostArtifactComment) != 0 {
+		if err := d.postArtifactComment(ctx, gitProvider, pr.Number); err != nil {
+			fmt.Printf("Warning: unable to post the artifact as a pull request comment: %v\n", err)
+		}
 	}
 
 	if !d.params.enablePullRequestMerge {
@@ -273,13 +361,148 @@ func (d *deployer) handleDestinationBranch(ctx context.Context, gitRepo *gitRepo
 	}
 
 	fmt.Println("Polling Argo Application until it's synced with the merged changes")
-	if err := pollSyncStatus(d.params.argoApp, d.params.argoNamespace, mr.Sha, d.params.argoSyncTimeout); err != nil {
+	if err := pollSyncStatus(ctx, d.params.argoApp, d.params.argoNamespace, mr.Sha, d.params.argoSyncTimeout); err != nil {
 		return fmt.Errorf("unable to verify argo application is synced: %v", err)
 	}
 	fmt.Printf("Argo Application synced with the merged changes\n")
 	return nil
 }
 
+// openPullRequest opens a pull request from the source branch to the destination branch. If configured,
+// the destination branch is created first when it doesn't exist.
+func openPullRequest(gitProvider provider.GitProvider, params *params, title, body string) (*provider.PullRequest, error) {
+	head, base, err := pullRequestBranches(params)
+	if err != nil {
+		return nil, err
+	}
+	if params.gitCreateDestinationBranch {
+		fmt.Printf("Creating branch %s from %s if it doesn't exist\n", params.gitDestinationBranch, params.gitDestinationBranchBase)
+		if err := gitProvider.CreateBranch(params.gitDestinationBranch, params.gitDestinationBranchBase); err != nil {
+			return nil, fmt.Errorf("unable to create branch %s from %s: %v", params.gitDestinationBranch, params.gitDestinationBranchBase, err)
+		}
+	}
+	fmt.Printf("Opening pull request from %s to %s\n", head, base)
+	pr, err := gitProvider.OpenPullRequest(head, base, title, body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open pull request from %s to %s: %v", head, base, err)
+	}
+	return pr, nil
+}
+
+// pullRequestBranches returns the head and base branches of the pull request. The head is the source branch
+// the changes are pushed to and the base is the gitPullRequestBase if provided, otherwise the destination branch.
+// Returns an error if the head and base are the same branch, or if the destination branch would be created
+// without being used as the base.
+func pullRequestBranches(params *params) (string, string, error) {
+	head := params.gitSourceBranch
+	base := params.gitPullRequestBase
+	if len(base) == 0 {
+		base = params.gitDestinationBranch
+	} else if params.gitCreateDestinationBranch {
+		return "", "", fmt.Errorf("the destination branch %s is only created to be the pull request base, it can't be created when the base is %s", params.gitDestinationBranch, base)
+	}
+	if head == base {
+		return "", "", fmt.Errorf("the pull request base branch %s must differ from the source branch it's opened from", base)
+	}
+	return head, base, nil
+}
+
+// postArtifactComment downloads the artifact configured with gitPostArtifactComment and posts its content
+// as a comment on the pull request.
+func (d *deployer) postArtifactComment(ctx context.Context, gitProvider provider.GitProvider, prNo int) error {
+	uri := d.params.gitPostArtifactComment
+	fmt.Printf("Downloading artifact %s to post as a pull request comment\n", uri)
+	content, err := d.readObject(ctx, uri)
+	if err != nil {
+		return fmt.Errorf("unable to download artifact %s: %v", uri, err)
+	}
+	comment := pullRequestComment(uri, content)
+	if len(comment) == 0 {
+		fmt.Printf("Artifact %s is empty, not posting a pull request comment\n", uri)
+		return nil
+	}
+	fmt.Printf("Posting the artifact as a comment on pull request %d\n", prNo)
+	if err := gitProvider.CommentOnPullRequest(prNo, comment); err != nil {
+		return fmt.Errorf("unable to comment on pull request %d: %v", prNo, err)
+	}
+	return nil
+}
+
+// pullRequestComment returns the pull request comment for the artifact content. Content longer than the
+// maximum comment length is truncated with a note pointing to the artifact. Returns an empty string if
+// the content is empty.
+func pullRequestComment(uri string, content []byte) string {
+	comment := strings.TrimSpace(string(content))
+	if len(comment) == 0 {
+		return ""
+	}
+	if len(comment) <= maxCommentLength {
+		return comment
+	}
+	note := fmt.Sprintf("\n\n_The artifact was truncated, the full content is in `%s`._", uri)
+	// Leave room for the note and for closing a code block the truncation may have cut through.
+	truncated := strings.ToValidUTF8(comment[:maxCommentLength-len(note)-len("\n```")], "")
+	if strings.Count(truncated, "```")%2 == 1 {
+		truncated += "\n```"
+	}
+	return truncated + note
+}
+
+// readObject returns the content of the object at the provided URI, read from the storage of the deploy request.
+func (d *deployer) readObject(ctx context.Context, uri string) ([]byte, error) {
+	f, err := os.CreateTemp("", "artifact-*")
+	if err != nil {
+		return nil, err
+	}
+	localPath := f.Name()
+	f.Close()
+	defer os.Remove(localPath)
+	if err := d.req.DownloadObject(ctx, d.gcsClient, uri, localPath); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(localPath)
+}
+
+// deployRecord is the machine-readable record of a deployment that is committed next to the manifest.
+type deployRecord struct {
+	Project   string    `json:"project"`
+	Location  string    `json:"location"`
+	Pipeline  string    `json:"deliveryPipeline"`
+	Release   string    `json:"release"`
+	Rollout   string    `json:"rollout"`
+	Target    string    `json:"target"`
+	Phase     string    `json:"phase"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// newDeployRecord returns the deploy record for the deploy request at the provided time.
+func newDeployRecord(req *clouddeploy.DeployRequest, now time.Time) *deployRecord {
+	return &deployRecord{
+		Project:   req.Project,
+		Location:  req.Location,
+		Pipeline:  req.Pipeline,
+		Release:   req.Release,
+		Rollout:   req.Rollout,
+		Target:    req.Target,
+		Phase:     req.Phase,
+		Timestamp: now.UTC(),
+	}
+}
+
+// writeDeployRecord writes the deploy record as JSON to the deploy record file in the provided directory.
+// Returns the path of the written file.
+func writeDeployRecord(record *deployRecord, dir string) (string, error) {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, deployRecordFileName)
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
 // copyToLocalGitRepo copies a local file to a local Git repository. Returns the path of
 // the new file in the local Git repository.
 func copyToLocalGitRepo(srcPath, repo, gitPath string) (string, error) {
@@ -315,28 +538,32 @@ func copyToLocalGitRepo(srcPath, repo, gitPath string) (string, error) {
 	return gitManifestPath, nil
 }
 
-// pollSyncStatus polls the sync status of the Argo application until it's synced or the timeout is reached.
-func pollSyncStatus(name string, ns string, rev string, timeout time.Duration) error {
-	ticker := time.NewTicker(argoSyncInterval)
-	defer ticker.Stop()
-	done := make(chan bool)
-	go func() {
-		time.Sleep(timeout)
-		done <- true
-	}()
-	for {
-		select {
-		case <-done:
-			return errors.New("timed out checking sync status of application")
-		case <-ticker.C:
-			fmt.Println("Tick...Checking the sync status")
-			if err := checkSyncStatus(name, ns, rev); err != nil {
-				fmt.Printf("%v\n", err)
-				continue
-			}
-			return nil
+// pollSyncStatus polls the sync status of the Argo application until it's synced, the timeout is reached
+// or the context is canceled.
+func pollSyncStatus(ctx context.Context, name string, ns string, rev string, timeout time.Duration) error {
+	return waitForSync(ctx, argoSyncInterval, timeout, func() error {
+		return checkSyncStatus(name, ns, rev)
+	})
+}
+
+// waitForSync polls with clouddeploy.PollUntil, calling check every interval until it succeeds, the timeout
+// is reached or the context is canceled. Errors returned by check mean the application isn't synced yet.
+func waitForSync(ctx context.Context, interval, timeout time.Duration, check func() error) error {
+	err := clouddeploy.PollUntil(ctx, interval, timeout, func(ctx context.Context) (bool, error) {
+		fmt.Println("Checking the sync status")
+		if err := check(); err != nil {
+			fmt.Printf("%v\n", err)
+			return false, err
 		}
+		return true, nil
+	})
+	if errors.Is(err, clouddeploy.ErrPollTimeout) {
+		return fmt.Errorf("timed out checking sync status of application: %v", err)
 	}
+	if err != nil {
+		return fmt.Errorf("stopped checking sync status of application: %v", err)
+	}
+	return nil
 }
 
 // checkSyncStatus checks whether the Argo application is synced.
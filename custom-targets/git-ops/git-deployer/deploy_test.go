@@ -0,0 +1,592 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	provider "github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/git-ops/git-deployer/providers"
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+	"google.golang.org/api/option"
+)
+
+// fakeProvider records the calls made to the GitProvider interface.
+type fakeProvider struct {
+	calls     []string
+	createErr error
+	// comments records the bodies of the pull request comments.
+	comments []string
+}
+
+func (f *fakeProvider) CreateBranch(name, base string) error {
+	f.calls = append(f.calls, "CreateBranch "+name+" "+base)
+	return f.createErr
+}
+
+func (f *fakeProvider) OpenPullRequest(src, dst, title, body string) (*provider.PullRequest, error) {
+	f.calls = append(f.calls, "OpenPullRequest "+src+" "+dst)
+	return &provider.PullRequest{Number: 1}, nil
+}
+
+func (f *fakeProvider) MergePullRequest(prNo int) (*provider.MergeResponse, error) {
+	f.calls = append(f.calls, "MergePullRequest")
+	return &provider.MergeResponse{}, nil
+}
+
+func (f *fakeProvider) CommentOnPullRequest(prNo int, body string) error {
+	f.calls = append(f.calls, "CommentOnPullRequest")
+	f.comments = append(f.comments, body)
+	return nil
+}
+
+func TestOpenPullRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		params    *params
+		createErr error
+		wantCalls []string
+		wantErr   bool
+	}{
+		{
+			name:      "create branch disabled",
+			params:    &params{gitSourceBranch: "staging", gitDestinationBranch: "prod", gitDestinationBranchBase: "staging"},
+			wantCalls: []string{"OpenPullRequest staging prod"},
+		},
+		{
+			name:      "create branch enabled",
+			params:    &params{gitSourceBranch: "staging", gitDestinationBranch: "prod", gitDestinationBranchBase: "main", gitCreateDestinationBranch: true},
+			wantCalls: []string{"CreateBranch prod main", "OpenPullRequest staging prod"},
+		},
+		{
+			name:      "create branch fails",
+			params:    &params{gitSourceBranch: "staging", gitDestinationBranch: "prod", gitDestinationBranchBase: "main", gitCreateDestinationBranch: true},
+			createErr: errors.New("forbidden"),
+			wantCalls: []string{"CreateBranch prod main"},
+			wantErr:   true,
+		},
+		{
+			name:      "pull request base differs from destination branch",
+			params:    &params{gitSourceBranch: "staging", gitDestinationBranch: "prod", gitDestinationBranchBase: "main", gitPullRequestBase: "release"},
+			wantCalls: []string{"OpenPullRequest staging release"},
+		},
+		{
+			name:    "pull request base with create branch enabled",
+			params:  &params{gitSourceBranch: "staging", gitDestinationBranch: "prod", gitDestinationBranchBase: "main", gitCreateDestinationBranch: true, gitPullRequestBase: "release"},
+			wantErr: true,
+		},
+		{
+			name:    "pull request base is the source branch",
+			params:  &params{gitSourceBranch: "staging", gitDestinationBranch: "prod", gitPullRequestBase: "staging"},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fp := &fakeProvider{createErr: tc.createErr}
+			_, err := openPullRequest(fp, tc.params, "title", "body")
+			if (err != nil) != tc.wantErr {
+				t.Errorf("openPullRequest() error: %v, wantErr: %t", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(fp.calls, tc.wantCalls) {
+				t.Errorf("openPullRequest() calls got: %v, want: %v", fp.calls, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestPullRequestBranches(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   *params
+		wantHead string
+		wantBase string
+		wantErr  bool
+	}{
+		{
+			name:     "defaults to destination branch",
+			params:   &params{gitSourceBranch: "staging", gitDestinationBranch: "prod"},
+			wantHead: "staging",
+			wantBase: "prod",
+		},
+		{
+			name:     "pull request base",
+			params:   &params{gitSourceBranch: "staging", gitDestinationBranch: "prod", gitPullRequestBase: "release-1.2"},
+			wantHead: "staging",
+			wantBase: "release-1.2",
+		},
+		{
+			name:    "pull request base is the source branch",
+			params:  &params{gitSourceBranch: "staging", gitDestinationBranch: "prod", gitPullRequestBase: "staging"},
+			wantErr: true,
+		},
+		{
+			name:    "destination branch is the source branch",
+			params:  &params{gitSourceBranch: "prod", gitDestinationBranch: "prod"},
+			wantErr: true,
+		},
+		{
+			name:     "create branch enabled",
+			params:   &params{gitSourceBranch: "staging", gitDestinationBranch: "prod", gitCreateDestinationBranch: true},
+			wantHead: "staging",
+			wantBase: "prod",
+		},
+		{
+			name:    "pull request base with create branch enabled",
+			params:  &params{gitSourceBranch: "staging", gitDestinationBranch: "prod", gitCreateDestinationBranch: true, gitPullRequestBase: "release-1.2"},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			head, base, err := pullRequestBranches(tc.params)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("pullRequestBranches() error: %v, wantErr: %t", err, tc.wantErr)
+			}
+			if head != tc.wantHead || base != tc.wantBase {
+				t.Errorf("pullRequestBranches() got: %s, %s, want: %s, %s", head, base, tc.wantHead, tc.wantBase)
+			}
+		})
+	}
+}
+
+func TestCommitMessage(t *testing.T) {
+	req := &clouddeploy.DeployRequest{
+		Pipeline: "my-pipeline",
+		Release:  "rel-1",
+		Rollout:  "rel-1-to-prod-0001",
+		Target:   "prod",
+		Phase:    "stable",
+	}
+	tests := []struct {
+		name    string
+		tmpl    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "default",
+			want: "Delivery Pipeline: my-pipeline Release: rel-1 Rollout: rel-1-to-prod-0001",
+		},
+		{
+			name: "no placeholders",
+			tmpl: "Update manifest",
+			want: "Update manifest",
+		},
+		{
+			name: "all placeholders",
+			tmpl: "Deploy {release} to {target} ({phase})\n\nPipeline: {pipeline}\nRollout: {rollout}",
+			want: "Deploy rel-1 to prod (stable)\n\nPipeline: my-pipeline\nRollout: rel-1-to-prod-0001",
+		},
+		{
+			name: "repeated placeholder",
+			tmpl: "{target}/{target}",
+			want: "prod/prod",
+		},
+		{
+			name:    "unknown placeholder",
+			tmpl:    "Deploy {release} to {cluster}",
+			wantErr: true,
+		},
+		{
+			name:    "empty placeholder",
+			tmpl:    "Deploy {}",
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := commitMessage(tc.tmpl, req)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("commitMessage() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("commitMessage() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWriteDeployRecord(t *testing.T) {
+	req := &clouddeploy.DeployRequest{
+		Project:  "my-project",
+		Location: "us-central1",
+		Pipeline: "my-pipeline",
+		Release:  "rel-1",
+		Rollout:  "rel-1-to-prod-0001",
+		Target:   "prod",
+		Phase:    "stable",
+	}
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("PST", -8*60*60))
+	dir := t.TempDir()
+	path, err := writeDeployRecord(newDeployRecord(req, now), dir)
+	if err != nil {
+		t.Fatalf("writeDeployRecord() failed: %v", err)
+	}
+	if want := filepath.Join(dir, deployRecordFileName); path != want {
+		t.Errorf("writeDeployRecord() path = %q, want %q", path, want)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read deploy record: %v", err)
+	}
+	got := map[string]string{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("unable to parse deploy record: %v", err)
+	}
+	want := map[string]string{
+		"project":          "my-project",
+		"location":         "us-central1",
+		"deliveryPipeline": "my-pipeline",
+		"release":          "rel-1",
+		"rollout":          "rel-1-to-prod-0001",
+		"target":           "prod",
+		"phase":            "stable",
+		"timestamp":        "2024-01-02T11:04:05Z",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("deploy record = %v, want %v", got, want)
+	}
+}
+
+func TestDeployRecordCommitted(t *testing.T) {
+	if _, err := exec.LookPath(gitBin); err != nil {
+		t.Skip("git binary not available")
+	}
+	dir := t.TempDir()
+	gitRepo := &gitRepository{dir: dir, username: "test"}
+	if _, err := runCmd(gitBin, []string{"init"}, dir, false); err != nil {
+		t.Fatalf("git init failed: %v", err)
+	}
+	if err := gitRepo.config(); err != nil {
+		t.Fatalf("git config failed: %v", err)
+	}
+
+	manifest := filepath.Join(t.TempDir(), "manifest.yaml")
+	if err := os.WriteFile(manifest, []byte("kind: ConfigMap\n"), 0644); err != nil {
+		t.Fatalf("unable to write manifest: %v", err)
+	}
+	gitManifestPath, err := copyToLocalGitRepo(manifest, dir, "env/prod/manifest.yaml")
+	if err != nil {
+		t.Fatalf("copyToLocalGitRepo() failed: %v", err)
+	}
+	if _, err := writeDeployRecord(newDeployRecord(&clouddeploy.DeployRequest{Release: "rel-1"}, time.Now()), filepath.Dir(gitManifestPath)); err != nil {
+		t.Fatalf("writeDeployRecord() failed: %v", err)
+	}
+	if _, err := gitRepo.add(); err != nil {
+		t.Fatalf("git add failed: %v", err)
+	}
+	if _, err := gitRepo.commit("deploy"); err != nil {
+		t.Fatalf("git commit failed: %v", err)
+	}
+
+	out, err := runCmd(gitBin, []string{"show", "--name-only", "--format=", "HEAD"}, dir, false)
+	if err != nil {
+		t.Fatalf("git show failed: %v", err)
+	}
+	got := strings.Fields(string(out))
+	want := []string{"env/prod/deploy-record.json", "env/prod/manifest.yaml"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("committed files = %v, want %v", got, want)
+	}
+}
+
+func TestWaitForSync(t *testing.T) {
+	notSynced := errors.New("synced revision does not match")
+	tests := []struct {
+		name      string
+		attempts  int
+		timeout   time.Duration
+		wantErr   bool
+		wantCalls int
+	}{
+		{
+			name:      "synced on first check",
+			attempts:  1,
+			timeout:   time.Minute,
+			wantCalls: 1,
+		},
+		{
+			name:      "synced after retries",
+			attempts:  3,
+			timeout:   time.Minute,
+			wantCalls: 3,
+		},
+		{
+			name:     "timeout",
+			attempts: 1000,
+			timeout:  50 * time.Millisecond,
+			wantErr:  true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			err := waitForSync(context.Background(), time.Millisecond, tc.timeout, func() error {
+				calls++
+				if calls < tc.attempts {
+					return notSynced
+				}
+				return nil
+			})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("waitForSync() got err: %v, want err: %v", err, tc.wantErr)
+			}
+			if tc.wantCalls != 0 && calls != tc.wantCalls {
+				t.Errorf("got: %d calls, want: %d", calls, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWaitForSyncCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	err := waitForSync(ctx, time.Millisecond, time.Minute, func() error {
+		cancel()
+		return errors.New("not synced")
+	})
+	if err == nil || strings.Contains(err.Error(), "timed out") {
+		t.Errorf("waitForSync() got err: %v, want a cancellation error", err)
+	}
+}
+
+func TestWaitForSyncEarlySuccessDoesNotLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		if err := waitForSync(context.Background(), time.Millisecond, time.Hour, func() error { return nil }); err != nil {
+			t.Fatalf("waitForSync() failed: %v", err)
+		}
+	}
+	// Give any goroutines that are exiting a chance to finish before counting.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("goroutines leaked after early success, got: %d, want at most: %d", after, before)
+	}
+}
+
+func TestPullRequestComment(t *testing.T) {
+	uri := "gs://bucket/render/plan-summary.md"
+	long := "### Terraform plan\n\n```\n" + strings.Repeat("+ resource\n", maxCommentLength/10) + "```\n"
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "empty",
+			content: " \n",
+			want:    "",
+		},
+		{
+			name:    "trimmed",
+			content: "\n### Terraform plan\n\nPlan: 1 to add, 0 to change, 0 to destroy.\n\n",
+			want:    "### Terraform plan\n\nPlan: 1 to add, 0 to change, 0 to destroy.",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := pullRequestComment(uri, []byte(tc.content)); got != tc.want {
+				t.Errorf("pullRequestComment() got: %q, want: %q", got, tc.want)
+			}
+		})
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		got := pullRequestComment(uri, []byte(long))
+		if len(got) > maxCommentLength {
+			t.Errorf("pullRequestComment() got length: %d, want at most: %d", len(got), maxCommentLength)
+		}
+		if !strings.HasPrefix(got, "### Terraform plan\n\n```\n+ resource\n") {
+			t.Errorf("pullRequestComment() got unexpected prefix: %q", got[:50])
+		}
+		if !strings.HasSuffix(got, "\n```\n\n_The artifact was truncated, the full content is in `gs://bucket/render/plan-summary.md`._") {
+			t.Errorf("pullRequestComment() got unexpected suffix: %q", got[len(got)-120:])
+		}
+		if strings.Count(got, "```")%2 != 0 {
+			t.Errorf("pullRequestComment() left a code block open")
+		}
+	})
+}
+
+// fakeGCSServer is a minimal fake of the Cloud Storage upload API that records the uploaded objects and
+// the maximum number of uploads in progress at the same time.
+type fakeGCSServer struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	inFlight int
+	maxIn    int
+	// delays holds how long the upload of an object is held open, keyed by object name.
+	delays map[string]time.Duration
+}
+
+func (f *fakeGCSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Multipart uploads: /upload/storage/v1/b/{bucket}/o
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/") {
+		http.Error(w, "unsupported", http.StatusNotImplemented)
+		return
+	}
+	bucket := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/upload/storage/v1/b/"), "/o")
+	_, mp, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(r.Body, mp["boundary"])
+	var meta struct {
+		Name string `json:"name"`
+	}
+	metaPart, err := mr.NextPart()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := json.NewDecoder(metaPart).Decode(&meta); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dataPart, err := mr.NextPart()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(dataPart)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	f.inFlight++
+	if f.inFlight > f.maxIn {
+		f.maxIn = f.inFlight
+	}
+	delay := f.delays[meta.Name]
+	f.mu.Unlock()
+	time.Sleep(delay)
+	f.mu.Lock()
+	f.inFlight--
+	f.objects[bucket+"/"+meta.Name] = data
+	f.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]string{"bucket": bucket, "name": meta.Name, "size": strconv.Itoa(len(data))})
+}
+
+// Tests that the artifact is read from the storage of the request rather than always from Cloud Storage.
+func TestPostArtifactComment(t *testing.T) {
+	s := clouddeploy.NewMemoryStorage()
+	s.Put("s3://bucket/render/plan-summary.md", []byte("### Terraform plan\n"))
+	d := &deployer{
+		req:    &clouddeploy.DeployRequest{Storage: s},
+		params: &params{gitPostArtifactComment: "s3://bucket/render/plan-summary.md"},
+	}
+	p := &fakeProvider{}
+	if err := d.postArtifactComment(context.Background(), p, 1); err != nil {
+		t.Fatalf("postArtifactComment() failed: %v", err)
+	}
+	if want := []string{"### Terraform plan"}; !reflect.DeepEqual(p.comments, want) {
+		t.Errorf("postArtifactComment() comments got: %q, want: %q", p.comments, want)
+	}
+
+	d.params.gitPostArtifactComment = "s3://bucket/render/missing.md"
+	if err := d.postArtifactComment(context.Background(), p, 1); err == nil {
+		t.Errorf("postArtifactComment() succeeded, want error for a missing artifact")
+	}
+}
+
+func TestUploadArtifacts(t *testing.T) {
+	f := &fakeGCSServer{objects: map[string][]byte{}, delays: map[string]time.Duration{}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("unable to create storage client: %v", err)
+	}
+	defer client.Close()
+
+	dir := t.TempDir()
+	var artifacts []deployArtifact
+	var want []string
+	for i := 0; i < 6; i++ {
+		name := fmt.Sprintf("file-%d.yaml", i)
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("unable to write artifact: %v", err)
+		}
+		artifacts = append(artifacts, deployArtifact{name: name, localPath: path})
+		want = append(want, "gs://bucket/out/"+name)
+		// Earlier artifacts take longer to upload, so the uploads complete out of order.
+		f.delays["out/"+name] = time.Duration(6-i) * 20 * time.Millisecond
+	}
+
+	req := &clouddeploy.DeployRequest{OutputGCSPath: "gs://bucket/out"}
+	got, err := uploadArtifacts(context.Background(), req, client, artifacts, 2)
+	if err != nil {
+		t.Fatalf("uploadArtifacts() failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("uploadArtifacts() = %v, want %v", got, want)
+	}
+	for _, a := range artifacts {
+		if data := f.objects["bucket/out/"+a.name]; string(data) != a.name {
+			t.Errorf("uploaded object %s content = %q, want %q", a.name, data, a.name)
+		}
+	}
+	if f.maxIn > 2 {
+		t.Errorf("uploadArtifacts() had %d uploads in progress, want at most 2", f.maxIn)
+	}
+}
+
+func TestUploadArtifactsFails(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer srv.Close()
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("unable to create storage client: %v", err)
+	}
+	defer client.Close()
+
+	path := filepath.Join(t.TempDir(), "manifest.yaml")
+	if err := os.WriteFile(path, []byte("kind: ConfigMap\n"), 0644); err != nil {
+		t.Fatalf("unable to write artifact: %v", err)
+	}
+	req := &clouddeploy.DeployRequest{OutputGCSPath: "gs://bucket/out"}
+	if _, err := uploadArtifacts(context.Background(), req, client, []deployArtifact{{name: "manifest.yaml", localPath: path}}, 1); err == nil {
+		t.Errorf("uploadArtifacts() succeeded, want error")
+	}
+}
@@ -31,6 +31,8 @@ type gitRepository struct {
 	repoName string
 	email    string
 	username string
+	// Environment variables set for the git commands, e.g. GIT_SSH_COMMAND when authenticating over SSH.
+	env []string
 }
 
 // newGitRepository returns a gitRepository to interact with a repository.
@@ -44,17 +46,33 @@ func newGitRepository(hostname, owner, repoName, email, username string) *gitRep
 	}
 }
 
-// cloneRepo clones a Git repository to the local filesystem.
-func (g *gitRepository) cloneRepo(secret string) ([]byte, error) {
-	args := []string{"clone", fmt.Sprintf("https://%s:%s@%s/%s/%s.git", g.owner, secret, g.hostname, g.owner, g.repoName)}
+// remoteURL returns the URL of the Git repository with the provided credentials.
+func (g *gitRepository) remoteURL(user, secret string) string {
+	return fmt.Sprintf("https://%s:%s@%s/%s/%s.git", user, secret, g.hostname, g.owner, g.repoName)
+}
+
+// sshRemoteURL returns the SSH URL of the Git repository.
+func (g *gitRepository) sshRemoteURL() string {
+	return fmt.Sprintf("git@%s:%s/%s.git", g.hostname, g.owner, g.repoName)
+}
+
+// cloneRepo clones the Git repository at the provided remote URL to the local filesystem.
+func (g *gitRepository) cloneRepo(url string) ([]byte, error) {
+	args := []string{"clone", url}
 	g.dir = g.repoName
-	return runCmd(gitBin, args, "", false)
+	return runCmdWithEnv(gitBin, args, "", g.env, false)
+}
+
+// setRemoteCredentials updates the credentials in the URL of the remote, e.g. when a short-lived token is renewed.
+func (g *gitRepository) setRemoteCredentials(user, secret string) ([]byte, error) {
+	args := []string{"remote", "set-url", remote, g.remoteURL(user, secret)}
+	return runCmdWithEnv(gitBin, args, g.dir, g.env, false)
 }
 
 // config sets up the git config with a username and email in the Git repository.
 func (g *gitRepository) config() error {
 	uArgs := []string{"config", "user.name", fmt.Sprintf("%q", g.username)}
-	if _, err := runCmd(gitBin, uArgs, g.dir, true); err != nil {
+	if _, err := runCmdWithEnv(gitBin, uArgs, g.dir, g.env, true); err != nil {
 		return err
 	}
 
@@ -64,7 +82,7 @@ func (g *gitRepository) config() error {
 		email = "<>"
 	}
 	eArgs := []string{"config", "user.email", email}
-	if _, err := runCmd(gitBin, eArgs, g.dir, true); err != nil {
+	if _, err := runCmdWithEnv(gitBin, eArgs, g.dir, g.env, true); err != nil {
 		return err
 	}
 	return nil
@@ -73,41 +91,41 @@ func (g *gitRepository) config() error {
 // checkoutBranch checkouts and resets an existing branch or creates a new one.
 func (g *gitRepository) checkoutBranch(branch string) ([]byte, error) {
 	args := []string{"checkout", "-B", branch}
-	return runCmd(gitBin, args, g.dir, true)
+	return runCmdWithEnv(gitBin, args, g.dir, g.env, true)
 }
 
 // add adds all the files in the working tree to the index.
 func (g *gitRepository) add() ([]byte, error) {
 	args := []string{"add", "."}
-	return runCmd(gitBin, args, g.dir, true)
+	return runCmdWithEnv(gitBin, args, g.dir, g.env, true)
 }
 
 // detectDiff gets the working tree status and uses the porcelain command to simplify scripting.
 func (g *gitRepository) detectDiff() ([]byte, error) {
 	args := []string{"status", "--porcelain"}
-	return runCmd(gitBin, args, g.dir, true)
+	return runCmdWithEnv(gitBin, args, g.dir, g.env, true)
 }
 
 // commit commits the changes in the index to the repository with the provided message.
 func (g *gitRepository) commit(msg string) ([]byte, error) {
 	args := []string{"commit", "-a", "-m", msg}
-	return runCmd(gitBin, args, g.dir, true)
+	return runCmdWithEnv(gitBin, args, g.dir, g.env, true)
 }
 
 // push pushes the changes a remote branch.
 func (g *gitRepository) push(branch string) ([]byte, error) {
 	args := []string{"push", remote, branch}
-	return runCmd(gitBin, args, g.dir, true)
+	return runCmdWithEnv(gitBin, args, g.dir, g.env, true)
 }
 
 // checkIfExists checks if a branch exists on the remote.
 func (g *gitRepository) checkIfExists(branch string) ([]byte, error) {
 	args := []string{"ls-remote", "--heads", remote, fmt.Sprintf("refs/heads/%s", branch)}
-	return runCmd(gitBin, args, g.dir, true)
+	return runCmdWithEnv(gitBin, args, g.dir, g.env, true)
 }
 
 // pull pulls changes from a remote branch.
 func (g *gitRepository) pull(branch string) ([]byte, error) {
 	args := []string{"pull", remote, branch}
-	return runCmd(gitBin, args, g.dir, true)
+	return runCmdWithEnv(gitBin, args, g.dir, g.env, true)
 }
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -33,14 +34,33 @@ const (
 	gitEmailEnvKey                  = "CLOUD_DEPLOY_customTarget_gitEmail"
 	gitCommitMessageEnvKey          = "CLOUD_DEPLOY_customTarget_gitCommitMessage"
 	gitDestinationBranchEnvKey      = "CLOUD_DEPLOY_customTarget_gitDestinationBranch"
+	gitCreateDestBranchEnvKey       = "CLOUD_DEPLOY_customTarget_gitCreateDestinationBranch"
+	gitDestinationBranchBaseEnvKey  = "CLOUD_DEPLOY_customTarget_gitDestinationBranchBase"
 	gitPullRequestTitleEnvKey       = "CLOUD_DEPLOY_customTarget_gitPullRequestTitle"
 	gitPullRequestBodyEnvKey        = "CLOUD_DEPLOY_customTarget_gitPullRequestBody"
+	gitPullRequestBaseEnvKey        = "CLOUD_DEPLOY_customTarget_gitPullRequestBase"
 	gitEnablePullRequestMergeEnvKey = "CLOUD_DEPLOY_customTarget_gitEnablePullRequestMerge"
 	gitEnableArgoSyncPollEnvKey     = "CLOUD_DEPLOY_customTarget_gitEnableArgoSyncPoll"
 	gitGKEClusterEnvKey             = "CLOUD_DEPLOY_customTarget_gitGKECluster"
 	gitArgoAppEnvKey                = "CLOUD_DEPLOY_customTarget_gitArgoApplication"
 	gitArgoNamespaceEnvKey          = "CLOUD_DEPLOY_customTarget_gitArgoNamespace"
 	gitArgoSyncTimeoutEnvKey        = "CLOUD_DEPLOY_customTarget_gitArgoSyncTimeout"
+	gitWriteDeployRecordEnvKey      = "CLOUD_DEPLOY_customTarget_gitWriteDeployRecord"
+	gitPostArtifactCommentEnvKey    = "CLOUD_DEPLOY_customTarget_gitPostArtifactComment"
+	gitAuthTypeEnvKey               = "CLOUD_DEPLOY_customTarget_gitAuthType"
+	gitKnownHostsEnvKey             = "CLOUD_DEPLOY_customTarget_gitKnownHosts"
+	gitSSHAcceptNewHostKeyEnvKey    = "CLOUD_DEPLOY_customTarget_gitSSHAcceptNewHostKey"
+	gitUploadConcurrencyEnvKey      = "CLOUD_DEPLOY_customTarget_gitArtifactUploadConcurrency"
+)
+
+// Supported values of the gitAuthType parameter.
+const (
+	// The secret contains a personal access token.
+	authTypeToken = "token"
+	// The secret contains the configuration of a GitHub App, which is used to mint installation tokens.
+	authTypeGitHubApp = "githubapp"
+	// The secret contains an SSH private key, which is used for cloning and pushing over SSH.
+	authTypeSSH = "ssh"
 )
 
 const (
@@ -48,6 +68,8 @@ const (
 	defaultSyncTimeout = 30 * time.Minute
 	// Default committer username when not provided.
 	defaultUsername = "Cloud Deploy"
+	// Default number of deploy artifacts uploaded at the same time.
+	defaultUploadConcurrency = 4
 )
 
 type params struct {
@@ -61,19 +83,37 @@ type params struct {
 	// The name of the Secret Manager SecretVersion resource used for cloning the Git repository
 	// and optionally opening pull requests.
 	gitSecret string
+	// How the secret is used to authenticate, either "token", "githubapp" or "ssh". If not provided
+	// then defaults to "token".
+	gitAuthType string
+	// The known_hosts entries used to verify the host key of the Git server when authenticating over
+	// SSH. If not provided then the host key is verified with the system's known hosts.
+	gitKnownHosts string
+	// Whether a host key of the Git server that isn't known is accepted without verification when
+	// authenticating over SSH. Disabled by default.
+	gitSSHAcceptNewHostKey bool
 	// The committer username. If not provided then defaults to "Cloud Deploy".
 	gitUsername string
 	// The commiter email. If not provided then the email address is left empty.
 	gitEmail string
-	// The commit message to use. If not provided then defaults to:
-	// "Delivery Pipeline: {pipeline-id} Release: {release-id} Rollout: {rollout-id}"
+	// The commit message template to use. Supports the {pipeline}, {release}, {rollout}, {target}
+	// and {phase} placeholders. If not provided then defaults to:
+	// "Delivery Pipeline: {pipeline} Release: {release} Rollout: {rollout}"
 	gitCommitMessage string
 	// The branch a pull request will be opened against. If not provided then no pull request is
 	// opened and the deploy completes upon the commit and push to the git source branch.
 	gitDestinationBranch string
+	// Whether to create the destination branch if it doesn't exist before opening the pull request.
+	gitCreateDestinationBranch bool
+	// The branch the destination branch is created from when gitCreateDestinationBranch is enabled.
+	// If not provided then defaults to the source branch.
+	gitDestinationBranchBase string
 	// The title of the pull request. If not provided then defaults to:
 	// "Cloud Deploy: Release {release-id}, Rollout {rollout-id}"
 	gitPullRequestTitle string
+	// Whether to write a deploy-record.json file describing the rollout next to the manifest and
+	// include it in the commit.
+	gitWriteDeployRecord bool
 	// The body of the pull request. If not provided then defaults to:
 	// "Project: {project-num}
 	//  Location: {location}
@@ -82,6 +122,14 @@ type params struct {
 	//	Release: {release-id}
 	//	Rollout: {rollout-id}"
 	gitPullRequestBody string
+	// The base branch of the pull request, when it differs from the destination branch, e.g. a
+	// release branch that's merged separately. If not provided then defaults to the destination branch.
+	gitPullRequestBase string
+	// The URI of an artifact in the storage of the deploy request, e.g. the plan-summary.md written by the
+	// Terraform deployer, whose content is posted as a comment on the pull request. If not provided then no comment is posted.
+	gitPostArtifactComment string
+	// The maximum number of deploy artifacts uploaded at the same time. If not provided then defaults to 4.
+	gitArtifactUploadConcurrency int
 	// Whether to merge the pull request opened against the gitDestintionBranch.
 	enablePullRequestMerge bool
 	// Whether to poll the sync status of an Argo Application. If enabled then the deploy only
@@ -114,6 +162,34 @@ func determineParams() (*params, error) {
 	}
 	params.gitSecret = secret
 
+	params.gitAuthType = os.Getenv(gitAuthTypeEnvKey)
+	switch params.gitAuthType {
+	case "":
+		params.gitAuthType = authTypeToken
+	case authTypeToken:
+	case authTypeGitHubApp:
+		if !strings.HasPrefix(repo, "github.com/") {
+			return nil, fmt.Errorf("parameter %q must be a GitHub repository when %q is %q", gitRepoEnvKey, gitAuthTypeEnvKey, authTypeGitHubApp)
+		}
+	case authTypeSSH:
+	default:
+		return nil, fmt.Errorf("invalid value %q for parameter %q, must be one of %q, %q or %q", params.gitAuthType, gitAuthTypeEnvKey, authTypeToken, authTypeGitHubApp, authTypeSSH)
+	}
+	params.gitKnownHosts = os.Getenv(gitKnownHostsEnvKey)
+	if len(params.gitKnownHosts) != 0 && params.gitAuthType != authTypeSSH {
+		return nil, fmt.Errorf("parameter %q is only supported when %q is %q", gitKnownHostsEnvKey, gitAuthTypeEnvKey, authTypeSSH)
+	}
+	if anhk, ok := os.LookupEnv(gitSSHAcceptNewHostKeyEnvKey); ok {
+		acceptNewHostKey, err := strconv.ParseBool(anhk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", gitSSHAcceptNewHostKeyEnvKey, err)
+		}
+		if acceptNewHostKey && params.gitAuthType != authTypeSSH {
+			return nil, fmt.Errorf("parameter %q is only supported when %q is %q", gitSSHAcceptNewHostKeyEnvKey, gitAuthTypeEnvKey, authTypeSSH)
+		}
+		params.gitSSHAcceptNewHostKey = acceptNewHostKey
+	}
+
 	srcBranch := os.Getenv(gitSourceBranchEnvKey)
 	if len(srcBranch) == 0 {
 		return nil, fmt.Errorf("parameter %q is required", gitSourceBranchEnvKey)
@@ -130,7 +206,71 @@ func determineParams() (*params, error) {
 	params.gitCommitMessage = os.Getenv(gitCommitMessageEnvKey)
 	params.gitDestinationBranch = os.Getenv(gitDestinationBranchEnvKey)
 	params.gitPullRequestTitle = os.Getenv(gitPullRequestTitleEnvKey)
+	params.gitDestinationBranchBase = os.Getenv(gitDestinationBranchBaseEnvKey)
+	if len(params.gitDestinationBranchBase) == 0 {
+		params.gitDestinationBranchBase = srcBranch
+	}
 	params.gitPullRequestBody = os.Getenv(gitPullRequestBodyEnvKey)
+	params.gitPullRequestBase = os.Getenv(gitPullRequestBaseEnvKey)
+	if len(params.gitPullRequestBase) != 0 && len(params.gitDestinationBranch) == 0 {
+		return nil, fmt.Errorf("parameter %q is required when %q is provided", gitDestinationBranchEnvKey, gitPullRequestBaseEnvKey)
+	}
+
+	createDestBranch := false
+	cdb, ok := os.LookupEnv(gitCreateDestBranchEnvKey)
+	if ok {
+		var err error
+		createDestBranch, err = strconv.ParseBool(cdb)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", gitCreateDestBranchEnvKey, err)
+		}
+	}
+	if createDestBranch && len(params.gitDestinationBranch) == 0 {
+		return nil, fmt.Errorf("parameter %q is required when %q is true", gitDestinationBranchEnvKey, gitCreateDestBranchEnvKey)
+	}
+	params.gitCreateDestinationBranch = createDestBranch
+
+	if len(params.gitDestinationBranch) != 0 {
+		if _, _, err := pullRequestBranches(params); err != nil {
+			return nil, err
+		}
+		// Opening pull requests calls the Git provider API, which requires a token.
+		if params.gitAuthType == authTypeSSH {
+			return nil, fmt.Errorf("parameter %q is not supported when %q is %q", gitDestinationBranchEnvKey, gitAuthTypeEnvKey, authTypeSSH)
+		}
+	}
+
+	params.gitPostArtifactComment = os.Getenv(gitPostArtifactCommentEnvKey)
+	if len(params.gitPostArtifactComment) != 0 {
+		if len(params.gitDestinationBranch) == 0 {
+			return nil, fmt.Errorf("parameter %q is required when %q is provided", gitDestinationBranchEnvKey, gitPostArtifactCommentEnvKey)
+		}
+	}
+
+	uploadConcurrency := defaultUploadConcurrency
+	uc, ok := os.LookupEnv(gitUploadConcurrencyEnvKey)
+	if ok {
+		var err error
+		uploadConcurrency, err = strconv.Atoi(uc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", gitUploadConcurrencyEnvKey, err)
+		}
+		if uploadConcurrency < 1 {
+			return nil, fmt.Errorf("parameter %q must be at least 1, got %d", gitUploadConcurrencyEnvKey, uploadConcurrency)
+		}
+	}
+	params.gitArtifactUploadConcurrency = uploadConcurrency
+
+	writeDeployRecord := false
+	wdr, ok := os.LookupEnv(gitWriteDeployRecordEnvKey)
+	if ok {
+		var err error
+		writeDeployRecord, err = strconv.ParseBool(wdr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", gitWriteDeployRecordEnvKey, err)
+		}
+	}
+	params.gitWriteDeployRecord = writeDeployRecord
 
 	enablePRMerge := false
 	prm, ok := os.LookupEnv(gitEnablePullRequestMergeEnvKey)
@@ -0,0 +1,256 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// bitbucketAPIURL is the base URL of the Bitbucket Cloud REST API.
+const bitbucketAPIURL = "https://api.bitbucket.org/2.0"
+
+// BitbucketTokenUser is the username Bitbucket expects when cloning and pushing with a repository,
+// project or workspace access token.
+const BitbucketTokenUser = "x-token-auth"
+
+// fullShaLen is the length of a full commit hash, Bitbucket may return an abbreviated hash for the merge commit.
+const fullShaLen = 40
+
+// BitbucketProvider implements the GitProvider interface for interacting with the Bitbucket Cloud API.
+// The Owner is the Bitbucket workspace of the repository.
+type BitbucketProvider struct {
+	Repository string
+	Token      string
+	Owner      string
+
+	// baseURL overrides the Bitbucket API base URL, only set in tests.
+	baseURL string
+}
+
+// bitbucketBranch represents the response when querying for a Bitbucket branch.
+type bitbucketBranch struct {
+	Target struct {
+		Hash string `json:"hash"`
+	} `json:"target"`
+}
+
+// bitbucketPullRequest represents the response when opening or merging a Bitbucket pull request.
+type bitbucketPullRequest struct {
+	ID          int `json:"id"`
+	MergeCommit *struct {
+		Hash string `json:"hash"`
+	} `json:"merge_commit"`
+}
+
+// bitbucketCommit represents the response when querying for a Bitbucket commit.
+type bitbucketCommit struct {
+	Hash string `json:"hash"`
+}
+
+// apiURL returns the base URL to use for Bitbucket API calls on the repository.
+func (p *BitbucketProvider) apiURL() string {
+	base := bitbucketAPIURL
+	if len(p.baseURL) != 0 {
+		base = p.baseURL
+	}
+	return fmt.Sprintf("%s/repositories/%s/%s", base, p.Owner, p.Repository)
+}
+
+// do sends a Bitbucket API request with the JSON encoded payload, if not nil, and returns the
+// status code and body of the response.
+func (p *BitbucketProvider) do(method, url string, payload any) (int, []byte, error) {
+	var body io.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return 0, nil, fmt.Errorf("unable to marshal json: %v", err)
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to create new request: %v", err)
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", p.Token))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	r, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to read response body: %v", err)
+	}
+	return resp.StatusCode, r, nil
+}
+
+// CreateBranch calls the Bitbucket API for creating a branch from the head of the base branch. If the
+// branch already exists, including when it's created concurrently, then no error is returned.
+func (p *BitbucketProvider) CreateBranch(name, base string) error {
+	exists, _, err := p.getBranchSha(name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	baseExists, sha, err := p.getBranchSha(base)
+	if err != nil {
+		return err
+	}
+	if !baseExists {
+		return fmt.Errorf("base branch %s does not exist", base)
+	}
+
+	payload := map[string]any{
+		"name":   name,
+		"target": map[string]string{"hash": sha},
+	}
+	status, r, err := p.do(http.MethodPost, fmt.Sprintf("%s/refs/branches", p.apiURL()), payload)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusCreated:
+		return nil
+	case http.StatusBadRequest:
+		// The branch was created between the existence check and the create call.
+		if exists, _, err := p.getBranchSha(name); err == nil && exists {
+			return nil
+		}
+	}
+	return fmt.Errorf("create branch body: %q, status got: %v want: %v", r, status, http.StatusCreated)
+}
+
+// getBranchSha calls the Bitbucket API for the head commit sha of a branch. Returns false if the branch
+// does not exist.
+func (p *BitbucketProvider) getBranchSha(branch string) (bool, string, error) {
+	status, r, err := p.do(http.MethodGet, fmt.Sprintf("%s/refs/branches/%s", p.apiURL(), url.PathEscape(branch)), nil)
+	if err != nil {
+		return false, "", err
+	}
+	if status == http.StatusNotFound {
+		return false, "", nil
+	}
+	if status != http.StatusOK {
+		return false, "", fmt.Errorf("get branch body: %q, status got: %v want: %v", r, status, http.StatusOK)
+	}
+	var b bitbucketBranch
+	if err := json.Unmarshal(r, &b); err != nil {
+		return false, "", fmt.Errorf("unable to unmarshal get branch response: %v", err)
+	}
+	return true, b.Target.Hash, nil
+}
+
+// OpenPullRequest calls the Bitbucket API for opening a pull request from a source branch to a destination branch.
+func (p *BitbucketProvider) OpenPullRequest(src, dst, title, body string) (*PullRequest, error) {
+	payload := map[string]any{
+		"title":       title,
+		"description": body,
+		"source":      map[string]any{"branch": map[string]string{"name": src}},
+		"destination": map[string]any{"branch": map[string]string{"name": dst}},
+	}
+	status, r, err := p.do(http.MethodPost, fmt.Sprintf("%s/pullrequests", p.apiURL()), payload)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusCreated {
+		return nil, fmt.Errorf("create pull request body: %q, status got: %v want: %v", r, status, http.StatusCreated)
+	}
+	var pr bitbucketPullRequest
+	if err := json.Unmarshal(r, &pr); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal open pull request response: %v", err)
+	}
+	return &PullRequest{Number: pr.ID}, nil
+}
+
+// CommentOnPullRequest calls the Bitbucket API for adding a comment to a pull request.
+func (p *BitbucketProvider) CommentOnPullRequest(prNo int, body string) error {
+	payload := map[string]any{
+		"content": map[string]string{"raw": body},
+	}
+	status, r, err := p.do(http.MethodPost, fmt.Sprintf("%s/pullrequests/%d/comments", p.apiURL(), prNo), payload)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusCreated {
+		return fmt.Errorf("comment on pull request body: %q, status got: %v want: %v", r, status, http.StatusCreated)
+	}
+	return nil
+}
+
+// MergePullRequest calls the Bitbucket API for merging a pull request with a merge commit. The
+// returned sha is the full hash of the merge commit.
+func (p *BitbucketProvider) MergePullRequest(prNo int) (*MergeResponse, error) {
+	call := func(prNo int) (*MergeResponse, error) {
+		payload := map[string]string{
+			"merge_strategy": "merge_commit",
+		}
+		status, r, err := p.do(http.MethodPost, fmt.Sprintf("%s/pullrequests/%d/merge", p.apiURL(), prNo), payload)
+		if err != nil {
+			return nil, err
+		}
+		if status != http.StatusOK {
+			return nil, fmt.Errorf("merge pull request body: %q, status got: %v want: %v", r, status, http.StatusOK)
+		}
+		var pr bitbucketPullRequest
+		if err := json.Unmarshal(r, &pr); err != nil {
+			return nil, fmt.Errorf("unable to unmarshal merge pull request response: %v", err)
+		}
+		if pr.MergeCommit == nil || len(pr.MergeCommit.Hash) == 0 {
+			return nil, fmt.Errorf("merge pull request response is missing the merge commit: %q", r)
+		}
+		return &MergeResponse{Sha: pr.MergeCommit.Hash}, nil
+	}
+
+	mr, err := mergePullRequestWithRetries(prNo, call)
+	if err != nil {
+		return nil, err
+	}
+	// The merge commit may be abbreviated, the full hash is needed to compare with the synced revision.
+	if len(mr.Sha) < fullShaLen {
+		sha, err := p.getCommitSha(mr.Sha)
+		if err != nil {
+			return nil, err
+		}
+		mr.Sha = sha
+	}
+	return mr, nil
+}
+
+// getCommitSha calls the Bitbucket API for the full hash of a possibly abbreviated commit hash.
+func (p *BitbucketProvider) getCommitSha(sha string) (string, error) {
+	status, r, err := p.do(http.MethodGet, fmt.Sprintf("%s/commit/%s", p.apiURL(), url.PathEscape(sha)), nil)
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK {
+		return "", fmt.Errorf("get commit body: %q, status got: %v want: %v", r, status, http.StatusOK)
+	}
+	var c bitbucketCommit
+	if err := json.Unmarshal(r, &c); err != nil {
+		return "", fmt.Errorf("unable to unmarshal get commit response: %v", err)
+	}
+	return c.Hash, nil
+}
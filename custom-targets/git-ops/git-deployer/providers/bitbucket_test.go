@@ -0,0 +1,215 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const bitbucketRepoPath = "/repositories/workspace/repo"
+
+// fakeBitbucket is a minimal fake of the Bitbucket Cloud API endpoints used for opening and merging
+// pull requests.
+type fakeBitbucket struct {
+	branches map[string]string
+	// createConflict simulates the branch being created concurrently by another caller.
+	createConflict bool
+	// mergeSha is the full merge commit hash, the merge response only contains its first 12 characters.
+	mergeSha string
+	calls    []string
+	// pullRequests records the bodies of the opened pull requests.
+	pullRequests []map[string]any
+	// comments records the bodies of the comments posted on each pull request.
+	comments map[string][]string
+}
+
+func (f *fakeBitbucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, bitbucketRepoPath)
+	f.calls = append(f.calls, fmt.Sprintf("%s %s", r.Method, path))
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/refs/branches/"):
+		sha, ok := f.branches[strings.TrimPrefix(path, "/refs/branches/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"target":{"hash":%q}}`, sha)
+	case r.Method == http.MethodPost && path == "/refs/branches":
+		var body struct {
+			Name   string `json:"name"`
+			Target struct {
+				Hash string `json:"hash"`
+			} `json:"target"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.branches[body.Name] = body.Target.Hash
+		if f.createConflict {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"type":"error","error":{"message":"BRANCH_ALREADY_EXISTS"}}`)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPost && path == "/pullrequests":
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		f.pullRequests = append(f.pullRequests, body)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"id":%d}`, len(f.pullRequests))
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/pullrequests/") && strings.HasSuffix(path, "/comments"):
+		var body struct {
+			Content struct {
+				Raw string `json:"raw"`
+			} `json:"content"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		pr := strings.TrimSuffix(strings.TrimPrefix(path, "/pullrequests/"), "/comments")
+		if f.comments == nil {
+			f.comments = map[string][]string{}
+		}
+		f.comments[pr] = append(f.comments[pr], body.Content.Raw)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id":1}`)
+	case r.Method == http.MethodPost && path == "/pullrequests/1/merge":
+		fmt.Fprintf(w, `{"id":1,"state":"MERGED","merge_commit":{"hash":%q}}`, f.mergeSha[:12])
+	case r.Method == http.MethodGet && path == "/commit/"+f.mergeSha[:12]:
+		fmt.Fprintf(w, `{"hash":%q}`, f.mergeSha)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestBitbucketCreateBranch(t *testing.T) {
+	tests := []struct {
+		name           string
+		branches       map[string]string
+		createConflict bool
+		wantCreate     bool
+		wantErr        bool
+	}{
+		{
+			name:       "destination branch missing",
+			branches:   map[string]string{"main": "abc123"},
+			wantCreate: true,
+		},
+		{
+			name:     "destination branch exists",
+			branches: map[string]string{"main": "abc123", "prod": "def456"},
+		},
+		{
+			name:           "destination branch created concurrently",
+			branches:       map[string]string{"main": "abc123"},
+			createConflict: true,
+			wantCreate:     true,
+		},
+		{
+			name:     "base branch missing",
+			branches: map[string]string{},
+			wantErr:  true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeBitbucket{branches: tc.branches, createConflict: tc.createConflict}
+			srv := httptest.NewServer(fake)
+			defer srv.Close()
+			p := &BitbucketProvider{Repository: "repo", Owner: "workspace", Token: "token", baseURL: srv.URL}
+
+			err := p.CreateBranch("prod", "main")
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("CreateBranch() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CreateBranch() failed: %v", err)
+			}
+			created := false
+			for _, c := range fake.calls {
+				if c == "POST /refs/branches" {
+					created = true
+				}
+			}
+			if created != tc.wantCreate {
+				t.Errorf("CreateBranch() created branch: %t, want: %t", created, tc.wantCreate)
+			}
+			if got := fake.branches["prod"]; tc.wantCreate && got != "abc123" {
+				t.Errorf("CreateBranch() got branch target: %q, want: %q", got, "abc123")
+			}
+		})
+	}
+}
+
+func TestBitbucketOpenAndMergePullRequest(t *testing.T) {
+	fake := &fakeBitbucket{branches: map[string]string{}, mergeSha: "0123456789abcdef0123456789abcdef01234567"}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	p := &BitbucketProvider{Repository: "repo", Owner: "workspace", Token: "token", baseURL: srv.URL}
+
+	pr, err := p.OpenPullRequest("main", "prod", "title", "body")
+	if err != nil {
+		t.Fatalf("OpenPullRequest() failed: %v", err)
+	}
+	if pr.Number != 1 {
+		t.Errorf("OpenPullRequest() got PR number: %d, want: 1", pr.Number)
+	}
+	want := []map[string]any{{
+		"title":       "title",
+		"description": "body",
+		"source":      map[string]any{"branch": map[string]any{"name": "main"}},
+		"destination": map[string]any{"branch": map[string]any{"name": "prod"}},
+	}}
+	if !reflect.DeepEqual(fake.pullRequests, want) {
+		t.Errorf("OpenPullRequest() got pull requests: %v, want: %v", fake.pullRequests, want)
+	}
+
+	mr, err := p.MergePullRequest(pr.Number)
+	if err != nil {
+		t.Fatalf("MergePullRequest() failed: %v", err)
+	}
+	if mr.Sha != fake.mergeSha {
+		t.Errorf("MergePullRequest() got sha: %q, want the full hash: %q", mr.Sha, fake.mergeSha)
+	}
+}
+
+func TestBitbucketCommentOnPullRequest(t *testing.T) {
+	fake := &fakeBitbucket{branches: map[string]string{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	p := &BitbucketProvider{Repository: "repo", Owner: "workspace", Token: "token", baseURL: srv.URL}
+
+	if err := p.CommentOnPullRequest(7, "### Terraform plan\n\nPlan: 1 to add"); err != nil {
+		t.Fatalf("CommentOnPullRequest() failed: %v", err)
+	}
+	want := map[string][]string{"7": {"### Terraform plan\n\nPlan: 1 to add"}}
+	if !reflect.DeepEqual(fake.comments, want) {
+		t.Errorf("CommentOnPullRequest() got comments: %v, want: %v", fake.comments, want)
+	}
+
+	p.Token = "invalid"
+	if err := p.CommentOnPullRequest(7, "body"); err == nil {
+		t.Errorf("CommentOnPullRequest() succeeded with an invalid token, want error")
+	}
+}
@@ -22,11 +22,135 @@ import (
 	"net/http"
 )
 
+// gitHubAPIURL is the base URL of the GitHub REST API.
+const gitHubAPIURL = "https://api.github.com"
+
 // GithubProvider implements the GitProvider interface for interacting with the Github API.
 type GitHubProvider struct {
 	Repository string
 	Token      string
 	Owner      string
+	// TokenSource mints the token used for the API calls instead of Token when set, e.g. for
+	// authenticating as a GitHub App installation.
+	TokenSource *GitHubAppTokenSource
+
+	// baseURL overrides the GitHub API base URL, only set in tests.
+	baseURL string
+}
+
+// gitHubRef represents the response when querying for a GitHub Git reference.
+type gitHubRef struct {
+	Object struct {
+		Sha string `json:"sha"`
+	} `json:"object"`
+}
+
+// apiURL returns the base URL to use for GitHub API calls.
+func (p *GitHubProvider) apiURL() string {
+	if len(p.baseURL) != 0 {
+		return p.baseURL
+	}
+	return gitHubAPIURL
+}
+
+// newRequest creates a GitHub API request with the common headers set.
+func (p *GitHubProvider) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create new request: %v", err)
+	}
+	token := p.Token
+	if p.TokenSource != nil {
+		token, err = p.TokenSource.Token()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get GitHub App installation token: %v", err)
+		}
+	}
+	req.Header.Add("Accept", "application/vnd.github+json")
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Add("X-GitHub-Api-Version", "2022-11-28")
+	return req, nil
+}
+
+// CreateBranch calls the GitHub API for creating a branch from the head of the base branch. If the
+// branch already exists, including when it's created concurrently, then no error is returned.
+func (p *GitHubProvider) CreateBranch(name, base string) error {
+	exists, _, err := p.getBranchSha(name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	baseExists, sha, err := p.getBranchSha(base)
+	if err != nil {
+		return err
+	}
+	if !baseExists {
+		return fmt.Errorf("base branch %s does not exist", base)
+	}
+
+	payload, err := json.Marshal(map[string]string{
+		"ref": fmt.Sprintf("refs/heads/%s", name),
+		"sha": sha,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to marshal json for creating branch: %v", err)
+	}
+	req, err := p.newRequest(http.MethodPost, fmt.Sprintf("%s/repos/%s/%s/git/refs", p.apiURL(), p.Owner, p.Repository), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	r, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read response body: %v", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return nil
+	case http.StatusUnprocessableEntity:
+		// The branch was created between the existence check and the create call.
+		if exists, _, err := p.getBranchSha(name); err == nil && exists {
+			return nil
+		}
+	}
+	return fmt.Errorf("create branch body: %q, status got: %v want: %v", r, resp.StatusCode, http.StatusCreated)
+}
+
+// getBranchSha calls the GitHub API for the head commit sha of a branch. Returns false if the branch
+// does not exist.
+func (p *GitHubProvider) getBranchSha(branch string) (bool, string, error) {
+	req, err := p.newRequest(http.MethodGet, fmt.Sprintf("%s/repos/%s/%s/git/ref/heads/%s", p.apiURL(), p.Owner, p.Repository, branch), nil)
+	if err != nil {
+		return false, "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, "", fmt.Errorf("unable to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	r, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, "", fmt.Errorf("unable to read response body: %v", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return false, "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("get branch body: %q, status got: %v want: %v", r, resp.StatusCode, http.StatusOK)
+	}
+	var ref gitHubRef
+	if err := json.Unmarshal(r, &ref); err != nil {
+		return false, "", fmt.Errorf("unable to unmarshal get branch response: %v", err)
+	}
+	return true, ref.Object.Sha, nil
 }
 
 // OpenPullRequest calls the GitHub API for opening a pull request from a source branch to a destination branch.
@@ -41,20 +165,16 @@ func (p *GitHubProvider) OpenPullRequest(src, dst, title, body string) (*PullReq
 		return nil, fmt.Errorf("unable to marshal json for pull request: %v", err)
 	}
 	reader := bytes.NewReader(payload)
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://api.github.com/repos/%s/%s/pulls", p.Owner, p.Repository), reader)
+	req, err := p.newRequest(http.MethodPost, fmt.Sprintf("%s/repos/%s/%s/pulls", p.apiURL(), p.Owner, p.Repository), reader)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create new request: %v", err)
+		return nil, err
 	}
 
-	req.Header.Add("Accept", "application/vnd.github+json")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", p.Token))
-	req.Header.Add("X-GitHub-Api-Version", "2022-11-28")
-
 	resp, err := http.DefaultClient.Do(req)
-	defer resp.Body.Close()
 	if err != nil {
 		return nil, fmt.Errorf("unable to make request: %v", err)
 	}
+	defer resp.Body.Close()
 	var pr PullRequest
 	r, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -70,6 +190,34 @@ func (p *GitHubProvider) OpenPullRequest(src, dst, title, body string) (*PullReq
 	return &pr, nil
 }
 
+// CommentOnPullRequest calls the GitHub API for adding a comment to a pull request.
+func (p *GitHubProvider) CommentOnPullRequest(prNo int, body string) error {
+	payload, err := json.Marshal(map[string]string{
+		"body": body,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to marshal json for pull request comment: %v", err)
+	}
+	req, err := p.newRequest(http.MethodPost, fmt.Sprintf("%s/repos/%s/%s/issues/%d/comments", p.apiURL(), p.Owner, p.Repository, prNo), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	r, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read response body: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("comment on pull request body: %q, status got: %v want: %v", r, resp.StatusCode, http.StatusCreated)
+	}
+	return nil
+}
+
 // MergePullRequest calls the GitHub API for merging a pull request.
 func (p *GitHubProvider) MergePullRequest(prNo int) (*MergeResponse, error) {
 	call := func(prNo int) (*MergeResponse, error) {
@@ -80,15 +228,11 @@ func (p *GitHubProvider) MergePullRequest(prNo int) (*MergeResponse, error) {
 			return nil, fmt.Errorf("unable to marshal json for merging pull request: %v", err)
 		}
 		reader := bytes.NewReader(payload)
-		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("https://api.github.com/repos/%s/%s/pulls/%d/merge", p.Owner, p.Repository, prNo), reader)
+		req, err := p.newRequest(http.MethodPut, fmt.Sprintf("%s/repos/%s/%s/pulls/%d/merge", p.apiURL(), p.Owner, p.Repository, prNo), reader)
 		if err != nil {
-			return nil, fmt.Errorf("unable to create new request: %v", err)
+			return nil, err
 		}
 
-		req.Header.Add("Accept", "application/vnd.github+json")
-		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", p.Token))
-		req.Header.Add("X-GitHub-Api-Version", "2022-11-28")
-
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			return nil, fmt.Errorf("unable to make request: %v", err)
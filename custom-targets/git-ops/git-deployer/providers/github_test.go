@@ -0,0 +1,165 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeGitHub is a minimal fake of the GitHub API endpoints used for creating branches.
+type fakeGitHub struct {
+	branches map[string]string
+	// createConflict simulates the branch being created concurrently by another caller.
+	createConflict bool
+	calls          []string
+	// comments records the bodies of the comments posted on each pull request.
+	comments map[string][]string
+}
+
+func (f *fakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.calls = append(f.calls, fmt.Sprintf("%s %s", r.Method, r.URL.Path))
+	switch {
+	case r.Method == http.MethodGet && len(r.URL.Path) > len("/repos/owner/repo/git/ref/heads/"):
+		name := r.URL.Path[len("/repos/owner/repo/git/ref/heads/"):]
+		sha, ok := f.branches[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"object":{"sha":%q}}`, sha)
+	case r.Method == http.MethodPost && r.URL.Path == "/repos/owner/repo/git/refs":
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		name := body["ref"][len("refs/heads/"):]
+		f.branches[name] = body["sha"]
+		if f.createConflict {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprint(w, `{"message":"Reference already exists"}`)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPost && r.URL.Path == "/repos/owner/repo/pulls":
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if _, ok := f.branches[body["base"]]; !ok {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"number":7}`)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/repos/owner/repo/issues/") && strings.HasSuffix(r.URL.Path, "/comments"):
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		pr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/repos/owner/repo/issues/"), "/comments")
+		if f.comments == nil {
+			f.comments = map[string][]string{}
+		}
+		f.comments[pr] = append(f.comments[pr], body["body"])
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id":1}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestGitHubCreateBranchThenOpenPullRequest(t *testing.T) {
+	tests := []struct {
+		name           string
+		branches       map[string]string
+		createConflict bool
+		wantCreate     bool
+	}{
+		{
+			name:       "destination branch missing",
+			branches:   map[string]string{"main": "abc123"},
+			wantCreate: true,
+		},
+		{
+			name:     "destination branch exists",
+			branches: map[string]string{"main": "abc123", "prod": "def456"},
+		},
+		{
+			name:           "destination branch created concurrently",
+			branches:       map[string]string{"main": "abc123"},
+			createConflict: true,
+			wantCreate:     true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeGitHub{branches: tc.branches, createConflict: tc.createConflict}
+			srv := httptest.NewServer(fake)
+			defer srv.Close()
+			p := &GitHubProvider{Repository: "repo", Owner: "owner", Token: "token", baseURL: srv.URL}
+
+			if err := p.CreateBranch("prod", "main"); err != nil {
+				t.Fatalf("CreateBranch() failed: %v", err)
+			}
+			pr, err := p.OpenPullRequest("main", "prod", "title", "body")
+			if err != nil {
+				t.Fatalf("OpenPullRequest() failed: %v", err)
+			}
+			if pr.Number != 7 {
+				t.Errorf("OpenPullRequest() got PR number %d, want 7", pr.Number)
+			}
+			created := false
+			for _, c := range fake.calls {
+				if c == "POST /repos/owner/repo/git/refs" {
+					created = true
+				}
+			}
+			if created != tc.wantCreate {
+				t.Errorf("CreateBranch() created branch: %t, want: %t", created, tc.wantCreate)
+			}
+		})
+	}
+}
+
+func TestGitHubCreateBranchMissingBase(t *testing.T) {
+	fake := &fakeGitHub{branches: map[string]string{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	p := &GitHubProvider{Repository: "repo", Owner: "owner", Token: "token", baseURL: srv.URL}
+
+	if err := p.CreateBranch("prod", "main"); err == nil {
+		t.Errorf("CreateBranch() succeeded with a missing base branch, want error")
+	}
+}
+
+func TestGitHubCommentOnPullRequest(t *testing.T) {
+	fake := &fakeGitHub{branches: map[string]string{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	p := &GitHubProvider{Repository: "repo", Owner: "owner", Token: "token", baseURL: srv.URL}
+
+	if err := p.CommentOnPullRequest(7, "### Terraform plan\n\nPlan: 1 to add"); err != nil {
+		t.Fatalf("CommentOnPullRequest() failed: %v", err)
+	}
+	want := map[string][]string{"7": {"### Terraform plan\n\nPlan: 1 to add"}}
+	if !reflect.DeepEqual(fake.comments, want) {
+		t.Errorf("CommentOnPullRequest() got comments: %v, want: %v", fake.comments, want)
+	}
+
+	srv.Close()
+	if err := p.CommentOnPullRequest(7, "body"); err == nil {
+		t.Errorf("CommentOnPullRequest() succeeded with the server unavailable, want error")
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// gitHubAppJWTLifetime is how long the JWT used to authenticate as the GitHub App is valid for,
+	// GitHub rejects JWTs that expire more than 10 minutes in the future.
+	gitHubAppJWTLifetime = 9 * time.Minute
+	// gitHubAppClockSkew is subtracted from the JWT issue time to allow for clock drift with GitHub.
+	gitHubAppClockSkew = time.Minute
+	// gitHubAppTokenExpiryMargin is how long before its expiry an installation token is replaced with
+	// a newly minted one, so a token doesn't expire in the middle of an operation.
+	gitHubAppTokenExpiryMargin = 5 * time.Minute
+)
+
+// GitHubAppConfig is the content of the secret used for authenticating as a GitHub App installation.
+type GitHubAppConfig struct {
+	// The ID of the GitHub App.
+	AppID string `json:"appId"`
+	// The ID of the installation of the GitHub App on the repository owner.
+	InstallationID string `json:"installationId"`
+	// The PEM encoded private key of the GitHub App.
+	PrivateKey string `json:"privateKey"`
+}
+
+// ParseGitHubAppConfig parses the JSON content of a GitHub App secret.
+func ParseGitHubAppConfig(data []byte) (*GitHubAppConfig, error) {
+	c := &GitHubAppConfig{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("unable to parse GitHub App configuration: %v", err)
+	}
+	if len(c.AppID) == 0 {
+		return nil, fmt.Errorf("GitHub App configuration is missing the %q field", "appId")
+	}
+	if len(c.InstallationID) == 0 {
+		return nil, fmt.Errorf("GitHub App configuration is missing the %q field", "installationId")
+	}
+	if len(c.PrivateKey) == 0 {
+		return nil, fmt.Errorf("GitHub App configuration is missing the %q field", "privateKey")
+	}
+	return c, nil
+}
+
+// GitHubAppTokenSource mints GitHub App installation tokens. A minted token is cached and reused
+// until it's close to expiring.
+type GitHubAppTokenSource struct {
+	appID          string
+	installationID string
+	key            *rsa.PrivateKey
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+
+	// baseURL overrides the GitHub API base URL, only set in tests.
+	baseURL string
+	// now overrides the current time, only set in tests.
+	now func() time.Time
+}
+
+// gitHubInstallationToken represents the response when creating a GitHub App installation token.
+type gitHubInstallationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NewGitHubAppTokenSource returns a GitHubAppTokenSource for the provided GitHub App configuration.
+func NewGitHubAppTokenSource(c *GitHubAppConfig) (*GitHubAppTokenSource, error) {
+	key, err := parsePrivateKey([]byte(c.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse GitHub App private key: %v", err)
+	}
+	return &GitHubAppTokenSource{
+		appID:          c.AppID,
+		installationID: c.InstallationID,
+		key:            key,
+	}, nil
+}
+
+// parsePrivateKey parses a PEM encoded RSA private key in either PKCS #1 format, which GitHub
+// generates, or PKCS #8 format.
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return key, nil
+}
+
+// apiURL returns the base URL to use for GitHub API calls.
+func (s *GitHubAppTokenSource) apiURL() string {
+	if len(s.baseURL) != 0 {
+		return s.baseURL
+	}
+	return gitHubAPIURL
+}
+
+// currentTime returns the current time.
+func (s *GitHubAppTokenSource) currentTime() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// Token returns a valid installation token, minting a new one if no token was minted yet or the
+// cached token is about to expire.
+func (s *GitHubAppTokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.token) != 0 && s.currentTime().Add(gitHubAppTokenExpiryMargin).Before(s.expiresAt) {
+		return s.token, nil
+	}
+	t, err := s.mintToken()
+	if err != nil {
+		return "", err
+	}
+	s.token = t.Token
+	s.expiresAt = t.ExpiresAt
+	return s.token, nil
+}
+
+// mintToken calls the GitHub API for creating an installation token, authenticating as the GitHub App.
+func (s *GitHubAppTokenSource) mintToken() (*gitHubInstallationToken, error) {
+	jwt, err := s.signJWT()
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign GitHub App JWT: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/app/installations/%s/access_tokens", s.apiURL(), s.installationID), nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create new request: %v", err)
+	}
+	req.Header.Add("Accept", "application/vnd.github+json")
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", jwt))
+	req.Header.Add("X-GitHub-Api-Version", "2022-11-28")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	r, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response body: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("create installation token body: %q, status got: %v want: %v", r, resp.StatusCode, http.StatusCreated)
+	}
+	var t gitHubInstallationToken
+	if err := json.Unmarshal(r, &t); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal create installation token response: %v", err)
+	}
+	if len(t.Token) == 0 {
+		return nil, fmt.Errorf("create installation token response has no token")
+	}
+	return &t, nil
+}
+
+// signJWT returns a JWT signed with the GitHub App private key, used for authenticating as the GitHub App.
+func (s *GitHubAppTokenSource) signJWT() (string, error) {
+	now := s.currentTime()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-gitHubAppClockSkew).Unix(),
+		"exp": now.Add(gitHubAppJWTLifetime).Unix(),
+		"iss": s.appID,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := fmt.Sprintf("%s.%s", base64.RawURLEncoding.EncodeToString(header), base64.RawURLEncoding.EncodeToString(claims))
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s.%s", unsigned, base64.RawURLEncoding.EncodeToString(sig)), nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeGitHubApp is a minimal fake of the GitHub API endpoint used for minting installation tokens.
+type fakeGitHubApp struct {
+	t   *testing.T
+	key *rsa.PublicKey
+	// now is the time the minted tokens are issued at.
+	now func() time.Time
+	// lifetime is how long the minted tokens are valid for.
+	lifetime time.Duration
+	// minted is the number of tokens minted.
+	minted int
+	// authHeaders records the Authorization header of the requests to other endpoints.
+	authHeaders []string
+}
+
+func (f *fakeGitHubApp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/app/installations/456/access_tokens" {
+		f.authHeaders = append(f.authHeaders, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id":1}`)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := f.verifyJWT(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")); err != nil {
+		f.t.Errorf("invalid JWT: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.minted++
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"token":"token-%d","expires_at":%q}`, f.minted, f.now().Add(f.lifetime).Format(time.RFC3339))
+}
+
+// verifyJWT verifies the signature and the claims of the JWT authenticating as the GitHub App.
+func (f *fakeGitHubApp) verifyJWT(jwt string) error {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("got %d parts, want 3", len(parts))
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(f.key, crypto.SHA256, digest[:], sig); err != nil {
+		return err
+	}
+	c, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	var claims struct {
+		Iat int64  `json:"iat"`
+		Exp int64  `json:"exp"`
+		Iss string `json:"iss"`
+	}
+	if err := json.Unmarshal(c, &claims); err != nil {
+		return err
+	}
+	if claims.Iss != "123" {
+		return fmt.Errorf("iss got: %q, want: %q", claims.Iss, "123")
+	}
+	if now := f.now().Unix(); claims.Iat > now || claims.Exp <= now || claims.Exp-now > 600 {
+		return fmt.Errorf("JWT valid from %d to %d isn't valid at %d for at most 10 minutes", claims.Iat, claims.Exp, now)
+	}
+	return nil
+}
+
+// newTestTokenSource returns a GitHubAppTokenSource backed by a fake GitHub API.
+func newTestTokenSource(t *testing.T, now func() time.Time, lifetime time.Duration) (*GitHubAppTokenSource, *fakeGitHubApp, func()) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	c, err := ParseGitHubAppConfig([]byte(fmt.Sprintf(`{"appId":"123","installationId":"456","privateKey":%q}`, pemKey)))
+	if err != nil {
+		t.Fatalf("ParseGitHubAppConfig() failed: %v", err)
+	}
+	ts, err := NewGitHubAppTokenSource(c)
+	if err != nil {
+		t.Fatalf("NewGitHubAppTokenSource() failed: %v", err)
+	}
+	fake := &fakeGitHubApp{t: t, key: &key.PublicKey, now: now, lifetime: lifetime}
+	srv := httptest.NewServer(fake)
+	ts.baseURL = srv.URL
+	ts.now = now
+	return ts, fake, srv.Close
+}
+
+func TestGitHubAppTokenSourceCachesToken(t *testing.T) {
+	now := time.Now()
+	ts, fake, done := newTestTokenSource(t, func() time.Time { return now }, time.Hour)
+	defer done()
+
+	for i := 0; i < 3; i++ {
+		got, err := ts.Token()
+		if err != nil {
+			t.Fatalf("Token() failed: %v", err)
+		}
+		if got != "token-1" {
+			t.Errorf("Token() got: %q, want: %q", got, "token-1")
+		}
+	}
+	if fake.minted != 1 {
+		t.Errorf("Token() minted %d tokens, want 1", fake.minted)
+	}
+}
+
+func TestGitHubAppTokenSourceRenewsExpiringToken(t *testing.T) {
+	now := time.Now()
+	ts, fake, done := newTestTokenSource(t, func() time.Time { return now }, time.Hour)
+	defer done()
+
+	if _, err := ts.Token(); err != nil {
+		t.Fatalf("Token() failed: %v", err)
+	}
+	// Still valid for longer than the expiry margin.
+	now = now.Add(50 * time.Minute)
+	if got, err := ts.Token(); err != nil || got != "token-1" {
+		t.Errorf("Token() got: %q, %v, want: %q", got, err, "token-1")
+	}
+	// Within the expiry margin.
+	now = now.Add(6 * time.Minute)
+	if got, err := ts.Token(); err != nil || got != "token-2" {
+		t.Errorf("Token() got: %q, %v, want: %q", got, err, "token-2")
+	}
+	if fake.minted != 2 {
+		t.Errorf("Token() minted %d tokens, want 2", fake.minted)
+	}
+}
+
+func TestGitHubAppTokenSourceMintFails(t *testing.T) {
+	ts, _, done := newTestTokenSource(t, time.Now, time.Hour)
+	ts.installationID = "789"
+	defer done()
+
+	if _, err := ts.Token(); err == nil {
+		t.Errorf("Token() succeeded for an unknown installation, want error")
+	}
+}
+
+func TestGitHubProviderUsesTokenSource(t *testing.T) {
+	ts, fake, done := newTestTokenSource(t, time.Now, time.Hour)
+	defer done()
+	p := &GitHubProvider{Repository: "repo", Owner: "owner", TokenSource: ts, baseURL: ts.baseURL}
+
+	if err := p.CommentOnPullRequest(7, "body"); err != nil {
+		t.Fatalf("CommentOnPullRequest() failed: %v", err)
+	}
+	if len(fake.authHeaders) != 1 || fake.authHeaders[0] != "Bearer token-1" {
+		t.Errorf("CommentOnPullRequest() got Authorization headers: %v, want: [Bearer token-1]", fake.authHeaders)
+	}
+}
+
+func TestParseGitHubAppConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			data: `{"appId":"123","installationId":"456","privateKey":"key"}`,
+		},
+		{
+			name:    "not json",
+			data:    "ghp_token",
+			wantErr: true,
+		},
+		{
+			name:    "missing installation id",
+			data:    `{"appId":"123","privateKey":"key"}`,
+			wantErr: true,
+		},
+		{
+			name:    "missing private key",
+			data:    `{"appId":"123","installationId":"456"}`,
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseGitHubAppConfig([]byte(tc.data))
+			if (err != nil) != tc.wantErr {
+				t.Errorf("ParseGitHubAppConfig() got err: %v, want err: %t", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewGitHubAppTokenSourceInvalidKey(t *testing.T) {
+	if _, err := NewGitHubAppTokenSource(&GitHubAppConfig{AppID: "123", InstallationID: "456", PrivateKey: "not a key"}); err == nil {
+		t.Errorf("NewGitHubAppTokenSource() succeeded with an invalid private key, want error")
+	}
+}
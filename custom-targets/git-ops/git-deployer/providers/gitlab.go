@@ -20,13 +20,21 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
+// gitLabAPIURL is the base URL of the GitLab REST API.
+const gitLabAPIURL = "https://gitlab.com/api/v4"
+
 // GitLabProvider implements the GitProvider interface for interacting with the Gitlab API.
 type GitLabProvider struct {
 	Repository string
 	Token      string
 	Owner      string
+
+	// baseURL overrides the GitLab API base URL, only set in tests.
+	baseURL string
 }
 
 // gitLabMergeRequest represents the response when querying for a GitLab Merge request.
@@ -39,6 +47,46 @@ type gitLabMergeResponse struct {
 	Sha string `json:"merge_commit_sha"`
 }
 
+// apiURL returns the base URL to use for GitLab API calls.
+func (p *GitLabProvider) apiURL() string {
+	if len(p.baseURL) != 0 {
+		return p.baseURL
+	}
+	return gitLabAPIURL
+}
+
+// CreateBranch calls the GitLab API for creating a branch from the head of the base branch. If the
+// branch already exists, including when it's created concurrently, then no error is returned.
+func (p *GitLabProvider) CreateBranch(name, base string) error {
+	u := fmt.Sprintf("%s/projects/%s%%2F%s/repository/branches?branch=%s&ref=%s", p.apiURL(), p.Owner, p.Repository, url.QueryEscape(name), url.QueryEscape(base))
+	req, err := http.NewRequest(http.MethodPost, u, nil)
+	if err != nil {
+		return fmt.Errorf("unable to create new request: %v", err)
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", p.Token))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	r, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read response body: %v", err)
+	}
+	if resp.StatusCode == http.StatusCreated {
+		return nil
+	}
+	// GitLab responds with a 400 if the branch already exists.
+	if resp.StatusCode == http.StatusBadRequest && strings.Contains(string(r), "already exists") {
+		return nil
+	}
+	return fmt.Errorf("create branch body: %q, status got: %v want: %v", r, resp.StatusCode, http.StatusCreated)
+}
+
 // OpenPullRequest calls the GitLab API for opening a merge request from a source branch to a destination branch.
 func (p *GitLabProvider) OpenPullRequest(src, dst, title, body string) (*PullRequest, error) {
 	payload, err := json.Marshal(map[string]string{
@@ -51,7 +99,7 @@ func (p *GitLabProvider) OpenPullRequest(src, dst, title, body string) (*PullReq
 		return nil, fmt.Errorf("unable to marshal json for merge request: %v", err)
 	}
 	reader := bytes.NewReader(payload)
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://gitlab.com/api/v4/projects/%s%%2F%s/merge_requests", p.Owner, p.Repository), reader)
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/projects/%s%%2F%s/merge_requests", p.apiURL(), p.Owner, p.Repository), reader)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create new request: %v", err)
 	}
@@ -80,10 +128,15 @@ func (p *GitLabProvider) OpenPullRequest(src, dst, title, body string) (*PullReq
 	return &PullRequest{Number: mr.InternalID}, nil
 }
 
+// CommentOnPullRequest is not supported for GitLab.
+func (p *GitLabProvider) CommentOnPullRequest(prNo int, body string) error {
+	return fmt.Errorf("commenting on merge requests is not supported for GitLab")
+}
+
 // MergePullRequest calls the Gitlab API for merging a merge request.
 func (p *GitLabProvider) MergePullRequest(prNo int) (*MergeResponse, error) {
 	call := func(prNo int) (*MergeResponse, error) {
-		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("https://gitlab.com/api/v4/projects/%s%%2F%s/merge_requests/%d/merge", p.Owner, p.Repository, prNo), nil)
+		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/projects/%s%%2F%s/merge_requests/%d/merge", p.apiURL(), p.Owner, p.Repository, prNo), nil)
 		if err != nil {
 			return nil, fmt.Errorf("unable to create new request: %v", err)
 		}
@@ -92,10 +145,11 @@ func (p *GitLabProvider) MergePullRequest(prNo int) (*MergeResponse, error) {
 		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", p.Token))
 
 		resp, err := http.DefaultClient.Do(req)
-		defer resp.Body.Close()
 		if err != nil {
 			return nil, fmt.Errorf("unable to make request: %v", err)
 		}
+		defer resp.Body.Close()
+
 		var mr gitLabMergeResponse
 		r, err := io.ReadAll(resp.Body)
 		if err != nil {
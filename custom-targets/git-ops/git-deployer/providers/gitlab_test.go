@@ -0,0 +1,112 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// fakeGitLab is a minimal fake of the GitLab API endpoints used for opening and merging merge requests.
+type fakeGitLab struct {
+	branches map[string]bool
+	// mergeRequests records the merge request bodies by internal ID.
+	mergeRequests map[int]map[string]string
+	// mergeSha is the merge commit sha returned when merging.
+	mergeSha    string
+	authHeaders []string
+}
+
+func (f *fakeGitLab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.authHeaders = append(f.authHeaders, r.Header.Get("Authorization"))
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/projects/owner/repo/repository/branches":
+		name := r.URL.Query().Get("branch")
+		if f.branches[name] {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"message":"Branch already exists"}`)
+			return
+		}
+		f.branches[name] = true
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPost && r.URL.Path == "/projects/owner/repo/merge_requests":
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if !f.branches[body["target_branch"]] {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		iid := len(f.mergeRequests) + 1
+		f.mergeRequests[iid] = body
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"id":1000,"iid":%d}`, iid)
+	case r.Method == http.MethodPut && r.URL.Path == "/projects/owner/repo/merge_requests/1/merge":
+		fmt.Fprintf(w, `{"iid":1,"state":"merged","merge_commit_sha":%q}`, f.mergeSha)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestGitLabOpenAndMergePullRequest(t *testing.T) {
+	fake := &fakeGitLab{branches: map[string]bool{"main": true}, mergeRequests: map[int]map[string]string{}, mergeSha: "0123456789abcdef0123456789abcdef01234567"}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	p := &GitLabProvider{Repository: "repo", Owner: "owner", Token: "token", baseURL: srv.URL}
+
+	if err := p.CreateBranch("prod", "main"); err != nil {
+		t.Fatalf("CreateBranch() failed: %v", err)
+	}
+	if err := p.CreateBranch("prod", "main"); err != nil {
+		t.Fatalf("CreateBranch() failed for an existing branch: %v", err)
+	}
+	pr, err := p.OpenPullRequest("main", "prod", "title", "body")
+	if err != nil {
+		t.Fatalf("OpenPullRequest() failed: %v", err)
+	}
+	if pr.Number != 1 {
+		t.Errorf("OpenPullRequest() got merge request number: %d, want: 1", pr.Number)
+	}
+	want := map[string]string{"title": "title", "source_branch": "main", "target_branch": "prod", "description": "body"}
+	if got := fake.mergeRequests[1]; !reflect.DeepEqual(got, want) {
+		t.Errorf("OpenPullRequest() got merge request: %v, want: %v", got, want)
+	}
+	mr, err := p.MergePullRequest(pr.Number)
+	if err != nil {
+		t.Fatalf("MergePullRequest() failed: %v", err)
+	}
+	if mr.Sha != fake.mergeSha {
+		t.Errorf("MergePullRequest() got sha: %q, want: %q", mr.Sha, fake.mergeSha)
+	}
+	for _, h := range fake.authHeaders {
+		if h != "Bearer token" {
+			t.Errorf("request got Authorization header: %q, want: %q", h, "Bearer token")
+		}
+	}
+}
+
+func TestGitLabOpenPullRequestMissingDestination(t *testing.T) {
+	fake := &fakeGitLab{branches: map[string]bool{"main": true}, mergeRequests: map[int]map[string]string{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	p := &GitLabProvider{Repository: "repo", Owner: "owner", Token: "token", baseURL: srv.URL}
+
+	if _, err := p.OpenPullRequest("main", "prod", "title", "body"); err == nil {
+		t.Errorf("OpenPullRequest() succeeded with a missing destination branch, want error")
+	}
+}
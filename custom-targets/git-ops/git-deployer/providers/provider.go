@@ -21,8 +21,10 @@ import (
 
 // GitProvider interface provides methods for interacting with the API of a Git Provider.
 type GitProvider interface {
+	CreateBranch(name, base string) error
 	OpenPullRequest(src, dst, title, body string) (*PullRequest, error)
 	MergePullRequest(prNo int) (*MergeResponse, error)
+	CommentOnPullRequest(prNo int, body string) error
 }
 
 // PullRequest represents a pull request resource from a Git provider.
@@ -52,12 +54,31 @@ func CreateProvider(hostname, repoName, owner, secret string) (GitProvider, erro
 			Token:      secret,
 			Owner:      owner,
 		}
+	case "bitbucket.org":
+		provider = &BitbucketProvider{
+			Repository: repoName,
+			Token:      secret,
+			Owner:      owner,
+		}
 	default:
 		return nil, fmt.Errorf("unsupported git provider: %s", hostname)
 	}
 	return provider, nil
 }
 
+// CreateGitHubAppProvider returns an instance of the GitProvider that authenticates as a GitHub App
+// installation. Returns an error if the hostname isn't GitHub.
+func CreateGitHubAppProvider(hostname, repoName, owner string, ts *GitHubAppTokenSource) (GitProvider, error) {
+	if hostname != "github.com" {
+		return nil, fmt.Errorf("GitHub App authentication is not supported for git provider: %s", hostname)
+	}
+	return &GitHubProvider{
+		Repository:  repoName,
+		Owner:       owner,
+		TokenSource: ts,
+	}, nil
+}
+
 func mergePullRequestWithRetries(prNo int, call func(prNo int) (*MergeResponse, error)) (*MergeResponse, error) {
 	endTime := time.Now().Add(2 * time.Minute)
 	startWait := time.Second * 2
@@ -0,0 +1,50 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCreateProvider(t *testing.T) {
+	tests := []struct {
+		hostname string
+		want     GitProvider
+		wantErr  bool
+	}{
+		{hostname: "github.com", want: &GitHubProvider{Repository: "repo", Owner: "owner", Token: "secret"}},
+		{hostname: "gitlab.com", want: &GitLabProvider{Repository: "repo", Owner: "owner", Token: "secret"}},
+		{hostname: "bitbucket.org", want: &BitbucketProvider{Repository: "repo", Owner: "owner", Token: "secret"}},
+		{hostname: "example.com", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.hostname, func(t *testing.T) {
+			got, err := CreateProvider(tc.hostname, "repo", "owner", "secret")
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("CreateProvider(%q) succeeded, want error", tc.hostname)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CreateProvider(%q) failed: %v", tc.hostname, err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("CreateProvider(%q) got: %#v, want: %#v", tc.hostname, got, tc.want)
+			}
+		})
+	}
+}
@@ -2,7 +2,9 @@
 
 SOURCE_DIR="$( cd "$( dirname "${BASH_SOURCE[0]}" )" &> /dev/null && pwd )"
 
-export _CT_SRCDIR="${SOURCE_DIR}/helm-deployer"
+# The build context is the custom-targets directory since the deployer is built against the util module.
+export _CT_SRCDIR="${SOURCE_DIR}/.."
+export _CT_DOCKERFILE=helm/helm-deployer/Dockerfile
 export _CT_IMAGE_NAME=helm
 export _CT_TYPE_NAME=helm
 export _CT_CUSTOM_ACTION_NAME=helm-deployer
@@ -16,51 +16,187 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
 )
 
-const (
-	helmBin   = "helm"
-	gcloudBin = "gcloud"
-)
+const gcloudBin = "gcloud"
+
+// Path to the helm binary used for all commands.
+var helmBin = "helm"
 
 // helmTemplateOptions configures the args provided to `helm template`.
 type helmTemplateOptions struct {
-	lookup   bool
-	validate bool
+	lookup      bool
+	validate    bool
+	includeCRDs bool
+	// Kubeconfig context used to connect to the cluster. If not provided then the current context is used.
+	kubeContext string
+	// Paths of the values files provided in order, followed by the values provided with --set.
+	valuesFiles []string
+	setValues   map[string]string
+	// Additional args appended after the args for the other options so they can override them.
+	extraArgs []string
+	// Retries and timeout used when the command connects to the cluster, i.e. lookup or validate
+	// is enabled. If nil then the command is run once without a deadline.
+	retry *retryOptions
 }
 
 // helmTemplate runs `helm template` for the provided release name and chart path with the
 // provided options. The output from this command is not written to stdout. Returns the
 // manifest in YAML format.
-func helmTemplate(releaseName, chartPath string, opts *helmTemplateOptions) ([]byte, error) {
-	args := []string{"template", releaseName, chartPath, "--include-crds"}
+func helmTemplate(ctx context.Context, releaseName, chartPath string, opts *helmTemplateOptions) ([]byte, error) {
+	args := helmTemplateArgs(releaseName, chartPath, opts)
+	if !opts.lookup && !opts.validate {
+		return runCmd(helmBin, args, true)
+	}
+	return runClusterCmd(ctx, runCmdContext, opts.retry, helmBin, args, true)
+}
+
+// helmTemplateArgs returns the args provided to `helm template`.
+func helmTemplateArgs(releaseName, chartPath string, opts *helmTemplateOptions) []string {
+	args := []string{"template", releaseName, chartPath}
+	if opts.includeCRDs {
+		args = append(args, "--include-crds")
+	}
 	if opts.lookup {
 		args = append(args, "--dry-run=server")
 	}
 	if opts.validate {
 		args = append(args, "--validate")
 	}
-	return runCmd(helmBin, args, true)
+	if len(opts.kubeContext) != 0 {
+		args = append(args, fmt.Sprintf("--kube-context=%s", opts.kubeContext))
+	}
+	args = append(args, valuesArgs(opts.valuesFiles, opts.setValues)...)
+	return append(args, opts.extraArgs...)
 }
 
 // helmUpgradeOptions configures the args provided to `helm upgrade`.
 type helmUpgradeOptions struct {
-	timeout string
+	timeout     string
+	skipCRDs    bool
+	description string
+	labels      map[string]string
+	// How the values of the installed release are handled, one of the helmValuesMode values.
+	valuesMode string
+	// Paths of the values files provided in order, followed by the values provided with --set.
+	valuesFiles []string
+	setValues   map[string]string
+	// Additional args appended after the args for the other options so they can override them.
+	extraArgs []string
+	// Retries and timeout for the command. If nil then the command is run once without a deadline.
+	retry *retryOptions
 }
 
 // helmUpgrade runs `helm upgrade` for the provided release and chart path with the
 // provided options.
-func helmUpgrade(releaseName, chartPath string, opts *helmUpgradeOptions) ([]byte, error) {
+func helmUpgrade(ctx context.Context, releaseName, chartPath string, opts *helmUpgradeOptions) ([]byte, error) {
+	return runClusterCmd(ctx, runCmdContext, opts.retry, helmBin, helmUpgradeArgs(releaseName, chartPath, opts), false)
+}
+
+// helmUpgradeArgs returns the args provided to `helm upgrade`.
+func helmUpgradeArgs(releaseName, chartPath string, opts *helmUpgradeOptions) []string {
 	args := []string{"upgrade", releaseName, chartPath, "--install", "--wait", "--wait-for-jobs"}
-	if len(opts.timeout) != 0 {
-		args = append(args, fmt.Sprintf("--timeout=%s", opts.timeout))
+	timeout := opts.timeout
+	if len(timeout) == 0 && opts.retry != nil && opts.retry.timeout > 0 {
+		// Let helm stop waiting on its own and mark the release as failed, rather than relying on the
+		// attempt being interrupted at its deadline.
+		timeout = opts.retry.timeout.String()
+	}
+	if len(timeout) != 0 {
+		args = append(args, fmt.Sprintf("--timeout=%s", timeout))
+	}
+	if opts.skipCRDs {
+		args = append(args, "--skip-crds")
+	}
+	if len(opts.description) != 0 {
+		args = append(args, fmt.Sprintf("--description=%s", opts.description))
+	}
+	if len(opts.labels) != 0 {
+		// Sort the labels so the args are consistent between runs.
+		var labels []string
+		for k, v := range opts.labels {
+			labels = append(labels, fmt.Sprintf("%s=%s", k, v))
+		}
+		sort.Strings(labels)
+		args = append(args, fmt.Sprintf("--labels=%s", strings.Join(labels, ",")))
+	}
+	switch opts.valuesMode {
+	case valuesModeReuse:
+		args = append(args, "--reuse-values")
+	case valuesModeReset:
+		args = append(args, "--reset-values")
+	}
+	args = append(args, valuesArgs(opts.valuesFiles, opts.setValues)...)
+	return append(args, opts.extraArgs...)
+}
+
+// setValueEscaper escapes the characters helm parses in a --set value, so commas don't split the value into
+// multiple values.
+var setValueEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`)
+
+// valuesArgs returns the args providing the values files, in order, and the --set values to helm. Later
+// args take precedence, so the --set values override the values files.
+func valuesArgs(valuesFiles []string, setValues map[string]string) []string {
+	var args []string
+	for _, vf := range valuesFiles {
+		args = append(args, fmt.Sprintf("--values=%s", vf))
+	}
+	// Sort the values so the args are consistent between runs.
+	var keys []string
+	for k := range setValues {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, fmt.Sprintf("--set=%s=%s", k, setValueEscaper.Replace(setValues[k])))
+	}
+	return args
+}
+
+// helmRegistryLogin runs `helm registry login` for the provided registry host, providing the password on stdin
+// so it isn't visible in the command args.
+func helmRegistryLogin(ctx context.Context, host, username string, password []byte) error {
+	args := helmRegistryLoginArgs(host, username)
+	fmt.Printf("Running the following command: %s %s\n", helmBin, args)
+	cmd := exec.CommandContext(ctx, helmBin, args...)
+	cmd.Stdin = bytes.NewReader(password)
+	cmd.Stdout = os.Stdout
+	var stderr bytes.Buffer
+	cmd.Stderr = io.MultiWriter(&stderr, os.Stderr)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error running command: %v\n%s", err, stderr.Bytes())
 	}
-	return runCmd(helmBin, args, false)
+	return nil
+}
+
+// helmRegistryLoginArgs returns the args provided to `helm registry login`.
+func helmRegistryLoginArgs(host, username string) []string {
+	return []string{"registry", "login", host, fmt.Sprintf("--username=%s", username), "--password-stdin"}
+}
+
+// helmPull runs `helm pull` for the provided chart reference, unpacking the chart into the provided
+// directory. If a version is provided then that version of the chart is pulled, otherwise the latest.
+func helmPull(ctx context.Context, chartRef, version, destDir string) ([]byte, error) {
+	return runCmdContext(ctx, helmBin, helmPullArgs(chartRef, version, destDir), false)
+}
+
+// helmPullArgs returns the args provided to `helm pull`.
+func helmPullArgs(chartRef, version, destDir string) []string {
+	args := []string{"pull", chartRef, "--untar", fmt.Sprintf("--untardir=%s", destDir)}
+	if len(version) != 0 {
+		args = append(args, fmt.Sprintf("--version=%s", version))
+	}
+	return args
 }
 
 // helmGetManifest runs `helm get manifest` for the provided release name. The output
@@ -84,11 +220,112 @@ func gcloudClusterCredentials(gkeCluster string) ([]byte, error) {
 	return runCmd(gcloudBin, args, false)
 }
 
+// retryOptions configures how a command that interacts with the cluster is retried.
+type retryOptions struct {
+	// Number of times to retry the command after a transient cluster error.
+	retries int
+	// Deadline for each attempt, zero means there is no deadline.
+	timeout time.Duration
+	// Duration to wait before the first retry, doubled after each retry.
+	backoff time.Duration
+}
+
+// errCmdTimeout is returned when an attempt of a command exceeds its deadline.
+var errCmdTimeout = errors.New("command timed out")
+
+// cmdWaitDelay is how long a command that is interrupted because its context is done has to exit before
+// it's killed.
+const cmdWaitDelay = 30 * time.Second
+
+// cmdRunner runs the provided command with args, returning its stdout if it succeeds. Allows faking
+// the command execution in tests.
+type cmdRunner func(ctx context.Context, binPath string, args []string, closeOSStdout bool) ([]byte, error)
+
+// retryableClusterErrors are substrings of the errors reported by helm and kubectl when the
+// Kubernetes API server is temporarily unreachable or overloaded.
+var retryableClusterErrors = []string{
+	"connection refused",
+	"connection reset by peer",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"http2: client connection lost",
+	"Kubernetes cluster unreachable",
+	"no route to host",
+	"the server is currently unable to handle the request",
+	"the server was unable to return a response in the time allotted",
+	"etcdserver: request timed out",
+	"etcdserver: leader changed",
+	"Too Many Requests",
+	"ServiceUnavailable",
+}
+
+// isRetryable returns whether the error is a transient cluster error that may succeed when retried.
+// Any other error, e.g. an invalid chart or a failed template, is fatal.
+func isRetryable(err error) bool {
+	if errors.Is(err, errCmdTimeout) {
+		return true
+	}
+	for _, s := range retryableClusterErrors {
+		if strings.Contains(err.Error(), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// runClusterCmd runs the provided command with run, retrying it with exponential backoff while it
+// fails with a transient cluster error and retries remain. Fatal errors are returned immediately.
+func runClusterCmd(ctx context.Context, run cmdRunner, opts *retryOptions, binPath string, args []string, closeOSStdout bool) ([]byte, error) {
+	if opts == nil {
+		opts = &retryOptions{}
+	}
+	backoff := opts.backoff
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if opts.timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, opts.timeout)
+		}
+		out, err := run(attemptCtx, binPath, args, closeOSStdout)
+		cancel()
+		if err == nil {
+			return out, nil
+		}
+		if !isRetryable(err) {
+			return nil, err
+		}
+		if attempt > opts.retries {
+			if attempt == 1 {
+				return nil, err
+			}
+			return nil, fmt.Errorf("failed after %d attempts: %w", attempt, err)
+		}
+		fmt.Printf("Attempt %d of %d failed with a transient cluster error, retrying in %v: %v\n", attempt, opts.retries+1, backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("stopped retrying after %d attempts: %v: %w", attempt, ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
 // runCmd starts and waits for the provided command with args to complete. If the command
 // succeeds it returns the stdout of the command.
 func runCmd(binPath string, args []string, closeOSStdout bool) ([]byte, error) {
+	return runCmdContext(context.Background(), binPath, args, closeOSStdout)
+}
+
+// runCmdContext starts and waits for the provided command with args to complete, interrupting it if the
+// context is done first so helm can release the lock on the release before exiting. The command is killed
+// if it doesn't exit within cmdWaitDelay of the interrupt. If the command succeeds it returns the stdout of
+// the command.
+func runCmdContext(ctx context.Context, binPath string, args []string, closeOSStdout bool) ([]byte, error) {
 	fmt.Printf("Running the following command: %s %s\n", binPath, args)
-	cmd := exec.Command(binPath, args...)
+	cmd := exec.CommandContext(ctx, binPath, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = cmdWaitDelay
 
 	var stderr bytes.Buffer
 	errWriter := io.MultiWriter(&stderr, os.Stderr)
@@ -105,6 +342,9 @@ func runCmd(binPath string, args []string, closeOSStdout bool) ([]byte, error) {
 		return nil, fmt.Errorf("failed to start command: %v", err)
 	}
 	if err := cmd.Wait(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w: %v\n%s", errCmdTimeout, err, stderr.Bytes())
+		}
 		return nil, fmt.Errorf("error running command: %v\n%s", err, stderr.Bytes())
 	}
 	return stdout.Bytes(), nil
@@ -0,0 +1,342 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHelmTemplateArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *helmTemplateOptions
+		want []string
+	}{
+		{
+			name: "no options",
+			opts: &helmTemplateOptions{},
+			want: []string{"template", "release", "chart"},
+		},
+		{
+			name: "include CRDs",
+			opts: &helmTemplateOptions{includeCRDs: true},
+			want: []string{"template", "release", "chart", "--include-crds"},
+		},
+		{
+			name: "all options",
+			opts: &helmTemplateOptions{includeCRDs: true, lookup: true, validate: true},
+			want: []string{"template", "release", "chart", "--include-crds", "--dry-run=server", "--validate"},
+		},
+		{
+			name: "kube context",
+			opts: &helmTemplateOptions{lookup: true, kubeContext: "minikube"},
+			want: []string{"template", "release", "chart", "--dry-run=server", "--kube-context=minikube"},
+		},
+		{
+			name: "values files and set values",
+			opts: &helmTemplateOptions{valuesFiles: []string{"values.yaml", "values-prod.yaml"}, setValues: map[string]string{"replicas": "3", "image.tag": "v1"}},
+			want: []string{"template", "release", "chart", "--values=values.yaml", "--values=values-prod.yaml", "--set=image.tag=v1", "--set=replicas=3"},
+		},
+		{
+			name: "set values with commas and backslashes",
+			opts: &helmTemplateOptions{setValues: map[string]string{"hosts": "a.example.com,b.example.com", "path": `C:\charts`}},
+			want: []string{"template", "release", "chart", `--set=hosts=a.example.com\,b.example.com`, `--set=path=C:\\charts`},
+		},
+		{
+			name: "extra args after options",
+			opts: &helmTemplateOptions{includeCRDs: true, extraArgs: []string{"--kube-version=1.28", "--set", "a=b c"}},
+			want: []string{"template", "release", "chart", "--include-crds", "--kube-version=1.28", "--set", "a=b c"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := helmTemplateArgs("release", "chart", tc.opts)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("helmTemplateArgs() got: %v, want: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHelmUpgradeArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *helmUpgradeOptions
+		want []string
+	}{
+		{
+			name: "no options",
+			opts: &helmUpgradeOptions{},
+			want: []string{"upgrade", "release", "chart", "--install", "--wait", "--wait-for-jobs"},
+		},
+		{
+			name: "timeout and skip CRDs",
+			opts: &helmUpgradeOptions{timeout: "10m", skipCRDs: true},
+			want: []string{"upgrade", "release", "chart", "--install", "--wait", "--wait-for-jobs", "--timeout=10m", "--skip-crds"},
+		},
+		{
+			name: "attempt deadline as timeout",
+			opts: &helmUpgradeOptions{retry: &retryOptions{timeout: 15 * time.Minute}},
+			want: []string{"upgrade", "release", "chart", "--install", "--wait", "--wait-for-jobs", "--timeout=15m0s"},
+		},
+		{
+			name: "timeout with attempt deadline",
+			opts: &helmUpgradeOptions{timeout: "10m", retry: &retryOptions{timeout: 15 * time.Minute}},
+			want: []string{"upgrade", "release", "chart", "--install", "--wait", "--wait-for-jobs", "--timeout=10m"},
+		},
+		{
+			name: "description and labels",
+			opts: &helmUpgradeOptions{description: "Rollout r-1", labels: map[string]string{"b": "2", "a": "1"}},
+			want: []string{"upgrade", "release", "chart", "--install", "--wait", "--wait-for-jobs", "--description=Rollout r-1", "--labels=a=1,b=2"},
+		},
+		{
+			name: "values mode none",
+			opts: &helmUpgradeOptions{valuesMode: valuesModeNone},
+			want: []string{"upgrade", "release", "chart", "--install", "--wait", "--wait-for-jobs"},
+		},
+		{
+			name: "values mode reuse",
+			opts: &helmUpgradeOptions{valuesMode: valuesModeReuse},
+			want: []string{"upgrade", "release", "chart", "--install", "--wait", "--wait-for-jobs", "--reuse-values"},
+		},
+		{
+			name: "values mode reset",
+			opts: &helmUpgradeOptions{valuesMode: valuesModeReset, extraArgs: []string{"--set=image.tag=v2"}},
+			want: []string{"upgrade", "release", "chart", "--install", "--wait", "--wait-for-jobs", "--reset-values", "--set=image.tag=v2"},
+		},
+		{
+			name: "values files and set values",
+			opts: &helmUpgradeOptions{valuesMode: valuesModeReuse, valuesFiles: []string{"values.yaml", "values-prod.yaml"}, setValues: map[string]string{"replicas": "3", "image.tag": "v1"}},
+			want: []string{"upgrade", "release", "chart", "--install", "--wait", "--wait-for-jobs", "--reuse-values", "--values=values.yaml", "--values=values-prod.yaml", "--set=image.tag=v1", "--set=replicas=3"},
+		},
+		{
+			name: "extra args override options",
+			opts: &helmUpgradeOptions{timeout: "10m", extraArgs: []string{"--timeout=20m", "--atomic"}},
+			want: []string{"upgrade", "release", "chart", "--install", "--wait", "--wait-for-jobs", "--timeout=10m", "--timeout=20m", "--atomic"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := helmUpgradeArgs("release", "chart", tc.opts)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("helmUpgradeArgs() got: %v, want: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHelmPullArgs(t *testing.T) {
+	got := helmPullArgs("oci://us-docker.pkg.dev/p/charts/mychart", "1.2.3", "/workspace/source/.oci-chart")
+	want := []string{"pull", "oci://us-docker.pkg.dev/p/charts/mychart", "--untar", "--untardir=/workspace/source/.oci-chart", "--version=1.2.3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("helmPullArgs() got: %v, want: %v", got, want)
+	}
+	got = helmPullArgs("oci://us-docker.pkg.dev/p/charts/mychart", "", "dir")
+	want = []string{"pull", "oci://us-docker.pkg.dev/p/charts/mychart", "--untar", "--untardir=dir"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("helmPullArgs() got: %v, want: %v", got, want)
+	}
+}
+
+func TestHelmRegistryLoginArgs(t *testing.T) {
+	got := helmRegistryLoginArgs("us-docker.pkg.dev", "_json_key")
+	want := []string{"registry", "login", "us-docker.pkg.dev", "--username=_json_key", "--password-stdin"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("helmRegistryLoginArgs() got: %v, want: %v", got, want)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "connection refused",
+			err:  errors.New("error running command: exit status 1\nError: Kubernetes cluster unreachable: Get \"https://10.0.0.1/version\": dial tcp 10.0.0.1:443: connect: connection refused"),
+			want: true,
+		},
+		{
+			name: "api server unavailable",
+			err:  errors.New("error running command: exit status 1\nError: the server is currently unable to handle the request"),
+			want: true,
+		},
+		{
+			name: "attempt timed out",
+			err:  fmt.Errorf("%w: signal: killed", errCmdTimeout),
+			want: true,
+		},
+		{
+			name: "template error",
+			err:  errors.New("error running command: exit status 1\nError: template: mychart/templates/deployment.yaml:7:20: executing \"mychart/templates/deployment.yaml\" at <.Values.image.tag>: nil pointer evaluating interface {}.tag"),
+			want: false,
+		},
+		{
+			name: "template parse error",
+			err:  errors.New("error running command: exit status 1\nError: parse error at (mychart/templates/deployment.yaml:12): unexpected EOF"),
+			want: false,
+		},
+		{
+			name: "invalid chart",
+			err:  errors.New("error running command: exit status 1\nError: Chart.yaml file is missing"),
+			want: false,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isRetryable(tc.err); got != tc.want {
+				t.Errorf("isRetryable() got: %t, want: %t", got, tc.want)
+			}
+		})
+	}
+}
+
+// fakeRunner returns a cmdRunner that returns the provided errors in order, succeeding once they
+// are exhausted, and records the number of calls.
+func fakeRunner(calls *int, errs ...error) cmdRunner {
+	return func(ctx context.Context, binPath string, args []string, closeOSStdout bool) ([]byte, error) {
+		*calls++
+		if *calls <= len(errs) {
+			return nil, errs[*calls-1]
+		}
+		return []byte("ok"), nil
+	}
+}
+
+func TestRunClusterCmd(t *testing.T) {
+	transient := errors.New("dial tcp 10.0.0.1:443: connect: connection refused")
+	fatal := errors.New("Error: Chart.yaml file is missing")
+	tests := []struct {
+		name      string
+		errs      []error
+		retries   int
+		wantCalls int
+		wantErr   error
+	}{
+		{
+			name:      "succeeds first attempt",
+			retries:   2,
+			wantCalls: 1,
+		},
+		{
+			name:      "succeeds after transient errors",
+			errs:      []error{transient, transient},
+			retries:   2,
+			wantCalls: 3,
+		},
+		{
+			name:      "retries exhausted",
+			errs:      []error{transient, transient, transient},
+			retries:   2,
+			wantCalls: 3,
+			wantErr:   transient,
+		},
+		{
+			name:      "fatal error not retried",
+			errs:      []error{fatal},
+			retries:   2,
+			wantCalls: 1,
+			wantErr:   fatal,
+		},
+		{
+			name:      "fatal error after transient error",
+			errs:      []error{transient, fatal},
+			retries:   2,
+			wantCalls: 2,
+			wantErr:   fatal,
+		},
+		{
+			name:      "no retries",
+			errs:      []error{transient},
+			wantCalls: 1,
+			wantErr:   transient,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			out, err := runClusterCmd(context.Background(), fakeRunner(&calls, tc.errs...), &retryOptions{retries: tc.retries}, "helm", nil, false)
+			if calls != tc.wantCalls {
+				t.Errorf("runClusterCmd() got calls: %d, want: %d", calls, tc.wantCalls)
+			}
+			if tc.wantErr == nil {
+				if err != nil {
+					t.Fatalf("runClusterCmd() failed: %v", err)
+				}
+				if string(out) != "ok" {
+					t.Errorf("runClusterCmd() got output: %q, want: %q", out, "ok")
+				}
+				return
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("runClusterCmd() got err: %v, want: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunClusterCmdTimeout(t *testing.T) {
+	calls := 0
+	run := func(ctx context.Context, binPath string, args []string, closeOSStdout bool) ([]byte, error) {
+		calls++
+		if _, ok := ctx.Deadline(); !ok {
+			t.Errorf("attempt %d has no deadline", calls)
+		}
+		if calls == 1 {
+			<-ctx.Done()
+			return nil, fmt.Errorf("%w: %v", errCmdTimeout, ctx.Err())
+		}
+		return []byte("ok"), nil
+	}
+	if _, err := runClusterCmd(context.Background(), run, &retryOptions{retries: 1, timeout: 10 * time.Millisecond}, "helm", nil, false); err != nil {
+		t.Fatalf("runClusterCmd() failed: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("runClusterCmd() got calls: %d, want: 2", calls)
+	}
+}
+
+func TestRunCmdContextInterrupt(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := runCmdContext(ctx, "sh", []string{"-c", "trap 'echo interrupted >&2; exit 3' INT; while true; do sleep 0.01; done"}, true)
+	if !errors.Is(err, errCmdTimeout) {
+		t.Fatalf("runCmdContext() got err: %v, want: %v", err, errCmdTimeout)
+	}
+	if !strings.Contains(err.Error(), "interrupted") {
+		t.Errorf("runCmdContext() got err: %v, want the command to handle the interrupt", err)
+	}
+}
+
+func TestRunClusterCmdCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls := 0
+	transient := errors.New("connect: connection refused")
+	_, err := runClusterCmd(ctx, fakeRunner(&calls, transient), &retryOptions{retries: 3, backoff: time.Hour}, "helm", nil, false)
+	if !errors.Is(err, transient) {
+		t.Errorf("runClusterCmd() got err: %v, want: %v", err, transient)
+	}
+	if calls != 1 {
+		t.Errorf("runClusterCmd() got calls: %d, want: 1", calls)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
 
 	"cloud.google.com/go/storage"
 	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
@@ -65,7 +66,8 @@ func (d *deployer) process(ctx context.Context) error {
 }
 
 // deploy performs the following steps:
-//  1. Run helm upgrade for the provided helm chart
+//  1. Run helm upgrade for the provided helm chart, recording the Cloud Deploy rollout in the helm release
+//     description and labels.
 //  2. Get the helm release manifest and upload to GCS as a deploy artifact.
 //
 // Returns either the deploy results or an error if the deploy failed.
@@ -82,6 +84,9 @@ func (d *deployer) deploy(ctx context.Context) (*clouddeploy.DeployResult, error
 		return nil, fmt.Errorf("unable to open archive file %s: %v", srcArchivePath, err)
 	}
 	fmt.Printf("Unarchiving helm configuration in %s to %s\n", srcArchivePath, srcPath)
+	if err := clouddeploy.CheckArchivePaths(archiveFile.Name(), archiver.NewTarGz()); err != nil {
+		return nil, fmt.Errorf("unable to unarchive helm configuration: %v", err)
+	}
 	if err := archiver.NewTarGz().Unarchive(archiveFile.Name(), srcPath); err != nil {
 		return nil, fmt.Errorf("unable to unarchive helm configuration: %v", err)
 	}
@@ -95,7 +100,22 @@ func (d *deployer) deploy(ctx context.Context) (*clouddeploy.DeployResult, error
 	// Use the pipeline ID as the helm release since this should be consistent.
 	helmRelease := d.req.Pipeline
 	chartPath := determineChartPath(d.params)
-	if _, err := helmUpgrade(helmRelease, chartPath, &helmUpgradeOptions{timeout: d.params.upgradeTimeout}); err != nil {
+	valuesFiles, err := resolveValuesFiles(srcPath, d.params.valuesFiles)
+	if err != nil {
+		return nil, err
+	}
+	upgradeOpts := &helmUpgradeOptions{
+		timeout:     d.params.upgradeTimeout,
+		skipCRDs:    !d.params.includeCRDs,
+		description: upgradeDescription(d.params.upgradeDescription, d.req),
+		labels:      releaseLabels(d.req),
+		valuesMode:  d.params.valuesMode,
+		valuesFiles: valuesFiles,
+		setValues:   d.params.setValues,
+		extraArgs:   d.params.extraUpgradeArgs,
+		retry:       d.params.clusterRetryOptions(),
+	}
+	if _, err := helmUpgrade(ctx, helmRelease, chartPath, upgradeOpts); err != nil {
 		return nil, fmt.Errorf("error running helm upgrade: %v", err)
 	}
 
@@ -105,7 +125,8 @@ func (d *deployer) deploy(ctx context.Context) (*clouddeploy.DeployResult, error
 		return nil, fmt.Errorf("error running helm get manifest aft upgrade: %v", err)
 	}
 	fmt.Println("Uploading helm release manifest as a deploy artifact")
-	mURI, err := d.req.UploadArtifact(ctx, d.gcsClient, "manifest.yaml", &clouddeploy.GCSUploadContent{Data: manifest})
+	mContent := &clouddeploy.GCSUploadContent{Data: manifest}
+	mURI, err := d.req.UploadArtifact(ctx, d.gcsClient, "manifest.yaml", mContent)
 	if err != nil {
 		return nil, fmt.Errorf("error uploading helm release manifest deploy artifact: %v", err)
 	}
@@ -120,3 +141,34 @@ func (d *deployer) deploy(ctx context.Context) (*clouddeploy.DeployResult, error
 	}
 	return dr, nil
 }
+
+// defaultUpgradeDescription is the template used for the helm upgrade description if one is not provided.
+const defaultUpgradeDescription = "Cloud Deploy Delivery Pipeline: {pipeline} Release: {release} Rollout: {rollout}"
+
+// upgradeDescription returns the description to provide to helm upgrade, which is recorded in the
+// helm release history, with the placeholders in the template replaced by the deploy request values.
+func upgradeDescription(tmpl string, req *clouddeploy.DeployRequest) string {
+	if len(tmpl) == 0 {
+		tmpl = defaultUpgradeDescription
+	}
+	r := strings.NewReplacer(
+		"{project}", req.Project,
+		"{location}", req.Location,
+		"{pipeline}", req.Pipeline,
+		"{release}", req.Release,
+		"{rollout}", req.Rollout,
+		"{target}", req.Target,
+	)
+	return r.Replace(tmpl)
+}
+
+// releaseLabels returns the labels to set on the helm release to identify the Cloud Deploy rollout
+// that performed the upgrade.
+func releaseLabels(req *clouddeploy.DeployRequest) map[string]string {
+	return map[string]string{
+		"deploy.cloud.google.com/delivery-pipeline-id": req.Pipeline,
+		"deploy.cloud.google.com/release-id":           req.Release,
+		"deploy.cloud.google.com/rollout-id":           req.Rollout,
+		"deploy.cloud.google.com/target-id":            req.Target,
+	}
+}
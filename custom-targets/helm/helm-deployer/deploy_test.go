@@ -0,0 +1,54 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+)
+
+func TestUpgradeDescription(t *testing.T) {
+	req := &clouddeploy.DeployRequest{
+		Project:  "my-project",
+		Location: "us-central1",
+		Pipeline: "my-pipeline",
+		Release:  "rel-1",
+		Rollout:  "rel-1-to-prod-0001",
+		Target:   "prod",
+	}
+	tests := []struct {
+		name string
+		tmpl string
+		want string
+	}{
+		{
+			name: "default template",
+			want: "Cloud Deploy Delivery Pipeline: my-pipeline Release: rel-1 Rollout: rel-1-to-prod-0001",
+		},
+		{
+			name: "custom template",
+			tmpl: "{project}/{location}: {rollout} to {target}",
+			want: "my-project/us-central1: rel-1-to-prod-0001 to prod",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := upgradeDescription(tc.tmpl, req); got != tc.want {
+				t.Errorf("upgradeDescription() got: %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"os"
 
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"cloud.google.com/go/storage"
 	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
 )
@@ -68,11 +69,20 @@ type requestHandler interface {
 func createRequestHandler(ctx context.Context, cloudDeployRequest interface{}, params *params, gcsClient *storage.Client) (requestHandler, error) {
 	switch r := cloudDeployRequest.(type) {
 	case *clouddeploy.RenderRequest:
-		return &renderer{
+		rr := &renderer{
 			req:       r,
 			params:    params,
 			gcsClient: gcsClient,
-		}, nil
+		}
+		// The Secret Manager client is only needed to log in to the OCI registry the chart is pulled from.
+		if len(params.registrySecret) != 0 {
+			smClient, err := secretmanager.NewClient(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("unable to create secret manager client: %v", err)
+			}
+			rr.smClient = smClient
+		}
+		return rr, nil
 
 	case *clouddeploy.DeployRequest:
 		return &deployer{
@@ -15,9 +15,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Environment variable keys whose values determine the behavior of the Terraform deployer.
@@ -29,8 +33,46 @@ const (
 	templateLookupEnvKey   = "CLOUD_DEPLOY_customTarget_helmTemplateLookup"
 	templateValidateEnvKey = "CLOUD_DEPLOY_customTarget_helmTemplateValidate"
 	upgradeTimeoutEnvKey   = "CLOUD_DEPLOY_customTarget_helmUpgradeTimeout"
+	includeCRDsEnvKey      = "CLOUD_DEPLOY_customTarget_helmIncludeCRDs"
+	descriptionEnvKey      = "CLOUD_DEPLOY_customTarget_helmUpgradeDescription"
+	expectedVersionEnvKey  = "CLOUD_DEPLOY_customTarget_helmExpectedChartVersion"
+	extraTemplateArgsKey   = "CLOUD_DEPLOY_customTarget_helmExtraTemplateArgs"
+	extraUpgradeArgsKey    = "CLOUD_DEPLOY_customTarget_helmExtraUpgradeArgs"
+	archiveScopeEnvKey     = "CLOUD_DEPLOY_customTarget_helmArchiveScope"
+	clusterRetriesEnvKey   = "CLOUD_DEPLOY_customTarget_helmClusterRetries"
+	clusterTimeoutEnvKey   = "CLOUD_DEPLOY_customTarget_helmClusterTimeout"
+	valuesModeEnvKey       = "CLOUD_DEPLOY_customTarget_helmValuesMode"
+	kubeContextEnvKey      = "CLOUD_DEPLOY_customTarget_helmKubeContext"
+	valuesFilesEnvKey      = "CLOUD_DEPLOY_customTarget_helmValuesFiles"
+	setValuesEnvKey        = "CLOUD_DEPLOY_customTarget_helmSet"
+	chartRefEnvKey         = "CLOUD_DEPLOY_customTarget_helmChartRef"
+	chartVersionEnvKey     = "CLOUD_DEPLOY_customTarget_helmChartVersion"
+	registrySecretEnvKey   = "CLOUD_DEPLOY_customTarget_helmRegistrySecret"
+	registryUserEnvKey     = "CLOUD_DEPLOY_customTarget_helmRegistryUsername"
 )
 
+// Supported values for the helmArchiveScope parameter.
+const (
+	// Upload the entire render input for use at deploy time.
+	archiveScopeSource = "source"
+	// Upload only the chart directory, including the dependencies in its charts/ directory.
+	archiveScopeChart = "chart"
+)
+
+// Supported values for the helmValuesMode parameter.
+const (
+	// Use Helm's default handling of the values of the installed release.
+	valuesModeNone = "none"
+	// Merge the provided values over the values of the installed release, `helm upgrade --reuse-values`.
+	valuesModeReuse = "reuse"
+	// Discard the values of the installed release, `helm upgrade --reset-values`.
+	valuesModeReset = "reset"
+)
+
+// defaultRegistryUsername is the username used to log in to the OCI registry when the helmRegistryUsername
+// parameter isn't provided, which Artifact Registry expects for a service account key.
+const defaultRegistryUsername = "_json_key"
+
 // params contains the deploy parameter values passed into the execution environment.
 type params struct {
 	// Name of the GKE cluster.
@@ -46,6 +88,52 @@ type params struct {
 	templateValidate bool
 	// Timeout duration when performing helm upgrade.
 	upgradeTimeout string
+	// Whether to include the CRDs in the chart's crds/ directory. When enabled, the CRDs are
+	// included in the manifest produced by helm template and installed by helm upgrade. When
+	// disabled, they are omitted from the manifest and skipped by helm upgrade. Defaults to true.
+	includeCRDs bool
+	// Template for the description provided to helm upgrade. Supports the placeholders {project},
+	// {location}, {pipeline}, {release}, {rollout} and {target}. If not provided then defaults to:
+	// "Cloud Deploy Delivery Pipeline: {pipeline} Release: {release} Rollout: {rollout}"
+	upgradeDescription string
+	// The version the chart's Chart.yaml is expected to declare. If provided then the render
+	// fails when the chart version differs.
+	expectedChartVersion string
+	// Additional args appended to helm template. These aren't validated.
+	extraTemplateArgs []string
+	// Additional args appended to helm upgrade. These aren't validated.
+	extraUpgradeArgs []string
+	// What is archived at render time for use at deploy time, either "source" or "chart". Defaults
+	// to "source".
+	archiveScope string
+	// Number of times to retry helm upgrade, and helm template when it connects to the cluster, after
+	// a transient cluster error. Defaults to 0.
+	clusterRetries int
+	// Deadline for each attempt of the helm commands that connect to the cluster, zero means there is
+	// no deadline.
+	clusterTimeout time.Duration
+	// How helm upgrade handles the values of the installed release, either "none", "reuse" or
+	// "reset". Defaults to "none".
+	valuesMode string
+	// Name of an existing kubeconfig context used to connect to the cluster at render time instead of
+	// getting the GKE cluster credentials. If not provided then the GKE cluster credentials are used.
+	kubeContext string
+	// Paths of the values files, relative to the root of the Cloud Deploy release archive, provided to
+	// helm template and helm upgrade in order.
+	valuesFiles []string
+	// Values provided to helm template and helm upgrade with --set, taking precedence over the values files.
+	setValues map[string]string
+	// Reference of a chart in an OCI registry, e.g. "oci://us-docker.pkg.dev/project/repo/mychart", pulled at
+	// render time instead of using a chart in the Cloud Deploy release archive.
+	chartRef string
+	// Version of the chart referenced by chartRef to pull, e.g. "1.2.3" or a range such as "^1.2.0". If not
+	// provided then the latest version is pulled.
+	chartVersion string
+	// Name of the Secret Manager secret version containing the password used to log in to the OCI registry,
+	// e.g. "projects/{project}/secrets/{secret}/versions/{version}". If not provided then no login is performed.
+	registrySecret string
+	// Username used to log in to the OCI registry. Defaults to "_json_key".
+	registryUsername string
 }
 
 // determineParams returns the params provided in the execution environment via environment variables.
@@ -69,17 +157,195 @@ func determineParams() (*params, error) {
 	tv, ok := os.LookupEnv(templateValidateEnvKey)
 	if ok {
 		var err error
-		templateLookup, err = strconv.ParseBool(tv)
+		templateValidate, err = strconv.ParseBool(tv)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse parameter %q: %v", templateValidateEnvKey, err)
 		}
 	}
 
+	includeCRDs := true
+	ic, ok := os.LookupEnv(includeCRDsEnvKey)
+	if ok {
+		var err error
+		includeCRDs, err = strconv.ParseBool(ic)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", includeCRDsEnvKey, err)
+		}
+	}
+
+	extraTemplateArgs, err := splitArgs(os.Getenv(extraTemplateArgsKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse parameter %q: %v", extraTemplateArgsKey, err)
+	}
+	extraUpgradeArgs, err := splitArgs(os.Getenv(extraUpgradeArgsKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse parameter %q: %v", extraUpgradeArgsKey, err)
+	}
+
+	archiveScope := archiveScopeSource
+	if as, ok := os.LookupEnv(archiveScopeEnvKey); ok {
+		archiveScope = as
+	}
+	if archiveScope != archiveScopeSource && archiveScope != archiveScopeChart {
+		return nil, fmt.Errorf("parameter %q must be %q or %q, got %q", archiveScopeEnvKey, archiveScopeSource, archiveScopeChart, archiveScope)
+	}
+
+	var clusterRetries int
+	if cr, ok := os.LookupEnv(clusterRetriesEnvKey); ok {
+		clusterRetries, err = strconv.Atoi(cr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", clusterRetriesEnvKey, err)
+		}
+		if clusterRetries < 0 {
+			return nil, fmt.Errorf("parameter %q must not be negative", clusterRetriesEnvKey)
+		}
+	}
+
+	var clusterTimeout time.Duration
+	if ct, ok := os.LookupEnv(clusterTimeoutEnvKey); ok {
+		clusterTimeout, err = time.ParseDuration(ct)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", clusterTimeoutEnvKey, err)
+		}
+		if clusterTimeout < 0 {
+			return nil, fmt.Errorf("parameter %q must not be negative", clusterTimeoutEnvKey)
+		}
+	}
+
+	valuesMode := valuesModeNone
+	if vm, ok := os.LookupEnv(valuesModeEnvKey); ok {
+		valuesMode = vm
+	}
+	if valuesMode != valuesModeNone && valuesMode != valuesModeReuse && valuesMode != valuesModeReset {
+		return nil, fmt.Errorf("parameter %q must be %q, %q or %q, got %q", valuesModeEnvKey, valuesModeNone, valuesModeReuse, valuesModeReset, valuesMode)
+	}
+
+	var valuesFiles []string
+	for _, vf := range strings.Split(os.Getenv(valuesFilesEnvKey), ",") {
+		vf = strings.TrimSpace(vf)
+		if len(vf) == 0 {
+			continue
+		}
+		if filepath.IsAbs(vf) || !filepath.IsLocal(vf) {
+			return nil, fmt.Errorf("parameter %q must contain paths relative to the root of the release archive, got %q", valuesFilesEnvKey, vf)
+		}
+		valuesFiles = append(valuesFiles, vf)
+	}
+
+	var setValues map[string]string
+	if sv, ok := os.LookupEnv(setValuesEnvKey); ok && len(sv) != 0 {
+		if err := json.Unmarshal([]byte(sv), &setValues); err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q, must be a JSON object of string values: %v", setValuesEnvKey, err)
+		}
+	}
+
+	chartRef := os.Getenv(chartRefEnvKey)
+	if len(chartRef) != 0 {
+		if _, _, err := parseChartRef(chartRef); err != nil {
+			return nil, fmt.Errorf("invalid parameter %q: %v", chartRefEnvKey, err)
+		}
+		if len(os.Getenv(configPathEnvKey)) != 0 {
+			return nil, fmt.Errorf("parameters %q and %q can't both be provided, the chart is either in the release archive or in an OCI registry", configPathEnvKey, chartRefEnvKey)
+		}
+	}
+	chartVersion := os.Getenv(chartVersionEnvKey)
+	if len(chartVersion) != 0 && len(chartRef) == 0 {
+		return nil, fmt.Errorf("parameter %q requires parameter %q", chartVersionEnvKey, chartRefEnvKey)
+	}
+	registrySecret := os.Getenv(registrySecretEnvKey)
+	if len(registrySecret) != 0 && len(chartRef) == 0 {
+		return nil, fmt.Errorf("parameter %q requires parameter %q", registrySecretEnvKey, chartRefEnvKey)
+	}
+	registryUsername := defaultRegistryUsername
+	if ru, ok := os.LookupEnv(registryUserEnvKey); ok && len(ru) != 0 {
+		registryUsername = ru
+	}
+
 	return &params{
-		gkeCluster:       cluster,
-		configPath:       os.Getenv(configPathEnvKey),
-		templateLookup:   templateLookup,
-		templateValidate: templateValidate,
-		upgradeTimeout:   os.Getenv(upgradeTimeoutEnvKey),
+		gkeCluster:           cluster,
+		configPath:           os.Getenv(configPathEnvKey),
+		templateLookup:       templateLookup,
+		templateValidate:     templateValidate,
+		upgradeTimeout:       os.Getenv(upgradeTimeoutEnvKey),
+		includeCRDs:          includeCRDs,
+		upgradeDescription:   os.Getenv(descriptionEnvKey),
+		expectedChartVersion: os.Getenv(expectedVersionEnvKey),
+		extraTemplateArgs:    extraTemplateArgs,
+		extraUpgradeArgs:     extraUpgradeArgs,
+		archiveScope:         archiveScope,
+		clusterRetries:       clusterRetries,
+		clusterTimeout:       clusterTimeout,
+		valuesMode:           valuesMode,
+		kubeContext:          os.Getenv(kubeContextEnvKey),
+		valuesFiles:          valuesFiles,
+		setValues:            setValues,
+		chartRef:             chartRef,
+		chartVersion:         chartVersion,
+		registrySecret:       registrySecret,
+		registryUsername:     registryUsername,
 	}, nil
 }
+
+// clusterRetryBackoff is the duration to wait before the first retry of a helm command after a
+// transient cluster error, doubled after each retry.
+const clusterRetryBackoff = 5 * time.Second
+
+// clusterRetryOptions returns the retry options for the helm commands that connect to the cluster.
+func (p *params) clusterRetryOptions() *retryOptions {
+	return &retryOptions{retries: p.clusterRetries, timeout: p.clusterTimeout, backoff: clusterRetryBackoff}
+}
+
+// splitArgs splits the provided string into args the way a POSIX shell splits words. Single quotes
+// preserve everything within them, double quotes preserve everything except backslash escapes of
+// a double quote or backslash, and a backslash outside of quotes escapes the next character. No
+// expansion is performed.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		case c == '\\':
+			if i+1 == len(s) {
+				return nil, fmt.Errorf("trailing backslash in %q", s)
+			}
+			i++
+			cur.WriteByte(s[i])
+			inArg = true
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated single quote in %q", s)
+			}
+			cur.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inArg = true
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+					i++
+				}
+				cur.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("unterminated double quote in %q", s)
+			}
+			inArg = true
+		default:
+			cur.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDetermineParamsTemplateOptions(t *testing.T) {
+	t.Setenv(gkeClusterEnvkey, "projects/p/locations/l/clusters/c")
+	t.Setenv(templateValidateEnvKey, "true")
+	t.Setenv(kubeContextEnvKey, "minikube")
+	p, err := determineParams()
+	if err != nil {
+		t.Fatalf("determineParams() failed: %v", err)
+	}
+	if p.templateLookup {
+		t.Errorf("determineParams() templateLookup got: %v, want: false", p.templateLookup)
+	}
+	if !p.templateValidate {
+		t.Errorf("determineParams() templateValidate got: %v, want: true", p.templateValidate)
+	}
+	if p.kubeContext != "minikube" {
+		t.Errorf("determineParams() kubeContext got: %q, want: %q", p.kubeContext, "minikube")
+	}
+}
+
+func TestDetermineParamsValues(t *testing.T) {
+	tests := []struct {
+		name            string
+		valuesFiles     string
+		setValues       string
+		wantValuesFiles []string
+		wantSetValues   map[string]string
+		wantErr         bool
+	}{
+		{
+			name: "not provided",
+		},
+		{
+			name:            "values files and set values",
+			valuesFiles:     "mychart/values.yaml, env/values-prod.yaml",
+			setValues:       `{"image.tag": "v1", "replicas": "3"}`,
+			wantValuesFiles: []string{"mychart/values.yaml", "env/values-prod.yaml"},
+			wantSetValues:   map[string]string{"image.tag": "v1", "replicas": "3"},
+		},
+		{
+			name:        "values file outside of the archive",
+			valuesFiles: "../values.yaml",
+			wantErr:     true,
+		},
+		{
+			name:        "absolute values file",
+			valuesFiles: "/etc/values.yaml",
+			wantErr:     true,
+		},
+		{
+			name:      "set values not a JSON object of strings",
+			setValues: `{"replicas": 3}`,
+			wantErr:   true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(gkeClusterEnvkey, "projects/p/locations/l/clusters/c")
+			t.Setenv(valuesFilesEnvKey, tc.valuesFiles)
+			t.Setenv(setValuesEnvKey, tc.setValues)
+			p, err := determineParams()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("determineParams() got err: %v, want err: %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(p.valuesFiles, tc.wantValuesFiles) {
+				t.Errorf("determineParams() valuesFiles got: %v, want: %v", p.valuesFiles, tc.wantValuesFiles)
+			}
+			if !reflect.DeepEqual(p.setValues, tc.wantSetValues) {
+				t.Errorf("determineParams() setValues got: %v, want: %v", p.setValues, tc.wantSetValues)
+			}
+		})
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", in: "", want: nil},
+		{name: "whitespace only", in: "  \t ", want: nil},
+		{name: "plain", in: "--atomic  --history-max=5", want: []string{"--atomic", "--history-max=5"}},
+		{name: "double quotes", in: `--set "image.tag=v1 beta" --x`, want: []string{"--set", "image.tag=v1 beta", "--x"}},
+		{name: "single quotes", in: `--set-json 'a={"b": "c d"}'`, want: []string{"--set-json", `a={"b": "c d"}`}},
+		{name: "escaped quote in double quotes", in: `"say \"hi\""`, want: []string{`say "hi"`}},
+		{name: "backslash escape", in: `a\ b c`, want: []string{"a b", "c"}},
+		{name: "adjacent quoted parts", in: `--set=a="b c"'d'`, want: []string{"--set=a=b cd"}},
+		{name: "empty quoted arg", in: `--description ""`, want: []string{"--description", ""}},
+		{name: "unterminated double quote", in: `--set "a=b`, wantErr: true},
+		{name: "unterminated single quote", in: `--set 'a=b`, wantErr: true},
+		{name: "trailing backslash", in: `--set a\`, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := splitArgs(tc.in)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("splitArgs() error: %v, wantErr: %t", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("splitArgs() got: %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDetermineParamsChartRef(t *testing.T) {
+	tests := []struct {
+		name           string
+		env            map[string]string
+		wantUsername   string
+		wantErrContent string
+	}{
+		{
+			name:         "chart ref",
+			env:          map[string]string{chartRefEnvKey: "oci://us-docker.pkg.dev/p/charts/app", registrySecretEnvKey: "projects/p/secrets/s/versions/1"},
+			wantUsername: defaultRegistryUsername,
+		},
+		{
+			name:         "registry username",
+			env:          map[string]string{chartRefEnvKey: "oci://us-docker.pkg.dev/p/charts/app", registryUserEnvKey: "oauth2accesstoken"},
+			wantUsername: "oauth2accesstoken",
+		},
+		{
+			name:           "chart ref and configuration path",
+			env:            map[string]string{chartRefEnvKey: "oci://us-docker.pkg.dev/p/charts/app", configPathEnvKey: "mychart"},
+			wantErrContent: "can't both be provided",
+		},
+		{
+			name:           "invalid chart ref",
+			env:            map[string]string{chartRefEnvKey: "us-docker.pkg.dev/p/charts/app"},
+			wantErrContent: "oci://",
+		},
+		{
+			name:           "chart version without chart ref",
+			env:            map[string]string{chartVersionEnvKey: "1.2.3"},
+			wantErrContent: "requires parameter",
+		},
+		{
+			name:           "registry secret without chart ref",
+			env:            map[string]string{registrySecretEnvKey: "projects/p/secrets/s/versions/1"},
+			wantErrContent: "requires parameter",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(gkeClusterEnvkey, "projects/p/locations/l/clusters/c")
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			p, err := determineParams()
+			if len(tc.wantErrContent) != 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErrContent) {
+					t.Errorf("determineParams() got err: %v, want err containing: %q", err, tc.wantErrContent)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("determineParams() failed: %v", err)
+			}
+			if p.registryUsername != tc.wantUsername {
+				t.Errorf("determineParams() registryUsername got: %q, want: %q", p.registryUsername, tc.wantUsername)
+			}
+		})
+	}
+}
@@ -15,13 +15,22 @@
 package main
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"context"
 	"fmt"
+	"io"
+	"io/fs"
+	"os"
 	"path"
+	"path/filepath"
+	"strings"
 	"time"
 
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"cloud.google.com/go/storage"
 	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+	"sigs.k8s.io/yaml"
 )
 
 const (
@@ -31,6 +40,17 @@ const (
 	srcPath = "/workspace/source"
 	// Name of the archive uploaded at render time that will be downloaded at deploy time.
 	renderedArchiveName = "helm-archive.tgz"
+	// Path to use when archiving only the chart directory for use at deploy time.
+	chartArchivePath = "/workspace/chart-archive.tgz"
+	// Directory within the source where a chart pulled from an OCI registry is unpacked, so it's archived
+	// with the source for use at deploy time.
+	pulledChartDirName = ".oci-chart"
+)
+
+// Render result metadata keys recording the chart pulled from an OCI registry.
+const (
+	chartRefMetadataKey     = "helm-chart-ref"
+	chartVersionMetadataKey = "helm-chart-version"
 )
 
 var (
@@ -43,6 +63,8 @@ type renderer struct {
 	req       *clouddeploy.RenderRequest
 	params    *params
 	gcsClient *storage.Client
+	// Only set when the helmRegistrySecret parameter is provided.
+	smClient *secretmanager.Client
 }
 
 // process processes a render request and uploads succeeded or failed results to GCS for Cloud Deploy.
@@ -79,9 +101,11 @@ func (r *renderer) process(ctx context.Context) error {
 }
 
 // render performs the following steps:
-//  1. Run helm template for the provided helm chart to produce a manifest
-//  2. Upload the manifest to GCS to use as the Cloud Deploy Release inspector artifact.
-//  3. Upload the archived helm configuration to GCS so it can be used at deploy time.
+//  1. If an expected chart version is provided, verify it matches the version in Chart.yaml.
+//  2. Run helm template for the provided helm chart to produce a manifest
+//  3. Upload the manifest to GCS to use as the Cloud Deploy Release inspector artifact.
+//  4. Upload the archived helm configuration, either the entire source or only the chart, to GCS so
+//     it can be used at deploy time.
 //
 // Returns either the render results or an error if the render failed.
 func (r *renderer) render(ctx context.Context) (*clouddeploy.RenderResult, error) {
@@ -94,17 +118,45 @@ func (r *renderer) render(ctx context.Context) (*clouddeploy.RenderResult, error
 
 	// If template lookup or template validatation is enabled then connect to the cluster at render time.
 	if r.params.templateLookup || r.params.templateValidate {
-		fmt.Printf("Helm template lookup or validate enabled. Setting up cluster credentials for %s\n", r.params.gkeCluster)
-		if _, err := gcloudClusterCredentials(r.params.gkeCluster); err != nil {
-			return nil, fmt.Errorf("unable to set up cluster credentials: %v", err)
+		switch renderCredentialSource(r.params) {
+		case credentialSourceKubeContext:
+			fmt.Printf("Helm template lookup or validate enabled. Using existing kube context %s\n", r.params.kubeContext)
+			if err := verifyKubeContext(kubeconfigPaths(), r.params.kubeContext); err != nil {
+				return nil, fmt.Errorf("unable to use kube context: %v", err)
+			}
+		default:
+			fmt.Printf("Helm template lookup or validate enabled. Setting up cluster credentials for %s\n", r.params.gkeCluster)
+			if _, err := gcloudClusterCredentials(r.params.gkeCluster); err != nil {
+				return nil, fmt.Errorf("unable to set up cluster credentials: %v", err)
+			}
+			fmt.Printf("Finished setting up cluster credentials for %s\n", r.params.gkeCluster)
 		}
-		fmt.Printf("Finished setting up cluster credentials for %s\n", r.params.gkeCluster)
 	}
 
 	// Use the pipeline ID as the helm release since this should be consistent.
 	helmRelease := r.req.Pipeline
 	chartPath := determineChartPath(r.params)
-	templateOut, err := helmTemplate(helmRelease, chartPath, &helmTemplateOptions{lookup: r.params.templateLookup, validate: r.params.templateValidate})
+	if len(r.params.chartRef) != 0 {
+		if err := r.pullChart(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if len(r.params.expectedChartVersion) != 0 {
+		fmt.Printf("Verifying the chart version is %s\n", r.params.expectedChartVersion)
+		if err := verifyChartVersion(chartPath, r.params.expectedChartVersion); err != nil {
+			return nil, err
+		}
+	}
+	valuesFiles, err := resolveValuesFiles(srcPath, r.params.valuesFiles)
+	if err != nil {
+		return nil, err
+	}
+	if r.params.archiveScope == archiveScopeChart {
+		if err := checkValuesFilesInChart(chartPath, valuesFiles); err != nil {
+			return nil, err
+		}
+	}
+	templateOut, err := helmTemplate(ctx, helmRelease, chartPath, &helmTemplateOptions{lookup: r.params.templateLookup, validate: r.params.templateValidate, includeCRDs: r.params.includeCRDs, kubeContext: r.params.kubeContext, valuesFiles: valuesFiles, setValues: r.params.setValues, extraArgs: r.params.extraTemplateArgs, retry: r.params.clusterRetryOptions()})
 	if err != nil {
 		return nil, fmt.Errorf("error running helm template: %v", err)
 	}
@@ -118,14 +170,24 @@ func (r *renderer) render(ctx context.Context) (*clouddeploy.RenderResult, error
 	manifest = append(manifest, templateOut...)
 
 	fmt.Println("Uploading manifest from helm template")
-	mURI, err := r.req.UploadArtifact(ctx, r.gcsClient, "manifest.yaml", &clouddeploy.GCSUploadContent{Data: manifest})
+	mContent := &clouddeploy.GCSUploadContent{Data: manifest}
+	mURI, err := r.req.UploadArtifact(ctx, r.gcsClient, "manifest.yaml", mContent)
 	if err != nil {
 		return nil, fmt.Errorf("error uploading manifest: %v", err)
 	}
 	fmt.Printf("Uploaded manifest from helm template to %s\n", mURI)
 
+	archivePath := srcArchivePath
+	if r.params.archiveScope == archiveScopeChart {
+		fmt.Printf("Archiving helm chart in %s to %s\n", chartPath, chartArchivePath)
+		if err := archiveChart(srcPath, chartPath, chartArchivePath); err != nil {
+			return nil, fmt.Errorf("error archiving helm chart: %v", err)
+		}
+		archivePath = chartArchivePath
+	}
 	fmt.Println("Uploading archived helm configuration for use at deploy time")
-	ahURI, err := r.req.UploadArtifact(ctx, r.gcsClient, renderedArchiveName, &clouddeploy.GCSUploadContent{LocalPath: srcArchivePath})
+	ahContent := &clouddeploy.GCSUploadContent{LocalPath: archivePath}
+	ahURI, err := r.req.UploadArtifact(ctx, r.gcsClient, renderedArchiveName, ahContent)
 	if err != nil {
 		return nil, fmt.Errorf("error uploading archived helm configuration: %v", err)
 	}
@@ -139,11 +201,121 @@ func (r *renderer) render(ctx context.Context) (*clouddeploy.RenderResult, error
 			clouddeploy.CustomTargetSourceSHAMetadataKey: clouddeploy.GitCommit,
 		},
 	}
+	if len(r.params.chartRef) != 0 {
+		chart, err := readChartMetadata(chartPath)
+		if err != nil {
+			return nil, err
+		}
+		rr.Metadata[chartRefMetadataKey] = r.params.chartRef
+		rr.Metadata[chartVersionMetadataKey] = chart.Version
+	}
 	return rr, nil
 }
 
+// Sources of the credentials used to connect to the cluster at render time.
+const (
+	// Get the credentials of the GKE cluster with gcloud.
+	credentialSourceGKE = "gke"
+	// Use an existing context of the kubeconfig, e.g. for a cluster outside of GKE.
+	credentialSourceKubeContext = "kube-context"
+)
+
+// renderCredentialSource returns the source of the credentials used to connect to the cluster at render
+// time. The GKE cluster credentials are used unless a kube context is provided.
+func renderCredentialSource(params *params) string {
+	if len(params.kubeContext) != 0 {
+		return credentialSourceKubeContext
+	}
+	return credentialSourceGKE
+}
+
+// kubeconfigPaths returns the paths of the kubeconfig files helm reads, either the paths in the KUBECONFIG
+// environment variable or the default $HOME/.kube/config.
+func kubeconfigPaths() []string {
+	if kc := os.Getenv("KUBECONFIG"); len(kc) != 0 {
+		return filepath.SplitList(kc)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	return []string{filepath.Join(home, ".kube", "config")}
+}
+
+// verifyKubeContext returns an error if none of the provided kubeconfig files defines the provided context.
+// Missing kubeconfig files are skipped the same way helm skips them.
+func verifyKubeContext(kubeconfigs []string, kubeContext string) error {
+	found := false
+	for _, kc := range kubeconfigs {
+		data, err := os.ReadFile(kc)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read kubeconfig %s: %v", kc, err)
+		}
+		found = true
+		cfg := struct {
+			Contexts []struct {
+				Name string `json:"name"`
+			} `json:"contexts"`
+		}{}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return fmt.Errorf("unable to parse kubeconfig %s: %v", kc, err)
+		}
+		for _, c := range cfg.Contexts {
+			if c.Name == kubeContext {
+				return nil
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("no kubeconfig found at %q, a kubeconfig defining context %q is required", kubeconfigs, kubeContext)
+	}
+	return fmt.Errorf("context %q not found in kubeconfig %q", kubeContext, kubeconfigs)
+}
+
+// resolveValuesFiles returns the paths of the provided values files, which are relative to the provided root
+// directory. Returns an error naming the first values file that doesn't exist.
+func resolveValuesFiles(rootPath string, valuesFiles []string) ([]string, error) {
+	var paths []string
+	for _, vf := range valuesFiles {
+		p := path.Join(rootPath, vf)
+		info, err := os.Stat(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("values file %s from parameter %q not found at %s", vf, valuesFilesEnvKey, p)
+			}
+			return nil, fmt.Errorf("unable to read values file %s: %v", p, err)
+		}
+		if info.IsDir() {
+			return nil, fmt.Errorf("values file %s from parameter %q is a directory", vf, valuesFilesEnvKey)
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// checkValuesFilesInChart returns an error if one of the provided values files isn't within the chart directory,
+// since only the chart directory is available at deploy time when the archive scope is "chart".
+func checkValuesFilesInChart(chartPath string, valuesFiles []string) error {
+	for _, vf := range valuesFiles {
+		rel, err := filepath.Rel(chartPath, vf)
+		if err != nil || !filepath.IsLocal(rel) {
+			return fmt.Errorf("values file %s is outside of the chart directory %s, which is the only directory available at deploy time when parameter %q is %q", vf, chartPath, archiveScopeEnvKey, archiveScopeChart)
+		}
+	}
+	return nil
+}
+
 // determineChartPath determines the path to the helm chart based on the deploy parameters provided.
 func determineChartPath(params *params) string {
+	// A chart pulled from an OCI registry is unpacked into a directory named after the chart.
+	if len(params.chartRef) != 0 {
+		// The chart reference is validated when the parameters are determined.
+		_, name, _ := parseChartRef(params.chartRef)
+		return path.Join(srcPath, pulledChartDirName, name)
+	}
 	// If a path to the helm chart is provided then use it, otherwise default to "mychart" directory.
 	chartPath := defaultChartPath
 	if len(params.configPath) != 0 {
@@ -151,3 +323,145 @@ func determineChartPath(params *params) string {
 	}
 	return chartPath
 }
+
+// parseChartRef returns the registry host and the chart name of the provided OCI chart reference, which has
+// the form "oci://{host}/{path}/{chart}".
+func parseChartRef(chartRef string) (string, string, error) {
+	ref, ok := strings.CutPrefix(chartRef, "oci://")
+	if !ok {
+		return "", "", fmt.Errorf("chart reference %q must start with oci://", chartRef)
+	}
+	host, repo, _ := strings.Cut(ref, "/")
+	name := path.Base(repo)
+	if len(host) == 0 || len(repo) == 0 || name == "." || name == "/" || strings.ContainsAny(name, ":@") {
+		return "", "", fmt.Errorf("chart reference %q must have the form oci://{host}/{path}/{chart} without a tag or digest, the version is set with %q", chartRef, chartVersionEnvKey)
+	}
+	return host, name, nil
+}
+
+// pullChart pulls the chart referenced by the helmChartRef parameter into the source, logging in to the
+// registry first if a registry secret is provided. The version in helmChartVersion is pulled if provided,
+// otherwise the latest version.
+func (r *renderer) pullChart(ctx context.Context) error {
+	host, _, err := parseChartRef(r.params.chartRef)
+	if err != nil {
+		return err
+	}
+	if len(r.params.registrySecret) != 0 {
+		fmt.Printf("Logging in to OCI registry %s with the password in %s\n", host, r.params.registrySecret)
+		password, err := clouddeploy.AccessSecretVersion(ctx, r.smClient, r.params.registrySecret)
+		if err != nil {
+			return err
+		}
+		if err := helmRegistryLogin(ctx, host, r.params.registryUsername, password); err != nil {
+			return fmt.Errorf("error running helm registry login: %v", err)
+		}
+	}
+	destDir := path.Join(srcPath, pulledChartDirName)
+	fmt.Printf("Pulling chart %s to %s\n", r.params.chartRef, destDir)
+	if _, err := helmPull(ctx, r.params.chartRef, r.params.chartVersion, destDir); err != nil {
+		return fmt.Errorf("error running helm pull: %v", err)
+	}
+	return nil
+}
+
+// archiveChart creates a tar.gz archive at dst containing only the chart directory, including the
+// dependencies in its charts/ directory. Entries are named relative to rootPath so that unarchiving at
+// deploy time places the chart at the same path it was found at render time.
+func archiveChart(rootPath, chartPath, dst string) error {
+	rel, err := filepath.Rel(rootPath, chartPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("chart path %s is not within %s", chartPath, rootPath)
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("unable to create archive %s: %v", dst, err)
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	err = filepath.WalkDir(chartPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if d.Type()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(rootPath, p)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to archive %s: %v", chartPath, err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("unable to write archive %s: %v", dst, err)
+	}
+	if err := gw.Close(); err != nil {
+		return fmt.Errorf("unable to write archive %s: %v", dst, err)
+	}
+	return f.Close()
+}
+
+// chartMetadata contains the fields of a chart's Chart.yaml used by the deployer.
+type chartMetadata struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	AppVersion string `json:"appVersion"`
+}
+
+// readChartMetadata returns the metadata in the Chart.yaml of the chart at the provided path.
+func readChartMetadata(chartPath string) (*chartMetadata, error) {
+	chartFile := path.Join(chartPath, "Chart.yaml")
+	data, err := os.ReadFile(chartFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read chart metadata %s: %v", chartFile, err)
+	}
+	var chart chartMetadata
+	if err := yaml.Unmarshal(data, &chart); err != nil {
+		return nil, fmt.Errorf("unable to parse chart metadata %s: %v", chartFile, err)
+	}
+	return &chart, nil
+}
+
+// verifyChartVersion verifies that the version declared in the Chart.yaml of the provided chart
+// matches the expected version.
+func verifyChartVersion(chartPath, expectedVersion string) error {
+	chart, err := readChartMetadata(chartPath)
+	if err != nil {
+		return err
+	}
+	if chart.Version != expectedVersion {
+		return fmt.Errorf("chart %s version %q does not match the expected version %q (appVersion %q)", chart.Name, chart.Version, expectedVersion, chart.AppVersion)
+	}
+	return nil
+}
@@ -0,0 +1,395 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"hash/crc32"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+	"github.com/mholt/archiver/v3"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestVerifyChartVersion(t *testing.T) {
+	chartPath := t.TempDir()
+	chart := "apiVersion: v2\nname: mychart\nversion: 1.2.3\nappVersion: \"4.5.6\"\n"
+	if err := os.WriteFile(path.Join(chartPath, "Chart.yaml"), []byte(chart), 0644); err != nil {
+		t.Fatalf("unable to write Chart.yaml: %v", err)
+	}
+
+	if err := verifyChartVersion(chartPath, "1.2.3"); err != nil {
+		t.Errorf("verifyChartVersion() failed with matching version: %v", err)
+	}
+	if err := verifyChartVersion(chartPath, "1.2.4"); err == nil {
+		t.Errorf("verifyChartVersion() succeeded with mismatched version, want error")
+	}
+	if err := verifyChartVersion(t.TempDir(), "1.2.3"); err == nil {
+		t.Errorf("verifyChartVersion() succeeded with missing Chart.yaml, want error")
+	}
+}
+
+func TestArchiveChart(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"charts/app/Chart.yaml":             "apiVersion: v2\nname: app\nversion: 1.0.0\n",
+		"charts/app/templates/deploy.yaml":  "kind: Deployment\n",
+		"charts/app/charts/redis-1.0.0.tgz": "dependency",
+		"charts/other/Chart.yaml":           "apiVersion: v2\nname: other\nversion: 1.0.0\n",
+		"docs/README.md":                    "docs",
+	}
+	for name, content := range files {
+		p := path.Join(root, name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatalf("unable to create directory: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("unable to write %s: %v", name, err)
+		}
+	}
+
+	dst := path.Join(t.TempDir(), "chart-archive.tgz")
+	if err := archiveChart(root, path.Join(root, "charts/app"), dst); err != nil {
+		t.Fatalf("archiveChart() failed: %v", err)
+	}
+
+	var got []string
+	if err := archiver.NewTarGz().Walk(dst, func(f archiver.File) error {
+		got = append(got, f.Header.(*tar.Header).Name)
+		return nil
+	}); err != nil {
+		t.Fatalf("unable to walk archive: %v", err)
+	}
+	sort.Strings(got)
+	want := []string{
+		"charts/app/",
+		"charts/app/Chart.yaml",
+		"charts/app/charts/",
+		"charts/app/charts/redis-1.0.0.tgz",
+		"charts/app/templates/",
+		"charts/app/templates/deploy.yaml",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("archiveChart() entries got: %v, want: %v", got, want)
+	}
+
+	// Unarchive as the deploy does and verify the chart is at the same path relative to the root.
+	dest := t.TempDir()
+	if err := clouddeploy.CheckArchivePaths(dst, archiver.NewTarGz()); err != nil {
+		t.Fatalf("CheckArchivePaths() failed: %v", err)
+	}
+	if err := archiver.NewTarGz().Unarchive(dst, dest); err != nil {
+		t.Fatalf("unable to unarchive: %v", err)
+	}
+	b, err := os.ReadFile(path.Join(dest, "charts/app/Chart.yaml"))
+	if err != nil {
+		t.Fatalf("unable to read unarchived Chart.yaml: %v", err)
+	}
+	if string(b) != files["charts/app/Chart.yaml"] {
+		t.Errorf("unarchived Chart.yaml got: %q, want: %q", b, files["charts/app/Chart.yaml"])
+	}
+}
+
+func TestArchiveChartOutsideRoot(t *testing.T) {
+	root := t.TempDir()
+	dst := path.Join(t.TempDir(), "chart-archive.tgz")
+	if err := archiveChart(root, path.Join(root, "../mychart"), dst); err == nil {
+		t.Errorf("archiveChart() succeeded for a chart outside of the root, want error")
+	}
+}
+
+func TestRenderCredentialSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		params *params
+		want   string
+	}{
+		{
+			name:   "default",
+			params: &params{gkeCluster: "projects/p/locations/l/clusters/c"},
+			want:   credentialSourceGKE,
+		},
+		{
+			name:   "kube context",
+			params: &params{gkeCluster: "projects/p/locations/l/clusters/c", kubeContext: "minikube"},
+			want:   credentialSourceKubeContext,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := renderCredentialSource(tc.params); got != tc.want {
+				t.Errorf("renderCredentialSource() got: %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerifyKubeContext(t *testing.T) {
+	dir := t.TempDir()
+	kubeconfig := path.Join(dir, "config")
+	data := "apiVersion: v1\nkind: Config\ncontexts:\n- name: minikube\n  context:\n    cluster: minikube\n- name: kind-dev\n  context:\n    cluster: kind-dev\n"
+	if err := os.WriteFile(kubeconfig, []byte(data), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	missing := path.Join(dir, "missing")
+	tests := []struct {
+		name        string
+		kubeconfigs []string
+		context     string
+		wantErr     string
+	}{
+		{
+			name:        "context defined",
+			kubeconfigs: []string{kubeconfig},
+			context:     "kind-dev",
+		},
+		{
+			name:        "context defined in later kubeconfig",
+			kubeconfigs: []string{missing, kubeconfig},
+			context:     "minikube",
+		},
+		{
+			name:        "context not defined",
+			kubeconfigs: []string{kubeconfig},
+			context:     "prod",
+			wantErr:     "not found",
+		},
+		{
+			name:        "no kubeconfig",
+			kubeconfigs: []string{missing},
+			context:     "minikube",
+			wantErr:     "no kubeconfig found",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := verifyKubeContext(tc.kubeconfigs, tc.context)
+			if len(tc.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("verifyKubeContext() failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("verifyKubeContext() got err: %v, want err containing: %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolveValuesFiles(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"mychart/values.yaml", "env/values-prod.yaml"} {
+		p := path.Join(root, name)
+		if err := os.MkdirAll(path.Dir(p), os.ModePerm); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(p, []byte("replicas: 1\n"), 0644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+	got, err := resolveValuesFiles(root, []string{"env/values-prod.yaml", "mychart/values.yaml"})
+	if err != nil {
+		t.Fatalf("resolveValuesFiles() failed: %v", err)
+	}
+	want := []string{path.Join(root, "env/values-prod.yaml"), path.Join(root, "mychart/values.yaml")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("resolveValuesFiles() got: %v, want: %v", got, want)
+	}
+
+	_, err = resolveValuesFiles(root, []string{"mychart/values.yaml", "env/values-staging.yaml"})
+	if err == nil || !strings.Contains(err.Error(), path.Join(root, "env/values-staging.yaml")) {
+		t.Errorf("resolveValuesFiles() got err: %v, want err naming the missing values file", err)
+	}
+	if _, err := resolveValuesFiles(root, []string{"env"}); err == nil {
+		t.Errorf("resolveValuesFiles() got no error for a directory, want error")
+	}
+}
+
+func TestCheckValuesFilesInChart(t *testing.T) {
+	chartPath := path.Join(srcPath, "mychart")
+	if err := checkValuesFilesInChart(chartPath, []string{path.Join(chartPath, "values-prod.yaml"), path.Join(chartPath, "env/values.yaml")}); err != nil {
+		t.Errorf("checkValuesFilesInChart() failed: %v", err)
+	}
+	if err := checkValuesFilesInChart(chartPath, []string{path.Join(srcPath, "env/values-prod.yaml")}); err == nil {
+		t.Errorf("checkValuesFilesInChart() got no error for a values file outside of the chart, want error")
+	}
+}
+
+func TestParseChartRef(t *testing.T) {
+	tests := []struct {
+		ref      string
+		wantHost string
+		wantName string
+		wantErr  bool
+	}{
+		{ref: "oci://us-docker.pkg.dev/p/charts/mychart", wantHost: "us-docker.pkg.dev", wantName: "mychart"},
+		{ref: "oci://registry.example.com/mychart", wantHost: "registry.example.com", wantName: "mychart"},
+		{ref: "https://charts.example.com/mychart", wantErr: true},
+		{ref: "oci://us-docker.pkg.dev", wantErr: true},
+		{ref: "oci://us-docker.pkg.dev/p/charts/mychart:1.2.3", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.ref, func(t *testing.T) {
+			host, name, err := parseChartRef(tc.ref)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseChartRef() got err: %v, want err: %v", err, tc.wantErr)
+			}
+			if host != tc.wantHost || name != tc.wantName {
+				t.Errorf("parseChartRef() got: %q, %q, want: %q, %q", host, name, tc.wantHost, tc.wantName)
+			}
+		})
+	}
+}
+
+func TestDetermineChartPath(t *testing.T) {
+	tests := []struct {
+		name   string
+		params *params
+		want   string
+	}{
+		{
+			name:   "default",
+			params: &params{},
+			want:   path.Join(srcPath, "mychart"),
+		},
+		{
+			name:   "configuration path",
+			params: &params{configPath: "charts/app"},
+			want:   path.Join(srcPath, "charts/app"),
+		},
+		{
+			name:   "OCI chart",
+			params: &params{chartRef: "oci://us-docker.pkg.dev/p/charts/app"},
+			want:   path.Join(srcPath, pulledChartDirName, "app"),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := determineChartPath(tc.params); got != tc.want {
+				t.Errorf("determineChartPath() got: %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// fakeSecretManagerServer is a fake Secret Manager API that returns the same payload for every secret version.
+type fakeSecretManagerServer struct {
+	secretmanagerpb.UnimplementedSecretManagerServiceServer
+	payload *secretmanagerpb.SecretPayload
+}
+
+func (f *fakeSecretManagerServer) AccessSecretVersion(ctx context.Context, req *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+	return &secretmanagerpb.AccessSecretVersionResponse{Name: req.Name, Payload: f.payload}, nil
+}
+
+func TestPullChart(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	fake := &fakeSecretManagerServer{}
+	srv := grpc.NewServer()
+	secretmanagerpb.RegisterSecretManagerServiceServer(srv, fake)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	ctx := context.Background()
+	smClient, err := secretmanager.NewClient(ctx,
+		option.WithEndpoint(lis.Addr().String()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	)
+	if err != nil {
+		t.Fatalf("unable to create secret manager client: %v", err)
+	}
+	defer smClient.Close()
+
+	// The fake helm records its args, and what it reads on stdin for registry login, to a log.
+	dir := t.TempDir()
+	logPath := path.Join(dir, "commands.log")
+	bin := path.Join(dir, "helm")
+	script := "#!/bin/sh\necho \"$@\" >> " + logPath + "\nif [ \"$1\" = registry ]; then cat >> " + logPath + "; echo >> " + logPath + "; fi\n"
+	if err := os.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatalf("unable to write fake helm: %v", err)
+	}
+	orig := helmBin
+	helmBin = bin
+	t.Cleanup(func() { helmBin = orig })
+
+	data := []byte("registry-password")
+	checksum := int64(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	wrongChecksum := checksum + 1
+	destDir := path.Join(srcPath, pulledChartDirName)
+	tests := []struct {
+		name    string
+		params  *params
+		payload *secretmanagerpb.SecretPayload
+		wantLog []string
+		wantErr bool
+	}{
+		{
+			name:    "latest version without login",
+			params:  &params{chartRef: "oci://us-docker.pkg.dev/p/charts/app"},
+			wantLog: []string{"pull oci://us-docker.pkg.dev/p/charts/app --untar --untardir=" + destDir},
+		},
+		{
+			name:    "chart version with login",
+			params:  &params{chartRef: "oci://us-docker.pkg.dev/p/charts/app", chartVersion: "^1.2.0", expectedChartVersion: "1.2.3", registrySecret: "projects/p/secrets/s/versions/1", registryUsername: "_json_key"},
+			payload: &secretmanagerpb.SecretPayload{Data: data, DataCrc32C: &checksum},
+			wantLog: []string{
+				"registry login us-docker.pkg.dev --username=_json_key --password-stdin",
+				"registry-password",
+				"pull oci://us-docker.pkg.dev/p/charts/app --untar --untardir=" + destDir + " --version=^1.2.0",
+			},
+		},
+		{
+			name:    "secret checksum mismatch",
+			params:  &params{chartRef: "oci://us-docker.pkg.dev/p/charts/app", registrySecret: "projects/p/secrets/s/versions/1", registryUsername: "_json_key"},
+			payload: &secretmanagerpb.SecretPayload{Data: data, DataCrc32C: &wrongChecksum},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			os.Remove(logPath)
+			fake.payload = tc.payload
+			r := &renderer{params: tc.params, smClient: smClient}
+			err := r.pullChart(ctx)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("pullChart() got err: %v, want err: %v", err, tc.wantErr)
+			}
+			var gotLog []string
+			if b, err := os.ReadFile(logPath); err == nil {
+				gotLog = strings.Split(strings.TrimSpace(string(b)), "\n")
+			}
+			if !reflect.DeepEqual(gotLog, tc.wantLog) {
+				t.Errorf("pullChart() helm commands got: %q, want: %q", gotLog, tc.wantLog)
+			}
+		})
+	}
+}
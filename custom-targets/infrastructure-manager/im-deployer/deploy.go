@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"regexp"
+	"strings"
 
 	config "cloud.google.com/go/config/apiv1"
 	"cloud.google.com/go/config/apiv1/configpb"
@@ -35,6 +37,14 @@ const (
 	deploymentMetadataKey = "deployment"
 	// Key to use for the revision name in the metadata results when deploy succeeds.
 	revisionMetadataKey = "revision"
+	// Key to use for the Cloud Build log URL of the revision in the metadata results.
+	buildLogURLMetadataKey = "build-log-url"
+	// Label applied to the Deployment with the ID of the Cloud Deploy Rollout that last applied it.
+	rolloutLabelKey = "rollout-id"
+	// Key to use in the metadata results to indicate the deploy was a dry run.
+	dryRunMetadataKey = "dry-run"
+	// Key to use for the action a dry run determined would be taken, either "create" or "update".
+	dryRunActionMetadataKey = "dry-run-action"
 )
 
 // deployer implements the requestHandler interface for deploy requests.
@@ -43,14 +53,20 @@ type deployer struct {
 	params    *params
 	imClient  *config.Client
 	gcsClient *storage.Client
+	// Cloud Build log URL of the latest revision, included in the result metadata when known.
+	buildLogURL string
 }
 
 // process processes a deploy request and uploads succeeded or failed results to GCS for Cloud Deploy.
 func (d *deployer) process(ctx context.Context) error {
 	fmt.Println("Processing deploy request")
 
-	res, err := d.deploy(ctx)
+	opCtx, cancel := clouddeploy.WithOperationTimeout(ctx, d.params.operationTimeout)
+	defer cancel()
+	res, err := d.deploy(opCtx)
 	if err != nil {
+		// Results are uploaded with the parent context since the operation context may have expired.
+		err = clouddeploy.OperationTimeoutError(opCtx, d.params.operationTimeout, err)
 		fmt.Printf("Deploy failed: %v\n", err)
 		dr := &clouddeploy.DeployResult{
 			ResultStatus:   clouddeploy.DeployFailed,
@@ -60,6 +76,9 @@ func (d *deployer) process(ctx context.Context) error {
 				clouddeploy.CustomTargetSourceSHAMetadataKey: clouddeploy.GitCommit,
 			},
 		}
+		if len(d.buildLogURL) != 0 {
+			dr.Metadata[buildLogURLMetadataKey] = d.buildLogURL
+		}
 		fmt.Println("Uploading failed deploy results")
 		rURI, err := d.req.UploadResult(ctx, d.gcsClient, dr)
 		if err != nil {
@@ -80,6 +99,7 @@ func (d *deployer) process(ctx context.Context) error {
 
 // deploy performs the following steps:
 //  1. Create or update the Infrastructure Manager Deployment based on the Deployment YAML created at render time.
+//     If dry run is enabled then the Deployment is only validated and is neither created nor updated.
 //
 // Returns either the deploy results or an error if the deploy failed.
 func (d *deployer) deploy(ctx context.Context) (*clouddeploy.DeployResult, error) {
@@ -94,6 +114,15 @@ func (d *deployer) deploy(ctx context.Context) (*clouddeploy.DeployResult, error
 	if err != nil {
 		return nil, fmt.Errorf("error parsing rendered deployment: %v", err)
 	}
+	if d.params.dryRun {
+		return d.dryRun(ctx, rd)
+	}
+	if !d.params.disableCloudDeployLabels {
+		if rd.Labels == nil {
+			rd.Labels = map[string]string{}
+		}
+		rd.Labels[rolloutLabelKey] = d.req.Rollout
+	}
 	deployment, err := d.applyDeployment(ctx, rd)
 	if err != nil {
 		return nil, err
@@ -120,10 +149,16 @@ func (d *deployer) deploy(ctx context.Context) (*clouddeploy.DeployResult, error
 		return nil, fmt.Errorf("error getting revision %s: %v", revName, err)
 	}
 	fmt.Printf("Revision %s executed in Cloud Build %s\n", revName, rev.Build)
+	if url, err := buildLogURL(rev.Build, d.params.imProject, d.params.imLocation); err != nil {
+		fmt.Printf("Unable to determine the Cloud Build log URL: %v\n", err)
+	} else {
+		d.buildLogURL = url
+		fmt.Printf("Cloud Build logs are available at %s\n", url)
+	}
 
 	if isSucceededDeployment(deployment.State) {
 		fmt.Printf("Deployment Succeeded with latest Revision %s\n", revName)
-		return processDeploymentSucceeded(ctx, deployment, rev)
+		return processDeploymentSucceeded(ctx, deployment, rev, d.buildLogURL)
 	}
 	fmt.Printf("Deployment Failed with latest Revision %s\n", revName)
 	return nil, processDeploymentFailed(ctx, deployment, rev)
@@ -147,6 +182,56 @@ func renderedDeployment(deploymentYAMLPath string) (*configpb.Deployment, error)
 	return deployment, nil
 }
 
+// dryRun validates the rendered Deployment without creating or updating it. The Deployment must target the
+// configured Deployment name, its Terraform Blueprint must exist in GCS, and an existing Deployment must not be
+// locked or have an operation in progress. Returns a successful deploy result recording whether the Deployment
+// would be created or updated.
+func (d *deployer) dryRun(ctx context.Context, rd *configpb.Deployment) (*clouddeploy.DeployResult, error) {
+	fmt.Printf("Dry run enabled, validating Deployment %s without creating or updating it\n", rd.Name)
+	if rd.Name != d.params.deploymentName() {
+		return nil, fmt.Errorf("rendered deployment name %s doesn't match the configured deployment %s", rd.Name, d.params.deploymentName())
+	}
+	if rd.ServiceAccount == nil || len(*rd.ServiceAccount) == 0 {
+		return nil, fmt.Errorf("rendered deployment %s has no service account", rd.Name)
+	}
+	src := rd.GetTerraformBlueprint().GetGcsSource()
+	if len(src) == 0 {
+		return nil, fmt.Errorf("rendered deployment %s has no terraform blueprint in gcs", rd.Name)
+	}
+	bucket, object, ok := strings.Cut(strings.TrimPrefix(src, "gs://"), "/")
+	if !strings.HasPrefix(src, "gs://") || !ok {
+		return nil, fmt.Errorf("invalid terraform blueprint gcs source %q", src)
+	}
+	if _, err := d.gcsClient.Bucket(bucket).Object(object).Attrs(ctx); err != nil {
+		return nil, fmt.Errorf("unable to get terraform blueprint %s: %v", src, err)
+	}
+
+	action := "update"
+	existing, err := getDeployment(ctx, d.imClient, rd.Name)
+	switch {
+	case status.Code(err) == codes.NotFound:
+		action = "create"
+	case err != nil:
+		return nil, fmt.Errorf("error getting deployment %s: %v", rd.Name, err)
+	case existing.LockState != configpb.Deployment_UNLOCKED && existing.LockState != configpb.Deployment_LOCK_STATE_UNSPECIFIED:
+		return nil, fmt.Errorf("deployment %s has lock state %s and can't be updated", rd.Name, existing.LockState)
+	case isInProgressDeployment(existing.State):
+		return nil, fmt.Errorf("deployment %s has state %s and can't be updated until it finishes", rd.Name, existing.State)
+	}
+	fmt.Printf("Dry run succeeded, Deployment %s would be %sd\n", rd.Name, action)
+
+	return &clouddeploy.DeployResult{
+		ResultStatus: clouddeploy.DeploySucceeded,
+		Metadata: map[string]string{
+			clouddeploy.CustomTargetSourceMetadataKey:    imDeployerSampleName,
+			clouddeploy.CustomTargetSourceSHAMetadataKey: clouddeploy.GitCommit,
+			deploymentMetadataKey:                        rd.Name,
+			dryRunMetadataKey:                            "true",
+			dryRunActionMetadataKey:                      action,
+		},
+	}, nil
+}
+
 // applyDeployment either creates or updates an existing Infrastructure Manager Deployment with the
 // provided Deployment configuration.
 func (d *deployer) applyDeployment(ctx context.Context, renderedDeployment *configpb.Deployment) (*configpb.Deployment, error) {
@@ -178,13 +263,16 @@ func (d *deployer) applyDeployment(ctx context.Context, renderedDeployment *conf
 
 // processDeploymentSucceeded handles a successful Deployment and returns a successful deploy result that includes the
 // Infrastructure Manager revision's outputs in the result metadata.
-func processDeploymentSucceeded(ctx context.Context, deployment *configpb.Deployment, rev *configpb.Revision) (*clouddeploy.DeployResult, error) {
+func processDeploymentSucceeded(ctx context.Context, deployment *configpb.Deployment, rev *configpb.Revision, buildLogURL string) (*clouddeploy.DeployResult, error) {
 	metadata := map[string]string{
 		clouddeploy.CustomTargetSourceMetadataKey:    imDeployerSampleName,
 		clouddeploy.CustomTargetSourceSHAMetadataKey: clouddeploy.GitCommit,
 		deploymentMetadataKey:                        deployment.Name,
 		revisionMetadataKey:                          rev.Name,
 	}
+	if len(buildLogURL) != 0 {
+		metadata[buildLogURLMetadataKey] = buildLogURL
+	}
 	for k, v := range rev.ApplyResults.Outputs {
 		mv, err := v.Value.MarshalJSON()
 		if err != nil {
@@ -199,6 +287,26 @@ func processDeploymentSucceeded(ctx context.Context, deployment *configpb.Deploy
 	return res, nil
 }
 
+var (
+	// buildNameRegex matches a Cloud Build resource name.
+	buildNameRegex = regexp.MustCompile("^projects/([^/]+)/locations/([^/]+)/builds/([^/]+)$")
+	// buildIDRegex matches a Cloud Build ID.
+	buildIDRegex = regexp.MustCompile("^[A-Za-z0-9-]+$")
+)
+
+// buildLogURL returns the Cloud Console URL of the logs of the provided Cloud Build. The build is either a
+// resource name, "projects/{project}/locations/{location}/builds/{id}", or a build ID, in which case the
+// build is assumed to run in the provided project and location of the Deployment.
+func buildLogURL(build, project, location string) (string, error) {
+	if m := buildNameRegex.FindStringSubmatch(build); m != nil {
+		project, location, build = m[1], m[2], m[3]
+	}
+	if !buildIDRegex.MatchString(build) {
+		return "", fmt.Errorf("invalid cloud build %q", build)
+	}
+	return fmt.Sprintf("https://console.cloud.google.com/cloud-build/builds;region=%s/%s?project=%s", location, build, project), nil
+}
+
 // processDeploymentFailed handles a failed Deployment by logging various information from the Infrastructure Manager
 // resources to provide context on the failure.
 func processDeploymentFailed(ctx context.Context, deployment *configpb.Deployment, rev *configpb.Revision) error {
@@ -0,0 +1,277 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	config "cloud.google.com/go/config/apiv1"
+	"cloud.google.com/go/config/apiv1/configpb"
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
+	"cloud.google.com/go/storage"
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestDryRunInvalidDeployment(t *testing.T) {
+	// The fake Cloud Storage server doesn't have any objects, so every blueprint is missing.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+	}))
+	defer srv.Close()
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))
+	gcsClient, err := storage.NewClient(context.Background())
+	if err != nil {
+		t.Fatalf("unable to create storage client: %v", err)
+	}
+	defer gcsClient.Close()
+
+	name := "projects/p/locations/us-central1/deployments/d"
+	sa := "projects/p/serviceAccounts/im@p.iam.gserviceaccount.com"
+	empty := ""
+	blueprint := func(src string) *configpb.Deployment_TerraformBlueprint {
+		return &configpb.Deployment_TerraformBlueprint{
+			TerraformBlueprint: &configpb.TerraformBlueprint{Source: &configpb.TerraformBlueprint_GcsSource{GcsSource: src}},
+		}
+	}
+	tests := []struct {
+		name       string
+		deployment *configpb.Deployment
+		wantErr    string
+	}{
+		{
+			name:       "name mismatch",
+			deployment: &configpb.Deployment{Name: "projects/p/locations/us-central1/deployments/other", ServiceAccount: &sa, Blueprint: blueprint("gs://b/config.tar.gz")},
+			wantErr:    "doesn't match the configured deployment",
+		},
+		{
+			name:       "no service account",
+			deployment: &configpb.Deployment{Name: name, Blueprint: blueprint("gs://b/config.tar.gz")},
+			wantErr:    "has no service account",
+		},
+		{
+			name:       "empty service account",
+			deployment: &configpb.Deployment{Name: name, ServiceAccount: &empty, Blueprint: blueprint("gs://b/config.tar.gz")},
+			wantErr:    "has no service account",
+		},
+		{
+			name:       "no blueprint",
+			deployment: &configpb.Deployment{Name: name, ServiceAccount: &sa},
+			wantErr:    "has no terraform blueprint in gcs",
+		},
+		{
+			name:       "blueprint not in gcs",
+			deployment: &configpb.Deployment{Name: name, ServiceAccount: &sa, Blueprint: blueprint("https://example.com/config.tar.gz")},
+			wantErr:    "invalid terraform blueprint gcs source",
+		},
+		{
+			name:       "blueprint without object",
+			deployment: &configpb.Deployment{Name: name, ServiceAccount: &sa, Blueprint: blueprint("gs://b")},
+			wantErr:    "invalid terraform blueprint gcs source",
+		},
+		{
+			name:       "blueprint missing",
+			deployment: &configpb.Deployment{Name: name, ServiceAccount: &sa, Blueprint: blueprint("gs://b/config.tar.gz")},
+			wantErr:    "unable to get terraform blueprint",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &deployer{
+				params:    &params{imProject: "p", imLocation: "us-central1", imDeployment: "d", dryRun: true},
+				gcsClient: gcsClient,
+			}
+			_, err := d.dryRun(context.Background(), tc.deployment)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("dryRun() got err: %v, want err containing: %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// fakeConfigServer is an Infrastructure Manager API server that records the calls made to it.
+type fakeConfigServer struct {
+	configpb.UnimplementedConfigServer
+	// Deployment returned by GetDeployment, NotFound is returned if nil.
+	deployment *configpb.Deployment
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *fakeConfigServer) record(call string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+func (f *fakeConfigServer) GetDeployment(ctx context.Context, req *configpb.GetDeploymentRequest) (*configpb.Deployment, error) {
+	f.record("GetDeployment " + req.Name)
+	if f.deployment == nil {
+		return nil, status.Errorf(codes.NotFound, "deployment %s not found", req.Name)
+	}
+	return f.deployment, nil
+}
+
+func (f *fakeConfigServer) CreateDeployment(ctx context.Context, req *configpb.CreateDeploymentRequest) (*longrunningpb.Operation, error) {
+	f.record("CreateDeployment " + req.DeploymentId)
+	return nil, status.Error(codes.Unimplemented, "not implemented")
+}
+
+func (f *fakeConfigServer) UpdateDeployment(ctx context.Context, req *configpb.UpdateDeploymentRequest) (*longrunningpb.Operation, error) {
+	f.record("UpdateDeployment " + req.Deployment.GetName())
+	return nil, status.Error(codes.Unimplemented, "not implemented")
+}
+
+func TestDeployDryRun(t *testing.T) {
+	const renderedDeployment = `name: projects/p/locations/us-central1/deployments/d
+serviceAccount: projects/p/serviceAccounts/im@p.iam.gserviceaccount.com
+terraformBlueprint:
+  gcsSource: gs://b/config.tar.gz
+`
+	// The fake Cloud Storage server has every object, so the blueprint exists.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"bucket": "b", "name": "config.tar.gz"}`))
+	}))
+	defer srv.Close()
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))
+	gcsClient, err := storage.NewClient(context.Background())
+	if err != nil {
+		t.Fatalf("unable to create storage client: %v", err)
+	}
+	defer gcsClient.Close()
+
+	tests := []struct {
+		name       string
+		existing   *configpb.Deployment
+		wantAction string
+	}{
+		{
+			name:       "deployment doesn't exist",
+			wantAction: "create",
+		},
+		{
+			name:       "deployment exists",
+			existing:   &configpb.Deployment{Name: "projects/p/locations/us-central1/deployments/d", State: configpb.Deployment_ACTIVE, LockState: configpb.Deployment_UNLOCKED},
+			wantAction: "update",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeConfigServer{deployment: tc.existing}
+			lis, err := net.Listen("tcp", "localhost:0")
+			if err != nil {
+				t.Fatalf("unable to listen: %v", err)
+			}
+			gs := grpc.NewServer()
+			configpb.RegisterConfigServer(gs, fake)
+			go gs.Serve(lis)
+			defer gs.Stop()
+			imClient, err := config.NewClient(context.Background(),
+				option.WithEndpoint(lis.Addr().String()),
+				option.WithoutAuthentication(),
+				option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+			)
+			if err != nil {
+				t.Fatalf("unable to create infrastructure manager client: %v", err)
+			}
+			defer imClient.Close()
+
+			origSrcPath := srcPath
+			srcPath = filepath.Join(t.TempDir(), "source")
+			t.Cleanup(func() { srcPath = origSrcPath })
+			s := clouddeploy.NewMemoryStorage()
+			s.Put("gs://bucket/render/"+renderedDeploymentFileName, []byte(renderedDeployment))
+			d := &deployer{
+				req:       &clouddeploy.DeployRequest{InputGCSPath: "gs://bucket/render", Rollout: "r", Storage: s},
+				params:    &params{imProject: "p", imLocation: "us-central1", imDeployment: "d", dryRun: true},
+				imClient:  imClient,
+				gcsClient: gcsClient,
+			}
+
+			res, err := d.deploy(context.Background())
+			if err != nil {
+				t.Fatalf("deploy() failed: %v", err)
+			}
+			if res.ResultStatus != clouddeploy.DeploySucceeded {
+				t.Errorf("deploy() result status got: %v, want: %v", res.ResultStatus, clouddeploy.DeploySucceeded)
+			}
+			if got := res.Metadata[dryRunMetadataKey]; got != "true" {
+				t.Errorf("deploy() metadata %s got: %q, want: %q", dryRunMetadataKey, got, "true")
+			}
+			if got := res.Metadata[dryRunActionMetadataKey]; got != tc.wantAction {
+				t.Errorf("deploy() metadata %s got: %q, want: %q", dryRunActionMetadataKey, got, tc.wantAction)
+			}
+			// A dry run only gets the Deployment, applyDeployment would also create or update it.
+			want := []string{"GetDeployment projects/p/locations/us-central1/deployments/d"}
+			if !reflect.DeepEqual(fake.calls, want) {
+				t.Errorf("deploy() infrastructure manager calls got: %v, want: %v", fake.calls, want)
+			}
+		})
+	}
+}
+
+func TestBuildLogURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		build   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "resource name",
+			build: "projects/build-project/locations/europe-west1/builds/1234-abcd",
+			want:  "https://console.cloud.google.com/cloud-build/builds;region=europe-west1/1234-abcd?project=build-project",
+		},
+		{
+			name:  "build ID",
+			build: "1234-abcd",
+			want:  "https://console.cloud.google.com/cloud-build/builds;region=us-central1/1234-abcd?project=p",
+		},
+		{
+			name:    "invalid build",
+			build:   "projects/p/builds/1234-abcd",
+			wantErr: true,
+		},
+		{
+			name:    "empty build",
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := buildLogURL(tc.build, "p", "us-central1")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("buildLogURL() got err: %v, want err: %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("buildLogURL() got: %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
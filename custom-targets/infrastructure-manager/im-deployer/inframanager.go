@@ -64,6 +64,7 @@ func pollDeploymentUntilTerminal(ctx context.Context, client *config.Client, dep
 		}),
 		retry.Attempts(20),
 		retry.Delay(30*time.Second),
+		retry.Context(ctx),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("error polling deployment until terminal state after %d attempts: %v", attempts, err)
@@ -87,7 +88,9 @@ func createDeployment(ctx context.Context, client *config.Client, deployment *co
 	fmt.Printf("Waiting on create Deployment operation %s\n", op.Name())
 	var d *configpb.Deployment
 	for {
-		time.Sleep(30 * time.Second)
+		if err := sleepContext(ctx, 30*time.Second); err != nil {
+			return nil, fmt.Errorf("error waiting on create deployment operation: %v", err)
+		}
 		pd, err := op.Poll(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("error polling create deployment operation: %v", err)
@@ -118,7 +121,9 @@ func updateDeployment(ctx context.Context, client *config.Client, renderedDeploy
 	fmt.Printf("Waiting on update Deployment operation %s\n", op.Name())
 	var d *configpb.Deployment
 	for {
-		time.Sleep(30 * time.Second)
+		if err := sleepContext(ctx, 30*time.Second); err != nil {
+			return nil, fmt.Errorf("error waiting on update deployment operation: %v", err)
+		}
 		pd, err := op.Poll(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("error polling create deployment operation: %v", err)
@@ -166,3 +171,16 @@ func getRevision(ctx context.Context, client *config.Client, revisionName string
 	}
 	return client.GetRevision(ctx, req)
 }
+
+// sleepContext pauses for the provided duration or until the context is done, in which case the
+// context error is returned.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
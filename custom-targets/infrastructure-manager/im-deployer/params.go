@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"time"
 )
 
 // Environment variable keys whose values determine the behavior of the Infrastructure Manager deployer.
@@ -33,9 +34,14 @@ const (
 	imWorkerPoolEnvKey             = "CLOUD_DEPLOY_customTarget_imWorkerPool"
 	importExistingResourcesEnvKey  = "CLOUD_DEPLOY_customTarget_imImportExistingResources"
 	disableCloudDeployLabelsEnvKey = "CLOUD_DEPLOY_customTarget_imDisableCloudDeployLabels"
+	imDryRunEnvKey                 = "CLOUD_DEPLOY_customTarget_imDryRun"
 	imVarEnvKeyPrefix              = "CLOUD_DEPLOY_customTarget_imVar_"
 )
 
+// operationTimeoutEnvKey is the environment variable key for the optional deadline of the render or deploy
+// operation. The value is a duration string, e.g. "45m", and when unset there is no deadline.
+const operationTimeoutEnvKey = "CLOUD_DEPLOY_OPERATION_TIMEOUT"
+
 const (
 	// The deploy parameter key prefix for variables.
 	imVarDeployParamKeyPrefix = "customTarget/imVar_"
@@ -65,6 +71,11 @@ type params struct {
 	importExistingResources bool
 	// Whether to disable the Cloud Deploy labels on the Infrastructure Manager Deployment resource.
 	disableCloudDeployLabels bool
+	// Whether the deploy only validates the rendered Deployment and reports whether it would be created or
+	// updated, without creating or updating it.
+	dryRun bool
+	// Deadline for the render or deploy operation, zero means there is no deadline.
+	operationTimeout time.Duration
 }
 
 // determineParams returns the params provided in the execution environment via environment variables.
@@ -101,6 +112,28 @@ func determineParams() (*params, error) {
 		}
 	}
 
+	dryRun := false
+	dr, ok := os.LookupEnv(imDryRunEnvKey)
+	if ok {
+		var err error
+		dryRun, err = strconv.ParseBool(dr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", imDryRunEnvKey, err)
+		}
+	}
+
+	var operationTimeout time.Duration
+	if ot, ok := os.LookupEnv(operationTimeoutEnvKey); ok {
+		var err error
+		operationTimeout, err = time.ParseDuration(ot)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q: %v", operationTimeoutEnvKey, err)
+		}
+		if operationTimeout < 0 {
+			return nil, fmt.Errorf("%q must not be negative", operationTimeoutEnvKey)
+		}
+	}
+
 	return &params{
 		imProject:                imProject,
 		imLocation:               imLocation,
@@ -111,6 +144,8 @@ func determineParams() (*params, error) {
 		variablePath:             os.Getenv(variablePathEnvKey),
 		importExistingResources:  importRes,
 		disableCloudDeployLabels: disCDLabels,
+		dryRun:                   dryRun,
+		operationTimeout:         operationTimeout,
 	}, nil
 }
 
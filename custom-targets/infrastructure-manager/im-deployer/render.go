@@ -35,11 +35,14 @@ import (
 	"google.golang.org/protobuf/encoding/protojson"
 )
 
-const (
+var (
 	// Path to use when downloading the source input archive file.
 	srcArchivePath = "/workspace/archive.tgz"
 	// Path to use when unarchiving the source input.
 	srcPath = "/workspace/source"
+)
+
+const (
 	// File name to use for the generated variables file.
 	autoTFVarsFileName = "clouddeploy.auto.tfvars"
 	// Name of the file that contains the YAML representation of the Infrastructure Manager Deployment
@@ -61,8 +64,12 @@ type renderer struct {
 func (r *renderer) process(ctx context.Context) error {
 	fmt.Println("Processing render request")
 
-	res, err := r.render(ctx)
+	opCtx, cancel := clouddeploy.WithOperationTimeout(ctx, r.params.operationTimeout)
+	defer cancel()
+	res, err := r.render(opCtx)
 	if err != nil {
+		// Results are uploaded with the parent context since the operation context may have expired.
+		err = clouddeploy.OperationTimeoutError(opCtx, r.params.operationTimeout, err)
 		fmt.Printf("Render failed: %v\n", err)
 		rr := &clouddeploy.RenderResult{
 			ResultStatus:   clouddeploy.RenderFailed,
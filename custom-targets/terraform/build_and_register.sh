@@ -2,7 +2,9 @@
 
 SOURCE_DIR="$( cd "$( dirname "${BASH_SOURCE[0]}" )" &> /dev/null && pwd )"
 
-export _CT_SRCDIR="${SOURCE_DIR}/terraform-deployer"
+# The build context is the custom-targets directory since the deployer is built against the util module.
+export _CT_SRCDIR="${SOURCE_DIR}/.."
+export _CT_DOCKERFILE=terraform/terraform-deployer/Dockerfile
 export _CT_IMAGE_NAME=terraform
 export _CT_TYPE_NAME=terraform
 export _CT_CUSTOM_ACTION_NAME=terraform-deployer
@@ -15,16 +15,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"sort"
+	"strings"
 
 	"cloud.google.com/go/storage"
 	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
 	tfjson "github.com/hashicorp/terraform-json"
-	"github.com/mholt/archiver/v3"
 )
 
 // deployer implements the requestHandler interface for deploy requests.
@@ -32,14 +35,20 @@ type deployer struct {
 	req       *clouddeploy.DeployRequest
 	params    *params
 	gcsClient *storage.Client
+	// Output of the Terraform commands run at deploy time, only set when tfUploadApplyLog is enabled.
+	applyLog *bytes.Buffer
 }
 
 // process processes a deploy request and uploads succeeded or failed results to GCS for Cloud Deploy.
 func (d *deployer) process(ctx context.Context) error {
 	fmt.Println("Processing deploy request")
 
-	res, err := d.deploy(ctx)
+	opCtx, cancel := clouddeploy.WithOperationTimeout(ctx, d.params.operationTimeout)
+	defer cancel()
+	res, err := d.deploy(opCtx)
 	if err != nil {
+		// Results are uploaded with the parent context since the operation context may have expired.
+		err = clouddeploy.OperationTimeoutError(opCtx, d.params.operationTimeout, err)
 		fmt.Printf("Deploy failed: %v\n", err)
 		dr := &clouddeploy.DeployResult{
 			ResultStatus:   clouddeploy.DeployFailed,
@@ -49,19 +58,30 @@ func (d *deployer) process(ctx context.Context) error {
 				clouddeploy.CustomTargetSourceSHAMetadataKey: clouddeploy.GitCommit,
 			},
 		}
+		// The log of a failed apply is the most useful for debugging, a failed upload is only logged so the
+		// failed result is still reported.
+		if d.applyLog != nil && d.applyLog.Len() != 0 {
+			if logURI, err := d.uploadApplyLog(ctx, nil); err != nil {
+				fmt.Printf("Unable to upload Terraform apply log: %v\n", err)
+			} else {
+				dr.ArtifactFiles = []string{logURI}
+				dr.Metadata[applyLogMetadataKey] = logURI
+			}
+		}
 		fmt.Println("Uploading failed deploy results")
-		rURI, err := d.req.UploadResult(ctx, d.gcsClient, dr)
-		if err != nil {
-			return fmt.Errorf("error uploading failed deploy results: %v", err)
+		rURI, uErr := d.req.UploadResult(ctx, d.gcsClient, dr)
+		if uErr != nil {
+			return clouddeploy.Classify(clouddeploy.TransientError, fmt.Errorf("error uploading failed deploy results: %v", uErr))
 		}
 		fmt.Printf("Uploaded failed deploy results to %s\n", rURI)
+		// The failure is reported in the results, the error is returned so the exit code reflects its kind.
 		return err
 	}
 
 	fmt.Println("Uploading deploy results")
 	rURI, err := d.req.UploadResult(ctx, d.gcsClient, res)
 	if err != nil {
-		return fmt.Errorf("error uploading deploy results: %v", err)
+		return clouddeploy.Classify(clouddeploy.TransientError, fmt.Errorf("error uploading deploy results: %v", err))
 	}
 	fmt.Printf("Uploaded deploy results to %s\n", rURI)
 	return nil
@@ -69,85 +89,298 @@ func (d *deployer) process(ctx context.Context) error {
 
 // deploy performs the following steps:
 //  1. Initialize the Terraform configuration only to install providers. Modules and backend were initialized at render time.
-//  2. Apply the Terraform configuration.
-//  3. Get the Terraform state and upload to GCS as a deploy artifact.
+//  2. If enabled, plan the Terraform configuration and skip the deploy if there are no changes.
+//  3. If enabled, plan the Terraform configuration and fail the deploy if planning fails.
+//  4. Apply the Terraform configuration, followed by a refresh-only apply if enabled.
+//  5. Get the Terraform state and upload to GCS as a deploy artifact.
 //
 // Returns either the deploy results or an error if the deploy failed.
 func (d *deployer) deploy(ctx context.Context) (*clouddeploy.DeployResult, error) {
+	if err := useTerraformVersion(ctx, d.params.tfVersion); err != nil {
+		return nil, err
+	}
+	// The archive format is read from the render results so a change to the tfArchiveFormat param after the
+	// release was rendered doesn't affect the deploy.
+	rr, err := d.req.DownloadRenderResult(ctx, d.gcsClient)
+	if err != nil {
+		return nil, clouddeploy.Classify(clouddeploy.TransientError, fmt.Errorf("unable to download render results: %v", err))
+	}
 	// Download the Terraform configuration uploaded at render time and unarchive it in the same
 	// directory that was used at render time.
+	archiveName := renderedArchiveName(renderedArchiveFormat(rr))
 	fmt.Printf("Downloading Terraform configuration archive to %s\n", srcArchivePath)
-	inURI, err := d.req.DownloadInput(ctx, d.gcsClient, renderedArchiveName, srcArchivePath)
+	inURI, err := d.req.DownloadInput(ctx, d.gcsClient, archiveName, srcArchivePath)
 	if err != nil {
-		return nil, fmt.Errorf("unable to download deploy input with object suffix %s: %v", renderedArchiveName, err)
+		return nil, clouddeploy.Classify(clouddeploy.TransientError, fmt.Errorf("unable to download deploy input with object suffix %s: %v", archiveName, err))
 	}
 	fmt.Printf("Downloaded Terraform configuration archive from %s\n", inURI)
 
-	archiveFile, err := os.Open(srcArchivePath)
-	if err != nil {
-		return nil, fmt.Errorf("unable to open archive file %s: %v", srcArchivePath, err)
-	}
 	fmt.Printf("Unarchiving Terraform configuration in %s to %s\n", srcArchivePath, srcPath)
-	if err := archiver.NewTarGz().Unarchive(archiveFile.Name(), srcPath); err != nil {
+	if err := unarchiveRenderedArchive(srcArchivePath, srcPath); err != nil {
 		return nil, fmt.Errorf("unable to unarchive terraform configuration: %v", err)
 	}
 
+	// A nil *bytes.Buffer isn't a nil io.Writer, so the log writer is only set when enabled.
+	var cmdLog io.Writer
+	if d.params.uploadApplyLog {
+		d.applyLog = &bytes.Buffer{}
+		cmdLog = d.applyLog
+	}
+
 	terraformConfigPath := path.Join(srcPath, d.params.configPath)
 	fmt.Println("Initializing Terraform configuration to install providers")
-	if _, err := terraformInit(terraformConfigPath, &terraformInitOptions{disableBackendInitialization: true, disableModuleDownloads: true}); err != nil {
-		return nil, fmt.Errorf("error running terraform init to install providers: %v", err)
+	if _, err := terraformInit(ctx, terraformConfigPath, &terraformInitOptions{disableBackendInitialization: true, disableModuleDownloads: true, log: cmdLog}); err != nil {
+		return nil, clouddeploy.Classify(clouddeploy.ExecError, fmt.Errorf("error running terraform init to install providers: %v", err))
 	}
-	if _, err := terraformApply(terraformConfigPath, &terraformApplyOptions{applyParallelism: d.params.applyParallelism, lockTimeout: d.params.lockTimeout}); err != nil {
-		return nil, fmt.Errorf("error running terraform apply: %v", err)
+	if d.params.skipOnNoChanges {
+		changes, err := terraformPlanHasChanges(ctx, terraformConfigPath, d.params.lockTimeout)
+		if err != nil {
+			return nil, clouddeploy.Classify(clouddeploy.ExecError, fmt.Errorf("error running terraform plan to detect changes: %v", err))
+		}
+		if !changes {
+			fmt.Println("Terraform plan detected no changes, skipping apply")
+			return &clouddeploy.DeployResult{
+				ResultStatus: clouddeploy.DeploySkipped,
+				SkipMessage:  "Terraform plan detected no changes to apply",
+				Metadata: map[string]string{
+					clouddeploy.CustomTargetSourceMetadataKey:    tfDeployerSampleName,
+					clouddeploy.CustomTargetSourceSHAMetadataKey: clouddeploy.GitCommit,
+				},
+			}, nil
+		}
 	}
-	fmt.Println("Finished applying Terraform configuration")
-
-	fmt.Println("Getting the Terraform state to provide as a deploy artifact")
-	ts, err := terraformShowState(terraformConfigPath)
+	ts, warnings, err := applyAndShowState(ctx, terraformConfigPath, d.params, cmdLog)
 	if err != nil {
-		return nil, fmt.Errorf("error getting terraform state after apply: %v", err)
+		return nil, err
 	}
 	fmt.Println("Extracting Terraform output values from the Terraform state")
-	metadata, err := extractOutputsFromTfState(ts)
+	metadata, err := extractOutputsFromTfState(ts, d.params.outputAllowlist)
 	if err != nil {
 		return nil, fmt.Errorf("error extracting terraform outputs from the terraform state: %v", err)
 	}
 	fmt.Println("Uploading Terraform state as a deploy artifact")
 	stateGCSURI, err := d.req.UploadArtifact(ctx, d.gcsClient, "deployed-state.json", &clouddeploy.GCSUploadContent{Data: ts})
 	if err != nil {
-		return nil, fmt.Errorf("error uploading terraform state deploy artifact: %v", err)
+		return nil, clouddeploy.Classify(clouddeploy.TransientError, fmt.Errorf("error uploading terraform state deploy artifact: %v", err))
 	}
 	fmt.Printf("Uploaded Terraform state deploy artifact to %s\n", stateGCSURI)
+	artifacts := []string{stateGCSURI}
+	if d.applyLog != nil {
+		logURI, err := d.uploadApplyLog(ctx, ts)
+		if err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, logURI)
+		metadata[applyLogMetadataKey] = logURI
+	}
 
 	// Metadata consists of the Terraform output values and an indicator that the deploy was handled by the
 	// cloud deploy terraform sample.
 	metadata[clouddeploy.CustomTargetSourceMetadataKey] = tfDeployerSampleName
 	metadata[clouddeploy.CustomTargetSourceSHAMetadataKey] = clouddeploy.GitCommit
+	if len(warnings) != 0 {
+		fmt.Printf("Terraform apply succeeded with %d warning(s), recording them in the deploy metadata\n", len(warnings))
+		w, err := json.Marshal(warnings)
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal terraform warnings: %v", err)
+		}
+		metadata[warningsMetadataKey] = string(w)
+	}
 
 	deployResult := &clouddeploy.DeployResult{
 		ResultStatus:  clouddeploy.DeploySucceeded,
-		ArtifactFiles: []string{stateGCSURI},
+		ArtifactFiles: artifacts,
 		Metadata:      metadata,
 	}
 	return deployResult, nil
 }
 
+// warningsMetadataKey is the deploy result metadata key of the JSON list of warnings emitted by a
+// successful Terraform apply.
+const warningsMetadataKey = "tf-warnings"
+
+// applyAndShowState applies the Terraform configuration in the provided directory and returns the resulting
+// Terraform state along with the warnings emitted by the apply. If enabled, a plan is run before the apply so
+// configuration errors abort the deploy before any infrastructure is changed, and a refresh-only apply is run
+// after the apply so the state reflects the latest values of resources and data sources changed out-of-band.
+func applyAndShowState(ctx context.Context, terraformConfigPath string, p *params, cmdLog io.Writer) ([]byte, []string, error) {
+	// The plan run to detect changes already verified the configuration can be planned.
+	if p.preApplyPlan && !p.skipOnNoChanges {
+		if _, err := terraformPlanCheck(ctx, terraformConfigPath, p.lockTimeout, cmdLog); err != nil {
+			return nil, nil, clouddeploy.Classify(clouddeploy.ExecError, fmt.Errorf("error running terraform plan before apply, the configuration wasn't applied: %v", err))
+		}
+		fmt.Println("Terraform plan succeeded, applying the Terraform configuration")
+	}
+	out, err := terraformApply(ctx, terraformConfigPath, &terraformApplyOptions{applyParallelism: p.applyParallelism, lockTimeout: p.lockTimeout, log: cmdLog})
+	if err != nil {
+		return nil, nil, clouddeploy.Classify(clouddeploy.ExecError, fmt.Errorf("error running terraform apply: %v", err))
+	}
+	fmt.Println("Finished applying Terraform configuration")
+	warnings := parseTerraformWarnings(out)
+
+	if p.postApplyRefresh {
+		fmt.Println("Refreshing the Terraform state after apply")
+		if _, err := terraformApply(ctx, terraformConfigPath, &terraformApplyOptions{lockTimeout: p.lockTimeout, refreshOnly: true, log: cmdLog}); err != nil {
+			return nil, nil, clouddeploy.Classify(clouddeploy.ExecError, fmt.Errorf("error running terraform apply -refresh-only: %v", err))
+		}
+	}
+
+	fmt.Println("Getting the Terraform state to provide as a deploy artifact")
+	ts, err := terraformShowState(ctx, terraformConfigPath, p.stateFormat)
+	if err != nil {
+		return nil, nil, clouddeploy.Classify(clouddeploy.ExecError, fmt.Errorf("error getting terraform state after apply: %v", err))
+	}
+	return ts, warnings, nil
+}
+
+// applyLogArtifactName is the name of the deploy artifact containing the output of terraform init and apply.
+const applyLogArtifactName = "terraform-apply.log"
+
+// renderedArchiveFormat returns the format of the rendered archive recorded in the render result metadata.
+// Releases rendered before the format was recorded always used tar.gz.
+func renderedArchiveFormat(rr *clouddeploy.RenderResult) string {
+	if f, ok := rr.Metadata[archiveFormatMetadataKey]; ok {
+		return f
+	}
+	return archiveFormatTarGz
+}
+
+// applyLogMetadataKey is the deploy result metadata key of the Cloud Storage URI of the apply log artifact.
+const applyLogMetadataKey = "tf-apply-log"
+
+// uploadApplyLog redacts the sensitive values in the log of the Terraform commands and uploads it as a deploy
+// artifact. The sensitive outputs of the provided Terraform state, if any, are also redacted.
+func (d *deployer) uploadApplyLog(ctx context.Context, tfState []byte) (string, error) {
+	content := &clouddeploy.GCSUploadContent{Data: redactApplyLog(d.applyLog.Bytes(), sensitiveLogValues(tfState, d.params.tfVars))}
+	fmt.Println("Uploading Terraform apply log as a deploy artifact")
+	uri, err := d.req.UploadArtifact(ctx, d.gcsClient, applyLogArtifactName, content)
+	if err != nil {
+		return "", clouddeploy.Classify(clouddeploy.TransientError, fmt.Errorf("error uploading terraform apply log deploy artifact: %v", err))
+	}
+	fmt.Printf("Uploaded Terraform apply log deploy artifact to %s\n", uri)
+	return uri, nil
+}
+
+// sensitiveLogValues returns the values to redact from the apply log. Terraform already hides values it marks
+// as sensitive in its output, this covers the values that can still appear: the outputs marked as sensitive in
+// the Terraform state and the variables with a sensitive name, e.g. "db_password", provided via the tfVars
+// param or TF_VAR_ prefixed environment variables.
+func sensitiveLogValues(tfState []byte, tfVars string) []string {
+	var values []string
+	if len(tfState) != 0 {
+		s := &tfjson.State{}
+		if err := s.UnmarshalJSON(tfState); err == nil && s.Values != nil {
+			for _, o := range s.Values.Outputs {
+				if !o.Sensitive {
+					continue
+				}
+				if v, ok := o.Value.(string); ok {
+					values = append(values, v)
+				} else if v, err := json.Marshal(o.Value); err == nil {
+					values = append(values, string(v))
+				}
+			}
+		}
+	}
+	vars := map[string]interface{}{}
+	if len(tfVars) != 0 {
+		// An invalid tfVars param fails the render, so it's only parsed on a best effort basis here.
+		json.Unmarshal([]byte(tfVars), &vars)
+	}
+	for _, ev := range os.Environ() {
+		if name, v, ok := strings.Cut(strings.TrimPrefix(ev, "TF_VAR_"), "="); ok && strings.HasPrefix(ev, "TF_VAR_") {
+			vars[name] = v
+		}
+	}
+	for name, v := range vars {
+		s, ok := v.(string)
+		if !ok {
+			b, err := json.Marshal(v)
+			if err != nil {
+				continue
+			}
+			s = string(b)
+		}
+		if clouddeploy.RedactSensitive(name, s) != s {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// redactApplyLog returns a copy of the log with every occurrence of the provided values replaced by clouddeploy.RedactedValue.
+func redactApplyLog(log []byte, values []string) []byte {
+	// Longer values are replaced first so a value containing another one is fully redacted.
+	sorted := append([]string(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	out := append([]byte(nil), log...)
+	for _, v := range sorted {
+		if len(v) == 0 {
+			continue
+		}
+		out = bytes.ReplaceAll(out, []byte(v), []byte(clouddeploy.RedactedValue))
+	}
+	return out
+}
+
+// metadataSizeWarningThreshold is the total size of the Terraform outputs in bytes above which a
+// warning is logged, since large deploy result metadata may be rejected by Cloud Deploy.
+const metadataSizeWarningThreshold = 64 * 1024
+
 // extractOutputsFromTfState returns a map of the Terraform outputs in the provided JSON Terraform state. The map
-// values are the JSON strings of the output values.
-func extractOutputsFromTfState(jsonTfState []byte) (map[string]string, error) {
+// values are the JSON strings of the output values. If an allowlist is provided then only the outputs in the
+// allowlist are returned. Outputs marked as sensitive are only returned if they are in the allowlist.
+func extractOutputsFromTfState(jsonTfState []byte, allowlist []string) (map[string]string, error) {
 	s := &tfjson.State{}
 	if err := s.UnmarshalJSON(jsonTfState); err != nil {
 		return nil, fmt.Errorf("unable to unmarshal terraform state: %v", err)
 	}
 
+	allowed := make(map[string]bool)
+	for _, a := range allowlist {
+		allowed[a] = true
+	}
+
 	res := make(map[string]string)
+	if s.Values == nil {
+		return res, nil
+	}
+	size := 0
 	// Parse each Terraform output from the Terraform state into JSON strings.
 	for k, v := range s.Values.Outputs {
+		if len(allowed) != 0 && !allowed[k] {
+			continue
+		}
+		if v.Sensitive && !allowed[k] {
+			fmt.Printf("Skipping sensitive Terraform output %s, add it to %s to include it in the deploy metadata\n", k, outputAllowlistEnvKey)
+			continue
+		}
 		sv, err := json.Marshal(v.Value)
 		if err != nil {
 			return nil, fmt.Errorf("unable to marshal terraform state output for key %s: %v", k, err)
 		}
 		res[k] = string(sv)
+		size += len(k) + len(sv)
+	}
+	if len(allowed) == 0 && size > metadataSizeWarningThreshold {
+		fmt.Printf("Warning: Terraform outputs total %d bytes of deploy metadata, consider limiting the outputs with %s\n", size, outputAllowlistEnvKey)
 	}
 	return res, nil
 }
+
+// unarchiveRenderedArchive unarchives the rendered archive at the provided path into the destination
+// directory. The archive format is detected from the contents of the archive.
+func unarchiveRenderedArchive(archivePath, destPath string) error {
+	format, err := detectArchiveFormat(archivePath)
+	if err != nil {
+		return err
+	}
+	a, err := newArchiveFormat(format)
+	if err != nil {
+		return err
+	}
+	if err := clouddeploy.CheckArchivePaths(archivePath, a); err != nil {
+		return err
+	}
+	return a.Unarchive(archivePath, destPath)
+}
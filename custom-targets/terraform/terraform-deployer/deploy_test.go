@@ -0,0 +1,413 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+)
+
+const testTfState = `{
+  "format_version": "1.0",
+  "terraform_version": "1.5.7",
+  "values": {
+    "outputs": {
+      "bucket": {"sensitive": false, "value": "my-bucket", "type": "string"},
+      "ports": {"sensitive": false, "value": [80, 443], "type": ["list", "number"]},
+      "password": {"sensitive": true, "value": "hunter2", "type": "string"}
+    },
+    "root_module": {}
+  }
+}`
+
+func TestExtractOutputsFromTfState(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowlist []string
+		want      map[string]string
+	}{
+		{
+			name: "no allowlist skips sensitive outputs",
+			want: map[string]string{"bucket": `"my-bucket"`, "ports": "[80,443]"},
+		},
+		{
+			name:      "allowlist filters outputs",
+			allowlist: []string{"bucket"},
+			want:      map[string]string{"bucket": `"my-bucket"`},
+		},
+		{
+			name:      "allowlisted sensitive output included",
+			allowlist: []string{"bucket", "password"},
+			want:      map[string]string{"bucket": `"my-bucket"`, "password": `"hunter2"`},
+		},
+		{
+			name:      "allowlisted output missing from state",
+			allowlist: []string{"missing"},
+			want:      map[string]string{},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := extractOutputsFromTfState([]byte(testTfState), tc.allowlist)
+			if err != nil {
+				t.Fatalf("extractOutputsFromTfState() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("extractOutputsFromTfState() got: %v, want: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExtractOutputsFromTfStateFormats(t *testing.T) {
+	want, err := extractOutputsFromTfState([]byte(testTfState), nil)
+	if err != nil {
+		t.Fatalf("extractOutputsFromTfState() failed: %v", err)
+	}
+	for name, format := range map[string]func([]byte) ([]byte, error){stateFormatPretty: addIndentationToJSON, stateFormatCompact: compactJSON} {
+		t.Run(name, func(t *testing.T) {
+			ts, err := format([]byte(testTfState))
+			if err != nil {
+				t.Fatalf("formatting state failed: %v", err)
+			}
+			got, err := extractOutputsFromTfState(ts, nil)
+			if err != nil {
+				t.Fatalf("extractOutputsFromTfState() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("extractOutputsFromTfState() got: %v, want: %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRenderedArchiveRoundTrip(t *testing.T) {
+	files := map[string]string{
+		"main.tf":                 "# main\n",
+		"backend.tf":              "# backend\n",
+		"modules/network/main.tf": "# network\n",
+	}
+	for _, format := range []string{archiveFormatTarGz, archiveFormatZip, archiveFormatTarZst} {
+		t.Run(format, func(t *testing.T) {
+			srcDir := t.TempDir()
+			for name, content := range files {
+				p := filepath.Join(srcDir, name)
+				if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+					t.Fatalf("unable to create directory: %v", err)
+				}
+				if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+					t.Fatalf("unable to write file: %v", err)
+				}
+			}
+			archivePath := filepath.Join(t.TempDir(), renderedArchiveName(format))
+			if err := archiveDir(srcDir, archivePath, format, nil); err != nil {
+				t.Fatalf("archiveDir() failed: %v", err)
+			}
+			got, err := detectArchiveFormat(archivePath)
+			if err != nil {
+				t.Fatalf("detectArchiveFormat() failed: %v", err)
+			}
+			if got != format {
+				t.Errorf("detectArchiveFormat() got: %q, want: %q", got, format)
+			}
+
+			// The deploy downloads the rendered archive to a fixed path regardless of the format.
+			downloadPath := filepath.Join(t.TempDir(), "archive.tgz")
+			data, err := os.ReadFile(archivePath)
+			if err != nil {
+				t.Fatalf("unable to read archive: %v", err)
+			}
+			if err := os.WriteFile(downloadPath, data, 0644); err != nil {
+				t.Fatalf("unable to write archive: %v", err)
+			}
+			destDir := filepath.Join(t.TempDir(), "source")
+			if err := unarchiveRenderedArchive(downloadPath, destDir); err != nil {
+				t.Fatalf("unarchiveRenderedArchive() failed: %v", err)
+			}
+			for name, content := range files {
+				got, err := os.ReadFile(filepath.Join(destDir, name))
+				if err != nil {
+					t.Fatalf("unable to read unarchived file: %v", err)
+				}
+				if string(got) != content {
+					t.Errorf("unarchived %s got: %q, want: %q", name, got, content)
+				}
+			}
+		})
+	}
+}
+
+func TestNewArchiveFormatInvalid(t *testing.T) {
+	for _, format := range []string{"", "tgz", "tar.bz2"} {
+		if _, err := newArchiveFormat(format); err == nil {
+			t.Errorf("newArchiveFormat(%q) succeeded, want error", format)
+		}
+	}
+}
+
+// useFakeTerraform replaces the Terraform binary with a script that records its args, one command per line,
+// and prints an empty JSON object. Returns the path of the file the commands are recorded in.
+func useFakeTerraform(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "commands.log")
+	bin := filepath.Join(dir, "terraform")
+	script := "#!/bin/sh\necho \"$@\" >> " + logPath + "\necho '{}'\n"
+	if err := os.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatalf("unable to write fake terraform: %v", err)
+	}
+	orig := terraformBin
+	terraformBin = bin
+	t.Cleanup(func() { terraformBin = orig })
+	return logPath
+}
+
+func TestApplyAndShowState(t *testing.T) {
+	tests := []struct {
+		name   string
+		params *params
+		want   []string
+	}{
+		{
+			name:   "refresh disabled",
+			params: &params{lockTimeout: "30s", applyParallelism: 5},
+			want: []string{
+				"apply -auto-approve -no-color -lock-timeout=30s -parallelism=5",
+				"show -json",
+			},
+		},
+		{
+			name:   "refresh enabled",
+			params: &params{lockTimeout: "30s", applyParallelism: 5, postApplyRefresh: true},
+			want: []string{
+				"apply -auto-approve -no-color -lock-timeout=30s -parallelism=5",
+				"apply -auto-approve -no-color -refresh-only -lock-timeout=30s",
+				"show -json",
+			},
+		},
+		{
+			name:   "pre-apply plan enabled",
+			params: &params{lockTimeout: "30s", preApplyPlan: true},
+			want: []string{
+				"plan -no-color -input=false -lock-timeout=30s",
+				"apply -auto-approve -no-color -lock-timeout=30s",
+				"show -json",
+			},
+		},
+		{
+			// The plan to detect changes runs before applyAndShowState, so the configuration isn't planned twice.
+			name:   "pre-apply plan with skip on no changes",
+			params: &params{preApplyPlan: true, skipOnNoChanges: true},
+			want: []string{
+				"apply -auto-approve -no-color",
+				"show -json",
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logPath := useFakeTerraform(t)
+			if _, _, err := applyAndShowState(context.Background(), t.TempDir(), tc.params, nil); err != nil {
+				t.Fatalf("applyAndShowState() failed: %v", err)
+			}
+			log, err := os.ReadFile(logPath)
+			if err != nil {
+				t.Fatalf("unable to read commands: %v", err)
+			}
+			got := strings.Split(strings.TrimSpace(string(log)), "\n")
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("applyAndShowState() commands got: %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplyAndShowStatePreApplyPlanFails(t *testing.T) {
+	logPath := useFakeTerraform(t)
+	// Make the fake terraform fail the plan, after recording it.
+	script := "#!/bin/sh\necho \"$@\" >> " + logPath + "\nif [ \"$1\" = plan ]; then echo 'Error: Unsupported argument' >&2; exit 1; fi\necho '{}'\n"
+	if err := os.WriteFile(terraformBin, []byte(script), 0755); err != nil {
+		t.Fatalf("unable to write fake terraform: %v", err)
+	}
+	_, _, err := applyAndShowState(context.Background(), t.TempDir(), &params{preApplyPlan: true}, nil)
+	if err == nil || !strings.Contains(err.Error(), "Unsupported argument") {
+		t.Errorf("applyAndShowState() got err: %v, want the plan error", err)
+	}
+	log, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("unable to read commands: %v", err)
+	}
+	if got, want := strings.TrimSpace(string(log)), "plan -no-color -input=false"; got != want {
+		t.Errorf("applyAndShowState() commands got: %q, want: %q", got, want)
+	}
+}
+
+// useFakeDeployInput points the source paths at a temporary directory and returns storage containing the
+// render results and the rendered archive of a Terraform configuration, in the provided format, at gs://bucket/render.
+func useFakeDeployInput(t *testing.T, format string) *clouddeploy.MemoryStorage {
+	t.Helper()
+	workDir := t.TempDir()
+	origArchivePath, origSrcPath := srcArchivePath, srcPath
+	srcArchivePath, srcPath = filepath.Join(workDir, "archive.tgz"), filepath.Join(workDir, "source")
+	t.Cleanup(func() { srcArchivePath, srcPath = origArchivePath, origSrcPath })
+
+	configDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(configDir, "main.tf"), []byte("# main\n"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	archivePath := filepath.Join(t.TempDir(), renderedArchiveName(format))
+	if err := archiveDir(configDir, archivePath, format, nil); err != nil {
+		t.Fatalf("archiveDir() failed: %v", err)
+	}
+	archive, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatalf("unable to read archive: %v", err)
+	}
+	s := clouddeploy.NewMemoryStorage()
+	s.Put("gs://bucket/render/"+renderedArchiveName(format), archive)
+	s.Put("gs://bucket/render/results.json", []byte(`{"resultStatus": "SUCCEEDED", "metadata": {"`+archiveFormatMetadataKey+`": "`+format+`"}}`))
+	return s
+}
+
+func TestProcessFailedApplyExitCode(t *testing.T) {
+	logPath := useFakeTerraform(t)
+	// Make the fake terraform fail the apply, after recording it.
+	script := "#!/bin/sh\necho \"$@\" >> " + logPath + "\nif [ \"$1\" = apply ]; then echo 'Error: Error creating Bucket' >&2; exit 1; fi\necho '{}'\n"
+	if err := os.WriteFile(terraformBin, []byte(script), 0755); err != nil {
+		t.Fatalf("unable to write fake terraform: %v", err)
+	}
+	s := useFakeDeployInput(t, archiveFormatTarGz)
+	d := &deployer{
+		req:    &clouddeploy.DeployRequest{InputGCSPath: "gs://bucket/render", OutputGCSPath: "gs://bucket/deploy", Storage: s},
+		params: &params{},
+	}
+
+	err := d.process(context.Background())
+	if got, want := clouddeploy.ExitCode(err), clouddeploy.ExitCode(clouddeploy.Classify(clouddeploy.ExecError, errors.New("failed"))); got != want {
+		t.Errorf("process() got exit code: %d, want: %d for err: %v", got, want, err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "Error creating Bucket") {
+		t.Errorf("process() got err: %v, want the apply error", err)
+	}
+	res, ok := s.Get("gs://bucket/deploy/results.json")
+	if !ok {
+		t.Fatalf("process() didn't upload the deploy results")
+	}
+	if !strings.Contains(string(res), string(clouddeploy.DeployFailed)) {
+		t.Errorf("process() uploaded results: %s, want a failed deploy", res)
+	}
+}
+
+func TestDeployUploadsApplyLog(t *testing.T) {
+	logPath := useFakeTerraform(t)
+	// Make the fake terraform print a sensitive variable value during the apply and an empty state.
+	script := "#!/bin/sh\necho \"$@\" >> " + logPath + "\nif [ \"$1\" = apply ]; then echo 'db_password = hunter2'; fi\nif [ \"$1\" = show ]; then echo '{\"format_version\": \"1.0\"}'; else echo '{}'; fi\n"
+	if err := os.WriteFile(terraformBin, []byte(script), 0755); err != nil {
+		t.Fatalf("unable to write fake terraform: %v", err)
+	}
+	// The archive format param differs from the format recorded at render time, which the deploy uses.
+	s := useFakeDeployInput(t, archiveFormatZip)
+	d := &deployer{
+		req:    &clouddeploy.DeployRequest{InputGCSPath: "gs://bucket/render", OutputGCSPath: "gs://bucket/deploy", Storage: s},
+		params: &params{archiveFormat: archiveFormatTarGz, uploadApplyLog: true, tfVars: `{"db_password":"hunter2"}`},
+	}
+
+	res, err := d.deploy(context.Background())
+	if err != nil {
+		t.Fatalf("deploy() failed: %v", err)
+	}
+	wantURI := "gs://bucket/deploy/" + applyLogArtifactName
+	if got := res.Metadata[applyLogMetadataKey]; got != wantURI {
+		t.Errorf("deploy() metadata %s got: %q, want: %q", applyLogMetadataKey, got, wantURI)
+	}
+	if !reflect.DeepEqual(res.ArtifactFiles, []string{"gs://bucket/deploy/deployed-state.json", wantURI}) {
+		t.Errorf("deploy() artifact files got: %v, want the state and %s", res.ArtifactFiles, wantURI)
+	}
+	log, ok := s.Get(wantURI)
+	if !ok {
+		t.Fatalf("deploy() didn't upload the apply log to %s", wantURI)
+	}
+	if got, want := string(log), "db_password = "+clouddeploy.RedactedValue; !strings.Contains(got, want) || strings.Contains(got, "hunter2") {
+		t.Errorf("deploy() uploaded apply log: %q, want it to contain %q", got, want)
+	}
+}
+
+func TestRenderedArchiveFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		rr   *clouddeploy.RenderResult
+		want string
+	}{
+		{
+			name: "recorded format",
+			rr:   &clouddeploy.RenderResult{Metadata: map[string]string{archiveFormatMetadataKey: archiveFormatTarZst}},
+			want: archiveFormatTarZst,
+		},
+		{
+			name: "rendered before the format was recorded",
+			rr:   &clouddeploy.RenderResult{},
+			want: archiveFormatTarGz,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := renderedArchiveFormat(tc.rr); got != tc.want {
+				t.Errorf("renderedArchiveFormat() got: %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSensitiveLogValues(t *testing.T) {
+	t.Setenv("TF_VAR_db_password", "s3cret")
+	t.Setenv("TF_VAR_region", "us-central1")
+	got := sensitiveLogValues([]byte(testTfState), `{"api_token":"abc123","zone":"a"}`)
+	sort.Strings(got)
+	want := []string{"abc123", "hunter2", "s3cret"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sensitiveLogValues() got: %v, want: %v", got, want)
+	}
+}
+
+func TestRedactApplyLog(t *testing.T) {
+	log := []byte("password = hunter2\ntoken = hunter2-extended\nbucket = my-bucket\n")
+	got := string(redactApplyLog(log, []string{"hunter2", "hunter2-extended", ""}))
+	want := "password = " + clouddeploy.RedactedValue + "\ntoken = " + clouddeploy.RedactedValue + "\nbucket = my-bucket\n"
+	if got != want {
+		t.Errorf("redactApplyLog() got: %q, want: %q", got, want)
+	}
+}
+
+func TestApplyAndShowStateLog(t *testing.T) {
+	useFakeTerraform(t)
+	var log bytes.Buffer
+	if _, _, err := applyAndShowState(context.Background(), t.TempDir(), &params{postApplyRefresh: true}, &log); err != nil {
+		t.Fatalf("applyAndShowState() failed: %v", err)
+	}
+	// The fake terraform prints an empty JSON object for each command, the apply and the refresh are logged
+	// but not the show.
+	if got, want := log.String(), "{}\n{}\n"; got != want {
+		t.Errorf("applyAndShowState() logged: %q, want: %q", got, want)
+	}
+}
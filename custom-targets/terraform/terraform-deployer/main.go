@@ -32,7 +32,7 @@ const (
 func main() {
 	if err := do(); err != nil {
 		fmt.Printf("err: %v\n", err)
-		os.Exit(1)
+		os.Exit(clouddeploy.ExitCode(err))
 	}
 	fmt.Println("Done!")
 }
@@ -41,18 +41,19 @@ func do() error {
 	ctx := context.Background()
 	gcsClient, err := storage.NewClient(ctx)
 	if err != nil {
-		return fmt.Errorf("unable to create cloud storage client: %v", err)
+		return clouddeploy.Classify(clouddeploy.TransientError, fmt.Errorf("unable to create cloud storage client: %v", err))
 	}
-	req, err := clouddeploy.DetermineRequest(ctx, gcsClient, []string{})
+	supportedFeatures := []string{}
+	req, err := clouddeploy.DetermineRequest(ctx, gcsClient, supportedFeatures)
 	if err != nil {
-		return fmt.Errorf("unable to determine cloud deploy request: %v", err)
+		return clouddeploy.RequestError(os.Getenv(clouddeploy.FeaturesEnvKey), supportedFeatures, fmt.Errorf("unable to determine cloud deploy request: %v", err))
 	}
 	params, err := determineParams()
 	if err != nil {
-		return fmt.Errorf("unable to determine params: %v", err)
+		return clouddeploy.Classify(clouddeploy.ConfigError, fmt.Errorf("unable to determine params: %v", err))
 	}
 	if err := setTerraformEnvVars(); err != nil {
-		return err
+		return clouddeploy.Classify(clouddeploy.ExecError, err)
 	}
 	h, err := createRequestHandler(ctx, req, params, gcsClient)
 	if err != nil {
@@ -85,7 +86,7 @@ func createRequestHandler(ctx context.Context, cloudDeployRequest interface{}, p
 		}, nil
 
 	default:
-		return nil, fmt.Errorf("received unsupported cloud deploy request type: %q", os.Getenv(clouddeploy.RequestTypeEnvKey))
+		return nil, clouddeploy.Classify(clouddeploy.NotSupportedError, fmt.Errorf("received unsupported cloud deploy request type: %q", os.Getenv(clouddeploy.RequestTypeEnvKey)))
 	}
 }
 
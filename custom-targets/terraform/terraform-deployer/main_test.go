@@ -0,0 +1,49 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+)
+
+func TestRunCmdOperationTimeout(t *testing.T) {
+	ctx, cancel := clouddeploy.WithOperationTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := runCmd(ctx, "sh", []string{"-c", "exec sleep 30"}, true); err == nil {
+		t.Fatalf("runCmd() succeeded, want error after the timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("runCmd() took %v, want the command to be interrupted at the timeout", elapsed)
+	}
+}
+
+func TestRunCmdOperationTimeoutInterrupts(t *testing.T) {
+	ctx, cancel := clouddeploy.WithOperationTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	// The trap lets the test see that the command received an interrupt rather than being killed.
+	_, err := runCmd(ctx, "sh", []string{"-c", "trap 'echo interrupted >&2; exit 3' INT; while true; do sleep 0.01; done"}, true)
+	if err == nil {
+		t.Fatalf("runCmd() succeeded, want error after the timeout")
+	}
+	if !strings.Contains(err.Error(), "interrupted") {
+		t.Errorf("runCmd() = %v, want the command to be interrupted", err)
+	}
+}
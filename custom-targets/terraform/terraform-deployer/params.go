@@ -18,6 +18,8 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Environment variable keys whose values determine the behavior of the Terraform deployer.
@@ -30,15 +32,71 @@ const (
 	variablePathEnvKey     = "CLOUD_DEPLOY_customTarget_tfVariablePath"
 	enableRenderPlanEnvKey = "CLOUD_DEPLOY_customTarget_tfEnableRenderPlan"
 	lockTimeoutEnvKey      = "CLOUD_DEPLOY_customTarget_tfLockTimeout"
+	initLockTimeoutEnvKey  = "CLOUD_DEPLOY_customTarget_tfInitLockTimeout"
 	applyParallelismEnvKey = "CLOUD_DEPLOY_customTarget_tfApplyParallelism"
+	tfVarsEnvKey           = "CLOUD_DEPLOY_customTarget_tfVars"
+	skipOnNoChangesEnvKey  = "CLOUD_DEPLOY_customTarget_tfSkipOnNoChanges"
+	outputAllowlistEnvKey  = "CLOUD_DEPLOY_customTarget_tfOutputAllowlist"
+	providerConfigEnvKey   = "CLOUD_DEPLOY_customTarget_tfProviderConfig"
+	fmtCheckEnvKey         = "CLOUD_DEPLOY_customTarget_tfFmtCheck"
+	versionEnvKey          = "CLOUD_DEPLOY_customTarget_tfVersion"
+	backendModeEnvKey      = "CLOUD_DEPLOY_customTarget_tfBackendMode"
+	archiveFormatEnvKey    = "CLOUD_DEPLOY_customTarget_tfArchiveFormat"
+	archiveExcludeEnvKey   = "CLOUD_DEPLOY_customTarget_tfArchiveExclude"
+	postApplyRefreshEnvKey = "CLOUD_DEPLOY_customTarget_tfPostApplyRefresh"
+	preApplyPlanEnvKey     = "CLOUD_DEPLOY_customTarget_tfPreApplyPlan"
+	uploadApplyLogEnvKey   = "CLOUD_DEPLOY_customTarget_tfUploadApplyLog"
+	inspectBackendEnvKey   = "CLOUD_DEPLOY_customTarget_tfInspectorIncludeBackend"
+	stateFormatEnvKey      = "CLOUD_DEPLOY_customTarget_tfStateFormat"
 )
 
+// Supported values for the tfArchiveFormat parameter.
+const (
+	archiveFormatTarGz  = "tar.gz"
+	archiveFormatZip    = "zip"
+	archiveFormatTarZst = "tar.zst"
+)
+
+// Supported values for the tfStateFormat parameter.
+const (
+	// Indent the state artifact for readability.
+	stateFormatPretty = "pretty"
+	// Store the state artifact without whitespace, roughly halving the size of large states.
+	stateFormatCompact = "compact"
+)
+
+// Supported values for the tfBackendMode parameter.
+const (
+	// Generate the backend configuration file, failing if it already exists.
+	backendModeGenerate = "generate"
+	// Set the bucket and prefix in the GCS backend block of an existing backend configuration file,
+	// generating the file if it doesn't exist.
+	backendModeMerge = "merge"
+	// Use the backend configured in the Terraform configuration as is.
+	backendModeUseExisting = "use-existing"
+)
+
+// Supported values for the tfFmtCheck parameter.
+const (
+	// Log the unformatted files and continue the render.
+	fmtCheckWarn = "warn"
+	// Fail the render with the list of unformatted files.
+	fmtCheckFail = "fail"
+)
+
+// operationTimeoutEnvKey is the environment variable key for the optional deadline of the render or deploy
+// operation. The value is a duration string, e.g. "45m", and when unset there is no deadline.
+const operationTimeoutEnvKey = "CLOUD_DEPLOY_OPERATION_TIMEOUT"
+
 // params contains the deploy parameter values passed into the execution environment.
 type params struct {
 	// Name of the Cloud Storage bucket used to store the Terraform state.
 	backendBucket string
 	// Prefix to use for the Cloud Storage objects that represent the Terraform state.
 	backendPrefix string
+	// How the backend configuration is handled at render time, one of "generate", "merge" or
+	// "use-existing". Defaults to "generate".
+	backendMode string
 	// Path to the Terraform configuration in the Cloud Deploy Release archive. If not
 	// provided then defaults to the root directory of the archive.
 	configPath string
@@ -49,19 +107,71 @@ type params struct {
 	enableRenderPlan bool
 	// Duration to retry a state lock, when unset Terraform defaults to 0s.
 	lockTimeout string
+	// Duration to retry a state lock while initializing the backend at render time, when unset Terraform
+	// defaults to 0s. When set, init is also run again if it fails to acquire the lock.
+	initLockTimeout string
 	// Parallelism to set when performing terraform apply, when unset Terraform
 	// defaults to 10.
 	applyParallelism int
+	// JSON object of variable values to include in the generated variables file. Values
+	// provided via TF_VAR_{name} environment variables take precedence.
+	tfVars string
+	// Whether to skip the deploy when a Terraform plan at deploy time detects no changes. The
+	// deploy result is reported as skipped instead of succeeded.
+	skipOnNoChanges bool
+	// Whether to run `terraform apply -refresh-only` after the apply, so the outputs in the deploy
+	// result reflect out-of-band changes, e.g. to data sources.
+	postApplyRefresh bool
+	// Whether to run `terraform plan` at deploy time before the apply, so configuration errors fail the
+	// deploy before any infrastructure is changed. The plan isn't persisted or used by the apply.
+	preApplyPlan bool
+	// Whether to upload the output of terraform init and apply at deploy time as a deploy artifact.
+	uploadApplyLog bool
+	// Whether to include the backend configuration used at deploy time in the Cloud Deploy Release inspector
+	// artifact, after the generated variables file.
+	inspectBackend bool
+	// Names of the Terraform outputs to include in the deploy result metadata. If not provided
+	// then all outputs not marked as sensitive are included.
+	outputAllowlist []string
+	// JSON object of provider names to the provider block attributes to generate at render time,
+	// e.g. custom endpoints or impersonation that shouldn't live in the Terraform configuration.
+	providerConfig string
+	// Whether to run `terraform fmt -check` at render time, either "warn" or "fail". If not
+	// provided then the check isn't run.
+	fmtCheck string
+	// Version of the Terraform CLI to use for all commands, e.g. "1.5.7". If not provided then the
+	// version bundled in the image is used.
+	tfVersion string
+	// Compression format of the rendered archive, one of "tar.gz", "zip" or "tar.zst". Defaults to "tar.gz".
+	// Only used at render time, the deploy reads the format from the render results.
+	archiveFormat string
+	// Glob patterns of the files and directories to leave out of the rendered archive, e.g. ".git". The
+	// downloaded providers are always left out.
+	archiveExclude []string
+	// Formatting of the Terraform state deploy artifact, either "pretty" or "compact". Defaults to "pretty".
+	stateFormat string
+	// Deadline for the render or deploy operation, zero means there is no deadline.
+	operationTimeout time.Duration
 }
 
 // determineParams returns the params provided in the execution environment via environment variables.
 func determineParams() (*params, error) {
+	backendMode := backendModeGenerate
+	if bm, ok := os.LookupEnv(backendModeEnvKey); ok {
+		backendMode = bm
+	}
+	switch backendMode {
+	case backendModeGenerate, backendModeMerge, backendModeUseExisting:
+	default:
+		return nil, fmt.Errorf("parameter %q must be one of %q, %q or %q, got %q", backendModeEnvKey, backendModeGenerate, backendModeMerge, backendModeUseExisting, backendMode)
+	}
+	// The bucket and prefix aren't used when the existing backend configuration is used as is.
 	backendBucket := os.Getenv(backendBucketEnvKey)
-	if len(backendBucket) == 0 {
+	if len(backendBucket) == 0 && backendMode != backendModeUseExisting {
 		return nil, fmt.Errorf("parameter %q is required", backendBucketEnvKey)
 	}
 	backendPrefix := os.Getenv(backendPrefixEnvKey)
-	if len(backendPrefix) == 0 {
+	if len(backendPrefix) == 0 && backendMode != backendModeUseExisting {
 		return nil, fmt.Errorf("parameter %q is required", backendPrefixEnvKey)
 	}
 
@@ -85,13 +195,137 @@ func determineParams() (*params, error) {
 		}
 	}
 
+	skipOnNoChanges := false
+	sc, ok := os.LookupEnv(skipOnNoChangesEnvKey)
+	if ok {
+		var err error
+		skipOnNoChanges, err = strconv.ParseBool(sc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", skipOnNoChangesEnvKey, err)
+		}
+	}
+
+	postApplyRefresh := false
+	par, ok := os.LookupEnv(postApplyRefreshEnvKey)
+	if ok {
+		var err error
+		postApplyRefresh, err = strconv.ParseBool(par)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", postApplyRefreshEnvKey, err)
+		}
+	}
+
+	preApplyPlan := false
+	pap, ok := os.LookupEnv(preApplyPlanEnvKey)
+	if ok {
+		var err error
+		preApplyPlan, err = strconv.ParseBool(pap)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", preApplyPlanEnvKey, err)
+		}
+	}
+
+	uploadApplyLog := false
+	ual, ok := os.LookupEnv(uploadApplyLogEnvKey)
+	if ok {
+		var err error
+		uploadApplyLog, err = strconv.ParseBool(ual)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", uploadApplyLogEnvKey, err)
+		}
+	}
+
+	inspectBackend := false
+	ib, ok := os.LookupEnv(inspectBackendEnvKey)
+	if ok {
+		var err error
+		inspectBackend, err = strconv.ParseBool(ib)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", inspectBackendEnvKey, err)
+		}
+	}
+
+	var outputAllowlist []string
+	for _, o := range strings.Split(os.Getenv(outputAllowlistEnvKey), ",") {
+		if o = strings.TrimSpace(o); len(o) != 0 {
+			outputAllowlist = append(outputAllowlist, o)
+		}
+	}
+
+	fmtCheck := os.Getenv(fmtCheckEnvKey)
+	if len(fmtCheck) != 0 && fmtCheck != fmtCheckWarn && fmtCheck != fmtCheckFail {
+		return nil, fmt.Errorf("parameter %q must be %q or %q, got %q", fmtCheckEnvKey, fmtCheckWarn, fmtCheckFail, fmtCheck)
+	}
+
+	archiveFormat := archiveFormatTarGz
+	if af, ok := os.LookupEnv(archiveFormatEnvKey); ok {
+		archiveFormat = af
+	}
+	if _, err := newArchiveFormat(archiveFormat); err != nil {
+		return nil, fmt.Errorf("invalid parameter %q: %v", archiveFormatEnvKey, err)
+	}
+
+	var archiveExclude []string
+	for _, e := range strings.Split(os.Getenv(archiveExcludeEnvKey), ",") {
+		if e = strings.TrimSpace(e); len(e) != 0 {
+			archiveExclude = append(archiveExclude, e)
+		}
+	}
+	if err := validateExcludePatterns(archiveExclude, os.Getenv(configPathEnvKey)); err != nil {
+		return nil, fmt.Errorf("invalid parameter %q: %v", archiveExcludeEnvKey, err)
+	}
+
+	stateFormat := stateFormatPretty
+	if sf, ok := os.LookupEnv(stateFormatEnvKey); ok {
+		stateFormat = sf
+	}
+	if stateFormat != stateFormatPretty && stateFormat != stateFormatCompact {
+		return nil, fmt.Errorf("parameter %q must be %q or %q, got %q", stateFormatEnvKey, stateFormatPretty, stateFormatCompact, stateFormat)
+	}
+
+	// The value is passed to Terraform as is, it's only parsed to fail early on an invalid duration.
+	initLockTimeout := os.Getenv(initLockTimeoutEnvKey)
+	if len(initLockTimeout) != 0 {
+		if _, err := time.ParseDuration(initLockTimeout); err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", initLockTimeoutEnvKey, err)
+		}
+	}
+
+	var operationTimeout time.Duration
+	if ot, ok := os.LookupEnv(operationTimeoutEnvKey); ok {
+		var err error
+		operationTimeout, err = time.ParseDuration(ot)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q: %v", operationTimeoutEnvKey, err)
+		}
+		if operationTimeout < 0 {
+			return nil, fmt.Errorf("%q must not be negative", operationTimeoutEnvKey)
+		}
+	}
+
 	return &params{
 		backendBucket:    backendBucket,
 		backendPrefix:    backendPrefix,
+		backendMode:      backendMode,
 		configPath:       os.Getenv(configPathEnvKey),
 		variablePath:     os.Getenv(variablePathEnvKey),
 		enableRenderPlan: enablePlan,
 		lockTimeout:      os.Getenv(lockTimeoutEnvKey),
+		initLockTimeout:  initLockTimeout,
 		applyParallelism: applyParallelism,
+		tfVars:           os.Getenv(tfVarsEnvKey),
+		skipOnNoChanges:  skipOnNoChanges,
+		postApplyRefresh: postApplyRefresh,
+		preApplyPlan:     preApplyPlan,
+		uploadApplyLog:   uploadApplyLog,
+		inspectBackend:   inspectBackend,
+		outputAllowlist:  outputAllowlist,
+		providerConfig:   os.Getenv(providerConfigEnvKey),
+		fmtCheck:         fmtCheck,
+		tfVersion:        os.Getenv(versionEnvKey),
+		archiveFormat:    archiveFormat,
+		archiveExclude:   archiveExclude,
+		stateFormat:      stateFormat,
+		operationTimeout: operationTimeout,
 	}, nil
 }
@@ -15,11 +15,15 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
@@ -34,12 +38,14 @@ import (
 )
 
 const (
-	// Path to use when downloading the source input archive file.
-	srcArchivePath = "/workspace/archive.tgz"
-	// Path to use when unarchiving the source input.
-	srcPath = "/workspace/source"
 	// File name to use for the generated Terraform backend configuration.
 	backendFileName = "backend.tf"
+	// File name to use for the generated provider configuration overriding provider blocks declared in the
+	// Terraform configuration. Terraform only merges files with an "_override.tf" suffix onto the configuration.
+	providerOverrideFileName = "clouddeploy-provider_override.tf"
+	// File name to use for the generated provider configuration of providers without a provider block in the
+	// Terraform configuration, since Terraform fails when an override file has no block to override.
+	providerConfigFileName = "clouddeploy-provider.tf"
 	// File name to use for the generated variables file.
 	autoTFVarsFileName = "clouddeploy.auto.tfvars"
 	// File name to use for the speculative Terraform plan.
@@ -49,14 +55,27 @@ const (
 	// Name of the release inspector artifact. This contains the contents of the generated variables file
 	// and the speculative Terraform plan.
 	inspectorArtifactName = "clouddeploy-release-inspector-artifact"
-	// Name of the rendered archive. The rendered archive contains the Terraform configuration after
-	// the rendering has completed.
-	renderedArchiveName = "terraform-archive.tgz"
+	// Name of the Markdown summary of the speculative Terraform plan, e.g. for the git-deployer to post on
+	// a pull request with its gitPostArtifactComment deploy parameter.
+	planSummaryArtifactName = "plan-summary.md"
+	// Name of the rendered archive without the extension. The rendered archive contains the Terraform
+	// configuration after the rendering has completed.
+	renderedArchiveBaseName = "terraform-archive"
+	// Key to use in the render result metadata for the format of the rendered archive, which the deploy reads
+	// to determine the name of the archive to download.
+	archiveFormatMetadataKey = "tf-archive-format"
 )
 
 var (
+	// Path to use when downloading the source input archive file.
+	srcArchivePath = "/workspace/archive.tgz"
+	// Path to use when unarchiving the source input.
+	srcPath = "/workspace/source"
 	// Path to use when creating the release inspector artifact.
 	inspectorArtifactPath = fmt.Sprintf("/workspace/%s", inspectorArtifactName)
+	// planChangesRegex matches the line summarizing the changes in the output of `terraform show`, e.g.
+	// "Plan: 1 to add, 0 to change, 0 to destroy." or "No changes. Your infrastructure matches the configuration."
+	planChangesRegex = regexp.MustCompile(`(?m)^(Plan: .*|No changes\..*)$`)
 )
 
 // renderer implements the requestHandler interface for render requests.
@@ -70,8 +89,12 @@ type renderer struct {
 func (r *renderer) process(ctx context.Context) error {
 	fmt.Println("Processing render request")
 
-	res, err := r.render(ctx)
+	opCtx, cancel := clouddeploy.WithOperationTimeout(ctx, r.params.operationTimeout)
+	defer cancel()
+	res, err := r.render(opCtx)
 	if err != nil {
+		// Results are uploaded with the parent context since the operation context may have expired.
+		err = clouddeploy.OperationTimeoutError(opCtx, r.params.operationTimeout, err)
 		fmt.Printf("Render failed: %v\n", err)
 		rr := &clouddeploy.RenderResult{
 			ResultStatus:   clouddeploy.RenderFailed,
@@ -82,93 +105,103 @@ func (r *renderer) process(ctx context.Context) error {
 			},
 		}
 		fmt.Println("Uploading failed render results")
-		rURI, err := r.req.UploadResult(ctx, r.gcsClient, rr)
-		if err != nil {
-			return fmt.Errorf("error uploading failed render results: %v", err)
+		rURI, uErr := r.req.UploadResult(ctx, r.gcsClient, rr)
+		if uErr != nil {
+			return clouddeploy.Classify(clouddeploy.TransientError, fmt.Errorf("error uploading failed render results: %v", uErr))
 		}
 		fmt.Printf("Uploaded failed render results to %s\n", rURI)
+		// The failure is reported in the results, the error is returned so the exit code reflects its kind.
 		return err
 	}
 
 	fmt.Println("Uploading render results")
 	rURI, err := r.req.UploadResult(ctx, r.gcsClient, res)
 	if err != nil {
-		return fmt.Errorf("error uploading render results: %v", err)
+		return clouddeploy.Classify(clouddeploy.TransientError, fmt.Errorf("error uploading render results: %v", err))
 	}
 	fmt.Printf("Uploaded render results to %s\n", rURI)
 	return nil
 }
 
 // render performs the following steps:
-//  1. Generate backend.tf with the GCS backend provided in the params.
-//  2. Generate clouddeploy.auto.tfvars with all the variable values provided via TF_VAR_{name} env vars.
-//  3. Initialize the Terraform Configuration and validate it.
-//  4. Generate speculative Terraform plan and upload it to GCS to use as the Cloud Deploy Release inspector artifact.
-//  5. Upload an archived version of the Terraform configuration to GCS so it can be used at deploy time.
+//  1. Generate backend.tf with the GCS backend provided in the params, or merge it into the existing backend
+//     block, before Terraform is initialized. If enabled, check the formatting of the Terraform configuration
+//     beforehand.
+//  2. If provided, generate the provider blocks from the tfProviderConfig param.
+//  3. Generate clouddeploy.auto.tfvars with all the variable values provided via the tfVars param and
+//     TF_VAR_{name} env vars.
+//  4. Initialize the Terraform Configuration and validate it.
+//  5. Generate speculative Terraform plan and upload it to GCS to use as the Cloud Deploy Release inspector artifact,
+//     along with a Markdown summary of the plan.
+//  6. Upload an archived version of the Terraform configuration to GCS so it can be used at deploy time.
 //
 // Returns either the render results or an error if the render failed.
 func (r *renderer) render(ctx context.Context) (*clouddeploy.RenderResult, error) {
+	if err := useTerraformVersion(ctx, r.params.tfVersion); err != nil {
+		return nil, err
+	}
 	fmt.Printf("Downloading render input archive to %s and unarchiving to %s\n", srcArchivePath, srcPath)
 	inURI, err := r.req.DownloadAndUnarchiveInput(ctx, r.gcsClient, srcArchivePath, srcPath)
 	if err != nil {
-		return nil, fmt.Errorf("unable to download and unarchive render input: %v", err)
+		return nil, clouddeploy.Classify(clouddeploy.TransientError, fmt.Errorf("unable to download and unarchive render input: %v", err))
 	}
 	fmt.Printf("Downloaded render input archive from %s\n", inURI)
 
 	// Determine the path to the Terraform configuration. This will be the working directory for Terraform initialization.
 	terraformConfigPath := path.Join(srcPath, r.params.configPath)
-	if _, err := terraformInit(terraformConfigPath, &terraformInitOptions{}); err != nil {
-		return nil, fmt.Errorf("error running terraform init: %v", err)
+	// The format check runs before initialization so downloaded modules aren't checked.
+	if len(r.params.fmtCheck) != 0 {
+		if err := checkFormatting(ctx, terraformConfigPath, r.params.fmtCheck); err != nil {
+			return nil, err
+		}
 	}
-
-	backendPath := path.Join(terraformConfigPath, backendFileName)
-	fmt.Printf("Generating Terraform backend configuration file: %s\n", backendPath)
-	if err := generateBackendFile(backendPath, r.params); err != nil {
-		return nil, fmt.Errorf("error generating backend configuration file: %v", err)
+	backendPath, err := r.prepareConfig(ctx, terraformConfigPath)
+	if err != nil {
+		return nil, err
 	}
-	fmt.Printf("Finished generating Terraform backend configuration file: %s\n", backendPath)
-
 	autoVarsPath := path.Join(terraformConfigPath, autoTFVarsFileName)
-	fmt.Printf("Generating auto variable definitions file: %s\n", autoVarsPath)
-	if err := generateAutoTFVarsFile(autoVarsPath, r.params); err != nil {
-		return nil, fmt.Errorf("error generating variable definitions file: %v", err)
-	}
-	fmt.Printf("Finished generating auto variable definitions file: %s\n", autoVarsPath)
-
-	if _, err := terraformInit(terraformConfigPath, &terraformInitOptions{}); err != nil {
-		return nil, fmt.Errorf("error initializing terraform: %v", err)
-	}
-	if _, err := terraformValidate(terraformConfigPath); err != nil {
-		return nil, fmt.Errorf("error validating terraform: %v", err)
-	}
 
 	specPlan := []byte{}
 	// Only generate the Terraform plan if enabled since this requires the service account to
 	// have permissions on the Cloud Storage bucket backend.
 	if r.params.enableRenderPlan {
 		fmt.Println("Generating speculative Terraform plan for informational purposes")
-		if _, err := terraformPlan(terraformConfigPath, speculativePlanFileName); err != nil {
-			return nil, fmt.Errorf("error generating terraform plan: %v", err)
+		if _, err := terraformPlan(ctx, terraformConfigPath, speculativePlanFileName); err != nil {
+			return nil, clouddeploy.Classify(clouddeploy.ExecError, fmt.Errorf("error generating terraform plan: %v", err))
 		}
 		var err error
-		specPlan, err = terraformShowPlan(terraformConfigPath, speculativePlanFileName)
+		specPlan, err = terraformShowPlan(ctx, terraformConfigPath, speculativePlanFileName)
 		if err != nil {
-			return nil, fmt.Errorf("error showing terraform plan: %v", err)
+			return nil, clouddeploy.Classify(clouddeploy.ExecError, fmt.Errorf("error showing terraform plan: %v", err))
 		}
 		fmt.Println("Finished generating Terraform plan")
 	}
 
 	fmt.Printf("Creating Cloud Deploy Release inspector artifact: %s\n", inspectorArtifactPath)
-	if err := createReleaseInspectorArtifact(autoVarsPath, specPlan, inspectorArtifactPath); err != nil {
+	inspectedBackendPath := ""
+	if r.params.inspectBackend {
+		inspectedBackendPath = backendPath
+	}
+	if err := createReleaseInspectorArtifact(autoVarsPath, inspectedBackendPath, specPlan, inspectorArtifactPath); err != nil {
 		return nil, fmt.Errorf("error creating cloud deploy release inspector artifact: %v", err)
 	}
 	fmt.Println("Uploading Cloud Deploy Release inspector artifact")
 	planGCSURI, err := r.req.UploadArtifact(ctx, r.gcsClient, inspectorArtifactName, &clouddeploy.GCSUploadContent{LocalPath: inspectorArtifactPath})
 	if err != nil {
-		return nil, fmt.Errorf("error uploading speculative plan: %v", err)
+		return nil, clouddeploy.Classify(clouddeploy.TransientError, fmt.Errorf("error uploading speculative plan: %v", err))
 	}
 	fmt.Printf("Uploaded Cloud Deploy Release inspector artifact to %s\n", planGCSURI)
 
+	if len(specPlan) != 0 {
+		fmt.Println("Uploading Terraform plan summary")
+		psContent := &clouddeploy.GCSUploadContent{Data: planSummary(r.req, specPlan)}
+		psURI, err := r.req.UploadArtifact(ctx, r.gcsClient, planSummaryArtifactName, psContent)
+		if err != nil {
+			return nil, clouddeploy.Classify(clouddeploy.TransientError, fmt.Errorf("error uploading terraform plan summary: %v", err))
+		}
+		fmt.Printf("Uploaded Terraform plan summary to %s\n", psURI)
+	}
+
 	// Delete the downloaded providers to save storage space in GCS. The provider versions are stored in the
 	// .terraform.lock.hcl file, so the correct versions will be redownloaded at deploy time.
 	os.RemoveAll(path.Join(terraformConfigPath, providersDirName))
@@ -176,14 +209,15 @@ func (r *renderer) render(ctx context.Context) (*clouddeploy.RenderResult, error
 	// We need to archive all the configuration provided (and generated) instead of just the configuration
 	// in the terraformConfigPath in case the Terraform configuration in terraformConfigPath has child modules
 	// in a parent directory.
-	fmt.Printf("Archiving Terraform configuration in %s for use at deploy time\n", srcPath)
-	if err := tarArchiveDir(srcPath, renderedArchiveName); err != nil {
+	archiveName := renderedArchiveName(r.params.archiveFormat)
+	fmt.Printf("Archiving Terraform configuration in %s as %s for use at deploy time\n", srcPath, r.params.archiveFormat)
+	if err := archiveDir(srcPath, archiveName, r.params.archiveFormat, r.params.archiveExclude); err != nil {
 		return nil, fmt.Errorf("error archiving terraform configuration: %v", err)
 	}
 	fmt.Println("Uploading archived Terraform configuration")
-	atURI, err := r.req.UploadArtifact(ctx, r.gcsClient, renderedArchiveName, &clouddeploy.GCSUploadContent{LocalPath: renderedArchiveName})
+	atURI, err := r.req.UploadArtifact(ctx, r.gcsClient, archiveName, &clouddeploy.GCSUploadContent{LocalPath: archiveName})
 	if err != nil {
-		return nil, fmt.Errorf("error uploading archived terraform configuration: %v", err)
+		return nil, clouddeploy.Classify(clouddeploy.TransientError, fmt.Errorf("error uploading archived terraform configuration: %v", err))
 	}
 	fmt.Printf("Uploaded archived Terraform configuration to %s\n", atURI)
 
@@ -193,11 +227,83 @@ func (r *renderer) render(ctx context.Context) (*clouddeploy.RenderResult, error
 		Metadata: map[string]string{
 			clouddeploy.CustomTargetSourceMetadataKey:    tfDeployerSampleName,
 			clouddeploy.CustomTargetSourceSHAMetadataKey: clouddeploy.GitCommit,
+			archiveFormatMetadataKey:                     r.params.archiveFormat,
 		},
 	}
 	return renderResult, nil
 }
 
+// prepareConfig configures the GCS backend from the params, initializes the Terraform configuration, generates
+// the provider blocks and the auto variable definitions file, then initializes and validates the configuration
+// again. The backend is configured before the first init so Terraform is never initialized against a backend
+// other than the one in the params. Returns the path of the file containing the backend configuration.
+func (r *renderer) prepareConfig(ctx context.Context, terraformConfigPath string) (string, error) {
+	backendPath := path.Join(terraformConfigPath, backendFileName)
+	switch r.params.backendMode {
+	case backendModeUseExisting:
+		fmt.Println("Using the backend configured in the Terraform configuration")
+	case backendModeMerge:
+		fmt.Printf("Merging the GCS backend into the Terraform backend configuration in %s\n", terraformConfigPath)
+		var err error
+		backendPath, err = mergeBackendFile(terraformConfigPath, r.params)
+		if err != nil {
+			return "", clouddeploy.Classify(clouddeploy.ConfigError, fmt.Errorf("error merging backend configuration file: %v", err))
+		}
+		fmt.Printf("Finished merging Terraform backend configuration file: %s\n", backendPath)
+	default:
+		fmt.Printf("Generating Terraform backend configuration file: %s\n", backendPath)
+		if err := generateBackendFile(backendPath, r.params); err != nil {
+			return "", clouddeploy.Classify(clouddeploy.ConfigError, fmt.Errorf("error generating backend configuration file: %v", err))
+		}
+		fmt.Printf("Finished generating Terraform backend configuration file: %s\n", backendPath)
+	}
+
+	if _, err := terraformInit(ctx, terraformConfigPath, &terraformInitOptions{lockTimeout: r.params.initLockTimeout}); err != nil {
+		return "", clouddeploy.Classify(clouddeploy.ExecError, fmt.Errorf("error running terraform init: %v", err))
+	}
+
+	if len(r.params.providerConfig) != 0 {
+		fmt.Printf("Generating Terraform provider configuration in %s\n", terraformConfigPath)
+		if err := generateProviderConfigFiles(terraformConfigPath, r.params.providerConfig); err != nil {
+			return "", clouddeploy.Classify(clouddeploy.ConfigError, fmt.Errorf("error generating provider configuration: %v", err))
+		}
+		fmt.Printf("Finished generating Terraform provider configuration in %s\n", terraformConfigPath)
+	}
+
+	autoVarsPath := path.Join(terraformConfigPath, autoTFVarsFileName)
+	fmt.Printf("Generating auto variable definitions file: %s\n", autoVarsPath)
+	if err := generateAutoTFVarsFile(autoVarsPath, r.params); err != nil {
+		return "", clouddeploy.Classify(clouddeploy.ConfigError, fmt.Errorf("error generating variable definitions file: %v", err))
+	}
+	fmt.Printf("Finished generating auto variable definitions file: %s\n", autoVarsPath)
+
+	if _, err := terraformInit(ctx, terraformConfigPath, &terraformInitOptions{lockTimeout: r.params.initLockTimeout}); err != nil {
+		return "", clouddeploy.Classify(clouddeploy.ExecError, fmt.Errorf("error initializing terraform: %v", err))
+	}
+	if _, err := terraformValidate(ctx, terraformConfigPath); err != nil {
+		return "", clouddeploy.Classify(clouddeploy.ExecError, fmt.Errorf("error validating terraform: %v", err))
+	}
+	return backendPath, nil
+}
+
+// checkFormatting runs `terraform fmt -check` on the Terraform configuration. The unformatted files are logged
+// when the mode is "warn" and returned in an error when the mode is "fail".
+func checkFormatting(ctx context.Context, terraformConfigPath string, mode string) error {
+	files, err := terraformFmtCheck(ctx, terraformConfigPath)
+	if err != nil {
+		return clouddeploy.Classify(clouddeploy.ExecError, fmt.Errorf("error running terraform fmt check: %v", err))
+	}
+	if len(files) == 0 {
+		fmt.Println("Terraform configuration is formatted")
+		return nil
+	}
+	if mode == fmtCheckFail {
+		return clouddeploy.Classify(clouddeploy.ConfigError, fmt.Errorf("terraform configuration files are not formatted, run terraform fmt: %s", strings.Join(files, ", ")))
+	}
+	fmt.Printf("Warning: Terraform configuration files are not formatted: %s\n", strings.Join(files, ", "))
+	return nil
+}
+
 // generateBackendFile generates a file with a GCS backend configuration at the provided path.
 func generateBackendFile(backendPath string, params *params) error {
 	// Check whether backend file exists. If it does then fail the render, otherwise create it.
@@ -225,10 +331,227 @@ func generateBackendFile(backendPath string, params *params) error {
 	return nil
 }
 
+// generateProviderConfigFiles generates the provider blocks described by the tfProviderConfig param in the
+// Terraform configuration directory. Providers that already have a provider block in the configuration are
+// written to an override file so the generated attributes take precedence over the same attributes in the
+// existing block, while the remaining attributes of the existing block are kept. Other providers are written
+// to a regular configuration file.
+func generateProviderConfigFiles(configDir string, rawProviderConfig string) error {
+	providers, err := parseProviderConfigParam(rawProviderConfig)
+	if err != nil {
+		return fmt.Errorf("unable to parse parameter %q: %v", providerConfigEnvKey, err)
+	}
+	declared, err := declaredProviders(configDir)
+	if err != nil {
+		return err
+	}
+
+	overrideFile := hclwrite.NewEmptyFile()
+	configFile := hclwrite.NewEmptyFile()
+	// We sort the providers so the ordering is consistent between Cloud Deploy Releases.
+	var names []string
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := configFile
+		if declared[name] {
+			fmt.Printf("Provider %s is declared in the Terraform configuration, generated attributes will override it\n", name)
+			f = overrideFile
+		}
+		body := f.Body().AppendNewBlock("provider", []string{name}).Body()
+		attrs := providers[name]
+		var keys []string
+		for k := range attrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			body.SetAttributeValue(k, attrs[k])
+		}
+	}
+
+	for fileName, f := range map[string]*hclwrite.File{providerOverrideFileName: overrideFile, providerConfigFileName: configFile} {
+		if len(f.Body().Blocks()) == 0 {
+			continue
+		}
+		p := path.Join(configDir, fileName)
+		// Check whether the provider configuration file exists. If it does then fail the render, otherwise create it.
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			return fmt.Errorf("provider configuration file %q already exists, failing render to avoid overwriting any configuration", p)
+		}
+		content := append([]byte("# Sourced from the customTarget/tfProviderConfig deploy parameter.\n"), f.Bytes()...)
+		if err := os.WriteFile(p, content, 0644); err != nil {
+			return fmt.Errorf("error writing provider configuration file %s: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// parseProviderConfigParam parses the JSON object provided in the tfProviderConfig parameter into a map of provider
+// names to the provider block attributes. The provider and attribute names must be valid Terraform identifiers.
+func parseProviderConfigParam(rawProviderConfig string) (map[string]map[string]cty.Value, error) {
+	var providers map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(rawProviderConfig), &providers); err != nil {
+		return nil, fmt.Errorf("value must be a JSON object: %v", err)
+	}
+	res := make(map[string]map[string]cty.Value)
+	for name, rawAttrs := range providers {
+		if !hclsyntax.ValidIdentifier(name) {
+			return nil, fmt.Errorf("invalid provider name %q", name)
+		}
+		attrs, err := parseTFVarsParam(string(rawAttrs))
+		if err != nil {
+			return nil, fmt.Errorf("invalid attributes for provider %q: %v", name, err)
+		}
+		for k := range attrs {
+			if !hclsyntax.ValidIdentifier(k) {
+				return nil, fmt.Errorf("invalid attribute name %q for provider %q", k, name)
+			}
+		}
+		res[name] = attrs
+	}
+	return res, nil
+}
+
+// declaredProviders returns the names of the providers that have a default, i.e. not aliased, provider block in
+// the Terraform configuration files in the provided directory.
+func declaredProviders(configDir string) (map[string]bool, error) {
+	files, err := filepath.Glob(path.Join(configDir, "*.tf"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to list terraform configuration files in %s: %v", configDir, err)
+	}
+	declared := make(map[string]bool)
+	for _, fp := range files {
+		src, err := os.ReadFile(fp)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read terraform configuration file %s: %v", fp, err)
+		}
+		f, diags := hclsyntax.ParseConfig(src, fp, hcl.InitialPos)
+		if diags.HasErrors() {
+			return nil, fmt.Errorf("unable to parse terraform configuration file %s: %v", fp, diags)
+		}
+		for _, b := range f.Body.(*hclsyntax.Body).Blocks {
+			if b.Type != "provider" || len(b.Labels) != 1 {
+				continue
+			}
+			if _, aliased := b.Body.Attributes["alias"]; aliased {
+				continue
+			}
+			declared[b.Labels[0]] = true
+		}
+	}
+	return declared, nil
+}
+
+// findBackendFile returns the path of the Terraform configuration file in the provided directory that contains
+// a backend block, or an empty string if none does. Fails if more than one backend block is found.
+func findBackendFile(configDir string) (string, error) {
+	files, err := filepath.Glob(path.Join(configDir, "*.tf"))
+	if err != nil {
+		return "", fmt.Errorf("unable to list terraform configuration files in %s: %v", configDir, err)
+	}
+	found := ""
+	for _, fp := range files {
+		src, err := os.ReadFile(fp)
+		if err != nil {
+			return "", fmt.Errorf("unable to read terraform configuration file %s: %v", fp, err)
+		}
+		f, diags := hclsyntax.ParseConfig(src, fp, hcl.InitialPos)
+		if diags.HasErrors() {
+			return "", fmt.Errorf("unable to parse terraform configuration file %s: %v", fp, diags)
+		}
+		for _, b := range f.Body.(*hclsyntax.Body).Blocks {
+			if b.Type != "terraform" {
+				continue
+			}
+			for _, nb := range b.Body.Blocks {
+				if nb.Type != "backend" {
+					continue
+				}
+				if len(found) != 0 {
+					return "", fmt.Errorf("terraform configuration contains multiple backend blocks, in %s and %s", found, fp)
+				}
+				found = fp
+			}
+		}
+	}
+	return found, nil
+}
+
+// mergeBackendFile sets the bucket and prefix from the params in the GCS backend block of the Terraform
+// configuration in the provided directory, whichever *.tf file it's in. If there is no backend block then
+// backend.tf is generated. Fails if the backend isn't GCS. Returns the path of the file containing the
+// backend block.
+func mergeBackendFile(configDir string, params *params) (string, error) {
+	backendPath, err := findBackendFile(configDir)
+	if err != nil {
+		return "", err
+	}
+	if len(backendPath) == 0 {
+		backendPath = path.Join(configDir, backendFileName)
+		fmt.Printf("Terraform configuration doesn't contain a backend block, generating %s\n", backendPath)
+		return backendPath, generateBackendFile(backendPath, params)
+	}
+	src, err := os.ReadFile(backendPath)
+	if err != nil {
+		return "", fmt.Errorf("unable to read backend configuration file: %v", err)
+	}
+	hclFile, diags := hclwrite.ParseConfig(src, backendPath, hcl.InitialPos)
+	if diags.HasErrors() {
+		return "", fmt.Errorf("unable to parse backend configuration file: %v", diags)
+	}
+
+	// findBackendFile guarantees there's exactly one backend block in the file.
+	var backendBlock *hclwrite.Block
+	for _, tfBlock := range hclFile.Body().Blocks() {
+		if tfBlock.Type() != "terraform" {
+			continue
+		}
+		for _, b := range tfBlock.Body().Blocks() {
+			if b.Type() == "backend" {
+				backendBlock = b
+			}
+		}
+	}
+	if labels := backendBlock.Labels(); len(labels) != 1 || labels[0] != "gcs" {
+		return "", fmt.Errorf("backend configuration file %q configures backend %q, only a gcs backend can be merged", backendPath, strings.Join(labels, " "))
+	}
+
+	body := backendBlock.Body()
+	// An empty single line block, e.g. `backend "gcs" {}`, needs a newline after the opening brace before
+	// attributes are added, otherwise the first attribute is written on the same line as the brace.
+	if !hasNewline(body.BuildTokens(nil)) {
+		body.AppendNewline()
+	}
+	for _, attr := range []struct{ name, val string }{{"bucket", params.backendBucket}, {"prefix", params.backendPrefix}} {
+		if body.GetAttribute(attr.name) != nil {
+			fmt.Printf("Overriding the backend %s in %s with %q\n", attr.name, backendPath, attr.val)
+		}
+		body.SetAttributeValue(attr.name, cty.StringVal(attr.val))
+	}
+	if err := os.WriteFile(backendPath, hclFile.Bytes(), 0644); err != nil {
+		return "", fmt.Errorf("error writing to backend configuration file: %v", err)
+	}
+	return backendPath, nil
+}
+
+// hasNewline returns whether the tokens contain a newline.
+func hasNewline(tokens hclwrite.Tokens) bool {
+	for _, t := range tokens {
+		if t.Type == hclsyntax.TokenNewline {
+			return true
+		}
+	}
+	return false
+}
+
 // generateAutoTFVarsFile generates a *.auto.tfvars file that contains the variables defined in the environment
-// with a "TF_VAR_" prefix and the variables defined in the variable file, if provided. This is done
-// so that that the Terraform configuration uploaded at the end of the render has all configuration present for
-// a Terraform apply.
+// with a "TF_VAR_" prefix, the variables defined in the tfVars param and the variables defined in the variable
+// file, if provided. Variables defined in the environment take precedence over the tfVars param, which takes
+// precedence over the variable file, so each variable is only defined once. This is done so that that the
+// Terraform configuration uploaded at the end of the render has all configuration present for a Terraform apply.
 func generateAutoTFVarsFile(autoTFVarsPath string, params *params) error {
 	// Check whether clouddeploy.auto.tfvars file exists. If it does then fail the render, otherwise create it.
 	if _, err := os.Stat(autoTFVarsPath); !os.IsNotExist(err) {
@@ -240,37 +563,23 @@ func generateAutoTFVarsFile(autoTFVarsPath string, params *params) error {
 	}
 	defer autoTFVarsFile.Close()
 
-	if len(params.variablePath) > 0 {
-		varsPath := path.Join(path.Dir(autoTFVarsPath), params.variablePath)
-		fmt.Printf("Attempting to copy contents from %s to %s so the variables are automatically consumed by Terraform\n", varsPath, autoTFVarsPath)
-		varsFile, err := os.Open(varsPath)
-		if err != nil {
-			return fmt.Errorf("unable to open variable file provided at %s: %v", varsPath, err)
-		}
-		defer varsFile.Close()
-
-		autoTFVarsFile.Write([]byte(fmt.Sprintf("# Sourced from %s.\n", params.variablePath)))
-		if _, err := io.Copy(autoTFVarsFile, varsFile); err != nil {
-			return fmt.Errorf("unable to copy contents from %s to %s: %v", varsPath, autoTFVarsPath, err)
-		}
-		autoTFVarsFile.Write([]byte("\n"))
-		fmt.Printf("Finished copying contents from %s to %s\n", varsPath, autoTFVarsPath)
-	}
-
 	hclFile := hclwrite.NewEmptyFile()
 	rootBody := hclFile.Body()
 
+	kv, err := parseTFVarsParam(params.tfVars)
+	if err != nil {
+		return fmt.Errorf("unable to parse parameter %q: %v", tfVarsEnvKey, err)
+	}
+	foundParam := len(kv) > 0
+
 	// Track whether we found any relevant environment variables to determine if we write to the file.
 	found := false
-	var keys []string
-	kv := make(map[string]cty.Value)
 	envVars := os.Environ()
 	for _, rawEV := range envVars {
 		if !strings.HasPrefix(rawEV, "TF_VAR_") {
 			continue
 		}
 		found = true
-		fmt.Printf("Found terraform environment variable %s, will add to %s\n", rawEV, autoTFVarsPath)
 
 		// Remove the prefix so we can get the variable name.
 		ev := strings.TrimPrefix(rawEV, "TF_VAR_")
@@ -281,23 +590,52 @@ func generateAutoTFVarsFile(autoTFVarsPath string, params *params) error {
 		}
 		name := ev[:eqIdx]
 		rawVal := ev[eqIdx+1:]
+		fmt.Printf("Found terraform environment variable TF_VAR_%s=%s, will add to %s\n", name, clouddeploy.RedactSensitive(name, rawVal), autoTFVarsPath)
 
 		val, err := parseCtyValue(rawVal, name)
 		if err != nil {
 			return err
 		}
-		keys = append(keys, name)
+		if _, ok := kv[name]; ok {
+			fmt.Printf("Terraform environment variable TF_VAR_%s overrides the value provided in %s\n", name, tfVarsEnvKey)
+		}
 		kv[name] = val
 	}
 
+	if len(params.variablePath) > 0 {
+		varsPath := path.Join(path.Dir(autoTFVarsPath), params.variablePath)
+		fmt.Printf("Attempting to copy contents from %s to %s so the variables are automatically consumed by Terraform\n", varsPath, autoTFVarsPath)
+		varsContent, err := variableFileWithoutOverrides(varsPath, kv)
+		if err != nil {
+			return err
+		}
+		autoTFVarsFile.Write([]byte(fmt.Sprintf("# Sourced from %s.\n", params.variablePath)))
+		if _, err := autoTFVarsFile.Write(varsContent); err != nil {
+			return fmt.Errorf("unable to copy contents from %s to %s: %v", varsPath, autoTFVarsPath, err)
+		}
+		autoTFVarsFile.Write([]byte("\n"))
+		fmt.Printf("Finished copying contents from %s to %s\n", varsPath, autoTFVarsPath)
+	}
+
 	// We sort the entries so the ordering is consistent between Cloud Deploy Releases.
+	var keys []string
+	for k := range kv {
+		keys = append(keys, k)
+	}
 	sort.Strings(keys)
 	for _, k := range keys {
 		rootBody.SetAttributeValue(k, kv[k])
 	}
 
-	if found {
-		autoTFVarsFile.Write([]byte("# Sourced from TF_VAR_ prefixed environment variables.\n"))
+	if found || foundParam {
+		var sources []string
+		if foundParam {
+			sources = append(sources, "the customTarget/tfVars deploy parameter")
+		}
+		if found {
+			sources = append(sources, "TF_VAR_ prefixed environment variables")
+		}
+		autoTFVarsFile.Write([]byte(fmt.Sprintf("# Sourced from %s.\n", strings.Join(sources, " and "))))
 		if _, err = autoTFVarsFile.Write(hclFile.Bytes()); err != nil {
 			return fmt.Errorf("error writing to cloud deploy auto.tfvars file: %v", err)
 		}
@@ -305,6 +643,61 @@ func generateAutoTFVarsFile(autoTFVarsPath string, params *params) error {
 	return nil
 }
 
+// variableFileWithoutOverrides returns the contents of the variable file at the provided path with the
+// definitions of the provided overriding variables removed, so that the variables aren't defined twice.
+func variableFileWithoutOverrides(varsPath string, overrides map[string]cty.Value) ([]byte, error) {
+	src, err := os.ReadFile(varsPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open variable file provided at %s: %v", varsPath, err)
+	}
+	f, diags := hclwrite.ParseConfig(src, varsPath, hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("unable to parse variable file provided at %s: %v", varsPath, diags)
+	}
+	// We sort the names so the logs are consistent between Cloud Deploy Releases.
+	var names []string
+	for name := range f.Body().Attributes() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := overrides[name]; !ok {
+			continue
+		}
+		fmt.Printf("Variable %s in %s is overridden by the value provided in %s or a TF_VAR_ environment variable\n", name, varsPath, tfVarsEnvKey)
+		f.Body().RemoveAttribute(name)
+	}
+	return f.Bytes(), nil
+}
+
+// parseTFVarsParam parses the JSON object provided in the tfVars parameter into a map of variable
+// names to cty.Values. Returns an empty map if the parameter is not set.
+func parseTFVarsParam(rawTFVars string) (map[string]cty.Value, error) {
+	kv := make(map[string]cty.Value)
+	if len(rawTFVars) == 0 {
+		return kv, nil
+	}
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(rawTFVars), &vars); err != nil {
+		return nil, fmt.Errorf("value must be a JSON object: %v", err)
+	}
+	for name, rawVal := range vars {
+		// JSON strings are used as is rather than parsed as HCL expressions so that values
+		// containing template sequences, e.g. "${", are preserved.
+		var str string
+		if err := json.Unmarshal(rawVal, &str); err == nil {
+			kv[name] = cty.StringVal(str)
+			continue
+		}
+		val, err := parseCtyValue(string(rawVal), name)
+		if err != nil {
+			return nil, err
+		}
+		kv[name] = val
+	}
+	return kv, nil
+}
+
 // parseCtyValue attempts to parse the provided string value into a cty.Value.
 func parseCtyValue(rawVal string, key string) (cty.Value, error) {
 	expr, diags := hclsyntax.ParseExpression([]byte(rawVal), "", hcl.InitialPos)
@@ -334,10 +727,26 @@ func parseCtyValue(rawVal string, key string) (cty.Value, error) {
 	return val, nil
 }
 
+// planSummary returns a Markdown summary of the speculative Terraform plan for reviewers, containing the
+// line summarizing the changes and the full plan in a collapsed section.
+func planSummary(req *clouddeploy.RenderRequest, plan []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "### Terraform plan for target `%s`\n\n", req.Target)
+	fmt.Fprintf(&b, "Speculative plan generated when rendering release `%s` of delivery pipeline `%s`. This plan is not used when applying the Terraform configuration.\n\n", req.Release, req.Pipeline)
+	if changes := planChangesRegex.Find(plan); changes != nil {
+		fmt.Fprintf(&b, "**%s**\n\n", changes)
+	}
+	b.WriteString("<details><summary>Show plan</summary>\n\n```\n")
+	b.Write(bytes.TrimSpace(plan))
+	b.WriteString("\n```\n\n</details>\n")
+	return b.Bytes()
+}
+
 // createReleaseInspectorArtifact creates a file that will be returned to Cloud Deploy as the rendered
 // manifest so it is viewable in the Release inspector. The file contains the contents of the generated
-// variables file and the speculative Terraform plan, if a plan was generated.
-func createReleaseInspectorArtifact(autoTFVarsPath string, planData []byte, dstPath string) error {
+// variables file, the backend configuration file if a path is provided, and the speculative Terraform
+// plan, if a plan was generated.
+func createReleaseInspectorArtifact(autoTFVarsPath, backendPath string, planData []byte, dstPath string) error {
 	dstFile, err := os.Create(dstPath)
 	if err != nil {
 		return fmt.Errorf("error creating file %s: %v", dstPath, err)
@@ -354,6 +763,12 @@ func createReleaseInspectorArtifact(autoTFVarsPath string, planData []byte, dstP
 		return fmt.Errorf("unable to copy contents from %s to %s: %v", autoTFVarsPath, dstPath, err)
 	}
 
+	if len(backendPath) != 0 {
+		if err := writeInspectorBackendSection(dstFile, backendPath); err != nil {
+			return err
+		}
+	}
+
 	// No plan was generated.
 	if len(planData) == 0 {
 		return nil
@@ -369,18 +784,205 @@ func createReleaseInspectorArtifact(autoTFVarsPath string, planData []byte, dstP
 	return nil
 }
 
-// tarArchiveDir creates a tar file with the provided name containing all the contents of the provided directory.
-func tarArchiveDir(dir string, dst string) error {
-	// Determine the sources for the archive, which is all the entries in the directory.
-	de, err := os.ReadDir(dir)
+// writeInspectorBackendSection writes the backend configuration file to the Release inspector artifact as a
+// separate document. The backend configuration isn't secret so it's written as is. When the configuration has
+// no backend configuration file, e.g. the backend is declared in another file with the use-existing backend
+// mode, the section only notes it.
+func writeInspectorBackendSection(w io.Writer, backendPath string) error {
+	backend, err := os.ReadFile(backendPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read backend configuration file %s: %v", backendPath, err)
+	}
+	name := path.Base(backendPath)
+	if _, err := fmt.Fprintf(w, "---\n# Terraform backend configuration from %s, used when applying the Terraform configuration.\n", name); err != nil {
+		return err
+	}
+	if backend == nil {
+		_, err := fmt.Fprintf(w, "# The Terraform configuration has no %s file, the backend is configured in another file.\n", name)
+		return err
+	}
+	if _, err := w.Write(backend); err != nil {
+		return err
+	}
+	if len(backend) != 0 && backend[len(backend)-1] != '\n' {
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveFormat is an archiver implementation for one of the supported rendered archive formats.
+type archiveFormat interface {
+	archiver.Archiver
+	archiver.Unarchiver
+	archiver.Walker
+	archiver.Writer
+}
+
+// newArchiveFormat returns the archiver implementation for the provided tfArchiveFormat value.
+func newArchiveFormat(format string) (archiveFormat, error) {
+	switch format {
+	case archiveFormatTarGz:
+		return archiver.NewTarGz(), nil
+	case archiveFormatZip:
+		return archiver.NewZip(), nil
+	case archiveFormatTarZst:
+		return archiver.NewTarZstd(), nil
+	default:
+		return nil, fmt.Errorf("unsupported archive format %q, must be one of %q, %q or %q", format, archiveFormatTarGz, archiveFormatZip, archiveFormatTarZst)
+	}
+}
+
+// renderedArchiveName returns the name of the rendered archive for the provided format. The tar.gz
+// name is unchanged from before the format was configurable.
+func renderedArchiveName(format string) string {
+	if format == archiveFormatTarGz {
+		return renderedArchiveBaseName + ".tgz"
+	}
+	return renderedArchiveBaseName + "." + format
+}
+
+// detectArchiveFormat returns the format of the archive at the provided path based on its contents.
+func detectArchiveFormat(archivePath string) (string, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return "", fmt.Errorf("unable to read archive %s: %v", archivePath, err)
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return archiveFormatTarGz, nil
+	case bytes.Equal(magic, []byte("PK\x03\x04")):
+		return archiveFormatZip, nil
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return archiveFormatTarZst, nil
+	default:
+		return "", fmt.Errorf("unable to detect the format of archive %s", archivePath)
+	}
+}
+
+// archiveDir creates an archive in the provided format with the provided name containing all the contents of the
+// provided directory, except the files and directories matching one of the exclude patterns. The directory itself
+// is left unchanged.
+func archiveDir(dir string, dst string, format string, exclude []string) error {
+	a, err := newArchiveFormat(format)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
 	if err != nil {
-		return fmt.Errorf("unable to read directory contents %s: %v", dir, err)
+		return fmt.Errorf("unable to create archive %s: %v", dst, err)
 	}
-	var sources []string
-	for _, e := range de {
-		// Name only returns the final element of the path so we need to reconstruct the path.
-		entryPath := path.Join(dir, e.Name())
-		sources = append(sources, entryPath)
+	defer out.Close()
+	if err := a.Create(out); err != nil {
+		return fmt.Errorf("unable to create archive %s: %v", dst, err)
+	}
+	if err := writeArchiveSources(a, dir, dst, exclude); err != nil {
+		a.Close()
+		return fmt.Errorf("unable to archive %s: %v", dir, err)
+	}
+	if err := a.Close(); err != nil {
+		return fmt.Errorf("unable to finish archive %s: %v", dst, err)
+	}
+	return out.Close()
+}
+
+// writeArchiveSources walks the provided directory and writes its files and directories to the archive, named by
+// their path relative to the directory. Paths matching one of the exclude patterns, and the archive itself, are
+// left out of the sources.
+func writeArchiveSources(a archiver.Writer, dir, dst string, exclude []string) error {
+	dstAbs, err := filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		if pAbs, err := filepath.Abs(p); err != nil || pAbs == dstAbs {
+			return err
+		}
+		nameInArchive := filepath.ToSlash(rel)
+		if matchesExcludePattern(nameInArchive, exclude) {
+			fmt.Printf("Excluding %s from the archive\n", nameInArchive)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		var file io.ReadCloser
+		if info.Mode().IsRegular() {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			file = f
+		}
+		return a.Write(archiver.File{
+			FileInfo:   archiver.FileInfo{FileInfo: info, CustomName: nameInArchive, SourcePath: p},
+			ReadCloser: file,
+		})
+	})
+}
+
+// requiredFileNames are the files in the Terraform configuration directory that the render generates or that the
+// deploy requires, so they can't be excluded from the rendered archive.
+var requiredFileNames = []string{
+	backendFileName,
+	providerOverrideFileName,
+	providerConfigFileName,
+	autoTFVarsFileName,
+	speculativePlanFileName,
+	".terraform.lock.hcl",
+}
+
+// validateExcludePatterns returns an error if one of the provided tfArchiveExclude patterns isn't a valid glob
+// pattern relative to the archived directory, or if it matches one of the required files in the Terraform
+// configuration at the provided path, or one of their parent directories.
+func validateExcludePatterns(patterns []string, configPath string) error {
+	configDir := strings.TrimPrefix(path.Clean("/"+configPath), "/")
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid glob pattern %q: %v", p, err)
+		}
+		if path.IsAbs(p) || p != path.Clean(p) || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+			return fmt.Errorf("invalid glob pattern %q, must be a clean path relative to the archived directory", p)
+		}
+		for _, name := range requiredFileNames {
+			required := path.Join(configDir, name)
+			for target := required; target != "."; target = path.Dir(target) {
+				if matchesExcludePattern(target, []string{p}) {
+					return fmt.Errorf("glob pattern %q excludes %s, which the rendered configuration requires", p, required)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// matchesExcludePattern returns whether the provided slash-separated path, relative to the archived directory,
+// matches one of the exclude patterns. Patterns containing a "/" are matched against the whole relative path,
+// other patterns are matched against the name of the file or directory at any depth, e.g. ".git".
+func matchesExcludePattern(relPath string, patterns []string) bool {
+	for _, p := range patterns {
+		target := relPath
+		if !strings.Contains(p, "/") {
+			target = path.Base(relPath)
+		}
+		// The patterns are validated when the parameters are determined.
+		if ok, _ := path.Match(p, target); ok {
+			return true
+		}
 	}
-	return archiver.NewTarGz().Archive(sources, dst)
+	return false
 }
@@ -0,0 +1,568 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestParseTFVarsParam(t *testing.T) {
+	kv, err := parseTFVarsParam(`{"region": "us-central1", "replicas": 3, "enabled": true, "zones": ["a", "b"], "labels": {"env": "prod"}, "tmpl": "${var.x}"}`)
+	if err != nil {
+		t.Fatalf("parseTFVarsParam() failed: %v", err)
+	}
+	want := map[string]cty.Value{
+		"region":   cty.StringVal("us-central1"),
+		"replicas": cty.NumberIntVal(3),
+		"enabled":  cty.True,
+		"zones":    cty.TupleVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b")}),
+		"labels":   cty.ObjectVal(map[string]cty.Value{"env": cty.StringVal("prod")}),
+		"tmpl":     cty.StringVal("${var.x}"),
+	}
+	if len(kv) != len(want) {
+		t.Fatalf("parseTFVarsParam() got %d variables, want %d", len(kv), len(want))
+	}
+	for k, v := range want {
+		if !kv[k].RawEquals(v) {
+			t.Errorf("parseTFVarsParam() variable %s got: %#v, want: %#v", k, kv[k], v)
+		}
+	}
+}
+
+func TestParseTFVarsParamInvalid(t *testing.T) {
+	for _, raw := range []string{`["a"]`, `not json`, `"str"`} {
+		if _, err := parseTFVarsParam(raw); err == nil {
+			t.Errorf("parseTFVarsParam(%s) succeeded, want error", raw)
+		}
+	}
+}
+
+func TestGenerateAutoTFVarsFileMergesTFVars(t *testing.T) {
+	t.Setenv("TF_VAR_region", "europe-west1")
+	autoVarsPath := path.Join(t.TempDir(), autoTFVarsFileName)
+	p := &params{tfVars: `{"region": "us-central1", "replicas": 3}`}
+	if err := generateAutoTFVarsFile(autoVarsPath, p); err != nil {
+		t.Fatalf("generateAutoTFVarsFile() failed: %v", err)
+	}
+	got, err := os.ReadFile(autoVarsPath)
+	if err != nil {
+		t.Fatalf("unable to read generated file: %v", err)
+	}
+	for _, want := range []string{`region   = "europe-west1"`, `replicas = 3`, "customTarget/tfVars", "TF_VAR_"} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("generateAutoTFVarsFile() output missing %q, got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(string(got), "us-central1") {
+		t.Errorf("generateAutoTFVarsFile() environment variable did not take precedence, got:\n%s", got)
+	}
+}
+
+func TestParseProviderConfigParamInvalid(t *testing.T) {
+	for _, raw := range []string{
+		`not json`,
+		`["google"]`,
+		`{"google": "us-central1"}`,
+		`{"goo gle": {"region": "us-central1"}}`,
+		`{"google": {"bad-attr!": true}}`,
+	} {
+		if _, err := parseProviderConfigParam(raw); err == nil {
+			t.Errorf("parseProviderConfigParam(%s) succeeded, want error", raw)
+		}
+	}
+}
+
+func TestGenerateProviderConfigFiles(t *testing.T) {
+	dir := t.TempDir()
+	mainTF := `provider "google" {
+  project = "my-project"
+  region  = "us-central1"
+}
+
+provider "google" {
+  alias  = "secondary"
+  region = "europe-west1"
+}
+`
+	if err := os.WriteFile(path.Join(dir, "main.tf"), []byte(mainTF), 0644); err != nil {
+		t.Fatalf("unable to write terraform configuration: %v", err)
+	}
+	raw := `{"google": {"region": "us-east1", "impersonate_service_account": "deployer@my-project.iam.gserviceaccount.com"}, "google-beta": {"user_project_override": true}}`
+	if err := generateProviderConfigFiles(dir, raw); err != nil {
+		t.Fatalf("generateProviderConfigFiles() failed: %v", err)
+	}
+
+	override, err := os.ReadFile(path.Join(dir, providerOverrideFileName))
+	if err != nil {
+		t.Fatalf("unable to read generated override file: %v", err)
+	}
+	wantOverride := `# Sourced from the customTarget/tfProviderConfig deploy parameter.
+provider "google" {
+  impersonate_service_account = "deployer@my-project.iam.gserviceaccount.com"
+  region                      = "us-east1"
+}
+`
+	if string(override) != wantOverride {
+		t.Errorf("generated override file got:\n%s\nwant:\n%s", override, wantOverride)
+	}
+
+	config, err := os.ReadFile(path.Join(dir, providerConfigFileName))
+	if err != nil {
+		t.Fatalf("unable to read generated provider file: %v", err)
+	}
+	wantConfig := `# Sourced from the customTarget/tfProviderConfig deploy parameter.
+provider "google-beta" {
+  user_project_override = true
+}
+`
+	if string(config) != wantConfig {
+		t.Errorf("generated provider file got:\n%s\nwant:\n%s", config, wantConfig)
+	}
+
+	// A second render over the same configuration must not overwrite the generated files.
+	if err := generateProviderConfigFiles(dir, raw); err == nil {
+		t.Errorf("generateProviderConfigFiles() succeeded with existing generated files, want error")
+	}
+}
+
+func TestGenerateAutoTFVarsFileDeduplicatesVariableFile(t *testing.T) {
+	t.Setenv("TF_VAR_region", "europe-west1")
+	dir := t.TempDir()
+	varsFile := `region   = "us-central1"
+replicas = 3
+# Production zones.
+zones = ["a", "b"]
+`
+	if err := os.WriteFile(path.Join(dir, "prod.tfvars"), []byte(varsFile), 0644); err != nil {
+		t.Fatalf("unable to write variable file: %v", err)
+	}
+	autoVarsPath := path.Join(dir, autoTFVarsFileName)
+	p := &params{variablePath: "prod.tfvars", tfVars: `{"replicas": 5}`}
+	if err := generateAutoTFVarsFile(autoVarsPath, p); err != nil {
+		t.Fatalf("generateAutoTFVarsFile() failed: %v", err)
+	}
+	got, err := os.ReadFile(autoVarsPath)
+	if err != nil {
+		t.Fatalf("unable to read generated file: %v", err)
+	}
+
+	// JustAttributes fails on duplicate attribute definitions, as Terraform does.
+	f, diags := hclsyntax.ParseConfig(got, autoTFVarsFileName, hcl.InitialPos)
+	if diags.HasErrors() {
+		t.Fatalf("generated file is invalid: %v\n%s", diags, got)
+	}
+	attrs, diags := f.Body.JustAttributes()
+	if diags.HasErrors() {
+		t.Fatalf("generated file has duplicate definitions: %v\n%s", diags, got)
+	}
+	want := map[string]cty.Value{
+		"region":   cty.StringVal("europe-west1"),
+		"replicas": cty.NumberIntVal(5),
+		"zones":    cty.TupleVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b")}),
+	}
+	if len(attrs) != len(want) {
+		t.Fatalf("generated file got %d variables, want %d:\n%s", len(attrs), len(want), got)
+	}
+	for k, v := range want {
+		val, diags := attrs[k].Expr.Value(nil)
+		if diags.HasErrors() {
+			t.Fatalf("unable to evaluate variable %s: %v", k, diags)
+		}
+		if !val.RawEquals(v) {
+			t.Errorf("generated variable %s got: %#v, want: %#v", k, val, v)
+		}
+	}
+	if !strings.Contains(string(got), "# Production zones.") {
+		t.Errorf("generated file dropped the variable file comments:\n%s", got)
+	}
+}
+
+func TestBackendFileModes(t *testing.T) {
+	p := &params{backendBucket: "state-bucket", backendPrefix: "app/prod"}
+	tests := []struct {
+		name     string
+		existing string
+		merge    bool
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name: "generate",
+			want: []string{`backend "gcs"`, `bucket = "state-bucket"`, `prefix = "app/prod"`},
+		},
+		{
+			name:     "generate with existing file",
+			existing: "terraform {\n  backend \"gcs\" {}\n}\n",
+			wantErr:  true,
+		},
+		{
+			name:     "merge into partial gcs backend",
+			existing: "terraform {\n  required_version = \">= 1.5\"\n  backend \"gcs\" {\n    impersonate_service_account = \"sa@p.iam.gserviceaccount.com\"\n    prefix = \"old\"\n  }\n}\n",
+			merge:    true,
+			want:     []string{`required_version = ">= 1.5"`, `impersonate_service_account = "sa@p.iam.gserviceaccount.com"`, `bucket`, `"state-bucket"`, `prefix`, `"app/prod"`},
+		},
+		{
+			name:  "merge without existing file",
+			merge: true,
+			want:  []string{`backend "gcs"`, `bucket = "state-bucket"`, `prefix = "app/prod"`},
+		},
+		{
+			name:     "merge conflicting backend type",
+			existing: "terraform {\n  backend \"s3\" {\n    region = \"us-east-1\"\n  }\n}\n",
+			merge:    true,
+			wantErr:  true,
+		},
+		{
+			name:     "merge multiple backend blocks",
+			existing: "terraform {\n  backend \"gcs\" {}\n}\nterraform {\n  backend \"gcs\" {}\n}\n",
+			merge:    true,
+			wantErr:  true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			backendPath := path.Join(dir, backendFileName)
+			if len(tc.existing) != 0 {
+				if err := os.WriteFile(backendPath, []byte(tc.existing), 0644); err != nil {
+					t.Fatalf("unable to write existing backend file: %v", err)
+				}
+			}
+			var err error
+			if tc.merge {
+				_, err = mergeBackendFile(dir, p)
+			} else {
+				err = generateBackendFile(backendPath, p)
+			}
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("backend file error: %v, wantErr: %t", err, tc.wantErr)
+			}
+			got, err := os.ReadFile(backendPath)
+			if err != nil {
+				t.Fatalf("unable to read backend file: %v", err)
+			}
+			if tc.wantErr {
+				if string(got) != tc.existing {
+					t.Errorf("backend file modified on error, got:\n%s", got)
+				}
+				return
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(string(got), want) {
+					t.Errorf("backend file missing %q, got:\n%s", want, got)
+				}
+			}
+			if strings.Contains(string(got), `"old"`) {
+				t.Errorf("backend file kept the existing prefix, got:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestMergeBackendFileInOtherFile(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := path.Join(dir, "main.tf")
+	main := "terraform {\n  backend \"gcs\" {}\n}\n\nresource \"null_resource\" \"a\" {}\n"
+	if err := os.WriteFile(mainPath, []byte(main), 0644); err != nil {
+		t.Fatalf("unable to write main.tf: %v", err)
+	}
+	got, err := mergeBackendFile(dir, &params{backendBucket: "state-bucket", backendPrefix: "app/prod"})
+	if err != nil {
+		t.Fatalf("mergeBackendFile() failed: %v", err)
+	}
+	if got != mainPath {
+		t.Errorf("mergeBackendFile() got path: %q, want: %q", got, mainPath)
+	}
+	if _, err := os.Stat(path.Join(dir, backendFileName)); !os.IsNotExist(err) {
+		t.Errorf("mergeBackendFile() generated %s next to the existing backend block, err: %v", backendFileName, err)
+	}
+	merged, err := os.ReadFile(mainPath)
+	if err != nil {
+		t.Fatalf("unable to read main.tf: %v", err)
+	}
+	for _, want := range []string{`"state-bucket"`, `"app/prod"`, `resource "null_resource" "a"`} {
+		if !strings.Contains(string(merged), want) {
+			t.Errorf("main.tf missing %q, got:\n%s", want, merged)
+		}
+	}
+	if _, diags := hclsyntax.ParseConfig(merged, mainPath, hcl.InitialPos); diags.HasErrors() {
+		t.Errorf("merged main.tf isn't valid HCL: %v, got:\n%s", diags, merged)
+	}
+}
+
+func TestPrepareConfigMergesBackendBeforeInit(t *testing.T) {
+	logPath := useFakeTerraform(t)
+	// Record the backend bucket in the configuration every time terraform init runs.
+	script := "#!/bin/sh\necho \"$@\" >> " + logPath + "\nif [ \"$1\" = init ]; then grep -h 'bucket' *.tf >> " + logPath + " || echo 'no bucket' >> " + logPath + "; fi\necho '{}'\n"
+	if err := os.WriteFile(terraformBin, []byte(script), 0755); err != nil {
+		t.Fatalf("unable to write fake terraform: %v", err)
+	}
+	dir := t.TempDir()
+	mainPath := path.Join(dir, "main.tf")
+	if err := os.WriteFile(mainPath, []byte("terraform {\n  backend \"gcs\" {}\n}\n"), 0644); err != nil {
+		t.Fatalf("unable to write main.tf: %v", err)
+	}
+	r := &renderer{params: &params{backendMode: backendModeMerge, backendBucket: "state-bucket", backendPrefix: "app/prod"}}
+
+	backendPath, err := r.prepareConfig(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("prepareConfig() failed: %v", err)
+	}
+	if backendPath != mainPath {
+		t.Errorf("prepareConfig() got backend path: %q, want: %q", backendPath, mainPath)
+	}
+	log, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("unable to read commands: %v", err)
+	}
+	var got []string
+	for _, l := range strings.Split(strings.TrimSpace(string(log)), "\n") {
+		got = append(got, strings.TrimSpace(l))
+	}
+	want := []string{
+		"init -no-color",
+		`bucket = "state-bucket"`,
+		"init -no-color",
+		`bucket = "state-bucket"`,
+		"validate -no-color",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("prepareConfig() commands got: %q, want: %q", got, want)
+	}
+}
+
+func TestDetermineParamsBackendMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		bucket  string
+		want    string
+		wantErr bool
+	}{
+		{name: "default", bucket: "b", want: backendModeGenerate},
+		{name: "merge", mode: backendModeMerge, bucket: "b", want: backendModeMerge},
+		{name: "use existing without bucket", mode: backendModeUseExisting, want: backendModeUseExisting},
+		{name: "merge without bucket", mode: backendModeMerge, wantErr: true},
+		{name: "invalid", mode: "replace", bucket: "b", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(backendBucketEnvKey, tc.bucket)
+			t.Setenv(backendPrefixEnvKey, "prefix")
+			if len(tc.mode) != 0 {
+				t.Setenv(backendModeEnvKey, tc.mode)
+			}
+			p, err := determineParams()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("determineParams() error: %v, wantErr: %t", err, tc.wantErr)
+			}
+			if err == nil && p.backendMode != tc.want {
+				t.Errorf("determineParams() backendMode got: %q, want: %q", p.backendMode, tc.want)
+			}
+		})
+	}
+}
+
+func TestPlanSummary(t *testing.T) {
+	req := &clouddeploy.RenderRequest{Pipeline: "my-pipeline", Release: "rel-1", Target: "prod"}
+	tests := []struct {
+		name        string
+		plan        string
+		wantChanges string
+	}{
+		{
+			name:        "changes",
+			plan:        "Terraform will perform the following actions:\n\n  # google_storage_bucket.b will be created\n\nPlan: 1 to add, 0 to change, 0 to destroy.\n",
+			wantChanges: "**Plan: 1 to add, 0 to change, 0 to destroy.**\n\n",
+		},
+		{
+			name:        "no changes",
+			plan:        "No changes. Your infrastructure matches the configuration.\n",
+			wantChanges: "**No changes. Your infrastructure matches the configuration.**\n\n",
+		},
+		{
+			name: "no summary line",
+			plan: "Changes to Outputs:\n  + name = \"x\"\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := string(planSummary(req, []byte(tc.plan)))
+			want := "### Terraform plan for target `prod`\n\n" +
+				"Speculative plan generated when rendering release `rel-1` of delivery pipeline `my-pipeline`. This plan is not used when applying the Terraform configuration.\n\n" +
+				tc.wantChanges +
+				"<details><summary>Show plan</summary>\n\n```\n" + strings.TrimSpace(tc.plan) + "\n```\n\n</details>\n"
+			if got != want {
+				t.Errorf("planSummary() got:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestCreateReleaseInspectorArtifact(t *testing.T) {
+	dir := t.TempDir()
+	autoVarsPath := path.Join(dir, autoTFVarsFileName)
+	if err := os.WriteFile(autoVarsPath, []byte("region = \"us-central1\"\n"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	backendPath := path.Join(dir, backendFileName)
+	backend := "terraform {\n  backend \"gcs\" {\n    bucket = \"my-bucket\"\n    prefix = \"my-prefix\"\n  }\n}\n"
+	if err := os.WriteFile(backendPath, []byte(backend), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	tests := []struct {
+		name        string
+		backendPath string
+		want        []string
+		wantAbsent  []string
+	}{
+		{
+			name:       "backend not included",
+			want:       []string{"region = \"us-central1\""},
+			wantAbsent: []string{"backend configuration", "my-bucket"},
+		},
+		{
+			name:        "backend included",
+			backendPath: backendPath,
+			want:        []string{"region = \"us-central1\"", "---\n# Terraform backend configuration from backend.tf", "bucket = \"my-bucket\"", "prefix = \"my-prefix\""},
+		},
+		{
+			name:        "backend file missing",
+			backendPath: path.Join(t.TempDir(), backendFileName),
+			want:        []string{"has no backend.tf file"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dstPath := path.Join(t.TempDir(), "manifest.tf")
+			if err := createReleaseInspectorArtifact(autoVarsPath, tc.backendPath, []byte("plan"), dstPath); err != nil {
+				t.Fatalf("createReleaseInspectorArtifact() failed: %v", err)
+			}
+			data, err := os.ReadFile(dstPath)
+			if err != nil {
+				t.Fatalf("failed to read file: %v", err)
+			}
+			got := string(data)
+			for _, w := range tc.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("got: %q, want it to contain: %q", got, w)
+				}
+			}
+			for _, w := range tc.wantAbsent {
+				if strings.Contains(got, w) {
+					t.Errorf("got: %q, want it to not contain: %q", got, w)
+				}
+			}
+			// The plan is still the last section.
+			if !strings.HasSuffix(got, "plan") {
+				t.Errorf("got: %q, want it to end with the plan", got)
+			}
+		})
+	}
+}
+
+func TestValidateExcludePatterns(t *testing.T) {
+	tests := []struct {
+		name       string
+		patterns   []string
+		configPath string
+		wantErr    bool
+	}{
+		{name: "none"},
+		{name: "valid", patterns: []string{".git", "*.tfstate", "modules/*/test"}},
+		{name: "malformed", patterns: []string{"[a-"}, wantErr: true},
+		{name: "absolute", patterns: []string{"/etc"}, wantErr: true},
+		{name: "parent", patterns: []string{"../config"}, wantErr: true},
+		{name: "not clean", patterns: []string{"modules//test"}, wantErr: true},
+		{name: "backend file", patterns: []string{"backend.tf"}, wantErr: true},
+		{name: "generated variables", patterns: []string{"*.tfvars"}, wantErr: true},
+		{name: "lock file", patterns: []string{".terraform*"}, wantErr: true},
+		{name: "everything", patterns: []string{"*"}, wantErr: true},
+		{name: "configuration directory", patterns: []string{"env/prod"}, configPath: "env/prod", wantErr: true},
+		{name: "generated file in configuration directory", patterns: []string{"env/prod/clouddeploy.auto.tfvars"}, configPath: "/env/prod", wantErr: true},
+		{name: "other configuration directory", patterns: []string{"env/dev"}, configPath: "env/prod"},
+		{name: "backend file name with configuration directory", patterns: []string{"backend.tf"}, configPath: "env/prod", wantErr: true},
+		{name: "backend file in other configuration directory", patterns: []string{"env/dev/backend.tf"}, configPath: "env/prod"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateExcludePatterns(tc.patterns, tc.configPath)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("validateExcludePatterns() got err: %v, want err: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestArchiveDirExclude(t *testing.T) {
+	files := []string{
+		"main.tf",
+		".git/HEAD",
+		"terraform.tfstate",
+		"modules/network/main.tf",
+		"modules/network/.git/HEAD",
+		"modules/network/test/fixture.json",
+		"modules/network/tests/main.tftest.hcl",
+	}
+	srcDir := t.TempDir()
+	for _, name := range files {
+		p := path.Join(srcDir, name)
+		if err := os.MkdirAll(path.Dir(p), os.ModePerm); err != nil {
+			t.Fatalf("unable to create directory: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+	}
+	archivePath := path.Join(t.TempDir(), renderedArchiveName(archiveFormatTarGz))
+	if err := archiveDir(srcDir, archivePath, archiveFormatTarGz, []string{".git", "*.tfstate", "modules/*/test"}); err != nil {
+		t.Fatalf("archiveDir() failed: %v", err)
+	}
+	destDir := path.Join(t.TempDir(), "source")
+	if err := unarchiveRenderedArchive(archivePath, destDir); err != nil {
+		t.Fatalf("unarchiveRenderedArchive() failed: %v", err)
+	}
+	want := map[string]bool{
+		"main.tf":                               true,
+		".git/HEAD":                             false,
+		"terraform.tfstate":                     false,
+		"modules/network/main.tf":               true,
+		"modules/network/.git/HEAD":             false,
+		"modules/network/test/fixture.json":     false,
+		"modules/network/tests/main.tftest.hcl": true,
+	}
+	for name, wantIncluded := range want {
+		_, err := os.Stat(path.Join(destDir, name))
+		if got := err == nil; got != wantIncluded {
+			t.Errorf("%s in archive got: %v, want: %v", name, got, wantIncluded)
+		}
+	}
+	// The excluded paths are only left out of the archive, not deleted from the source.
+	for _, name := range files {
+		if _, err := os.Stat(path.Join(srcDir, name)); err != nil {
+			t.Errorf("%s in source got err: %v, want: nil", name, err)
+		}
+	}
+}
@@ -15,26 +15,222 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
 )
 
 const (
+	// cmdWaitDelay is how long an interrupted command has to exit, and for its output to be closed, before
+	// it's killed. Terraform uses this time to stop gracefully and release the state lock.
+	cmdWaitDelay = 30 * time.Second
+	// Number of times terraform init is run when it fails to acquire the state lock and the tfInitLockTimeout
+	// param is set.
+	initLockAttempts = 3
+)
+
+var (
+	// Path to the Terraform binary used for all commands. Defaults to the binary bundled in the image
+	// and is replaced by useTerraformVersion when a specific version is requested.
 	terraformBin = "terraform"
+	// Base URL to download Terraform releases from.
+	terraformReleasesURL = "https://releases.hashicorp.com/terraform"
+	// Path to HashiCorp's public PGP key, added to the image at build time, that signs the checksums of
+	// every Terraform release.
+	hashicorpKeyPath = "/etc/hashicorp/hashicorp.asc"
+	// terraformVersionRegex matches a Terraform release version, e.g. 1.5.7 or 1.6.0-beta1.
+	terraformVersionRegex = regexp.MustCompile(`^\d+\.\d+\.\d+(-[0-9A-Za-z.]+)?$`)
+	// How long to wait before running terraform init again after it failed to acquire the state lock.
+	initLockRetryDelay = 15 * time.Second
 )
 
+// useTerraformVersion sets the Terraform binary used for all commands to the provided version, installing
+// it in a temporary directory. If the version is empty then the bundled binary is used.
+func useTerraformVersion(ctx context.Context, version string) error {
+	bin, err := resolveTerraformBin(ctx, version, os.TempDir(), installTerraform)
+	if err != nil {
+		return err
+	}
+	terraformBin = bin
+	return nil
+}
+
+// resolveTerraformBin returns the path to the Terraform binary for the provided version, calling the install
+// function to install the version in the provided directory. Each render and deploy runs in a new container,
+// so the version is installed every time rather than cached.
+func resolveTerraformBin(ctx context.Context, version, installDir string, install func(ctx context.Context, version, dstPath string) error) (string, error) {
+	if len(version) == 0 {
+		return terraformBin, nil
+	}
+	if !terraformVersionRegex.MatchString(version) {
+		return "", fmt.Errorf("invalid terraform version %q, expected a release version such as 1.5.7", version)
+	}
+	binPath := filepath.Join(installDir, "terraform-"+version, "terraform")
+	fmt.Printf("Installing Terraform %s to %s\n", version, binPath)
+	if err := install(ctx, version, binPath); err != nil {
+		return "", fmt.Errorf("unable to install terraform version %s: %v", version, err)
+	}
+	return binPath, nil
+}
+
+// installTerraform downloads the Terraform release for the provided version, verifies the release
+// checksums are signed by HashiCorp and match the release, and extracts the binary to the provided path.
+func installTerraform(ctx context.Context, version, dstPath string) error {
+	zipName := fmt.Sprintf("terraform_%s_%s_%s.zip", version, runtime.GOOS, runtime.GOARCH)
+	sumsURL := fmt.Sprintf("%s/%s/terraform_%s_SHA256SUMS", terraformReleasesURL, version, version)
+	sums, err := httpGet(ctx, sumsURL)
+	if err != nil {
+		return fmt.Errorf("unable to download checksums: %v", err)
+	}
+	sig, err := httpGet(ctx, sumsURL+".sig")
+	if err != nil {
+		return fmt.Errorf("unable to download checksums signature: %v", err)
+	}
+	if err := verifyChecksumsSignature(sums, sig); err != nil {
+		return err
+	}
+	wantSum, err := releaseChecksum(sums, zipName)
+	if err != nil {
+		return err
+	}
+	archive, err := httpGet(ctx, fmt.Sprintf("%s/%s/%s", terraformReleasesURL, version, zipName))
+	if err != nil {
+		return fmt.Errorf("unable to download release: %v", err)
+	}
+	if gotSum := fmt.Sprintf("%x", sha256.Sum256(archive)); gotSum != wantSum {
+		return fmt.Errorf("checksum mismatch for %s, got %s, want %s", zipName, gotSum, wantSum)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return fmt.Errorf("unable to read release archive: %v", err)
+	}
+	for _, f := range zr.File {
+		if f.Name != "terraform" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("unable to open terraform binary in release archive: %v", err)
+		}
+		defer rc.Close()
+		if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+			return err
+		}
+		// Write to a temporary file first so a partial install is never used as a cached binary.
+		tmpPath := dstPath + ".tmp"
+		out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, rc); err != nil {
+			out.Close()
+			return fmt.Errorf("unable to extract terraform binary: %v", err)
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		return os.Rename(tmpPath, dstPath)
+	}
+	return fmt.Errorf("release archive %s does not contain a terraform binary", zipName)
+}
+
+// verifyChecksumsSignature verifies the detached signature of a SHA256SUMS file was made with HashiCorp's key.
+func verifyChecksumsSignature(sums, sig []byte) error {
+	key, err := os.Open(hashicorpKeyPath)
+	if err != nil {
+		return fmt.Errorf("unable to open hashicorp public key: %v", err)
+	}
+	defer key.Close()
+	keyring, err := openpgp.ReadArmoredKeyRing(key)
+	if err != nil {
+		return fmt.Errorf("unable to read hashicorp public key: %v", err)
+	}
+	if _, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(sums), bytes.NewReader(sig)); err != nil {
+		return fmt.Errorf("invalid checksums signature: %v", err)
+	}
+	return nil
+}
+
+// releaseChecksum returns the checksum for the provided file name from the contents of a SHA256SUMS file.
+func releaseChecksum(sums []byte, fileName string) (string, error) {
+	for _, l := range strings.Split(string(sums), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) == 2 && fields[1] == fileName {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("no checksum found for %s", fileName)
+}
+
+// httpGet returns the body of a GET request to the provided URL.
+func httpGet(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned status %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
 // terraformInitOptions configures the args provided to `terraform init`.
 type terraformInitOptions struct {
 	disableBackendInitialization bool
 	disableModuleDownloads       bool
+	// Duration to retry a state lock held while initializing the backend. When set, init is also run
+	// again if it still fails to acquire the lock.
+	lockTimeout string
+	// Writer the stdout and stderr of the command are also written to, if set.
+	log io.Writer
+}
+
+// terraformInit runs `terraform init` in the provided directory. If a lock timeout is set and init fails
+// to acquire the state lock, it's run again up to initLockAttempts times in total.
+func terraformInit(ctx context.Context, workingDir string, opts *terraformInitOptions) ([]byte, error) {
+	args := initArgs(opts)
+	attempts := 1
+	if len(opts.lockTimeout) != 0 {
+		attempts = initLockAttempts
+	}
+	for attempt := 1; ; attempt++ {
+		fmt.Printf("Running terraform init in %s\n", workingDir)
+		out, err := runCmd(ctx, terraformBin, args, false, setWorkingDir(workingDir), teeOutput(opts.log))
+		if err == nil || attempt >= attempts || !isStateLockError(err) {
+			return out, err
+		}
+		fmt.Printf("Terraform init failed to acquire the state lock, retrying in %s (attempt %d of %d)\n", initLockRetryDelay, attempt+1, attempts)
+		select {
+		case <-ctx.Done():
+			return out, err
+		case <-time.After(initLockRetryDelay):
+		}
+	}
 }
 
-// terraformInit runs `terraform init` in the provided directory.
-func terraformInit(workingDir string, opts *terraformInitOptions) ([]byte, error) {
+// initArgs returns the args for `terraform init` based on the provided options.
+func initArgs(opts *terraformInitOptions) []string {
 	args := []string{"init", "-no-color"}
 	if opts.disableBackendInitialization {
 		args = append(args, "-backend=false")
@@ -42,42 +238,129 @@ func terraformInit(workingDir string, opts *terraformInitOptions) ([]byte, error
 	if opts.disableModuleDownloads {
 		args = append(args, "-get=false")
 	}
-	fmt.Printf("Running terraform init in %s\n", workingDir)
-	return runCmd(terraformBin, args, false, setWorkingDir(workingDir))
+	if len(opts.lockTimeout) != 0 {
+		args = append(args, fmt.Sprintf("-lock-timeout=%s", opts.lockTimeout))
+	}
+	return args
+}
+
+// isStateLockError returns whether the error of a Terraform command is due to failing to acquire the state
+// lock, which is held by another operation and may be released by the time the command is run again.
+func isStateLockError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Error acquiring the state lock")
 }
 
 // terraformValidate runs `terraform validate` in the provided directory.
-func terraformValidate(workingDir string) ([]byte, error) {
+func terraformValidate(ctx context.Context, workingDir string) ([]byte, error) {
 	args := []string{"validate", "-no-color"}
 	fmt.Printf("Running terraform validate in %s\n", workingDir)
-	return runCmd(terraformBin, args, false, setWorkingDir(workingDir))
+	return runCmd(ctx, terraformBin, args, false, setWorkingDir(workingDir))
 }
 
 // terraformPlan runs `terraform plan` in the provided directory and creates the
 // plan in the working directory with the provided file name.
-func terraformPlan(workingDir, planFile string) ([]byte, error) {
+func terraformPlan(ctx context.Context, workingDir, planFile string) ([]byte, error) {
 	args := []string{"plan", "-no-color", fmt.Sprintf("-out=%s", planFile)}
 	fmt.Printf("Running terraform plan in %s\n", workingDir)
-	return runCmd(terraformBin, args, false, setWorkingDir(workingDir))
+	return runCmd(ctx, terraformBin, args, false, setWorkingDir(workingDir))
+}
+
+// terraformPlanHasChanges runs `terraform plan -detailed-exitcode` in the provided directory without
+// persisting the plan and returns whether the plan contains changes.
+func terraformPlanHasChanges(ctx context.Context, workingDir string, lockTimeout string) (bool, error) {
+	args := []string{"plan", "-no-color", "-detailed-exitcode"}
+	if len(lockTimeout) != 0 {
+		args = append(args, fmt.Sprintf("-lock-timeout=%s", lockTimeout))
+	}
+	fmt.Printf("Running terraform plan with detailed exit code in %s\n", workingDir)
+	_, err := runCmd(ctx, terraformBin, args, false, setWorkingDir(workingDir))
+	return planHasChanges(err)
+}
+
+// terraformPlanCheck runs `terraform plan` in the provided directory without persisting the plan, to verify
+// that the configuration can be planned before applying it.
+func terraformPlanCheck(ctx context.Context, workingDir string, lockTimeout string, log io.Writer) ([]byte, error) {
+	args := []string{"plan", "-no-color", "-input=false"}
+	if len(lockTimeout) != 0 {
+		args = append(args, fmt.Sprintf("-lock-timeout=%s", lockTimeout))
+	}
+	fmt.Printf("Running terraform plan before apply in %s\n", workingDir)
+	return runCmd(ctx, terraformBin, args, false, setWorkingDir(workingDir), teeOutput(log))
+}
+
+// planHasChanges interprets the error returned from running `terraform plan -detailed-exitcode`.
+// Exit code 0 means the plan succeeded with no changes, exit code 2 means the plan succeeded with
+// changes, and any other exit code means the plan failed.
+func planHasChanges(err error) (bool, error) {
+	if err == nil {
+		return false, nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+		return true, nil
+	}
+	return false, err
+}
+
+// fmtCheckArgs returns the args for `terraform fmt` to list the unformatted files in a directory
+// and its subdirectories without modifying them.
+func fmtCheckArgs() []string {
+	return []string{"fmt", "-check", "-recursive", "-list=true", "-no-color"}
+}
+
+// terraformFmtCheck runs `terraform fmt -check` in the provided directory and returns the paths,
+// relative to the directory, of the files that aren't formatted.
+func terraformFmtCheck(ctx context.Context, workingDir string) ([]string, error) {
+	fmt.Printf("Running terraform fmt check in %s\n", workingDir)
+	out, err := runCmd(ctx, terraformBin, fmtCheckArgs(), false, setWorkingDir(workingDir))
+	files := parseFmtCheckOutput(out)
+	if err != nil {
+		// The check exits with a non-zero code when there are unformatted files, any other
+		// failure, e.g. invalid syntax, doesn't list files.
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(files) != 0 {
+			return files, nil
+		}
+		return nil, err
+	}
+	return files, nil
+}
+
+// parseFmtCheckOutput parses the output of `terraform fmt -check -list=true`, which is a file path per line.
+func parseFmtCheckOutput(out []byte) []string {
+	var files []string
+	for _, l := range strings.Split(string(out), "\n") {
+		if l = strings.TrimSpace(l); len(l) != 0 {
+			files = append(files, l)
+		}
+	}
+	return files
 }
 
 // terraformShowPlan runs `terraform show` in the provided directory for a provided
 // plan file. The output from this command is not written to stdout.
-func terraformShowPlan(workingDir, planFile string) ([]byte, error) {
+func terraformShowPlan(ctx context.Context, workingDir, planFile string) ([]byte, error) {
 	args := []string{"show", "-no-color", planFile}
 	fmt.Printf("Running terraform show plan in %s\n", workingDir)
-	return runCmd(terraformBin, args, true, setWorkingDir(workingDir))
+	return runCmd(ctx, terraformBin, args, true, setWorkingDir(workingDir))
 }
 
 // terraformApplyOptions configures the args provided to `terraform apply`.
 type terraformApplyOptions struct {
 	applyParallelism int
 	lockTimeout      string
+	// Only update the state to match the real infrastructure, without changing it.
+	refreshOnly bool
+	// Writer the stdout and stderr of the command are also written to, if set.
+	log io.Writer
 }
 
 // terraformApply runs `terraform apply` in the provided directory.
-func terraformApply(workingDir string, opts *terraformApplyOptions) ([]byte, error) {
+func terraformApply(ctx context.Context, workingDir string, opts *terraformApplyOptions) ([]byte, error) {
 	args := []string{"apply", "-auto-approve", "-no-color"}
+	if opts.refreshOnly {
+		args = append(args, "-refresh-only")
+	}
 	if len(opts.lockTimeout) != 0 {
 		args = append(args, fmt.Sprintf("-lock-timeout=%s", opts.lockTimeout))
 	}
@@ -85,18 +368,46 @@ func terraformApply(workingDir string, opts *terraformApplyOptions) ([]byte, err
 		args = append(args, fmt.Sprintf("-parallelism=%d", opts.applyParallelism))
 	}
 	fmt.Printf("Running terraform apply in %s\n", workingDir)
-	return runCmd(terraformBin, args, false, setWorkingDir(workingDir))
+	return runCmd(ctx, terraformBin, args, false, setWorkingDir(workingDir), teeOutput(opts.log))
+}
+
+// terraformWarningRegex matches the summary line of a warning diagnostic in the output of a Terraform command
+// run with -no-color, optionally prefixed by the border Terraform draws around diagnostics.
+var terraformWarningRegex = regexp.MustCompile(`^[│╷|\s]*Warning: (.+)$`)
+
+// parseTerraformWarnings returns the summaries of the warning diagnostics in the output of a Terraform
+// command, in order and without duplicates. Terraform writes warnings to stdout and errors to stderr.
+func parseTerraformWarnings(out []byte) []string {
+	var warnings []string
+	seen := make(map[string]bool)
+	for _, l := range strings.Split(string(out), "\n") {
+		m := terraformWarningRegex.FindStringSubmatch(strings.TrimRight(l, " \r"))
+		if len(m) == 0 {
+			continue
+		}
+		w := strings.TrimSpace(m[1])
+		if seen[w] {
+			continue
+		}
+		seen[w] = true
+		warnings = append(warnings, w)
+	}
+	return warnings
 }
 
-// terraformShowState runs `terraform show` in the provided directory. The output
-// from this command is not written to stdout.
-func terraformShowState(workingDir string) ([]byte, error) {
+// terraformShowState runs `terraform show` in the provided directory and formats the
+// state based on the tfStateFormat parameter. The output from this command is not
+// written to stdout.
+func terraformShowState(ctx context.Context, workingDir, format string) ([]byte, error) {
 	args := []string{"show", "-json"}
 	fmt.Printf("Running terraform show in %s\n", workingDir)
-	out, err := runCmd(terraformBin, args, true, setWorkingDir(workingDir))
+	out, err := runCmd(ctx, terraformBin, args, true, setWorkingDir(workingDir))
 	if err != nil {
 		return nil, err
 	}
+	if format == stateFormatCompact {
+		return compactJSON(out)
+	}
 	return addIndentationToJSON(out)
 }
 
@@ -110,6 +421,15 @@ func addIndentationToJSON(in []byte) ([]byte, error) {
 	return pjson.Bytes(), nil
 }
 
+// compactJSON returns a copy of the provided JSON with insignificant whitespace removed.
+func compactJSON(in []byte) ([]byte, error) {
+	var cjson bytes.Buffer
+	if err := json.Compact(&cjson, in); err != nil {
+		return nil, fmt.Errorf("error compacting json: %v", err)
+	}
+	return cjson.Bytes(), nil
+}
+
 // commandOption configures an exec.Cmd object with additional options.
 type commandOption func(ce *exec.Cmd)
 
@@ -120,11 +440,28 @@ func setWorkingDir(workingDir string) commandOption {
 	}
 }
 
-// runCmd starts and waits for the provided command with args to complete. If the command
-// succeeds it returns the stdout of the command.
-func runCmd(binPath string, args []string, closeOSStdout bool, options ...commandOption) ([]byte, error) {
+// teeOutput returns a commandOption for also writing the stdout and stderr of the command to the provided
+// writer, e.g. to keep a log of the command. It's a no-op if the writer is nil.
+func teeOutput(w io.Writer) commandOption {
+	return func(cmd *exec.Cmd) {
+		if w == nil {
+			return
+		}
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, w)
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, w)
+	}
+}
+
+// runCmd starts and waits for the provided command with args to complete. The command is interrupted
+// if the provided context is done before it completes, and killed if it hasn't exited after cmdWaitDelay. It returns the stdout of the command, which
+// is also returned alongside the error if the command fails after starting.
+func runCmd(ctx context.Context, binPath string, args []string, closeOSStdout bool, options ...commandOption) ([]byte, error) {
 	fmt.Printf("Running the following command: %s %s\n", binPath, args)
-	cmd := exec.Command(binPath, args...)
+	cmd := exec.CommandContext(ctx, binPath, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = cmdWaitDelay
 
 	var stderr bytes.Buffer
 	cmd.Stderr = io.MultiWriter(&stderr, os.Stderr)
@@ -144,7 +481,7 @@ func runCmd(binPath string, args []string, closeOSStdout bool, options ...comman
 		return nil, fmt.Errorf("failed to start command: %v", err)
 	}
 	if err := cmd.Wait(); err != nil {
-		return nil, fmt.Errorf("error running command: %v\n%s", err, stderr.Bytes())
+		return stdout.Bytes(), fmt.Errorf("error running command: %w\n%s", err, stderr.Bytes())
 	}
 	return stdout.Bytes(), nil
 }
@@ -0,0 +1,406 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func TestPlanHasChanges(t *testing.T) {
+	tests := []struct {
+		name        string
+		exitCode    int
+		wantChanges bool
+		wantErr     bool
+	}{
+		{name: "no changes", exitCode: 0, wantChanges: false},
+		{name: "plan failed", exitCode: 1, wantErr: true},
+		{name: "changes present", exitCode: 2, wantChanges: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := runCmd(context.Background(), "sh", []string{"-c", fmt.Sprintf("exit %d", tc.exitCode)}, true)
+			changes, err := planHasChanges(err)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("planHasChanges() error: %v, wantErr: %t", err, tc.wantErr)
+			}
+			if changes != tc.wantChanges {
+				t.Errorf("planHasChanges() got: %t, want: %t", changes, tc.wantChanges)
+			}
+		})
+	}
+}
+
+func TestInitArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *terraformInitOptions
+		want []string
+	}{
+		{
+			name: "defaults",
+			opts: &terraformInitOptions{},
+			want: []string{"init", "-no-color"},
+		},
+		{
+			name: "lock timeout",
+			opts: &terraformInitOptions{lockTimeout: "2m"},
+			want: []string{"init", "-no-color", "-lock-timeout=2m"},
+		},
+		{
+			name: "providers only",
+			opts: &terraformInitOptions{disableBackendInitialization: true, disableModuleDownloads: true},
+			want: []string{"init", "-no-color", "-backend=false", "-get=false"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := initArgs(tc.opts); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("initArgs() got: %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIsStateLockError(t *testing.T) {
+	_, lockErr := runCmd(context.Background(), "sh", []string{"-c", "echo 'Error: Error acquiring the state lock' >&2; exit 1"}, true)
+	_, otherErr := runCmd(context.Background(), "sh", []string{"-c", "echo 'Error: Failed to get existing workspaces' >&2; exit 1"}, true)
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "lock error", err: lockErr, want: true},
+		{name: "other error", err: otherErr, want: false},
+		{name: "no error", err: nil, want: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isStateLockError(tc.err); got != tc.want {
+				t.Errorf("isStateLockError() got: %t, want: %t", got, tc.want)
+			}
+		})
+	}
+}
+
+// useFlakyInit makes the fake terraform fail init with the provided error the first failures times.
+func useFlakyInit(t *testing.T, failures int, errMsg string) string {
+	t.Helper()
+	logPath := useFakeTerraform(t)
+	orig := initLockRetryDelay
+	initLockRetryDelay = 0
+	t.Cleanup(func() { initLockRetryDelay = orig })
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %[1]s\nif [ $(wc -l < %[1]s) -le %[2]d ]; then echo 'Error: %[3]s' >&2; exit 1; fi\necho '{}'\n", logPath, failures, errMsg)
+	if err := os.WriteFile(terraformBin, []byte(script), 0755); err != nil {
+		t.Fatalf("unable to write fake terraform: %v", err)
+	}
+	return logPath
+}
+
+func TestTerraformInitRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         *terraformInitOptions
+		failures     int
+		errMsg       string
+		wantAttempts int
+		wantErr      bool
+	}{
+		{
+			name:         "lock released",
+			opts:         &terraformInitOptions{lockTimeout: "1m"},
+			failures:     2,
+			errMsg:       "Error acquiring the state lock",
+			wantAttempts: 3,
+		},
+		{
+			name:         "lock held",
+			opts:         &terraformInitOptions{lockTimeout: "1m"},
+			failures:     3,
+			errMsg:       "Error acquiring the state lock",
+			wantAttempts: 3,
+			wantErr:      true,
+		},
+		{
+			name:         "other error",
+			opts:         &terraformInitOptions{lockTimeout: "1m"},
+			failures:     1,
+			errMsg:       "Failed to get existing workspaces",
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+		{
+			name:         "no lock timeout",
+			opts:         &terraformInitOptions{},
+			failures:     1,
+			errMsg:       "Error acquiring the state lock",
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logPath := useFlakyInit(t, tc.failures, tc.errMsg)
+			_, err := terraformInit(context.Background(), t.TempDir(), tc.opts)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("terraformInit() got err: %v, want err: %t", err, tc.wantErr)
+			}
+			log, err := os.ReadFile(logPath)
+			if err != nil {
+				t.Fatalf("unable to read commands: %v", err)
+			}
+			if got := len(strings.Split(strings.TrimSpace(string(log)), "\n")); got != tc.wantAttempts {
+				t.Errorf("terraformInit() ran %d times, want: %d", got, tc.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestPlanHasChangesNonExitError(t *testing.T) {
+	if _, err := planHasChanges(errors.New("failed to start command")); err == nil {
+		t.Errorf("planHasChanges() succeeded, want error")
+	}
+}
+
+func TestFmtCheckArgs(t *testing.T) {
+	got := strings.Join(fmtCheckArgs(), " ")
+	want := "fmt -check -recursive -list=true -no-color"
+	if got != want {
+		t.Errorf("fmtCheckArgs() got: %q, want: %q", got, want)
+	}
+}
+
+func TestParseFmtCheckOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []string
+	}{
+		{name: "formatted", out: "", want: nil},
+		{name: "unformatted", out: "main.tf\nmodules/network/variables.tf\n", want: []string{"main.tf", "modules/network/variables.tf"}},
+		{name: "blank lines", out: "\nmain.tf\n\n", want: []string{"main.tf"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseFmtCheckOutput([]byte(tc.out))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseFmtCheckOutput() got: %v, want: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// applyOutputWithWarnings is the stdout of a `terraform apply -no-color` that succeeded with warnings.
+const applyOutputWithWarnings = `google_storage_bucket.b: Modifying... [id=my-bucket]
+google_storage_bucket.b: Modifications complete after 1s [id=my-bucket]
+
+Warning: Argument is deprecated
+
+  with google_container_cluster.c,
+  on main.tf line 12, in resource "google_container_cluster" "c":
+  12:   enable_binary_authorization = true
+
+Use binary_authorization.evaluation_mode instead.
+
+(and one more similar warning elsewhere)
+
+Warning: Value for undeclared variable
+
+The root module does not declare a variable named "replica" but a value was
+found in file "clouddeploy.auto.tfvars".
+
+╷
+│ Warning: Argument is deprecated
+│
+│ Use binary_authorization.evaluation_mode instead.
+╵
+
+Apply complete! Resources: 0 added, 1 changed, 0 destroyed.
+`
+
+func TestParseTerraformWarnings(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []string
+	}{
+		{
+			name: "no warnings",
+			out:  "Apply complete! Resources: 1 added, 0 changed, 0 destroyed.\n",
+			want: nil,
+		},
+		{
+			name: "warnings",
+			out:  applyOutputWithWarnings,
+			want: []string{"Argument is deprecated", "Value for undeclared variable"},
+		},
+		{
+			name: "warning mentioned in a resource attribute",
+			out:  "  + description = \"Warning: not a diagnostic\"\n",
+			want: nil,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseTerraformWarnings([]byte(tc.out))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseTerraformWarnings() got: %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveTerraformBin(t *testing.T) {
+	installDir := t.TempDir()
+	tests := []struct {
+		name        string
+		version     string
+		installErr  error
+		want        string
+		wantInstall bool
+		wantErr     bool
+	}{
+		{name: "bundled", version: "", want: terraformBin},
+		{name: "install", version: "1.6.0-beta1", want: filepath.Join(installDir, "terraform-1.6.0-beta1", "terraform"), wantInstall: true},
+		{name: "install fails", version: "1.4.0", installErr: errors.New("not found"), wantInstall: true, wantErr: true},
+		{name: "invalid", version: "latest", wantErr: true},
+		{name: "path traversal", version: "../1.5.7", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			installed := false
+			install := func(ctx context.Context, version, dstPath string) error {
+				installed = true
+				return tc.installErr
+			}
+			got, err := resolveTerraformBin(context.Background(), tc.version, installDir, install)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("resolveTerraformBin() error: %v, wantErr: %t", err, tc.wantErr)
+			}
+			if installed != tc.wantInstall {
+				t.Errorf("resolveTerraformBin() installed: %t, want: %t", installed, tc.wantInstall)
+			}
+			if got != tc.want {
+				t.Errorf("resolveTerraformBin() got: %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// useTestSigningKey replaces HashiCorp's public key with the public key of a new test entity, which is
+// returned so the test can sign checksums with it.
+func useTestSigningKey(t *testing.T) *openpgp.Entity {
+	t.Helper()
+	e, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("unable to create signing key: %v", err)
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("unable to armor public key: %v", err)
+	}
+	if err := e.Serialize(w); err != nil {
+		t.Fatalf("unable to serialize public key: %v", err)
+	}
+	w.Close()
+	keyPath := filepath.Join(t.TempDir(), "hashicorp.asc")
+	if err := os.WriteFile(keyPath, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("unable to write public key: %v", err)
+	}
+	orig := hashicorpKeyPath
+	hashicorpKeyPath = keyPath
+	t.Cleanup(func() { hashicorpKeyPath = orig })
+	return e
+}
+
+func TestInstallTerraform(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("terraform")
+	if err != nil {
+		t.Fatalf("unable to create zip entry: %v", err)
+	}
+	w.Write([]byte("#!/bin/sh\n"))
+	zw.Close()
+	archive := buf.Bytes()
+	zipName := fmt.Sprintf("terraform_1.5.7_%s_%s.zip", runtime.GOOS, runtime.GOARCH)
+	signer := useTestSigningKey(t)
+	other, err := openpgp.NewEntity("other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatalf("unable to create signing key: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		sum     string
+		signer  *openpgp.Entity
+		wantErr bool
+	}{
+		{name: "valid checksum", sum: fmt.Sprintf("%x", sha256.Sum256(archive)), signer: signer},
+		{name: "checksum mismatch", sum: fmt.Sprintf("%x", sha256.Sum256([]byte("other"))), signer: signer, wantErr: true},
+		{name: "signed with another key", sum: fmt.Sprintf("%x", sha256.Sum256(archive)), signer: other, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sums := fmt.Sprintf("%s  %s\n", tc.sum, zipName)
+			var sig bytes.Buffer
+			if err := openpgp.DetachSign(&sig, tc.signer, strings.NewReader(sums), nil); err != nil {
+				t.Fatalf("unable to sign checksums: %v", err)
+			}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/1.5.7/terraform_1.5.7_SHA256SUMS":
+					w.Write([]byte(sums))
+				case "/1.5.7/terraform_1.5.7_SHA256SUMS.sig":
+					w.Write(sig.Bytes())
+				case "/1.5.7/" + zipName:
+					w.Write(archive)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer srv.Close()
+			orig := terraformReleasesURL
+			terraformReleasesURL = srv.URL
+			defer func() { terraformReleasesURL = orig }()
+
+			dst := filepath.Join(t.TempDir(), "1.5.7", "terraform")
+			err := installTerraform(context.Background(), "1.5.7", dst)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("installTerraform() error: %v, wantErr: %t", err, tc.wantErr)
+			}
+			_, statErr := os.Stat(dst)
+			if tc.wantErr != os.IsNotExist(statErr) {
+				t.Errorf("installTerraform() binary exists: %t, want: %t", statErr == nil, !tc.wantErr)
+			}
+		})
+	}
+}
@@ -72,10 +72,13 @@ boldout "This will take approximately 10 minutes"
 # get the commit hash to pass to the build
 COMMIT_SHA=$(git rev-parse --verify HEAD)
 
+# The Dockerfile path is relative to the source directory, which is the build context.
+DOCKERFILE="${_CT_DOCKERFILE:-Dockerfile}"
+
 CLOUDBUILD_YAML="$( cd "$( dirname "${BASH_SOURCE[0]}" )" &> /dev/null && pwd )/cloudbuild.yaml"
 # Using `beta` because the non-beta command won't stream the build logs
 gcloud -q beta builds submit --project="$PROJECT" --region="$REGION" \
-    --substitutions=_AR_REPO_NAME=cd-custom-targets,_IMAGE_NAME=${_CT_IMAGE_NAME},COMMIT_SHA="${COMMIT_SHA}" \
+    --substitutions=_AR_REPO_NAME=cd-custom-targets,_IMAGE_NAME=${_CT_IMAGE_NAME},_DOCKERFILE="${DOCKERFILE}",COMMIT_SHA="${COMMIT_SHA}" \
     --config="${CLOUDBUILD_YAML}" \
     "${_CT_SRCDIR}"
 
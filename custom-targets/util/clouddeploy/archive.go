@@ -0,0 +1,377 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import (
+	"archive/tar"
+	stdzip "archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zip"
+	"github.com/mholt/archiver/v3"
+)
+
+// Default limits applied when unarchiving the source archive.
+const (
+	// DefaultUnarchiveMaxTotalSize is the default maximum total uncompressed size in bytes.
+	DefaultUnarchiveMaxTotalSize int64 = 2 << 30
+	// DefaultUnarchiveMaxEntries is the default maximum number of entries.
+	DefaultUnarchiveMaxEntries = 100000
+)
+
+// UnarchiveLimits bounds the contents of an archive being unarchived to guard against decompression bombs.
+// Zero values are replaced with the defaults.
+type UnarchiveLimits struct {
+	// Maximum total uncompressed size in bytes of the files in the archive.
+	MaxTotalSize int64
+	// Maximum number of entries, i.e. files, directories and links, in the archive.
+	MaxEntries int
+}
+
+// withDefaults returns a copy of the limits with zero values replaced by the defaults.
+func (l UnarchiveLimits) withDefaults() UnarchiveLimits {
+	if l.MaxTotalSize == 0 {
+		l.MaxTotalSize = DefaultUnarchiveMaxTotalSize
+	}
+	if l.MaxEntries == 0 {
+		l.MaxEntries = DefaultUnarchiveMaxEntries
+	}
+	return l
+}
+
+// unarchiver tracks the entries and bytes unarchived against the limits.
+type unarchiver struct {
+	destPath string
+	limits   UnarchiveLimits
+	links    linkResolver
+	entries  int
+	size     int64
+}
+
+// unarchive unarchives the tar.gz or zip archive at the provided path into the destination directory. The
+// format is determined from the contents of the archive. An error is returned if the archive exceeds the limits.
+func unarchive(archivePath, destPath string, limits UnarchiveLimits) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return fmt.Errorf("unable to read archive %s: %v", archivePath, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	u := &unarchiver{destPath: destPath, limits: limits.withDefaults(), links: linkResolver{}}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return u.tarGz(f)
+	case bytes.Equal(magic, []byte("PK\x03\x04")):
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		return u.zip(f, fi.Size())
+	default:
+		return fmt.Errorf("archive %s is not a tar.gz or zip archive", archivePath)
+	}
+}
+
+// tarGz unarchives the tar.gz archive read from r.
+func (u *unarchiver) tarGz(r io.Reader) error {
+	gz, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return fmt.Errorf("unable to read gzip stream: %v", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return u.links.check()
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read tar entry: %v", err)
+		}
+		if err := u.countEntry(); err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			target, err := u.targetPath(hdr.Name)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(target, os.ModePerm); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			target, err := u.targetPath(hdr.Name)
+			if err != nil {
+				return err
+			}
+			if err := u.writeFile(target, tr, hdr.FileInfo().Mode()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			linkPath, err := u.links.add(hdr.Name, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			target := filepath.Join(u.destPath, filepath.FromSlash(linkPath))
+			if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			fmt.Printf("Skipping unsupported tar entry %s of type %c\n", hdr.Name, hdr.Typeflag)
+		}
+	}
+}
+
+// zip unarchives the zip archive read from r.
+func (u *unarchiver) zip(r io.ReaderAt, size int64) error {
+	zr, err := stdzip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("unable to read zip archive: %v", err)
+	}
+	for _, zf := range zr.File {
+		if err := u.countEntry(); err != nil {
+			return err
+		}
+		target, err := u.targetPath(zf.Name)
+		if err != nil {
+			return err
+		}
+		if zf.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, os.ModePerm); err != nil {
+				return err
+			}
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return fmt.Errorf("unable to open zip entry %s: %v", zf.Name, err)
+		}
+		err = u.writeFile(target, rc, zf.Mode())
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countEntry counts an entry against the maximum number of entries.
+func (u *unarchiver) countEntry() error {
+	u.entries++
+	if u.entries > u.limits.MaxEntries {
+		return fmt.Errorf("archive exceeds the maximum of %d entries", u.limits.MaxEntries)
+	}
+	return nil
+}
+
+// targetPath returns the path in the destination directory for the archive entry name, failing if it's
+// outside of the destination directory, e.g. "../../etc/passwd", an absolute path, or a path through links
+// created by earlier entries that point outside of it. The returned path doesn't go through any links.
+func (u *unarchiver) targetPath(name string) (string, error) {
+	p, err := u.links.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(u.destPath, filepath.FromSlash(p)), nil
+}
+
+// writeFile writes the contents read from r to the target path, counting the bytes written against
+// the maximum total size. The declared size of the entry isn't trusted.
+func (u *unarchiver) writeFile(target string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	remaining := u.limits.MaxTotalSize - u.size
+	n, err := io.CopyN(out, r, remaining+1)
+	u.size += n
+	if u.size > u.limits.MaxTotalSize {
+		return fmt.Errorf("archive exceeds the maximum total uncompressed size of %d bytes", u.limits.MaxTotalSize)
+	}
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("unable to write %s: %v", target, err)
+	}
+	return nil
+}
+
+// maxLinkDepth is the maximum number of symbolic links followed when resolving an archive entry name.
+const maxLinkDepth = 40
+
+// linkResolver keeps track of the symbolic links in an archive to resolve the archive entry names to their
+// location in the destination directory, the way the filesystem would once the entries are unarchived. Checking
+// the names alone isn't enough, e.g. with "a/l -> .." and "a/l/m -> ../.." the entry "a/l/m/file" is outside
+// of the destination directory even though none of the names are.
+type linkResolver map[string]string
+
+// resolve returns the slash separated path relative to the destination directory that the archive entry
+// name refers to after following the links, failing if it's outside of the destination directory.
+func (r linkResolver) resolve(name string) (string, error) {
+	p, err := r.resolveDepth(filepath.ToSlash(name), 0)
+	if err != nil {
+		return "", fmt.Errorf("archive entry %q is outside of the destination directory: %v", name, err)
+	}
+	return p, nil
+}
+
+// resolveDepth resolves the slash separated path, where depth is the number of links already followed.
+func (r linkResolver) resolveDepth(name string, depth int) (string, error) {
+	if depth > maxLinkDepth {
+		return "", fmt.Errorf("too many levels of symbolic links")
+	}
+	if path.IsAbs(name) {
+		return "", fmt.Errorf("%q is an absolute path", name)
+	}
+	var resolved []string
+	for _, part := range strings.Split(name, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if len(resolved) == 0 {
+				return "", fmt.Errorf("%q refers to the parent of the destination directory", name)
+			}
+			resolved = resolved[:len(resolved)-1]
+		default:
+			resolved = append(resolved, part)
+			target, ok := r[path.Join(resolved...)]
+			if !ok {
+				continue
+			}
+			p, err := r.resolveDepth(joinLink(path.Join(resolved[:len(resolved)-1]...), target), depth+1)
+			if err != nil {
+				return "", err
+			}
+			resolved = nil
+			if len(p) != 0 {
+				resolved = strings.Split(p, "/")
+			}
+		}
+	}
+	return path.Join(resolved...), nil
+}
+
+// joinLink joins the slash separated directory of a link and its target without cleaning the result, since
+// ".." in the target refers to the parent of the directory the preceding elements resolve to.
+func joinLink(dir, target string) string {
+	if dir == "" || dir == "." {
+		return filepath.ToSlash(target)
+	}
+	return dir + "/" + filepath.ToSlash(target)
+}
+
+// add records the symbolic link entry with the provided name and target, failing if the link is outside of the
+// destination directory or points outside of it. Returns the slash separated path of the link relative to the
+// destination directory.
+func (r linkResolver) add(name, target string) (string, error) {
+	clean := path.Clean(filepath.ToSlash(name))
+	dir, base := path.Split(clean)
+	if base == "." || base == ".." || base == "" {
+		return "", fmt.Errorf("archive entry %q is outside of the destination directory", name)
+	}
+	dir, err := r.resolve(dir)
+	if err != nil {
+		return "", err
+	}
+	linkPath := path.Join(dir, base)
+	if _, err := r.resolveDepth(joinLink(dir, target), 0); err != nil || path.IsAbs(filepath.ToSlash(target)) {
+		return "", fmt.Errorf("archive entry %q links to %q outside of the destination directory", name, target)
+	}
+	r[linkPath] = target
+	return linkPath, nil
+}
+
+// check returns an error if any of the links points outside of the destination directory through links that
+// were added after it.
+func (r linkResolver) check() error {
+	for linkPath, target := range r {
+		if _, err := r.resolveDepth(joinLink(path.Dir(linkPath), target), 0); err != nil {
+			return fmt.Errorf("archive entry %q links to %q outside of the destination directory", linkPath, target)
+		}
+	}
+	return nil
+}
+
+// CheckArchivePaths returns an error if any entry in the archive at the provided path would be unarchived
+// outside of the destination directory, either through its name, e.g. "../../etc/passwd", or through the
+// symbolic and hard links in the archive. It's intended to be called before unarchiving the archive with
+// the archiver package, which doesn't check the links.
+func CheckArchivePaths(archivePath string, w archiver.Walker) error {
+	links := linkResolver{}
+	err := w.Walk(archivePath, func(f archiver.File) error {
+		var name, symlink, hardlink string
+		switch hdr := f.Header.(type) {
+		case *tar.Header:
+			name = hdr.Name
+			switch hdr.Typeflag {
+			case tar.TypeSymlink:
+				symlink = hdr.Linkname
+			case tar.TypeLink:
+				hardlink = hdr.Linkname
+			}
+		// archiver uses the klauspost/compress zip implementation.
+		case zip.FileHeader:
+			name = hdr.Name
+			// The target of a symbolic link in a zip archive is the content of the entry.
+			if hdr.Mode()&os.ModeSymlink != 0 {
+				target, err := io.ReadAll(f)
+				if err != nil {
+					return fmt.Errorf("unable to read symbolic link target of %q: %v", name, err)
+				}
+				symlink = string(target)
+			}
+		default:
+			return fmt.Errorf("unexpected archive entry header %T", f.Header)
+		}
+		if len(symlink) != 0 {
+			_, err := links.add(name, symlink)
+			return err
+		}
+		if _, err := links.resolve(name); err != nil {
+			return err
+		}
+		if len(hardlink) != 0 {
+			if _, err := links.resolve(hardlink); err != nil {
+				return fmt.Errorf("archive entry %q links to %q outside of the destination directory", name, hardlink)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return links.check()
+}
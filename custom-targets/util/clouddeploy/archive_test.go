@@ -0,0 +1,225 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mholt/archiver/v3"
+)
+
+// testArchiveFile is a file written to the test archives.
+type testArchiveFile struct {
+	name    string
+	content string
+	// Target of a symbolic link, only supported for tar archives.
+	link string
+}
+
+func writeTarGz(t *testing.T, files []testArchiveFile) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, f := range files {
+		if len(f.link) != 0 {
+			if err := tw.WriteHeader(&tar.Header{Name: f.name, Linkname: f.link, Mode: 0777, Typeflag: tar.TypeSymlink}); err != nil {
+				t.Fatalf("unable to write tar header: %v", err)
+			}
+			continue
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("unable to write tar header: %v", err)
+		}
+		tw.Write([]byte(f.content))
+	}
+	tw.Close()
+	gw.Close()
+	p := filepath.Join(t.TempDir(), "archive.tgz")
+	if err := os.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("unable to write archive: %v", err)
+	}
+	return p
+}
+
+func writeZip(t *testing.T, files []testArchiveFile) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatalf("unable to create zip entry: %v", err)
+		}
+		w.Write([]byte(f.content))
+	}
+	zw.Close()
+	p := filepath.Join(t.TempDir(), "archive.zip")
+	if err := os.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("unable to write archive: %v", err)
+	}
+	return p
+}
+
+func TestUnarchive(t *testing.T) {
+	files := []testArchiveFile{{name: "main.tf", content: "# main\n"}, {name: "modules/net/net.tf", content: "# net\n"}}
+	for name, write := range map[string]func(*testing.T, []testArchiveFile) string{"tar.gz": writeTarGz, "zip": writeZip} {
+		t.Run(name, func(t *testing.T) {
+			dest := t.TempDir()
+			if err := unarchive(write(t, files), dest, UnarchiveLimits{}); err != nil {
+				t.Fatalf("unarchive() failed: %v", err)
+			}
+			for _, f := range files {
+				got, err := os.ReadFile(filepath.Join(dest, f.name))
+				if err != nil {
+					t.Fatalf("unable to read unarchived file: %v", err)
+				}
+				if string(got) != f.content {
+					t.Errorf("unarchived %s = %q, want %q", f.name, got, f.content)
+				}
+			}
+		})
+	}
+}
+
+func TestUnarchiveLimits(t *testing.T) {
+	bomb := []testArchiveFile{{name: "a", content: strings.Repeat("0", 600)}, {name: "b", content: strings.Repeat("0", 600)}}
+	many := []testArchiveFile{{name: "a", content: "a"}, {name: "b", content: "b"}, {name: "c", content: "c"}}
+	tests := []struct {
+		name    string
+		files   []testArchiveFile
+		limits  UnarchiveLimits
+		wantErr string
+	}{
+		{name: "total size", files: bomb, limits: UnarchiveLimits{MaxTotalSize: 1000}, wantErr: "maximum total uncompressed size of 1000 bytes"},
+		{name: "entries", files: many, limits: UnarchiveLimits{MaxEntries: 2}, wantErr: "maximum of 2 entries"},
+		{name: "path traversal", files: []testArchiveFile{{name: "../escape.tf", content: "x"}}, wantErr: "outside of the destination directory"},
+		{name: "within limits", files: many, limits: UnarchiveLimits{MaxTotalSize: 3, MaxEntries: 3}},
+	}
+	for _, tc := range tests {
+		for format, write := range map[string]func(*testing.T, []testArchiveFile) string{"tar.gz": writeTarGz, "zip": writeZip} {
+			t.Run(tc.name+" "+format, func(t *testing.T) {
+				err := unarchive(write(t, tc.files), t.TempDir(), tc.limits)
+				if len(tc.wantErr) == 0 {
+					if err != nil {
+						t.Errorf("unarchive() failed: %v", err)
+					}
+					return
+				}
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("unarchive() error = %v, want error containing %q", err, tc.wantErr)
+				}
+			})
+		}
+	}
+}
+
+func TestRenderRequestUnarchiveLimits(t *testing.T) {
+	archive, err := os.ReadFile(writeTarGz(t, []testArchiveFile{{name: "big.tf", content: strings.Repeat("0", 2048)}}))
+	if err != nil {
+		t.Fatalf("unable to read archive: %v", err)
+	}
+	s := NewMemoryStorage()
+	s.Put("gs://bucket/source.tgz", archive)
+	req := &RenderRequest{InputGCSPath: "gs://bucket/source.tgz", Storage: s, UnarchiveLimits: UnarchiveLimits{MaxTotalSize: 1024}}
+	workDir := t.TempDir()
+	if _, err := req.DownloadAndUnarchiveInput(context.Background(), nil, filepath.Join(workDir, "archive.tgz"), filepath.Join(workDir, "source")); err == nil {
+		t.Errorf("DownloadAndUnarchiveInput() succeeded, want error for archive exceeding the limits")
+	}
+}
+
+func TestUnarchivePathTraversal(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   []testArchiveFile
+		wantErr bool
+	}{
+		{name: "parent directory entry", files: []testArchiveFile{{name: "main.tf", content: "x"}, {name: "../../outside/passwd", content: "x"}}, wantErr: true},
+		{name: "nested parent directory entry", files: []testArchiveFile{{name: "modules/../../outside/passwd", content: "x"}}, wantErr: true},
+		{name: "absolute entry", files: []testArchiveFile{{name: "/outside/passwd", content: "x"}}, wantErr: true},
+		{name: "symlink outside", files: []testArchiveFile{{name: "link", link: "../outside"}, {name: "link/passwd", content: "x"}}, wantErr: true},
+		{name: "absolute symlink", files: []testArchiveFile{{name: "link", link: "/etc"}}, wantErr: true},
+		{name: "symlink within", files: []testArchiveFile{{name: "modules/net.tf", content: "x"}, {name: "net.tf", link: "modules/net.tf"}}},
+		{name: "chained symlinks outside", files: []testArchiveFile{{name: "a/f", content: "x"}, {name: "a/l", link: ".."}, {name: "a/l/m", link: "../.."}, {name: "a/l/m/outside/passwd", content: "x"}}, wantErr: true},
+		{name: "symlink outside through later symlink", files: []testArchiveFile{{name: "c", link: "b/../outside"}, {name: "b", link: "."}}, wantErr: true},
+		{name: "file through symlink within", files: []testArchiveFile{{name: "modules/net.tf", content: "x"}, {name: "m", link: "modules"}, {name: "m/main.tf", content: "x"}}},
+		{name: "clean relative entry", files: []testArchiveFile{{name: "modules/../main.tf", content: "x"}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			dest := filepath.Join(root, "source")
+			err := unarchive(writeTarGz(t, tc.files), dest, UnarchiveLimits{})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unarchive() error = %v, wantErr %t", err, tc.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "outside of the destination directory") {
+				t.Errorf("unarchive() error = %v, want path traversal error", err)
+			}
+			if _, err := os.Stat(filepath.Join(root, "outside")); !os.IsNotExist(err) {
+				t.Errorf("unarchive() wrote outside of the destination directory")
+			}
+		})
+	}
+}
+
+func TestCheckArchivePaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []*tar.Header
+		wantErr bool
+	}{
+		{name: "valid", headers: []*tar.Header{{Name: "main.tf", Typeflag: tar.TypeReg}, {Name: "modules/net/", Typeflag: tar.TypeDir}, {Name: "net.tf", Linkname: "modules/net/net.tf", Typeflag: tar.TypeSymlink}}},
+		{name: "parent directory entry", headers: []*tar.Header{{Name: "../../etc/passwd", Typeflag: tar.TypeReg}}, wantErr: true},
+		{name: "absolute entry", headers: []*tar.Header{{Name: "/etc/passwd", Typeflag: tar.TypeReg}}, wantErr: true},
+		{name: "symlink outside", headers: []*tar.Header{{Name: "modules/etc", Linkname: "../../etc", Typeflag: tar.TypeSymlink}}, wantErr: true},
+		{name: "absolute symlink", headers: []*tar.Header{{Name: "etc", Linkname: "/etc", Typeflag: tar.TypeSymlink}}, wantErr: true},
+		{name: "chained symlinks outside", headers: []*tar.Header{{Name: "a/l", Linkname: "..", Typeflag: tar.TypeSymlink}, {Name: "a/l/m", Linkname: "../..", Typeflag: tar.TypeSymlink}, {Name: "a/l/m/escaped.txt", Typeflag: tar.TypeReg}}, wantErr: true},
+		{name: "symlink loop", headers: []*tar.Header{{Name: "a", Linkname: "b", Typeflag: tar.TypeSymlink}, {Name: "b", Linkname: "a", Typeflag: tar.TypeSymlink}}, wantErr: true},
+		{name: "hard link outside", headers: []*tar.Header{{Name: "passwd", Linkname: "../etc/passwd", Typeflag: tar.TypeLink}}, wantErr: true},
+		{name: "hard link through symlink outside", headers: []*tar.Header{{Name: "up", Linkname: ".", Typeflag: tar.TypeSymlink}, {Name: "passwd", Linkname: "up/../etc/passwd", Typeflag: tar.TypeLink}}, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			gw := gzip.NewWriter(&buf)
+			tw := tar.NewWriter(gw)
+			for _, hdr := range tc.headers {
+				hdr.Mode = 0644
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatalf("unable to write tar header: %v", err)
+				}
+			}
+			tw.Close()
+			gw.Close()
+			archivePath := filepath.Join(t.TempDir(), "archive.tgz")
+			if err := os.WriteFile(archivePath, buf.Bytes(), 0644); err != nil {
+				t.Fatalf("unable to write archive: %v", err)
+			}
+			err := CheckArchivePaths(archivePath, archiver.NewTarGz())
+			if (err != nil) != tc.wantErr {
+				t.Errorf("CheckArchivePaths() error: %v, wantErr: %t", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import (
+	"context"
+	"fmt"
+
+	deployapi "google.golang.org/api/clouddeploy/v1"
+)
+
+// newDeployService creates the Cloud Deploy service used to look up the rollout of a deploy request, overridden
+// in tests to use a fake API.
+var newDeployService = func(ctx context.Context) (*deployapi.Service, error) {
+	return deployapi.NewService(ctx)
+}
+
+// lookupAutomationRun returns the resource name of the automation run that created the deploy request's rollout,
+// read from the rollout's automation metadata since Cloud Deploy doesn't provide it in the environment. Returns
+// an empty string if the rollout wasn't created by Cloud Deploy Automation.
+func lookupAutomationRun(ctx context.Context, d *DeployRequest) (string, error) {
+	service, err := newDeployService(ctx)
+	if err != nil {
+		return "", fmt.Errorf("unable to create cloud deploy service: %v", err)
+	}
+	name := fmt.Sprintf("projects/%s/locations/%s/deliveryPipelines/%s/releases/%s/rollouts/%s", d.Project, d.Location, d.Pipeline, d.Release, d.Rollout)
+	rollout, err := service.Projects.Locations.DeliveryPipelines.Releases.Rollouts.Get(name).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("unable to get rollout %s: %v", name, err)
+	}
+	if rollout.Metadata == nil || rollout.Metadata.Automation == nil || len(rollout.Metadata.Automation.PromoteAutomationRun) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("projects/%s/locations/%s/deliveryPipelines/%s/automationRuns/%s", d.Project, d.Location, d.Pipeline, rollout.Metadata.Automation.PromoteAutomationRun), nil
+}
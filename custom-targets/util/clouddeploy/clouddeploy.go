@@ -21,15 +21,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
-	"github.com/mholt/archiver/v3"
 )
 
 // GitCommit SHA to be set during build time of the binary.
@@ -68,6 +70,35 @@ const (
 	cloudDeployCustomTargetEnvVarPrefix = "CLOUD_DEPLOY_customTarget_"
 )
 
+// KMSKeyNameEnvKey is the environment variable for the "customTarget/kmsKeyName" deploy parameter, the
+// Cloud KMS key used to encrypt the objects uploaded for the request. Default encryption is used when unset.
+const KMSKeyNameEnvKey = "CLOUD_DEPLOY_customTarget_kmsKeyName"
+
+// MaxArtifactSizeEnvKey is the environment variable for the "customTarget/maxArtifactSize" deploy parameter, the
+// maximum size in bytes of an artifact or result uploaded for the request. There is no limit when unset.
+const MaxArtifactSizeEnvKey = "CLOUD_DEPLOY_customTarget_maxArtifactSize"
+
+// AutomationRunMetadataKey is the result metadata key for the automation run that created the rollout. The
+// key is omitted from the results when the rollout isn't driven by Cloud Deploy Automation.
+const AutomationRunMetadataKey = "automation-run"
+
+// kmsKeyNameRegex matches the resource name of a Cloud KMS key.
+var kmsKeyNameRegex = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+// Supported values of the storage type environment variable.
+const (
+	// GCSStorageType selects Cloud Storage for the inputs and outputs. It's the storage type Cloud Deploy
+	// provides, and the default when the storage type isn't set.
+	GCSStorageType = "GCS"
+	// LocalStorageType is the storage type that selects the local filesystem for the inputs and outputs, where the
+	// input and output paths are local file paths. It's only meant for testing, Cloud Deploy always uses Cloud Storage.
+	LocalStorageType = "LOCAL"
+	// S3StorageType selects Amazon S3 or an S3-compatible service for the inputs and outputs, where the input and
+	// output paths are "s3://" URIs. The service and credentials are configured with the AWS environment variables,
+	// see NewS3StorageFromEnv.
+	S3StorageType = "S3"
+)
+
 // RenderRequest contains the Cloud Deploy values passed into the execution environment for a render operation.
 type RenderRequest struct {
 	// Cloud Deploy project.
@@ -84,7 +115,7 @@ type RenderRequest struct {
 	Phase string
 	// Percentage deployment requested.
 	Percentage int
-	// The storage type for inputs and outputs. Currently only "GCS" is supported.
+	// The storage type for inputs and outputs. Cloud Deploy only uses "GCS", "LOCAL" is supported for testing.
 	StorageType string
 	// Cloud Storage path to the tar.gz archive provided at the time of release creation in Cloud Deploy.
 	// Example: gs://my-bucket/dir/subdir/source.tar.gz
@@ -98,6 +129,16 @@ type RenderRequest struct {
 	WorkloadType string
 	// Information about the Cloud Build workload. Only present when WorkloadType is "CB".
 	WorkloadCBInfo CloudBuildWorkload
+	// Storage used to download the inputs and upload the outputs. If nil then Cloud Storage is used
+	// with the client passed to the request methods.
+	Storage Storage
+	// Limits applied when unarchiving the source archive. Zero values use the defaults.
+	UnarchiveLimits UnarchiveLimits
+	// Cloud KMS key used to encrypt the uploaded artifacts and results. Optional, when empty the
+	// bucket's default encryption is used.
+	KMSKeyName string
+	// Maximum size in bytes of an uploaded artifact or result. Zero means no limit.
+	MaxArtifactSize int64
 }
 
 // CloudBuildWorkload provides workload execution context when running in Cloud Build.
@@ -131,18 +172,18 @@ const (
 	CustomTargetSourceSHAMetadataKey = "custom-target-source-commit-sha"
 )
 
-// DownloadAndUnarchiveInput downloads the release archive and unarchives it to the provided path.
+// DownloadAndUnarchiveInput downloads the release archive and unarchives it to the provided path. The archive
+// may be a tar.gz or zip archive and the render fails if it exceeds the request's UnarchiveLimits.
 // Returns the Cloud Storage URI of the downloaded archive.
 func (r *RenderRequest) DownloadAndUnarchiveInput(ctx context.Context, gcsClient *storage.Client, localArchivePath, localUnarchivePath string) (string, error) {
 	// For render the input gcs path is the path to the source archive.
 	uri := r.InputGCSPath
-	out, err := downloadGCS(ctx, gcsClient, uri, localArchivePath)
-	if err != nil {
+	if err := storageOrGCS(r.Storage, gcsClient).Download(ctx, uri, localArchivePath); err != nil {
 		return "", err
 	}
-	// Unarchive the tarball downloaded from GCS into the provided unarchive path.
-	if err := archiver.NewTarGz().Unarchive(out.Name(), localUnarchivePath); err != nil {
-		return "", fmt.Errorf("unable to unarchive tarball from %q: %v", uri, err)
+	// Unarchive the downloaded archive into the provided unarchive path.
+	if err := unarchive(localArchivePath, localUnarchivePath, r.UnarchiveLimits); err != nil {
+		return "", fmt.Errorf("unable to unarchive archive from %q: %v", uri, err)
 	}
 	return uri, nil
 }
@@ -155,7 +196,10 @@ func (r *RenderRequest) UploadArtifact(ctx context.Context, gcsClient *storage.C
 	}
 	// For render the output gcs path is the path to a Cloud Storage directory.
 	uri := fmt.Sprintf("%s/%s", r.OutputGCSPath, objectSuffix)
-	if err := uploadGCS(ctx, gcsClient, uri, content); err != nil {
+	if err := CheckUploadSize(objectSuffix, content, r.MaxArtifactSize); err != nil {
+		return "", err
+	}
+	if err := storageOrGCS(r.Storage, gcsClient).Upload(ctx, uri, content.withDefaults(objectSuffix, r.KMSKeyName)); err != nil {
 		return "", err
 	}
 	return uri, nil
@@ -169,7 +213,10 @@ func (r *RenderRequest) UploadResult(ctx context.Context, gcsClient *storage.Cli
 	if err != nil {
 		return "", fmt.Errorf("error marshalling render result: %v", err)
 	}
-	if err := uploadGCS(ctx, gcsClient, uri, &GCSUploadContent{Data: res}); err != nil {
+	if err := CheckUploadSize(resultObjectSuffix, &GCSUploadContent{Data: res}, r.MaxArtifactSize); err != nil {
+		return "", err
+	}
+	if err := storageOrGCS(r.Storage, gcsClient).Upload(ctx, uri, &GCSUploadContent{Data: res, ContentType: "application/json", KMSKeyName: r.KMSKeyName}); err != nil {
 		return "", err
 	}
 	return uri, nil
@@ -193,7 +240,7 @@ type DeployRequest struct {
 	Phase string
 	// Percentage deployment requested.
 	Percentage int
-	// The storage type for inputs and outputs. Currently only GCS is supported.
+	// The storage type for inputs and outputs. Cloud Deploy only uses "GCS", "LOCAL" is supported for testing.
 	StorageType string
 	// Cloud Storage path where the inputs for the deploy are stored. This is equivalent to the output GCS
 	// path for the renderer. If Cloud Deploy performed the render via skaffold instead of this
@@ -216,6 +263,17 @@ type DeployRequest struct {
 	WorkloadType string
 	// Information about the Cloud Build workload. Only present when WorkloadType is "CB".
 	WorkloadCBInfo CloudBuildWorkload
+	// Storage used to download the inputs and upload the outputs. If nil then Cloud Storage is used
+	// with the client passed to the request methods.
+	Storage Storage
+	// Cloud KMS key used to encrypt the uploaded artifacts and results. Optional, when empty the
+	// bucket's default encryption is used.
+	KMSKeyName string
+	// Maximum size in bytes of an uploaded artifact or result. Zero means no limit.
+	MaxArtifactSize int64
+	// Resource name of the Cloud Deploy automation run that created the rollout, looked up from the rollout.
+	// Empty when the rollout wasn't created by Cloud Deploy Automation.
+	AutomationRun string
 }
 
 // DeployResult represents the json data expected in the results file by Cloud Deploy for a deploy operation.
@@ -243,23 +301,53 @@ func (d *DeployRequest) DownloadInput(ctx context.Context, gcsClient *storage.Cl
 	// For deploy the input gcs path is a path to a GCS directory. Need the suffix used when uploading at render
 	// time to determine the object to download.
 	uri := fmt.Sprintf("%s/%s", d.InputGCSPath, objectSuffix)
-	_, err := downloadGCS(ctx, gcsClient, uri, localPath)
-	if err != nil {
+	if err := storageOrGCS(d.Storage, gcsClient).Download(ctx, uri, localPath); err != nil {
 		return "", err
 	}
 	return uri, nil
 }
 
+// DownloadRenderResult downloads the result the render uploaded alongside the deploy input, e.g. to read
+// the metadata the render recorded for the deploy.
+func (d *DeployRequest) DownloadRenderResult(ctx context.Context, gcsClient *storage.Client) (*RenderResult, error) {
+	f, err := os.CreateTemp("", "render-results-*.json")
+	if err != nil {
+		return nil, err
+	}
+	localPath := f.Name()
+	f.Close()
+	defer os.Remove(localPath)
+	uri, err := d.DownloadInput(ctx, gcsClient, resultObjectSuffix, localPath)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(localPath)
+	if err != nil {
+		return nil, err
+	}
+	rr := &RenderResult{}
+	if err := json.Unmarshal(b, rr); err != nil {
+		return nil, fmt.Errorf("error unmarshalling render result %s: %v", uri, err)
+	}
+	return rr, nil
+}
+
 // DownloadManifest downloads the manifest to the provided local path. Returns the Cloud Storage URI of the downloaded manifest.
 func (d *DeployRequest) DownloadManifest(ctx context.Context, gcsClient *storage.Client, localPath string) (string, error) {
 	// The manifest gcs path is the path to the manifest file provided at render time.
 	uri := d.ManifestGCSPath
-	if _, err := downloadGCS(ctx, gcsClient, uri, localPath); err != nil {
+	if err := storageOrGCS(d.Storage, gcsClient).Download(ctx, uri, localPath); err != nil {
 		return "", err
 	}
 	return uri, nil
 }
 
+// DownloadObject downloads the object at the provided URI, e.g. an artifact of an earlier deploy, to the provided
+// local path. The object is read from the storage of the request, so the URI must be one it can address.
+func (d *DeployRequest) DownloadObject(ctx context.Context, gcsClient *storage.Client, uri, localPath string) error {
+	return storageOrGCS(d.Storage, gcsClient).Download(ctx, uri, localPath)
+}
+
 // UploadArtifact uploads the provided content as a deploy artifact. The objectSuffix must be provided
 // to determine the Cloud Storage URI to use for the object, the URI is returned.
 func (d *DeployRequest) UploadArtifact(ctx context.Context, gcsClient *storage.Client, objectSuffix string, content *GCSUploadContent) (string, error) {
@@ -268,7 +356,10 @@ func (d *DeployRequest) UploadArtifact(ctx context.Context, gcsClient *storage.C
 	}
 	// For deploy the output gcs path is the path to a Cloud Storage directory.
 	uri := fmt.Sprintf("%s/%s", d.OutputGCSPath, objectSuffix)
-	if err := uploadGCS(ctx, gcsClient, uri, content); err != nil {
+	if err := CheckUploadSize(objectSuffix, content, d.MaxArtifactSize); err != nil {
+		return "", err
+	}
+	if err := storageOrGCS(d.Storage, gcsClient).Upload(ctx, uri, content.withDefaults(objectSuffix, d.KMSKeyName)); err != nil {
 		return "", err
 	}
 	return uri, nil
@@ -278,16 +369,35 @@ func (d *DeployRequest) UploadArtifact(ctx context.Context, gcsClient *storage.C
 // Returns the Cloud Storage URI of the uploaded result.
 func (d *DeployRequest) UploadResult(ctx context.Context, gcsClient *storage.Client, deployResult *DeployResult) (string, error) {
 	uri := fmt.Sprintf("%s/%s", d.OutputGCSPath, resultObjectSuffix)
-	res, err := json.Marshal(deployResult)
+	dr := *deployResult
+	dr.Metadata = withAutomationRunMetadata(dr.Metadata, d.AutomationRun)
+	res, err := json.Marshal(dr)
 	if err != nil {
 		return "", fmt.Errorf("error marshalling deploy result: %v", err)
 	}
-	if err := uploadGCS(ctx, gcsClient, uri, &GCSUploadContent{Data: res}); err != nil {
+	if err := CheckUploadSize(resultObjectSuffix, &GCSUploadContent{Data: res}, d.MaxArtifactSize); err != nil {
+		return "", err
+	}
+	if err := storageOrGCS(d.Storage, gcsClient).Upload(ctx, uri, &GCSUploadContent{Data: res, ContentType: "application/json", KMSKeyName: d.KMSKeyName}); err != nil {
 		return "", err
 	}
 	return uri, nil
 }
 
+// withAutomationRunMetadata returns a copy of the result metadata with the automation run added. The
+// metadata is returned unchanged when there is no automation run.
+func withAutomationRunMetadata(metadata map[string]string, automationRun string) map[string]string {
+	if len(automationRun) == 0 {
+		return metadata
+	}
+	m := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		m[k] = v
+	}
+	m[AutomationRunMetadataKey] = automationRun
+	return m
+}
+
 // DetermineRequest determines the Cloud Deploy request based on the environment variables in the
 // execution environment and returns either a RenderRequest or DeployRequest. If the request
 // includes a feature that is not in provided supported features list then a NOT_SUPPORTED result
@@ -305,8 +415,25 @@ func DetermineRequest(ctx context.Context, gcsClient *storage.Client, supportedF
 		return nil, fmt.Errorf("failed to parse %q", PercentageEnvKey)
 	}
 	storageType := os.Getenv(StorageTypeEnvKey)
+	s, err := newStorage(storageType, gcsClient)
+	if err != nil {
+		return nil, err
+	}
 	inputGCSPath := os.Getenv(InputGCSEnvKey)
 	outputGCSPath := os.Getenv(OutputGCSEnvKey)
+	kmsKeyName := os.Getenv(KMSKeyNameEnvKey)
+	if len(kmsKeyName) != 0 {
+		if err := validateKMSKeyName(kmsKeyName); err != nil {
+			return nil, fmt.Errorf("failed to parse %q: %v", KMSKeyNameEnvKey, err)
+		}
+	}
+	var maxArtifactSize int64
+	if v := os.Getenv(MaxArtifactSizeEnvKey); len(v) != 0 {
+		maxArtifactSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxArtifactSize < 0 {
+			return nil, fmt.Errorf("failed to parse %q, must be a non-negative number of bytes: %q", MaxArtifactSizeEnvKey, v)
+		}
+	}
 
 	workloadType := os.Getenv(WorkloadTypeEnvKey)
 	var cbWorkload CloudBuildWorkload
@@ -325,18 +452,21 @@ func DetermineRequest(ctx context.Context, gcsClient *storage.Client, supportedF
 	switch reqType {
 	case "RENDER":
 		rr := &RenderRequest{
-			Project:        project,
-			Location:       location,
-			Pipeline:       pipeline,
-			Release:        release,
-			Target:         target,
-			Phase:          phase,
-			Percentage:     percentage,
-			StorageType:    storageType,
-			InputGCSPath:   inputGCSPath,
-			OutputGCSPath:  outputGCSPath,
-			WorkloadType:   workloadType,
-			WorkloadCBInfo: cbWorkload,
+			Project:         project,
+			Location:        location,
+			Pipeline:        pipeline,
+			Release:         release,
+			Target:          target,
+			Phase:           phase,
+			Percentage:      percentage,
+			StorageType:     storageType,
+			InputGCSPath:    inputGCSPath,
+			OutputGCSPath:   outputGCSPath,
+			WorkloadType:    workloadType,
+			WorkloadCBInfo:  cbWorkload,
+			Storage:         s,
+			KMSKeyName:      kmsKeyName,
+			MaxArtifactSize: maxArtifactSize,
 		}
 
 		for _, f := range features {
@@ -371,6 +501,9 @@ func DetermineRequest(ctx context.Context, gcsClient *storage.Client, supportedF
 			OutputGCSPath:   outputGCSPath,
 			WorkloadType:    workloadType,
 			WorkloadCBInfo:  cbWorkload,
+			Storage:         s,
+			KMSKeyName:      kmsKeyName,
+			MaxArtifactSize: maxArtifactSize,
 		}
 
 		for _, f := range features {
@@ -387,6 +520,12 @@ func DetermineRequest(ctx context.Context, gcsClient *storage.Client, supportedF
 			}
 		}
 
+		if len(dr.Rollout) != 0 {
+			// The automation run is only recorded for traceability, so a failed lookup doesn't fail the request.
+			if dr.AutomationRun, err = lookupAutomationRun(ctx, dr); err != nil {
+				fmt.Printf("Unable to look up the automation run of rollout %q, omitting it from the results: %v\n", dr.Rollout, err)
+			}
+		}
 		return dr, nil
 
 	default:
@@ -404,17 +543,30 @@ func isFeatureSupported(supportedFeatures []string, feature string) bool {
 	return false
 }
 
+// downloadMaxAttempts is the number of attempts made to read a Cloud Storage object before the
+// download fails. Reads interrupted by a transient error are resumed from the last byte written.
+const downloadMaxAttempts = 5
+
+// downloadRetryBackoff is the base duration to wait between download attempts.
+var downloadRetryBackoff = 2 * time.Second
+
 // downloadGCS downloads the Cloud Storage object for the specified URI to the provided local path.
+// If reading the object is interrupted by a transient error then the download is resumed with a range
+// read starting at the number of bytes already written, any other error fails the download immediately.
+// The size and CRC32C of the downloaded file are verified against the object attributes.
 func downloadGCS(ctx context.Context, gcsClient *storage.Client, gcsURI, localPath string) (*os.File, error) {
 	gcsObj, err := parseGCSURI(gcsURI)
 	if err != nil {
 		return nil, err
 	}
-	r, err := gcsClient.Bucket(gcsObj.bucket).Object(gcsObj.name).NewReader(ctx)
+	obj := gcsClient.Bucket(gcsObj.bucket).Object(gcsObj.name)
+	attrs, err := obj.Attrs(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer r.Close()
+	// Pin the generation so a resumed read can't mix the contents of two object versions. Retries
+	// of the read are handled below so that each attempt resumes from the bytes already written.
+	obj = obj.Generation(attrs.Generation).Retryer(storage.WithPolicy(storage.RetryNever))
 
 	if err := os.MkdirAll(filepath.Dir(localPath), os.ModePerm); err != nil {
 		return nil, err
@@ -425,12 +577,49 @@ func downloadGCS(ctx context.Context, gcsClient *storage.Client, gcsURI, localPa
 	}
 	defer file.Close()
 
-	if _, err := io.Copy(file, r); err != nil {
-		return nil, err
+	crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	w := io.MultiWriter(file, crc)
+	var offset int64
+	for attempt := 1; ; attempt++ {
+		n, err := readRange(ctx, obj, offset, w)
+		offset += n
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil || !storage.ShouldRetry(err) {
+			return nil, fmt.Errorf("unable to download %q: %w", gcsURI, err)
+		}
+		if attempt >= downloadMaxAttempts {
+			return nil, fmt.Errorf("unable to download %q after %d attempts: %w", gcsURI, attempt, err)
+		}
+		fmt.Printf("Download of %q interrupted after %d bytes, resuming: %v\n", gcsURI, offset, err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("unable to download %q: %w", gcsURI, ctx.Err())
+		case <-time.After(downloadRetryBackoff * time.Duration(attempt)):
+		}
+	}
+
+	if offset != attrs.Size {
+		return nil, fmt.Errorf("downloaded %d bytes from %q, expected %d", offset, gcsURI, attrs.Size)
+	}
+	if attrs.CRC32C != 0 && crc.Sum32() != attrs.CRC32C {
+		return nil, fmt.Errorf("data corruption detected downloading %q, CRC32C mismatch", gcsURI)
 	}
 	return file, nil
 }
 
+// readRange copies the object contents starting at the provided offset to the writer. Returns the
+// number of bytes written, which may be non-zero when an error is returned.
+func readRange(ctx context.Context, obj *storage.ObjectHandle, offset int64, w io.Writer) (int64, error) {
+	r, err := obj.NewRangeReader(ctx, offset, -1)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return io.Copy(w, r)
+}
+
 // GCSUploadContent is used as a parameter for the various GCS upload functions that points
 // to the source of the content to upload.
 type GCSUploadContent struct {
@@ -438,30 +627,117 @@ type GCSUploadContent struct {
 	Data []byte
 	// Content is in the file at this local path.
 	LocalPath string
+	// ContentType of the uploaded object, e.g. "application/json". When empty the content type of
+	// artifacts is inferred from the object suffix, otherwise Cloud Storage detects it.
+	ContentType string
+	// CacheControl of the uploaded object, e.g. "no-cache". Optional.
+	CacheControl string
+	// Metadata is custom metadata to set on the uploaded object. Optional.
+	Metadata map[string]string
+	// KMSKeyName is the resource name of the Cloud KMS key used to encrypt the uploaded object, in the
+	// format projects/*/locations/*/keyRings/*/cryptoKeys/*. Optional, when empty the request's key
+	// is used and otherwise the bucket's default encryption.
+	KMSKeyName string
 }
 
-// uploadGCS uploads the provided content to the specified Cloud Storage URI.
-func uploadGCS(ctx context.Context, gcsClient *storage.Client, gcsURI string, content *GCSUploadContent) error {
-	// Determine the source of the content to upload.
-	var contentData []byte
+// contentTypesByExt maps file extensions of uploaded artifacts to the content type set on the object.
+var contentTypesByExt = map[string]string{
+	".json": "application/json",
+	".yaml": "text/yaml",
+	".yml":  "text/yaml",
+	".txt":  "text/plain",
+}
+
+// withDefaults returns the content with the content type inferred from the object suffix and the
+// KMS key set to the provided key when they weren't provided.
+func (c *GCSUploadContent) withDefaults(objectSuffix, kmsKeyName string) *GCSUploadContent {
+	if c == nil {
+		return c
+	}
+	d := *c
+	if len(d.ContentType) == 0 {
+		d.ContentType = contentTypesByExt[strings.ToLower(filepath.Ext(objectSuffix))]
+	}
+	if len(d.KMSKeyName) == 0 {
+		d.KMSKeyName = kmsKeyName
+	}
+	return &d
+}
+
+// validateKMSKeyName returns an error if the provided key isn't a Cloud KMS key resource name.
+func validateKMSKeyName(name string) error {
+	if !kmsKeyNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid KMS key name %q, expected format projects/*/locations/*/keyRings/*/cryptoKeys/*", name)
+	}
+	return nil
+}
+
+// size returns the size in bytes of the content to upload.
+func (c *GCSUploadContent) size() (int64, error) {
 	switch {
-	case len(content.Data) != 0:
-		contentData = content.Data
-	case len(content.LocalPath) != 0:
-		var err error
-		contentData, err = os.ReadFile(content.LocalPath)
+	case len(c.Data) != 0:
+		return int64(len(c.Data)), nil
+	case len(c.LocalPath) != 0:
+		fi, err := os.Stat(c.LocalPath)
 		if err != nil {
-			return err
+			return 0, err
 		}
+		return fi.Size(), nil
 	default:
-		return fmt.Errorf("unable to determine the content to upload to GCS")
+		return 0, nil
+	}
+}
+
+// CheckUploadSize returns an error naming the artifact and its size if the content is larger than the
+// maximum size in bytes. A maximum of zero or less means there is no limit.
+func CheckUploadSize(name string, content *GCSUploadContent, max int64) error {
+	if max <= 0 || content == nil {
+		return nil
+	}
+	size, err := content.size()
+	if err != nil {
+		return fmt.Errorf("unable to determine the size of %s: %v", name, err)
+	}
+	if size > max {
+		return fmt.Errorf("%s is %d bytes, which exceeds the maximum artifact size of %d bytes", name, size, max)
+	}
+	return nil
+}
+
+// read returns the content to upload, either the data or the contents of the file at the local path.
+func (c *GCSUploadContent) read() ([]byte, error) {
+	switch {
+	case len(c.Data) != 0:
+		return c.Data, nil
+	case len(c.LocalPath) != 0:
+		return os.ReadFile(c.LocalPath)
+	default:
+		return nil, fmt.Errorf("unable to determine the content to upload")
+	}
+}
+
+// uploadGCS uploads the provided content to the specified Cloud Storage URI.
+func uploadGCS(ctx context.Context, gcsClient *storage.Client, gcsURI string, content *GCSUploadContent) error {
+	// Determine the source of the content to upload.
+	contentData, err := content.read()
+	if err != nil {
+		return err
 	}
 
 	gcsObjURI, err := parseGCSURI(gcsURI)
 	if err != nil {
 		return err
 	}
+	if len(content.KMSKeyName) != 0 {
+		if err := validateKMSKeyName(content.KMSKeyName); err != nil {
+			return err
+		}
+	}
 	w := gcsClient.Bucket(gcsObjURI.bucket).Object(gcsObjURI.name).NewWriter(ctx)
+	w.KMSKeyName = content.KMSKeyName
+	w.ContentType = content.ContentType
+	w.CacheControl = content.CacheControl
+	w.Metadata = content.Metadata
 	if _, err := w.Write(contentData); err != nil {
 		return err
 	}
@@ -519,7 +795,11 @@ func FetchDeployParameters() map[string]string {
 	params := map[string]string{}
 	environs := os.Environ()
 	for _, environ := range environs {
-		segments := strings.Split(environ, "=")
+		// Split on the first "=" only, values may contain "=", e.g. base64 or query strings.
+		segments := strings.SplitN(environ, "=", 2)
+		if len(segments) != 2 {
+			continue
+		}
 		if validKey, transformedKey := isDeployParamAndKey(segments[0]); validKey {
 			params[transformedKey] = segments[1]
 		}
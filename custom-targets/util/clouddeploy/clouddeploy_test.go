@@ -0,0 +1,521 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	deployapi "google.golang.org/api/clouddeploy/v1"
+	"google.golang.org/api/option"
+)
+
+// fakeGCSServer is a minimal in-memory fake of the Cloud Storage JSON and XML APIs, supporting
+// object metadata, ranged media reads and simple uploads.
+type fakeGCSServer struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	// attrs records the attributes each object was uploaded with.
+	attrs map[string]fakeObjectAttrs
+	// mediaResponses scripts how successive media reads are answered: "interrupt" cuts the response
+	// off halfway through, "unavailable" responds with a 503, "forbidden" responds with a 403 and
+	// anything else serves the object.
+	mediaResponses []string
+	// rangeStarts records the start offset of every media read.
+	rangeStarts []int64
+}
+
+// fakeObjectAttrs are the object attributes sent in the metadata part of an upload.
+type fakeObjectAttrs struct {
+	Name         string            `json:"name"`
+	ContentType  string            `json:"contentType"`
+	CacheControl string            `json:"cacheControl"`
+	Metadata     map[string]string `json:"metadata"`
+	// KMSKeyName is sent as a query parameter rather than in the metadata.
+	KMSKeyName string `json:"-"`
+}
+
+func newFakeGCSServer(t *testing.T) (*fakeGCSServer, *storage.Client) {
+	t.Helper()
+	f := &fakeGCSServer{objects: map[string][]byte{}, attrs: map[string]fakeObjectAttrs{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("failed to create storage client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return f, client
+}
+
+func (f *fakeGCSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/storage/v1/b/"):
+		// Object metadata: /storage/v1/b/{bucket}/o/{object}
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/storage/v1/b/"), "/o/", 2)
+		key := parts[0] + "/" + parts[1]
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		crc := crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+		json.NewEncoder(w).Encode(map[string]string{
+			"bucket":     parts[0],
+			"name":       parts[1],
+			"size":       strconv.Itoa(len(data)),
+			"generation": "1",
+			"crc32c":     encodeCRC32C(crc),
+		})
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/"):
+		f.handleUpload(w, r)
+	case r.Method == http.MethodGet:
+		// Media read: /{bucket}/{object}
+		data, ok := f.objects[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		var start int64
+		if rng := r.Header.Get("Range"); rng != "" {
+			fmt.Sscanf(rng, "bytes=%d-", &start)
+		}
+		f.rangeStarts = append(f.rangeStarts, start)
+		resp := ""
+		if len(f.mediaResponses) > 0 {
+			resp, f.mediaResponses = f.mediaResponses[0], f.mediaResponses[1:]
+		}
+		if resp == "unavailable" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if resp == "forbidden" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		body := data[start:]
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("X-Goog-Generation", "1")
+		if start > 0 {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		if resp == "interrupt" {
+			// Writing less than the declared content length causes the connection to be closed.
+			w.Write(body[:len(body)/2])
+			return
+		}
+		w.Write(body)
+	default:
+		http.Error(w, "unsupported", http.StatusNotImplemented)
+	}
+}
+
+// handleUpload handles multipart uploads: /upload/storage/v1/b/{bucket}/o
+func (f *fakeGCSServer) handleUpload(w http.ResponseWriter, r *http.Request) {
+	bucket := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/upload/storage/v1/b/"), "/o")
+	// The client sends multipart/related requests which http.Request.MultipartReader rejects.
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	var meta fakeObjectAttrs
+	metaPart, err := mr.NextPart()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := json.NewDecoder(metaPart).Decode(&meta); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dataPart, err := mr.NextPart()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(dataPart)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.objects[bucket+"/"+meta.Name] = data
+	meta.KMSKeyName = r.URL.Query().Get("kmsKeyName")
+	f.attrs[bucket+"/"+meta.Name] = meta
+	json.NewEncoder(w).Encode(map[string]string{
+		"bucket": bucket,
+		"name":   meta.Name,
+		"size":   strconv.Itoa(len(data)),
+	})
+}
+
+// encodeCRC32C encodes the checksum the way the Cloud Storage JSON API does.
+func encodeCRC32C(crc uint32) string {
+	b := []byte{byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc)}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func TestDownloadGCSResumesInterruptedRead(t *testing.T) {
+	downloadRetryBackoff = 0
+	fake, client := newFakeGCSServer(t)
+	data := []byte(strings.Repeat("0123456789", 1000))
+	fake.objects["bucket/source.tgz"] = data
+	// The first read is cut off and the client's immediate reopen fails, so the download needs to
+	// be resumed from the bytes already written.
+	fake.mediaResponses = []string{"interrupt", "unavailable", "ok"}
+
+	localPath := filepath.Join(t.TempDir(), "archive.tgz")
+	if _, err := downloadGCS(context.Background(), client, "gs://bucket/source.tgz", localPath); err != nil {
+		t.Fatalf("downloadGCS() failed: %v", err)
+	}
+	got, err := os.ReadFile(localPath)
+	if err != nil {
+		t.Fatalf("unable to read downloaded file: %v", err)
+	}
+	if string(got) != string(data) {
+		t.Errorf("downloadGCS() content mismatch, got %d bytes, want %d bytes", len(got), len(data))
+	}
+	wantStarts := []int64{0, 5000, 5000}
+	if fmt.Sprint(fake.rangeStarts) != fmt.Sprint(wantStarts) {
+		t.Errorf("downloadGCS() read offsets got: %v, want: %v", fake.rangeStarts, wantStarts)
+	}
+}
+
+func TestDownloadGCSFailsAfterMaxAttempts(t *testing.T) {
+	downloadRetryBackoff = 0
+	fake, client := newFakeGCSServer(t)
+	fake.objects["bucket/source.tgz"] = []byte(strings.Repeat("0123456789", 1000))
+	for i := 0; i < downloadMaxAttempts; i++ {
+		fake.mediaResponses = append(fake.mediaResponses, "unavailable")
+	}
+
+	localPath := filepath.Join(t.TempDir(), "archive.tgz")
+	if _, err := downloadGCS(context.Background(), client, "gs://bucket/source.tgz", localPath); err == nil {
+		t.Errorf("downloadGCS() succeeded, want error when every read fails")
+	}
+}
+
+func TestDownloadGCSPermanentErrorNotRetried(t *testing.T) {
+	downloadRetryBackoff = time.Hour
+	fake, client := newFakeGCSServer(t)
+	fake.objects["bucket/source.tgz"] = []byte(strings.Repeat("0123456789", 1000))
+	fake.mediaResponses = []string{"forbidden", "ok"}
+
+	localPath := filepath.Join(t.TempDir(), "archive.tgz")
+	if _, err := downloadGCS(context.Background(), client, "gs://bucket/source.tgz", localPath); err == nil {
+		t.Fatalf("downloadGCS() succeeded, want error when the read is forbidden")
+	}
+	if len(fake.rangeStarts) != 1 {
+		t.Errorf("downloadGCS() got %d read attempts, want 1 for a permanent error", len(fake.rangeStarts))
+	}
+}
+
+func TestDownloadGCSCanceledDuringBackoff(t *testing.T) {
+	downloadRetryBackoff = time.Hour
+	fake, client := newFakeGCSServer(t)
+	fake.objects["bucket/source.tgz"] = []byte(strings.Repeat("0123456789", 1000))
+	fake.mediaResponses = []string{"unavailable", "ok"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	localPath := filepath.Join(t.TempDir(), "archive.tgz")
+	_, err := downloadGCS(ctx, client, "gs://bucket/source.tgz", localPath)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("downloadGCS() got error: %v, want: %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestUploadObjectAttrs(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeGCSServer(t)
+	req := &DeployRequest{OutputGCSPath: "gs://bucket/out"}
+
+	if _, err := req.UploadResult(ctx, client, &DeployResult{ResultStatus: DeploySucceeded}); err != nil {
+		t.Fatalf("UploadResult() failed: %v", err)
+	}
+	if _, err := req.UploadArtifact(ctx, client, "manifest.yaml", &GCSUploadContent{Data: []byte("a: b")}); err != nil {
+		t.Fatalf("UploadArtifact() failed: %v", err)
+	}
+	if _, err := req.UploadArtifact(ctx, client, "state.bin", &GCSUploadContent{
+		Data:         []byte("state"),
+		ContentType:  "application/octet-stream",
+		CacheControl: "no-cache",
+		Metadata:     map[string]string{"rollout": "r1"},
+	}); err != nil {
+		t.Fatalf("UploadArtifact() failed: %v", err)
+	}
+
+	tests := []struct {
+		object string
+		want   fakeObjectAttrs
+	}{
+		{
+			object: "bucket/out/results.json",
+			want:   fakeObjectAttrs{Name: "out/results.json", ContentType: "application/json"},
+		},
+		{
+			object: "bucket/out/manifest.yaml",
+			want:   fakeObjectAttrs{Name: "out/manifest.yaml", ContentType: "text/yaml"},
+		},
+		{
+			object: "bucket/out/state.bin",
+			want: fakeObjectAttrs{
+				Name:         "out/state.bin",
+				ContentType:  "application/octet-stream",
+				CacheControl: "no-cache",
+				Metadata:     map[string]string{"rollout": "r1"},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.object, func(t *testing.T) {
+			got, ok := fake.attrs[tc.object]
+			if !ok {
+				t.Fatalf("object %q was not uploaded", tc.object)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("unexpected object attrs, got: %+v, want: %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUploadKMSKeyName(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeGCSServer(t)
+	requestKey := "projects/p/locations/us/keyRings/ring/cryptoKeys/request"
+	contentKey := "projects/p/locations/us/keyRings/ring/cryptoKeys/content"
+	req := &RenderRequest{OutputGCSPath: "gs://bucket/out", KMSKeyName: requestKey}
+
+	if _, err := req.UploadResult(ctx, client, &RenderResult{ResultStatus: RenderSucceeded}); err != nil {
+		t.Fatalf("UploadResult() failed: %v", err)
+	}
+	if _, err := req.UploadArtifact(ctx, client, "manifest.yaml", &GCSUploadContent{Data: []byte("a: b"), KMSKeyName: contentKey}); err != nil {
+		t.Fatalf("UploadArtifact() failed: %v", err)
+	}
+	if err := uploadGCS(ctx, client, "gs://bucket/default", &GCSUploadContent{Data: []byte("a")}); err != nil {
+		t.Fatalf("uploadGCS() failed: %v", err)
+	}
+	for object, want := range map[string]string{
+		"bucket/out/results.json":  requestKey,
+		"bucket/out/manifest.yaml": contentKey,
+		"bucket/default":           "",
+	} {
+		if got := fake.attrs[object].KMSKeyName; got != want {
+			t.Errorf("unexpected KMS key for %q, got: %q, want: %q", object, got, want)
+		}
+	}
+
+	err := uploadGCS(ctx, client, "gs://bucket/invalid", &GCSUploadContent{Data: []byte("a"), KMSKeyName: "projects/p/keyRings/ring"})
+	if err == nil {
+		t.Errorf("expected error uploading with an invalid KMS key name")
+	}
+	if _, ok := fake.objects["bucket/invalid"]; ok {
+		t.Errorf("object uploaded with an invalid KMS key name")
+	}
+}
+
+func TestDetermineRequestKMSKeyName(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{name: "unset"},
+		{name: "valid", key: "projects/p/locations/global/keyRings/r/cryptoKeys/k"},
+		{name: "missing key ring", key: "projects/p/locations/global/cryptoKeys/k", wantErr: true},
+		{name: "key version", key: "projects/p/locations/global/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(RequestTypeEnvKey, "DEPLOY")
+			t.Setenv(PercentageEnvKey, "100")
+			t.Setenv(KMSKeyNameEnvKey, tc.key)
+			req, err := DetermineRequest(context.Background(), nil, nil)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("DetermineRequest() got err: %v, want err: %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := req.(*DeployRequest).KMSKeyName; got != tc.key {
+				t.Errorf("got: %q, want: %q", got, tc.key)
+			}
+		})
+	}
+}
+
+func TestDetermineRequestAutomationRun(t *testing.T) {
+	rollouts := map[string]*deployapi.Rollout{
+		testReleases + "/rel-1/rollouts/automated": {Metadata: &deployapi.Metadata{Automation: &deployapi.AutomationRolloutMetadata{PromoteAutomationRun: "run-1"}}},
+		testReleases + "/rel-1/rollouts/manual":    {},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rollout, ok := rollouts[strings.TrimPrefix(r.URL.Path, "/v1/")]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(rollout)
+	}))
+	defer srv.Close()
+	origNewDeployService := newDeployService
+	defer func() { newDeployService = origNewDeployService }()
+	newDeployService = func(ctx context.Context) (*deployapi.Service, error) {
+		return deployapi.NewService(ctx, option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	}
+
+	for _, tc := range []struct {
+		name    string
+		reqType string
+		rollout string
+		want    string
+	}{
+		{name: "automated", reqType: "DEPLOY", rollout: "automated", want: "projects/p/locations/us-central1/deliveryPipelines/dp/automationRuns/run-1"},
+		{name: "manual", reqType: "DEPLOY", rollout: "manual"},
+		{name: "lookup failure", reqType: "DEPLOY", rollout: "deleted"},
+		{name: "no rollout", reqType: "DEPLOY"},
+		{name: "render", reqType: "RENDER", rollout: "automated"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(RequestTypeEnvKey, tc.reqType)
+			t.Setenv(PercentageEnvKey, "100")
+			t.Setenv(ProjectEnvKey, "p")
+			t.Setenv(LocationEnvKey, "us-central1")
+			t.Setenv(PipelineEnvKey, "dp")
+			t.Setenv(ReleaseEnvKey, "rel-1")
+			t.Setenv(RolloutEnvKey, tc.rollout)
+			req, err := DetermineRequest(context.Background(), nil, nil)
+			if err != nil {
+				t.Fatalf("DetermineRequest() failed: %v", err)
+			}
+			var got string
+			if dr, ok := req.(*DeployRequest); ok {
+				got = dr.AutomationRun
+			}
+			if got != tc.want {
+				t.Errorf("got: %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUploadResultAutomationRun(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeGCSServer(t)
+	run := "projects/p/locations/us-central1/deliveryPipelines/dp/automationRuns/run-1"
+	res := &DeployResult{ResultStatus: DeploySucceeded, Metadata: map[string]string{"key": "value"}}
+
+	for object, req := range map[string]*DeployRequest{
+		"bucket/automation/results.json": {OutputGCSPath: "gs://bucket/automation", AutomationRun: run},
+		"bucket/manual/results.json":     {OutputGCSPath: "gs://bucket/manual"},
+	} {
+		if _, err := req.UploadResult(ctx, client, res); err != nil {
+			t.Fatalf("UploadResult() failed: %v", err)
+		}
+		got := &DeployResult{}
+		if err := json.Unmarshal(fake.objects[object], got); err != nil {
+			t.Fatalf("unable to unmarshal %q: %v", object, err)
+		}
+		want := map[string]string{"key": "value"}
+		if len(req.AutomationRun) != 0 {
+			want[AutomationRunMetadataKey] = run
+		}
+		if !reflect.DeepEqual(got.Metadata, want) {
+			t.Errorf("unexpected metadata for %q, got: %v, want: %v", object, got.Metadata, want)
+		}
+	}
+	if _, ok := res.Metadata[AutomationRunMetadataKey]; ok {
+		t.Errorf("UploadResult() modified the provided result's metadata")
+	}
+}
+
+func TestDownloadRenderResult(t *testing.T) {
+	s := NewMemoryStorage()
+	s.Put("gs://bucket/render/results.json", []byte(`{"resultStatus": "SUCCEEDED", "manifestFile": "gs://bucket/render/manifest.yaml", "metadata": {"key": "value"}}`))
+	d := &DeployRequest{InputGCSPath: "gs://bucket/render", Storage: s}
+	got, err := d.DownloadRenderResult(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("DownloadRenderResult() failed: %v", err)
+	}
+	want := &RenderResult{ResultStatus: RenderSucceeded, ManifestFile: "gs://bucket/render/manifest.yaml", Metadata: map[string]string{"key": "value"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DownloadRenderResult() got: %+v, want: %+v", got, want)
+	}
+
+	if _, err := (&DeployRequest{InputGCSPath: "gs://bucket/other", Storage: s}).DownloadRenderResult(context.Background(), nil); err == nil {
+		t.Errorf("DownloadRenderResult() succeeded, want error for a missing render result")
+	}
+}
+
+func TestDeployRequestDownloadObject(t *testing.T) {
+	s := NewMemoryStorage()
+	s.Put("s3://bucket/plan/plan-summary.md", []byte("summary"))
+	d := &DeployRequest{Storage: s}
+	localPath := filepath.Join(t.TempDir(), "plan-summary.md")
+	if err := d.DownloadObject(context.Background(), nil, "s3://bucket/plan/plan-summary.md", localPath); err != nil {
+		t.Fatalf("DownloadObject() failed: %v", err)
+	}
+	if got, _ := os.ReadFile(localPath); string(got) != "summary" {
+		t.Errorf("DownloadObject() content got: %q, want: %q", got, "summary")
+	}
+	if err := d.DownloadObject(context.Background(), nil, "s3://bucket/missing.md", localPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("DownloadObject() of a missing object got err: %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestFetchDeployParameters(t *testing.T) {
+	t.Setenv("CLOUD_DEPLOY_customTarget_token", "dGVzdA==")
+	t.Setenv("CLOUD_DEPLOY_customTarget_url", "https://example.com/?a=1&b=2")
+	t.Setenv("CLOUD_DEPLOY_customTarget_empty", "")
+	t.Setenv("CLOUD_DEPLOY_PROJECT", "my-project")
+
+	params := FetchDeployParameters()
+	want := map[string]string{
+		"customTarget/token": "dGVzdA==",
+		"customTarget/url":   "https://example.com/?a=1&b=2",
+		"customTarget/empty": "",
+	}
+	for k, v := range want {
+		if got, ok := params[k]; !ok || got != v {
+			t.Errorf("FetchDeployParameters()[%q] got: %q, want: %q", k, got, v)
+		}
+	}
+	if _, ok := params["CLOUD_DEPLOY_PROJECT"]; ok {
+		t.Errorf("FetchDeployParameters() got Cloud Deploy env var CLOUD_DEPLOY_PROJECT, want it excluded")
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrorKind classifies why a deployer failed, each kind exits with a distinct exit code so
+// automation can decide whether a retry may succeed.
+type ErrorKind int
+
+const (
+	// The failure wasn't classified.
+	UnclassifiedError ErrorKind = iota
+	// The request uses a feature or request type the deployer doesn't support, a retry won't succeed.
+	NotSupportedError
+	// The deploy parameters or the execution environment are misconfigured, a retry won't succeed
+	// until the configuration is fixed.
+	ConfigError
+	// A call to a Google Cloud service failed, a retry may succeed.
+	TransientError
+	// A command run by the deployer failed.
+	ExecError
+)
+
+// Exit codes for each ErrorKind.
+var exitCodes = map[ErrorKind]int{
+	UnclassifiedError: 1,
+	NotSupportedError: 2,
+	ConfigError:       3,
+	TransientError:    4,
+	ExecError:         5,
+}
+
+// String returns the description of the error kind used as the prefix of the error message.
+func (k ErrorKind) String() string {
+	switch k {
+	case NotSupportedError:
+		return "not supported"
+	case ConfigError:
+		return "configuration error"
+	case TransientError:
+		return "transient error"
+	case ExecError:
+		return "execution error"
+	default:
+		return "error"
+	}
+}
+
+// deployerError is an error classified with an ErrorKind.
+type deployerError struct {
+	kind ErrorKind
+	err  error
+}
+
+// Classify returns the error classified with the provided kind. A nil error remains nil.
+func Classify(kind ErrorKind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &deployerError{kind: kind, err: err}
+}
+
+func (e *deployerError) Error() string {
+	return fmt.Sprintf("%s: %v", e.kind, e.err)
+}
+
+func (e *deployerError) Unwrap() error {
+	return e.err
+}
+
+// ExitCode returns the exit code for the error based on its ErrorKind, 0 for a nil error and 1 for
+// errors that weren't classified. If the error wraps several classified errors then the outermost
+// classification is used.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var de *deployerError
+	if errors.As(err, &de) {
+		return exitCodes[de.kind]
+	}
+	return exitCodes[UnclassifiedError]
+}
+
+// RequestError classifies an error returned by DetermineRequest. The request is not supported if it
+// includes a feature the deployer doesn't support, otherwise the request couldn't be determined from
+// the execution environment.
+func RequestError(features string, supportedFeatures []string, err error) error {
+	for _, f := range strings.Split(features, ",") {
+		if f = strings.TrimSpace(f); len(f) == 0 {
+			continue
+		}
+		supported := false
+		for _, sf := range supportedFeatures {
+			supported = supported || f == sf
+		}
+		if !supported {
+			return Classify(NotSupportedError, err)
+		}
+	}
+	return Classify(ConfigError, err)
+}
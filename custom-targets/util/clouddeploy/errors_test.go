@@ -0,0 +1,79 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "no error", want: 0},
+		{name: "unclassified", err: errors.New("failed"), want: 1},
+		{name: "not supported", err: Classify(NotSupportedError, errors.New("failed")), want: 2},
+		{name: "config", err: Classify(ConfigError, errors.New("failed")), want: 3},
+		{name: "transient", err: Classify(TransientError, errors.New("failed")), want: 4},
+		{name: "exec", err: Classify(ExecError, errors.New("failed")), want: 5},
+		{name: "wrapped", err: fmt.Errorf("outer: %w", Classify(ConfigError, errors.New("failed"))), want: 3},
+		{name: "classified nil", err: Classify(ConfigError, nil), want: 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ExitCode(tc.err); got != tc.want {
+				t.Errorf("ExitCode(%v) got: %d, want: %d", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExitCodesDistinct(t *testing.T) {
+	seen := map[int]ErrorKind{}
+	for kind, code := range exitCodes {
+		if other, ok := seen[code]; ok {
+			t.Errorf("%q and %q share exit code %d", kind, other, code)
+		}
+		seen[code] = kind
+	}
+}
+
+func TestDeployerErrorMessage(t *testing.T) {
+	inner := errors.New("parameter \"x\" must not be negative")
+	err := Classify(ConfigError, inner)
+	if got, want := err.Error(), "configuration error: parameter \"x\" must not be negative"; got != want {
+		t.Errorf("Error() got: %q, want: %q", got, want)
+	}
+	if !errors.Is(err, inner) {
+		t.Errorf("classified error doesn't wrap the original error")
+	}
+}
+
+func TestRequestError(t *testing.T) {
+	err := errors.New("failed")
+	if got := ExitCode(RequestError("CANARY", nil, err)); got != exitCodes[NotSupportedError] {
+		t.Errorf("RequestError() with an unsupported feature got exit code: %d, want: %d", got, exitCodes[NotSupportedError])
+	}
+	if got := ExitCode(RequestError("CANARY", []string{"CANARY"}, err)); got != exitCodes[ConfigError] {
+		t.Errorf("RequestError() with supported features got exit code: %d, want: %d", got, exitCodes[ConfigError])
+	}
+	if got := ExitCode(RequestError("", nil, err)); got != exitCodes[ConfigError] {
+		t.Errorf("RequestError() without features got exit code: %d, want: %d", got, exitCodes[ConfigError])
+	}
+}
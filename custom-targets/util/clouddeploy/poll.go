@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrPollTimeout is returned, wrapped, by PollUntil when the condition isn't met before the timeout.
+var ErrPollTimeout = errors.New("timed out polling")
+
+// PollFunc is called by PollUntil on each attempt and returns whether the condition is met. A returned
+// error is considered transient and polling continues, unless it's wrapped with FatalPollError.
+type PollFunc func(ctx context.Context) (bool, error)
+
+// fatalPollError is an error that stops the polling.
+type fatalPollError struct {
+	err error
+}
+
+func (e *fatalPollError) Error() string {
+	return e.err.Error()
+}
+
+func (e *fatalPollError) Unwrap() error {
+	return e.err
+}
+
+// FatalPollError wraps the error so PollUntil stops polling and returns it.
+func FatalPollError(err error) error {
+	return &fatalPollError{err: err}
+}
+
+// PollUntil calls fn immediately and then every interval until it reports the condition is met, it returns
+// a fatal error, the timeout elapses or the context is canceled. A timeout of zero or less only stops
+// polling when the context is done. On timeout the returned error wraps ErrPollTimeout and includes the
+// last transient error, and on cancellation it wraps the context error.
+func PollUntil(ctx context.Context, interval, timeout time.Duration, fn PollFunc) error {
+	pollCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		pollCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		done, err := fn(pollCtx)
+		var fatal *fatalPollError
+		switch {
+		case errors.As(err, &fatal):
+			return fatal.err
+		case err != nil:
+			lastErr = err
+		case done:
+			return nil
+		}
+
+		select {
+		case <-pollCtx.Done():
+			if ctx.Err() != nil {
+				return fmt.Errorf("polling canceled: %w", ctx.Err())
+			}
+			if lastErr != nil {
+				return fmt.Errorf("%w after %v, last error: %v", ErrPollTimeout, timeout, lastErr)
+			}
+			return fmt.Errorf("%w after %v", ErrPollTimeout, timeout)
+		case <-ticker.C:
+		}
+	}
+}
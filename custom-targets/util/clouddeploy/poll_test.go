@@ -0,0 +1,106 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPollUntil(t *testing.T) {
+	transient := errors.New("not synced yet")
+	fatal := errors.New("application not found")
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		results  []error
+		neverMet bool
+		wantErr  error
+		wantMsg  string
+		wantCall int
+	}{
+		{
+			name:     "met immediately",
+			timeout:  time.Second,
+			wantCall: 1,
+		},
+		{
+			name:     "met after transient errors",
+			timeout:  time.Second,
+			results:  []error{transient, transient},
+			wantCall: 3,
+		},
+		{
+			name:     "fatal error",
+			timeout:  time.Second,
+			results:  []error{transient, FatalPollError(fatal)},
+			wantErr:  fatal,
+			wantCall: 2,
+		},
+		{
+			name:     "timeout",
+			timeout:  50 * time.Millisecond,
+			results:  []error{transient},
+			neverMet: true,
+			wantErr:  ErrPollTimeout,
+			wantMsg:  "last error: not synced yet",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			err := PollUntil(context.Background(), 10*time.Millisecond, tc.timeout, func(ctx context.Context) (bool, error) {
+				calls++
+				if calls <= len(tc.results) {
+					return false, tc.results[calls-1]
+				}
+				return !tc.neverMet, nil
+			})
+			if !errors.Is(err, tc.wantErr) || (tc.wantErr == nil && err != nil) {
+				t.Fatalf("PollUntil() got err: %v, want: %v", err, tc.wantErr)
+			}
+			if tc.wantMsg != "" && !strings.Contains(err.Error(), tc.wantMsg) {
+				t.Errorf("PollUntil() got err: %v, want containing: %q", err, tc.wantMsg)
+			}
+			if tc.wantCall != 0 && calls != tc.wantCall {
+				t.Errorf("got: %d calls, want: %d", calls, tc.wantCall)
+			}
+		})
+	}
+}
+
+func TestPollUntilCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := PollUntil(ctx, 10*time.Millisecond, 0, func(ctx context.Context) (bool, error) {
+		calls++
+		if calls == 2 {
+			cancel()
+		}
+		return false, nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("PollUntil() got err: %v, want: %v", err, context.Canceled)
+	}
+	if errors.Is(err, ErrPollTimeout) {
+		t.Errorf("PollUntil() reported a timeout for a canceled context: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("got: %d calls, want: 2", calls)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	deployapi "google.golang.org/api/clouddeploy/v1"
+)
+
+// rolloutSucceededState is the state of a Cloud Deploy rollout that completed successfully.
+const rolloutSucceededState = "SUCCEEDED"
+
+// PreviousDeploy is the most recent successful deploy to the target of a request, before the request's rollout.
+// Since it's looked up on a best-effort basis any of the fields other than Rollout may be empty, e.g. when the
+// previous deploy's results were deleted by the bucket's lifecycle policy.
+type PreviousDeploy struct {
+	// Resource name of the rollout of the previous deploy.
+	Rollout string
+	// Cloud Storage path where the outputs of the previous deploy were stored. Empty if Cloud Deploy didn't
+	// record it on the rollout's deploy job run.
+	OutputGCSPath string
+	// Result of the previous deploy, nil if its results file isn't present.
+	Result *DeployResult
+}
+
+// Metadata returns the metadata of the previous deploy's result, nil if the result isn't present.
+func (p *PreviousDeploy) Metadata() map[string]string {
+	if p == nil || p.Result == nil {
+		return nil
+	}
+	return p.Result.Metadata
+}
+
+// FindPreviousDeploy looks up the most recent successful rollout to the request's target in the request's delivery
+// pipeline, other than the request's rollout, and downloads its deploy result. Returns nil if there's no previous
+// successful rollout. The lookup is best-effort: a missing output path or results file isn't an error, the
+// corresponding fields of the PreviousDeploy are left empty.
+func (d *DeployRequest) FindPreviousDeploy(ctx context.Context, gcsClient *storage.Client, service *deployapi.Service) (*PreviousDeploy, error) {
+	rollout, err := previousRollout(ctx, service, d)
+	if err != nil {
+		return nil, err
+	}
+	if rollout == nil {
+		return nil, nil
+	}
+	prev := &PreviousDeploy{Rollout: rollout.Name}
+	prev.OutputGCSPath, err = deployOutputPath(ctx, service, rollout.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(prev.OutputGCSPath) == 0 {
+		return prev, nil
+	}
+	prev.Result, err = d.downloadDeployResult(ctx, gcsClient, prev.OutputGCSPath)
+	if err != nil {
+		return nil, err
+	}
+	return prev, nil
+}
+
+// previousRollout returns the succeeded rollout to the request's target that finished deploying last, excluding
+// the request's rollout. Returns nil if there's none.
+func previousRollout(ctx context.Context, service *deployapi.Service, d *DeployRequest) (*deployapi.Rollout, error) {
+	// The "-" wildcard lists the rollouts of all the releases of the delivery pipeline.
+	parent := fmt.Sprintf("projects/%s/locations/%s/deliveryPipelines/%s/releases/-", d.Project, d.Location, d.Pipeline)
+	filter := fmt.Sprintf("targetId=%q AND state=%q", d.Target, rolloutSucceededState)
+	var latest *deployapi.Rollout
+	err := service.Projects.Locations.DeliveryPipelines.Releases.Rollouts.List(parent).Filter(filter).Pages(ctx, func(resp *deployapi.ListRolloutsResponse) error {
+		for _, r := range resp.Rollouts {
+			// The filter is applied again in case the API ignores it.
+			if r.TargetId != d.Target || r.State != rolloutSucceededState || path.Base(r.Name) == d.Rollout {
+				continue
+			}
+			// The end times are RFC 3339 timestamps in UTC, so they sort lexicographically.
+			if latest == nil || r.DeployEndTime > latest.DeployEndTime {
+				latest = r
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list rollouts: %v", err)
+	}
+	return latest, nil
+}
+
+// deployOutputPath returns the Cloud Storage path of the outputs of the rollout's last deploy job run. Returns an
+// empty string if none of the job runs recorded it.
+func deployOutputPath(ctx context.Context, service *deployapi.Service, rollout string) (string, error) {
+	var outputPath, endTime string
+	err := service.Projects.Locations.DeliveryPipelines.Releases.Rollouts.JobRuns.List(rollout).Pages(ctx, func(resp *deployapi.ListJobRunsResponse) error {
+		for _, jr := range resp.JobRuns {
+			if jr.DeployJobRun == nil || jr.DeployJobRun.Artifact == nil || len(jr.DeployJobRun.Artifact.ArtifactUri) == 0 {
+				continue
+			}
+			if len(outputPath) == 0 || jr.EndTime > endTime {
+				outputPath = strings.TrimSuffix(jr.DeployJobRun.Artifact.ArtifactUri, "/")
+				endTime = jr.EndTime
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to list job runs of rollout %s: %v", rollout, err)
+	}
+	return outputPath, nil
+}
+
+// downloadDeployResult downloads and parses the deploy result stored under the output path. Returns nil if the
+// results file isn't present.
+func (d *DeployRequest) downloadDeployResult(ctx context.Context, gcsClient *storage.Client, outputPath string) (*DeployResult, error) {
+	dir, err := os.MkdirTemp("", "previous-deploy")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	uri := fmt.Sprintf("%s/%s", outputPath, resultObjectSuffix)
+	localPath := filepath.Join(dir, resultObjectSuffix)
+	if err := storageOrGCS(d.Storage, gcsClient).Download(ctx, uri, localPath); err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to download previous deploy result %s: %v", uri, err)
+	}
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return nil, err
+	}
+	res := &DeployResult{}
+	if err := json.Unmarshal(data, res); err != nil {
+		return nil, fmt.Errorf("unable to parse previous deploy result %s: %v", uri, err)
+	}
+	return res, nil
+}
+
+// DownloadPreviousArtifacts downloads the artifacts of the previous deploy's result into the local directory, named
+// after the last element of their URI. Artifacts that are no longer present are skipped. Returns the local paths
+// of the downloaded artifacts.
+func (d *DeployRequest) DownloadPreviousArtifacts(ctx context.Context, gcsClient *storage.Client, prev *PreviousDeploy, localDir string) ([]string, error) {
+	if prev == nil || prev.Result == nil {
+		return nil, nil
+	}
+	var paths []string
+	for _, uri := range prev.Result.ArtifactFiles {
+		localPath := filepath.Join(localDir, path.Base(uri))
+		if err := storageOrGCS(d.Storage, gcsClient).Download(ctx, uri, localPath); err != nil {
+			if isNotFound(err) {
+				fmt.Printf("Previous deploy artifact %s is no longer present, skipping\n", uri)
+				continue
+			}
+			return nil, fmt.Errorf("unable to download previous deploy artifact %s: %v", uri, err)
+		}
+		paths = append(paths, localPath)
+	}
+	return paths, nil
+}
+
+// isNotFound returns whether the error is due to a missing object.
+func isNotFound(err error) bool {
+	return errors.Is(err, storage.ErrObjectNotExist) || errors.Is(err, os.ErrNotExist)
+}
@@ -0,0 +1,153 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	deployapi "google.golang.org/api/clouddeploy/v1"
+	"google.golang.org/api/option"
+)
+
+// newFakeDeployService returns a Cloud Deploy service backed by a fake API serving the provided rollouts, and
+// a deploy job run writing to the output path for each rollout with one.
+func newFakeDeployService(t *testing.T, rollouts []*deployapi.Rollout, outputPaths map[string]string) *deployapi.Service {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/v1/")
+		switch {
+		case strings.HasSuffix(name, "/releases/-/rollouts"):
+			json.NewEncoder(w).Encode(&deployapi.ListRolloutsResponse{Rollouts: rollouts})
+		case strings.HasSuffix(name, "/jobRuns"):
+			resp := &deployapi.ListJobRunsResponse{}
+			if p, ok := outputPaths[strings.TrimSuffix(name, "/jobRuns")]; ok {
+				resp.JobRuns = []*deployapi.JobRun{
+					{Name: "verify", VerifyJobRun: &deployapi.VerifyJobRun{}},
+					{Name: "deploy", EndTime: "2024-01-01T00:00:00Z", DeployJobRun: &deployapi.DeployJobRun{Artifact: &deployapi.DeployArtifact{ArtifactUri: p + "/"}}},
+				}
+			}
+			json.NewEncoder(w).Encode(resp)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	service, err := deployapi.NewService(context.Background(), option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("failed to create cloud deploy service: %v", err)
+	}
+	return service
+}
+
+const testReleases = "projects/p/locations/us-central1/deliveryPipelines/dp/releases"
+
+func TestFindPreviousDeploy(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeGCSServer(t)
+	rollouts := []*deployapi.Rollout{
+		{Name: testReleases + "/rel-1/rollouts/r-1", TargetId: "prod", State: "SUCCEEDED", DeployEndTime: "2024-01-01T00:00:00Z"},
+		{Name: testReleases + "/rel-2/rollouts/r-2", TargetId: "prod", State: "SUCCEEDED", DeployEndTime: "2024-01-02T00:00:00Z"},
+		{Name: testReleases + "/rel-3/rollouts/r-3", TargetId: "prod", State: "FAILED", DeployEndTime: "2024-01-03T00:00:00Z"},
+		{Name: testReleases + "/rel-3/rollouts/r-4", TargetId: "staging", State: "SUCCEEDED", DeployEndTime: "2024-01-04T00:00:00Z"},
+		{Name: testReleases + "/rel-4/rollouts/r-5", TargetId: "prod", State: "SUCCEEDED", DeployEndTime: "2024-01-05T00:00:00Z"},
+	}
+	service := newFakeDeployService(t, rollouts, map[string]string{
+		testReleases + "/rel-2/rollouts/r-2": "gs://bucket/r-2",
+	})
+	prevResult := &DeployResult{
+		ResultStatus:  DeploySucceeded,
+		ArtifactFiles: []string{"gs://bucket/r-2/manifest.yaml", "gs://bucket/r-2/deleted.yaml"},
+		Metadata:      map[string]string{"model": "model-1"},
+	}
+	data, err := json.Marshal(prevResult)
+	if err != nil {
+		t.Fatalf("unable to marshal result: %v", err)
+	}
+	fake.objects["bucket/r-2/results.json"] = data
+	fake.objects["bucket/r-2/manifest.yaml"] = []byte("kind: ConfigMap\n")
+
+	// The current rollout, r-5, is excluded.
+	req := &DeployRequest{Project: "p", Location: "us-central1", Pipeline: "dp", Target: "prod", Rollout: "r-5"}
+	prev, err := req.FindPreviousDeploy(ctx, client, service)
+	if err != nil {
+		t.Fatalf("FindPreviousDeploy() failed: %v", err)
+	}
+	want := &PreviousDeploy{Rollout: testReleases + "/rel-2/rollouts/r-2", OutputGCSPath: "gs://bucket/r-2", Result: prevResult}
+	if !reflect.DeepEqual(prev, want) {
+		t.Errorf("FindPreviousDeploy() got: %+v, want: %+v", prev, want)
+	}
+	if got := prev.Metadata()["model"]; got != "model-1" {
+		t.Errorf("Metadata() got model: %q, want: %q", got, "model-1")
+	}
+
+	dir := t.TempDir()
+	paths, err := req.DownloadPreviousArtifacts(ctx, client, prev, dir)
+	if err != nil {
+		t.Fatalf("DownloadPreviousArtifacts() failed: %v", err)
+	}
+	if want := []string{filepath.Join(dir, "manifest.yaml")}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("DownloadPreviousArtifacts() got: %v, want: %v", paths, want)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "manifest.yaml")); err != nil || string(got) != "kind: ConfigMap\n" {
+		t.Errorf("unexpected downloaded artifact, got: %q, %v", got, err)
+	}
+}
+
+func TestFindPreviousDeployResultAbsent(t *testing.T) {
+	ctx := context.Background()
+	_, client := newFakeGCSServer(t)
+	rollouts := []*deployapi.Rollout{
+		{Name: testReleases + "/rel-1/rollouts/r-1", TargetId: "prod", State: "SUCCEEDED", DeployEndTime: "2024-01-01T00:00:00Z"},
+	}
+	service := newFakeDeployService(t, rollouts, map[string]string{
+		testReleases + "/rel-1/rollouts/r-1": "gs://bucket/r-1",
+	})
+	req := &DeployRequest{Project: "p", Location: "us-central1", Pipeline: "dp", Target: "prod", Rollout: "r-2"}
+	prev, err := req.FindPreviousDeploy(ctx, client, service)
+	if err != nil {
+		t.Fatalf("FindPreviousDeploy() failed: %v", err)
+	}
+	want := &PreviousDeploy{Rollout: testReleases + "/rel-1/rollouts/r-1", OutputGCSPath: "gs://bucket/r-1"}
+	if !reflect.DeepEqual(prev, want) {
+		t.Errorf("FindPreviousDeploy() got: %+v, want: %+v", prev, want)
+	}
+	if prev.Metadata() != nil {
+		t.Errorf("Metadata() got: %v, want: nil", prev.Metadata())
+	}
+	if paths, err := req.DownloadPreviousArtifacts(ctx, client, prev, t.TempDir()); err != nil || len(paths) != 0 {
+		t.Errorf("DownloadPreviousArtifacts() got: %v, %v, want no artifacts", paths, err)
+	}
+}
+
+func TestFindPreviousDeployFirstDeploy(t *testing.T) {
+	_, client := newFakeGCSServer(t)
+	service := newFakeDeployService(t, nil, nil)
+	req := &DeployRequest{Project: "p", Location: "us-central1", Pipeline: "dp", Target: "prod", Rollout: "r-1"}
+	prev, err := req.FindPreviousDeploy(context.Background(), client, service)
+	if err != nil {
+		t.Fatalf("FindPreviousDeploy() failed: %v", err)
+	}
+	if prev != nil {
+		t.Errorf("FindPreviousDeploy() got: %+v, want: nil", prev)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// RedactedValue replaces the value of a sensitive deploy parameter or variable in logs.
+const RedactedValue = "[REDACTED]"
+
+// keyWordSeparatorRegex matches the separators between the words of a key, e.g. "db_password" or "api-key".
+var keyWordSeparatorRegex = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// IsSensitiveKey returns whether the key of a deploy parameter or variable names a sensitive value. A key is
+// sensitive if any of its words is "secret", "token", "password" or "passwd", or if its last word is "key",
+// e.g. "DB_PASSWORD", "customTarget/authToken" or "api_key" but not "kmsKeyName". Words are separated by
+// non-alphanumeric characters or camel case.
+func IsSensitiveKey(key string) bool {
+	words := keyWords(key)
+	for _, w := range words {
+		switch w {
+		case "secret", "secrets", "token", "tokens", "password", "passwords", "passwd":
+			return true
+		}
+	}
+	return len(words) != 0 && (words[len(words)-1] == "key" || words[len(words)-1] == "apikey")
+}
+
+// RedactSensitive returns the value to log for the provided key, which is RedactedValue if the key names a
+// sensitive value and the value isn't empty, otherwise the value itself.
+func RedactSensitive(key, value string) string {
+	if len(value) != 0 && IsSensitiveKey(key) {
+		return RedactedValue
+	}
+	return value
+}
+
+// keyWords splits the key into lowercase words on non-alphanumeric characters and camel case boundaries.
+func keyWords(key string) []string {
+	var words []string
+	for _, part := range keyWordSeparatorRegex.Split(key, -1) {
+		start := 0
+		runes := []rune(part)
+		for i := 1; i < len(runes); i++ {
+			if unicode.IsUpper(runes[i]) && unicode.IsLower(runes[i-1]) {
+				words = append(words, strings.ToLower(string(runes[start:i])))
+				start = i
+			}
+		}
+		if start < len(runes) {
+			words = append(words, strings.ToLower(string(runes[start:])))
+		}
+	}
+	return words
+}
@@ -0,0 +1,47 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import "testing"
+
+func TestRedactSensitive(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		want  string
+	}{
+		{key: "DB_PASSWORD", value: "hunter2", want: RedactedValue},
+		{key: "TF_VAR_db_passwd", value: "hunter2", want: RedactedValue},
+		{key: "customTarget/authToken", value: "abc", want: RedactedValue},
+		{key: "CLOUD_DEPLOY_customTarget_githubToken", value: "abc", want: RedactedValue},
+		{key: "client-secret", value: "abc", want: RedactedValue},
+		{key: "api_key", value: "abc", want: RedactedValue},
+		{key: "apiKey", value: "abc", want: RedactedValue},
+		{key: "APIKEY", value: "abc", want: RedactedValue},
+		{key: "PrivateKey", value: "abc", want: RedactedValue},
+		{key: "kmsKeyName", value: "projects/p", want: "projects/p"},
+		{key: "keyring", value: "ring", want: "ring"},
+		{key: "region", value: "us-central1", want: "us-central1"},
+		{key: "tokenizer_model", value: "bert", want: "bert"},
+		{key: "password", value: "", want: ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.key, func(t *testing.T) {
+			if got := RedactSensitive(tc.key, tc.value); got != tc.want {
+				t.Errorf("RedactSensitive(%q, %q) got: %q, want: %q", tc.key, tc.value, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// Environment variables configuring the S3 storage, following the conventions of the AWS CLI and SDKs.
+const (
+	s3AccessKeyIDEnvKey     = "AWS_ACCESS_KEY_ID"
+	s3SecretAccessKeyEnvKey = "AWS_SECRET_ACCESS_KEY"
+	s3SessionTokenEnvKey    = "AWS_SESSION_TOKEN"
+	s3RegionEnvKey          = "AWS_REGION"
+	s3DefaultRegionEnvKey   = "AWS_DEFAULT_REGION"
+	// Endpoint of an S3-compatible service, e.g. a MinIO server. Takes precedence over AWS_ENDPOINT_URL.
+	s3EndpointEnvKey       = "AWS_ENDPOINT_URL_S3"
+	s3GlobalEndpointEnvKey = "AWS_ENDPOINT_URL"
+)
+
+// s3DefaultRegion is the region used when neither AWS_REGION nor AWS_DEFAULT_REGION is set.
+const s3DefaultRegion = "us-east-1"
+
+// S3Storage is a Storage backed by Amazon S3 or an S3-compatible service such as MinIO, where the URIs have the
+// form "s3://{bucket}/{key}". Requests are authenticated with AWS Signature Version 4. It's selected when the
+// storage type is "S3", the upload options specific to Cloud Storage, e.g. the KMS key, are ignored.
+type S3Storage struct {
+	// Endpoint of the service. Objects are addressed with the bucket in the host unless pathStyle is set.
+	endpoint    *url.URL
+	pathStyle   bool
+	region      string
+	credentials aws.Credentials
+	signer      *v4.Signer
+	client      *http.Client
+	now         func() time.Time
+}
+
+// NewS3StorageFromEnv returns an S3Storage configured with the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+// AWS_SESSION_TOKEN, AWS_REGION and AWS_ENDPOINT_URL_S3 environment variables. When a custom endpoint is set the
+// objects are addressed with the bucket in the path, as S3-compatible services expect.
+func NewS3StorageFromEnv() (*S3Storage, error) {
+	accessKeyID := os.Getenv(s3AccessKeyIDEnvKey)
+	secretAccessKey := os.Getenv(s3SecretAccessKeyEnvKey)
+	if len(accessKeyID) == 0 || len(secretAccessKey) == 0 {
+		return nil, fmt.Errorf("%s and %s must be set to use S3 storage", s3AccessKeyIDEnvKey, s3SecretAccessKeyEnvKey)
+	}
+	region := os.Getenv(s3RegionEnvKey)
+	if len(region) == 0 {
+		region = os.Getenv(s3DefaultRegionEnvKey)
+	}
+	if len(region) == 0 {
+		region = s3DefaultRegion
+	}
+	endpoint := os.Getenv(s3EndpointEnvKey)
+	if len(endpoint) == 0 {
+		endpoint = os.Getenv(s3GlobalEndpointEnvKey)
+	}
+	pathStyle := len(endpoint) != 0
+	if !pathStyle {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid S3 endpoint %q, expected a URL such as https://minio.example.com:9000", endpoint)
+	}
+	return &S3Storage{
+		endpoint:  u,
+		pathStyle: pathStyle,
+		region:    region,
+		credentials: aws.Credentials{
+			AccessKeyID:     accessKeyID,
+			SecretAccessKey: secretAccessKey,
+			SessionToken:    os.Getenv(s3SessionTokenEnvKey),
+		},
+		signer: newS3Signer(),
+		client: http.DefaultClient,
+		now:    time.Now,
+	}, nil
+}
+
+// Download downloads the S3 object at the provided URI to the local path. A missing object returns an error
+// wrapping os.ErrNotExist.
+func (s *S3Storage) Download(ctx context.Context, uri, localPath string) error {
+	resp, err := s.do(ctx, http.MethodGet, uri, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("object %q not found: %w", uri, os.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unable to download %s, status: %s, body: %q", uri, resp.Status, body)
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), os.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Upload uploads the provided content to the S3 object at the provided URI.
+func (s *S3Storage) Upload(ctx context.Context, uri string, content *GCSUploadContent) error {
+	data, err := content.read()
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodPut, uri, data, content.ContentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unable to upload %s, status: %s, body: %q", uri, resp.Status, body)
+	}
+	return nil
+}
+
+// do sends a signed request for the S3 object at the provided URI with the provided body.
+func (s *S3Storage) do(ctx context.Context, method, uri string, body []byte, contentType string) (*http.Response, error) {
+	bucket, key, err := parseS3URI(uri)
+	if err != nil {
+		return nil, err
+	}
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + "/" + key
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	// The path is sent as it's signed, which requires escaping every character but the unreserved ones.
+	u.RawPath = s3EscapePath(u.Path)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request: %v", err)
+	}
+	if len(contentType) != 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if err := s.sign(ctx, req, body, s.now()); err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to send request for %s: %v", uri, err)
+	}
+	return resp, nil
+}
+
+// newS3Signer returns an AWS Signature Version 4 signer for S3, which signs the request path as it's sent
+// rather than escaping it a second time.
+func newS3Signer() *v4.Signer {
+	return v4.NewSigner(func(o *v4.SignerOptions) {
+		o.DisableURIPathEscaping = true
+	})
+}
+
+// sign adds the x-amz-content-sha256 header S3 requires and the AWS Signature Version 4 Authorization header
+// to the request.
+func (s *S3Storage) sign(ctx context.Context, req *http.Request, body []byte, t time.Time) error {
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if err := s.signer.SignHTTP(ctx, s.credentials, req, payloadHash, "s3", s.region, t); err != nil {
+		return fmt.Errorf("unable to sign request: %v", err)
+	}
+	return nil
+}
+
+// parseS3URI splits a URI of the form "s3://{bucket}/{key}" into the bucket and key.
+func parseS3URI(uri string) (string, string, error) {
+	trimmed, ok := strings.CutPrefix(uri, "s3://")
+	if !ok {
+		return "", "", fmt.Errorf("%q is not an S3 URI, must start with s3://", uri)
+	}
+	bucket, key, _ := strings.Cut(trimmed, "/")
+	if len(bucket) == 0 || len(key) == 0 {
+		return "", "", fmt.Errorf("%q must have the form s3://{bucket}/{key}", uri)
+	}
+	return bucket, key, nil
+}
+
+// s3EscapePath escapes every character of the path other than the unreserved characters of RFC 3986 and the
+// "/" separators, as AWS Signature Version 4 expects.
+func s3EscapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,44 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+)
+
+// AccessSecretVersion accesses the provided Secret Manager secret version and returns the data payload. The
+// checksum of the data is verified when Secret Manager provides one for the secret version.
+func AccessSecretVersion(ctx context.Context, client *secretmanager.Client, svName string) ([]byte, error) {
+	res, err := client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+		Name: svName,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to access secret version %s: %v", svName, err)
+	}
+
+	if res.Payload.DataCrc32C != nil {
+		crc32c := crc32.MakeTable(crc32.Castagnoli)
+		checksum := int64(crc32.Checksum(res.Payload.Data, crc32c))
+		if checksum != *res.Payload.DataCrc32C {
+			return nil, fmt.Errorf("data corruption detected with secret version %s", svName)
+		}
+	}
+	return res.Payload.Data, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import (
+	"context"
+	"hash/crc32"
+	"net"
+	"testing"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// fakeSecretManagerServer is a fake Secret Manager API that returns the same payload for every secret version.
+type fakeSecretManagerServer struct {
+	secretmanagerpb.UnimplementedSecretManagerServiceServer
+	payload *secretmanagerpb.SecretPayload
+}
+
+func (f *fakeSecretManagerServer) AccessSecretVersion(ctx context.Context, req *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+	return &secretmanagerpb.AccessSecretVersionResponse{Name: req.Name, Payload: f.payload}, nil
+}
+
+func TestAccessSecretVersion(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	fake := &fakeSecretManagerServer{}
+	srv := grpc.NewServer()
+	secretmanagerpb.RegisterSecretManagerServiceServer(srv, fake)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	ctx := context.Background()
+	smClient, err := secretmanager.NewClient(ctx,
+		option.WithEndpoint(lis.Addr().String()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	)
+	if err != nil {
+		t.Fatalf("unable to create secret manager client: %v", err)
+	}
+	defer smClient.Close()
+
+	data := []byte("registry-password")
+	checksum := int64(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	wrongChecksum := checksum + 1
+	tests := []struct {
+		name    string
+		payload *secretmanagerpb.SecretPayload
+		wantErr bool
+	}{
+		{
+			name:    "matching checksum",
+			payload: &secretmanagerpb.SecretPayload{Data: data, DataCrc32C: &checksum},
+		},
+		{
+			name:    "no checksum",
+			payload: &secretmanagerpb.SecretPayload{Data: data},
+		},
+		{
+			name:    "mismatched checksum",
+			payload: &secretmanagerpb.SecretPayload{Data: data, DataCrc32C: &wrongChecksum},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.payload = tc.payload
+			got, err := AccessSecretVersion(ctx, smClient, "projects/p/secrets/s/versions/1")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("AccessSecretVersion() got err: %v, want err: %v", err, tc.wantErr)
+			}
+			if !tc.wantErr && string(got) != string(data) {
+				t.Errorf("AccessSecretVersion() got: %q, want: %q", got, data)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// Storage provides access to the storage backend holding the inputs and outputs of a Cloud Deploy request.
+type Storage interface {
+	// Download downloads the object at the provided URI to the local path.
+	Download(ctx context.Context, uri, localPath string) error
+	// Upload uploads the provided content to the object at the provided URI.
+	Upload(ctx context.Context, uri string, content *GCSUploadContent) error
+}
+
+// GCSStorage is a Storage backed by Cloud Storage.
+type GCSStorage struct {
+	client *storage.Client
+}
+
+// NewGCSStorage returns a Storage that uses the provided Cloud Storage client.
+func NewGCSStorage(client *storage.Client) *GCSStorage {
+	return &GCSStorage{client: client}
+}
+
+// Download downloads the Cloud Storage object at the provided URI to the local path.
+func (s *GCSStorage) Download(ctx context.Context, uri, localPath string) error {
+	_, err := downloadGCS(ctx, s.client, uri, localPath)
+	return err
+}
+
+// Upload uploads the provided content to the Cloud Storage object at the provided URI.
+func (s *GCSStorage) Upload(ctx context.Context, uri string, content *GCSUploadContent) error {
+	return uploadGCS(ctx, s.client, uri, content)
+}
+
+// MemoryStorage is a Storage that keeps objects in memory, keyed by URI. It's intended for tests.
+type MemoryStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+// NewMemoryStorage returns an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{objects: map[string][]byte{}}
+}
+
+// Put stores the data as the object at the provided URI.
+func (s *MemoryStorage) Put(uri string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[uri] = append([]byte(nil), data...)
+}
+
+// Get returns the data of the object at the provided URI and whether the object exists.
+func (s *MemoryStorage) Get(uri string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[uri]
+	return append([]byte(nil), data...), ok
+}
+
+// Download writes the object at the provided URI to the local path.
+func (s *MemoryStorage) Download(ctx context.Context, uri, localPath string) error {
+	data, ok := s.Get(uri)
+	if !ok {
+		return fmt.Errorf("object %q not found: %w", uri, os.ErrNotExist)
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(localPath, data, 0644)
+}
+
+// Upload stores the provided content as the object at the provided URI.
+func (s *MemoryStorage) Upload(ctx context.Context, uri string, content *GCSUploadContent) error {
+	data, err := content.read()
+	if err != nil {
+		return err
+	}
+	s.Put(uri, data)
+	return nil
+}
+
+// LocalStorage is a Storage backed by the local filesystem, where the URIs are file paths or "file://" URIs.
+// It's selected when the storage type is "LOCAL" and is intended for testing the deployers end to end without
+// Cloud Storage, it's not supported by Cloud Deploy.
+type LocalStorage struct{}
+
+// NewLocalStorage returns a Storage backed by the local filesystem.
+func NewLocalStorage() *LocalStorage {
+	return &LocalStorage{}
+}
+
+// Download copies the file at the provided URI to the local path.
+func (s *LocalStorage) Download(ctx context.Context, uri, localPath string) error {
+	data, err := os.ReadFile(localPathFromURI(uri))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(localPath, data, 0644)
+}
+
+// Upload writes the provided content to the file at the provided URI, creating any missing directories.
+func (s *LocalStorage) Upload(ctx context.Context, uri string, content *GCSUploadContent) error {
+	data, err := content.read()
+	if err != nil {
+		return err
+	}
+	path := localPathFromURI(uri)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// localPathFromURI returns the file path for a local storage URI.
+func localPathFromURI(uri string) string {
+	return strings.TrimPrefix(uri, "file://")
+}
+
+// newStorage returns the Storage for the storage type of the request. An unknown storage type returns an error
+// without accessing any storage backend.
+func newStorage(storageType string, gcsClient *storage.Client) (Storage, error) {
+	switch storageType {
+	case "", GCSStorageType:
+		return NewGCSStorage(gcsClient), nil
+	case LocalStorageType:
+		return NewLocalStorage(), nil
+	case S3StorageType:
+		s, err := NewS3StorageFromEnv()
+		if err != nil {
+			return nil, fmt.Errorf("unable to configure S3 storage: %v", err)
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unsupported storage type %q in %s, must be one of %q, %q or %q", storageType, StorageTypeEnvKey, GCSStorageType, S3StorageType, LocalStorageType)
+	}
+}
+
+// storageOrGCS returns the provided Storage, or a Storage backed by the Cloud Storage client if it's nil.
+func storageOrGCS(s Storage, gcsClient *storage.Client) Storage {
+	if s != nil {
+		return s
+	}
+	return NewGCSStorage(gcsClient)
+}
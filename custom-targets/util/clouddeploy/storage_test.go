@@ -0,0 +1,276 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mholt/archiver/v3"
+)
+
+func TestRenderRequestWithMemoryStorage(t *testing.T) {
+	ctx := context.Background()
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "main.tf"), []byte("# terraform\n"), 0644); err != nil {
+		t.Fatalf("unable to write source file: %v", err)
+	}
+	archivePath := filepath.Join(t.TempDir(), "source.tgz")
+	if err := archiver.NewTarGz().Archive([]string{filepath.Join(srcDir, "main.tf")}, archivePath); err != nil {
+		t.Fatalf("unable to create archive: %v", err)
+	}
+	archive, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatalf("unable to read archive: %v", err)
+	}
+
+	s := NewMemoryStorage()
+	s.Put("gs://bucket/source.tgz", archive)
+	req := &RenderRequest{
+		InputGCSPath:  "gs://bucket/source.tgz",
+		OutputGCSPath: "gs://bucket/render",
+		Storage:       s,
+	}
+
+	workDir := t.TempDir()
+	uri, err := req.DownloadAndUnarchiveInput(ctx, nil, filepath.Join(workDir, "archive.tgz"), filepath.Join(workDir, "source"))
+	if err != nil {
+		t.Fatalf("DownloadAndUnarchiveInput() failed: %v", err)
+	}
+	if uri != "gs://bucket/source.tgz" {
+		t.Errorf("DownloadAndUnarchiveInput() uri = %q, want %q", uri, "gs://bucket/source.tgz")
+	}
+	got, err := os.ReadFile(filepath.Join(workDir, "source", "main.tf"))
+	if err != nil {
+		t.Fatalf("unable to read unarchived file: %v", err)
+	}
+	if string(got) != "# terraform\n" {
+		t.Errorf("unarchived file content = %q, want %q", got, "# terraform\n")
+	}
+
+	mURI, err := req.UploadArtifact(ctx, nil, "manifest.yaml", &GCSUploadContent{Data: []byte("kind: Pod\n")})
+	if err != nil {
+		t.Fatalf("UploadArtifact() failed: %v", err)
+	}
+	if data, ok := s.Get(mURI); !ok || string(data) != "kind: Pod\n" {
+		t.Errorf("uploaded artifact at %q = %q, %v", mURI, data, ok)
+	}
+
+	rURI, err := req.UploadResult(ctx, nil, &RenderResult{ResultStatus: RenderSucceeded, ManifestFile: mURI})
+	if err != nil {
+		t.Fatalf("UploadResult() failed: %v", err)
+	}
+	if rURI != "gs://bucket/render/results.json" {
+		t.Errorf("UploadResult() uri = %q, want %q", rURI, "gs://bucket/render/results.json")
+	}
+	data, _ := s.Get(rURI)
+	var res RenderResult
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatalf("unable to parse uploaded result: %v", err)
+	}
+	want := RenderResult{ResultStatus: RenderSucceeded, ManifestFile: "gs://bucket/render/manifest.yaml"}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("uploaded result = %+v, want %+v", res, want)
+	}
+}
+
+func TestDeployRequestWithMemoryStorage(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	s.Put("gs://bucket/render/manifest.yaml", []byte("kind: Pod\n"))
+	s.Put("gs://bucket/render/plan.json", []byte("{}"))
+	req := &DeployRequest{
+		InputGCSPath:    "gs://bucket/render",
+		ManifestGCSPath: "gs://bucket/render/manifest.yaml",
+		OutputGCSPath:   "gs://bucket/deploy",
+		Storage:         s,
+	}
+
+	dir := t.TempDir()
+	if _, err := req.DownloadManifest(ctx, nil, filepath.Join(dir, "manifest.yaml")); err != nil {
+		t.Fatalf("DownloadManifest() failed: %v", err)
+	}
+	if _, err := req.DownloadInput(ctx, nil, "plan.json", filepath.Join(dir, "plan.json")); err != nil {
+		t.Fatalf("DownloadInput() failed: %v", err)
+	}
+	if _, err := req.DownloadInput(ctx, nil, "missing.json", filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("DownloadInput() expected error for missing object")
+	}
+
+	localArtifact := filepath.Join(dir, "manifest.yaml")
+	aURI, err := req.UploadArtifact(ctx, nil, "manifest.yaml", &GCSUploadContent{LocalPath: localArtifact})
+	if err != nil {
+		t.Fatalf("UploadArtifact() failed: %v", err)
+	}
+	if data, ok := s.Get(aURI); !ok || string(data) != "kind: Pod\n" {
+		t.Errorf("uploaded artifact at %q = %q, %v", aURI, data, ok)
+	}
+
+	rURI, err := req.UploadResult(ctx, nil, &DeployResult{ResultStatus: DeploySucceeded, ArtifactFiles: []string{aURI}})
+	if err != nil {
+		t.Fatalf("UploadResult() failed: %v", err)
+	}
+	data, _ := s.Get(rURI)
+	var res DeployResult
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatalf("unable to parse uploaded result: %v", err)
+	}
+	if res.ResultStatus != DeploySucceeded || !reflect.DeepEqual(res.ArtifactFiles, []string{"gs://bucket/deploy/manifest.yaml"}) {
+		t.Errorf("uploaded result = %+v", res)
+	}
+}
+
+func TestGCSStorage(t *testing.T) {
+	fake, client := newFakeGCSServer(t)
+	ctx := context.Background()
+	s := NewGCSStorage(client)
+	if err := s.Upload(ctx, "gs://bucket/dir/object.txt", &GCSUploadContent{Data: []byte("hello")}); err != nil {
+		t.Fatalf("Upload() failed: %v", err)
+	}
+	if got := string(fake.objects["bucket/dir/object.txt"]); got != "hello" {
+		t.Errorf("uploaded object = %q, want %q", got, "hello")
+	}
+
+	localPath := filepath.Join(t.TempDir(), "object.txt")
+	if err := s.Download(ctx, "gs://bucket/dir/object.txt", localPath); err != nil {
+		t.Fatalf("Download() failed: %v", err)
+	}
+	if got, _ := os.ReadFile(localPath); string(got) != "hello" {
+		t.Errorf("downloaded object = %q, want %q", got, "hello")
+	}
+}
+
+func TestRenderRequestWithLocalStorage(t *testing.T) {
+	ctx := context.Background()
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "main.tf"), []byte("# terraform\n"), 0644); err != nil {
+		t.Fatalf("unable to write source file: %v", err)
+	}
+	inputDir := t.TempDir()
+	archivePath := filepath.Join(inputDir, "source.tgz")
+	if err := archiver.NewTarGz().Archive([]string{filepath.Join(srcDir, "main.tf")}, archivePath); err != nil {
+		t.Fatalf("unable to create archive: %v", err)
+	}
+	outputDir := filepath.Join(t.TempDir(), "render")
+
+	t.Setenv(RequestTypeEnvKey, "RENDER")
+	t.Setenv(PercentageEnvKey, "100")
+	t.Setenv(StorageTypeEnvKey, LocalStorageType)
+	t.Setenv(InputGCSEnvKey, "file://"+archivePath)
+	t.Setenv(OutputGCSEnvKey, outputDir)
+
+	r, err := DetermineRequest(ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("DetermineRequest() failed: %v", err)
+	}
+	req, ok := r.(*RenderRequest)
+	if !ok {
+		t.Fatalf("DetermineRequest() returned %T, want *RenderRequest", r)
+	}
+
+	workDir := t.TempDir()
+	if _, err := req.DownloadAndUnarchiveInput(ctx, nil, filepath.Join(workDir, "archive.tgz"), filepath.Join(workDir, "source")); err != nil {
+		t.Fatalf("DownloadAndUnarchiveInput() failed: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(workDir, "source", "main.tf"))
+	if err != nil {
+		t.Fatalf("unable to read unarchived file: %v", err)
+	}
+	if string(got) != "# terraform\n" {
+		t.Errorf("unarchived file content = %q, want %q", got, "# terraform\n")
+	}
+
+	mURI, err := req.UploadArtifact(ctx, nil, "manifest.yaml", &GCSUploadContent{Data: []byte("kind: Pod\n")})
+	if err != nil {
+		t.Fatalf("UploadArtifact() failed: %v", err)
+	}
+	if _, err := req.UploadResult(ctx, nil, &RenderResult{ResultStatus: RenderSucceeded, ManifestFile: mURI}); err != nil {
+		t.Fatalf("UploadResult() failed: %v", err)
+	}
+	manifest, err := os.ReadFile(filepath.Join(outputDir, "manifest.yaml"))
+	if err != nil {
+		t.Fatalf("unable to read uploaded manifest: %v", err)
+	}
+	if string(manifest) != "kind: Pod\n" {
+		t.Errorf("uploaded manifest = %q, want %q", manifest, "kind: Pod\n")
+	}
+	data, err := os.ReadFile(filepath.Join(outputDir, "results.json"))
+	if err != nil {
+		t.Fatalf("unable to read uploaded result: %v", err)
+	}
+	var res RenderResult
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatalf("unable to parse uploaded result: %v", err)
+	}
+	if res.ResultStatus != RenderSucceeded {
+		t.Errorf("uploaded result status = %q, want %q", res.ResultStatus, RenderSucceeded)
+	}
+}
+
+func TestCheckUploadSize(t *testing.T) {
+	localPath := filepath.Join(t.TempDir(), "archive.tgz")
+	if err := os.WriteFile(localPath, make([]byte, 100), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	tests := []struct {
+		name    string
+		content *GCSUploadContent
+		max     int64
+		wantErr bool
+	}{
+		{name: "no limit", content: &GCSUploadContent{Data: make([]byte, 100)}},
+		{name: "at limit", content: &GCSUploadContent{Data: make([]byte, 100)}, max: 100},
+		{name: "over limit", content: &GCSUploadContent{Data: make([]byte, 101)}, max: 100, wantErr: true},
+		{name: "file at limit", content: &GCSUploadContent{LocalPath: localPath}, max: 100},
+		{name: "file over limit", content: &GCSUploadContent{LocalPath: localPath}, max: 99, wantErr: true},
+		{name: "missing file", content: &GCSUploadContent{LocalPath: filepath.Join(t.TempDir(), "missing")}, max: 99, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CheckUploadSize("archive.tgz", tc.content, tc.max)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("CheckUploadSize() got err: %v, want err: %v", err, tc.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "archive.tgz") {
+				t.Errorf("CheckUploadSize() error doesn't name the artifact: %v", err)
+			}
+		})
+	}
+}
+
+func TestUploadArtifactMaxArtifactSize(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	req := &DeployRequest{OutputGCSPath: "gs://bucket/deploy", Storage: s, MaxArtifactSize: 10}
+
+	if _, err := req.UploadArtifact(ctx, nil, "manifest.yaml", &GCSUploadContent{Data: []byte("0123456789")}); err != nil {
+		t.Fatalf("UploadArtifact() failed: %v", err)
+	}
+	_, err := req.UploadArtifact(ctx, nil, "state.json", &GCSUploadContent{Data: []byte("0123456789a")})
+	if err == nil {
+		t.Fatalf("UploadArtifact() succeeded with an artifact over the maximum size")
+	}
+	if want := "state.json is 11 bytes, which exceeds the maximum artifact size of 10 bytes"; err.Error() != want {
+		t.Errorf("got: %q, want: %q", err.Error(), want)
+	}
+	if _, ok := s.Get("gs://bucket/deploy/state.json"); ok {
+		t.Errorf("artifact over the maximum size was uploaded")
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// WithOperationTimeout returns a copy of the provided context that is cancelled once the timeout elapses.
+// A zero timeout means there is no deadline.
+func WithOperationTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// OperationTimeoutError returns an error stating the operation exceeded the timeout if the deadline of the
+// provided context was exceeded, otherwise the provided error is returned unchanged.
+func OperationTimeoutError(ctx context.Context, timeout time.Duration, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("operation exceeded timeout of %s: %w", timeout, err)
+	}
+	return err
+}
@@ -0,0 +1,47 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clouddeploy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOperationTimeoutError(t *testing.T) {
+	opErr := errors.New("terraform apply failed")
+
+	ctx, cancel := WithOperationTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	err := OperationTimeoutError(ctx, time.Nanosecond, opErr)
+	if !strings.Contains(err.Error(), "operation exceeded timeout of 1ns") {
+		t.Errorf("OperationTimeoutError() = %q, want operation exceeded timeout error", err)
+	}
+	if !errors.Is(err, opErr) {
+		t.Errorf("OperationTimeoutError() = %v, want it to wrap %v", err, opErr)
+	}
+
+	ctx, cancel = WithOperationTimeout(context.Background(), 0)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("WithOperationTimeout() with zero timeout set a deadline")
+	}
+	if err := OperationTimeoutError(ctx, 0, opErr); err != opErr {
+		t.Errorf("OperationTimeoutError() = %v, want %v", err, opErr)
+	}
+}
@@ -2,7 +2,9 @@
 
 SOURCE_DIR="$( cd "$( dirname "${BASH_SOURCE[0]}" )" &> /dev/null && pwd )"
 
-export _CT_SRCDIR="${SOURCE_DIR}/pipeline-deployer"
+# The build context is the custom-targets directory since the deployer is built against the util module.
+export _CT_SRCDIR="${SOURCE_DIR}/.."
+export _CT_DOCKERFILE=vertex-ai-pipeline/pipeline-deployer/Dockerfile
 export _CT_IMAGE_NAME=vertexai
 export _CT_TYPE_NAME=vertex-ai-pipeline
 export _CT_CUSTOM_ACTION_NAME=vertex-ai-pipeline-deployer
@@ -0,0 +1,157 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// cancel.go contains logic to cancel a running Vertex AI pipeline job, e.g. when rolling back.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+	"google.golang.org/api/aiplatform/v1"
+)
+
+const (
+	// Deploy metadata key for the state of the pipeline job after the cancellation.
+	pipelineJobStateMetadataKey = "vertex-ai-pipeline-job-state"
+	// How often the pipeline job is polled while waiting for the cancellation to complete.
+	cancelPollInterval = 10 * time.Second
+)
+
+// cancelPipelineMode is set by the -cancel-pipeline-mode flag. When enabled the pipeline job provided via the
+// vertexAIPipelineJobName deploy parameter is cancelled instead of deploying a pipeline.
+var cancelPipelineMode bool
+
+// pipelineJobNameRegex matches the resource name of a pipeline job and captures its location.
+var pipelineJobNameRegex = regexp.MustCompile(`^projects/[^/]+/locations/([^/]+)/pipelineJobs/[^/]+$`)
+
+// terminalPipelineStates are the states of a pipeline job that no longer runs.
+var terminalPipelineStates = map[string]bool{
+	"PIPELINE_STATE_SUCCEEDED": true,
+	"PIPELINE_STATE_FAILED":    true,
+	"PIPELINE_STATE_CANCELLED": true,
+}
+
+// canceller implements the handler interface to cancel a running pipeline job.
+type canceller struct {
+	gcsClient         *storage.Client
+	aiPlatformService *aiplatform.Service
+	req               *clouddeploy.DeployRequest
+	// Resource name of the pipeline job to cancel.
+	jobName      string
+	pollInterval time.Duration
+}
+
+// newCancelHandler returns a handler for cancelling the pipeline job provided via the
+// vertexAIPipelineJobName deploy parameter.
+func newCancelHandler(ctx context.Context, cloudDeployRequest interface{}, gcsClient *storage.Client) (requestHandler, error) {
+	req, ok := cloudDeployRequest.(*clouddeploy.DeployRequest)
+	if !ok {
+		return nil, fmt.Errorf("cancel pipeline mode only supports deploy requests, received: %q", os.Getenv(clouddeploy.RequestTypeEnvKey))
+	}
+	jobName := os.Getenv(jobNameKey)
+	if jobName == "" {
+		return nil, fmt.Errorf("when cancel pipeline mode is enabled, the pipeline job to cancel needs to be passed through the %s environment variable", jobNameKey)
+	}
+	m := pipelineJobNameRegex.FindStringSubmatch(jobName)
+	if m == nil {
+		return nil, fmt.Errorf("environment variable %s must have the form projects/{project}/locations/{location}/pipelineJobs/{pipelineJob}, got %q", jobNameKey, jobName)
+	}
+	service, err := newAIPlatformService(ctx, m[1])
+	if err != nil {
+		return nil, err
+	}
+	return &canceller{
+		gcsClient:         gcsClient,
+		aiPlatformService: service,
+		req:               req,
+		jobName:           jobName,
+		pollInterval:      cancelPollInterval,
+	}, nil
+}
+
+// process cancels the pipeline job and uploads the outcome as the deploy result.
+func (c *canceller) process(ctx context.Context) error {
+	fmt.Println("Processing cancel pipeline request")
+
+	res := &clouddeploy.DeployResult{
+		ResultStatus: clouddeploy.DeploySucceeded,
+		Metadata:     map[string]string{pipelineJobMetadataKey: c.jobName},
+	}
+	state, err := cancelPipelineJob(ctx, c.aiPlatformService, c.jobName, c.pollInterval)
+	if err != nil {
+		fmt.Printf("Cancel failed: %v\n", err)
+		res.ResultStatus = clouddeploy.DeployFailed
+		res.FailureMessage = err.Error()
+	}
+	if state != "" {
+		res.Metadata[pipelineJobStateMetadataKey] = state
+	}
+	res.Metadata[clouddeploy.CustomTargetSourceMetadataKey] = aiDeployerSampleName
+	res.Metadata[clouddeploy.CustomTargetSourceSHAMetadataKey] = clouddeploy.GitCommit
+
+	fmt.Println("Uploading cancel pipeline results")
+	rURI, uErr := c.req.UploadResult(ctx, c.gcsClient, res)
+	if uErr != nil {
+		return fmt.Errorf("error uploading cancel pipeline results: %v", uErr)
+	}
+	fmt.Printf("Uploaded cancel pipeline results to %s\n", rURI)
+	return err
+}
+
+// cancelPipelineJob cancels the pipeline job and polls it until it reaches a terminal state, which is
+// returned. A job that already reached a terminal state isn't cancelled. Note that a job may still
+// succeed or fail if it completes before the cancellation takes effect.
+func cancelPipelineJob(ctx context.Context, service *aiplatform.Service, jobName string, pollInterval time.Duration) (string, error) {
+	job, err := service.Projects.Locations.PipelineJobs.Get(jobName).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch pipeline job: %v", err)
+	}
+	if terminalPipelineStates[job.State] {
+		fmt.Printf("Pipeline job %s is already in terminal state %s, nothing to cancel\n", jobName, job.State)
+		return job.State, nil
+	}
+
+	fmt.Printf("Cancelling pipeline job %s in state %s\n", jobName, job.State)
+	if _, err := service.Projects.Locations.PipelineJobs.Cancel(jobName, &aiplatform.GoogleCloudAiplatformV1CancelPipelineJobRequest{}).Context(ctx).Do(); err != nil {
+		// The job may have completed since it was fetched, in which case the cancellation is rejected.
+		if job, gErr := service.Projects.Locations.PipelineJobs.Get(jobName).Context(ctx).Do(); gErr == nil && terminalPipelineStates[job.State] {
+			fmt.Printf("Pipeline job %s reached terminal state %s before it was cancelled\n", jobName, job.State)
+			return job.State, nil
+		}
+		return job.State, fmt.Errorf("unable to cancel pipeline job: %v", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return job.State, fmt.Errorf("pipeline job %s was not cancelled: %v", jobName, ctx.Err())
+		case <-time.After(pollInterval):
+		}
+		job, err = service.Projects.Locations.PipelineJobs.Get(jobName).Context(ctx).Do()
+		if err != nil {
+			return "", fmt.Errorf("unable to fetch pipeline job: %v", err)
+		}
+		if terminalPipelineStates[job.State] {
+			fmt.Printf("Pipeline job %s is in terminal state %s\n", jobName, job.State)
+			return job.State, nil
+		}
+		fmt.Printf("Waiting for pipeline job %s to be cancelled, current state: %s\n", jobName, job.State)
+	}
+}
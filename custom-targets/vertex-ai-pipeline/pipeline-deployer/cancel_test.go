@@ -0,0 +1,128 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+	"google.golang.org/api/aiplatform/v1"
+	"google.golang.org/api/option"
+)
+
+const testJobName = "projects/p/locations/us-central1/pipelineJobs/j"
+
+// fakePipelineJobs is a fake of the Vertex AI pipeline jobs API for a single job. A cancelled job is in the
+// cancelling state for one poll before it's cancelled.
+type fakePipelineJobs struct {
+	state     string
+	cancelled int
+}
+
+func (f *fakePipelineJobs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, "/v1/") {
+	case testJobName:
+		fmt.Fprintf(w, `{"name": %q, "state": %q}`, testJobName, f.state)
+		if f.state == "PIPELINE_STATE_CANCELLING" {
+			f.state = "PIPELINE_STATE_CANCELLED"
+		}
+	case testJobName + ":cancel":
+		if terminalPipelineStates[f.state] {
+			http.Error(w, `{"error": {"code": 400, "message": "job is in a terminal state"}}`, http.StatusBadRequest)
+			return
+		}
+		f.cancelled++
+		f.state = "PIPELINE_STATE_CANCELLING"
+		w.Write([]byte(`{}`))
+	default:
+		http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+	}
+}
+
+// Tests that cancelPipelineJob cancels running jobs and waits for the cancellation, but leaves terminal jobs alone.
+func TestCancelPipelineJob(t *testing.T) {
+	tests := []struct {
+		name          string
+		state         string
+		want          string
+		wantCancelled int
+	}{
+		{name: "running", state: "PIPELINE_STATE_RUNNING", want: "PIPELINE_STATE_CANCELLED", wantCancelled: 1},
+		{name: "succeeded", state: "PIPELINE_STATE_SUCCEEDED", want: "PIPELINE_STATE_SUCCEEDED"},
+		{name: "cancelled", state: "PIPELINE_STATE_CANCELLED", want: "PIPELINE_STATE_CANCELLED"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakePipelineJobs{state: tc.state}
+			srv := httptest.NewServer(fake)
+			defer srv.Close()
+			service, err := aiplatform.NewService(context.Background(), option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+			if err != nil {
+				t.Fatalf("unable to create service: %v", err)
+			}
+
+			got, err := cancelPipelineJob(context.Background(), service, testJobName, time.Millisecond)
+			if err != nil {
+				t.Fatalf("Expected: success, Actual: %s", err)
+			}
+			if got != tc.want {
+				t.Errorf("Expected state: %s, Actual: %s", tc.want, got)
+			}
+			if fake.cancelled != tc.wantCancelled {
+				t.Errorf("Expected %d cancel calls, Actual: %d", tc.wantCancelled, fake.cancelled)
+			}
+		})
+	}
+}
+
+// Tests that cancelPipelineJob fails for a job that doesn't exist.
+func TestCancelPipelineJobNotFound(t *testing.T) {
+	srv := httptest.NewServer(&fakePipelineJobs{})
+	defer srv.Close()
+	service, err := aiplatform.NewService(context.Background(), option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("unable to create service: %v", err)
+	}
+	if _, err := cancelPipelineJob(context.Background(), service, "projects/p/locations/us-central1/pipelineJobs/missing", time.Millisecond); err == nil {
+		t.Errorf("Expected: error, Actual: %s", err)
+	}
+}
+
+// Tests that newCancelHandler validates the request type and the pipeline job name.
+func TestNewCancelHandlerFails(t *testing.T) {
+	defer os.Unsetenv(jobNameKey)
+
+	os.Setenv(jobNameKey, testJobName)
+	if _, err := newCancelHandler(context.Background(), &clouddeploy.RenderRequest{}, nil); err == nil {
+		t.Errorf("Expected: error for a render request, Actual: %s", err)
+	}
+
+	os.Unsetenv(jobNameKey)
+	if _, err := newCancelHandler(context.Background(), &clouddeploy.DeployRequest{}, nil); err == nil {
+		t.Errorf("Expected: error for a missing job name, Actual: %s", err)
+	}
+
+	os.Setenv(jobNameKey, "pipelineJobs/j")
+	if _, err := newCancelHandler(context.Background(), &clouddeploy.DeployRequest{}, nil); err == nil {
+		t.Errorf("Expected: error for an invalid job name, Actual: %s", err)
+	}
+}
@@ -27,7 +27,9 @@ import (
 
 const aiDeployerSampleName = "clouddeploy-vertex-ai-pipeline-sample"
 
-const localManifest = "manifest.yaml"
+// Deploy metadata key for the resource name of the created pipeline job, which can be passed to the
+// vertexAIPipelineJobName deploy parameter to cancel the job.
+const pipelineJobMetadataKey = "vertex-ai-pipeline-job"
 
 // deployer implements the handler interface to deploy a pipeline using the vertex AI API.
 type deployer struct {
@@ -71,16 +73,17 @@ func (d *deployer) process(ctx context.Context) error {
 // deploy performs the Vertex AI pipeline deployment
 func (d *deployer) deploy(ctx context.Context) (*clouddeploy.DeployResult, error) {
 
-	if err := d.downloadManifest(ctx); err != nil {
+	localManifest, err := d.downloadManifest(ctx)
+	if err != nil {
 		return nil, err
 	}
 
-	manifestData, err := d.applyPipeline(ctx, localManifest)
+	manifestData, jobName, err := d.applyPipeline(ctx, localManifest)
 	if err != nil {
 		return nil, fmt.Errorf("failed to deploy pipeline: %v", err)
 	}
 
-	mURI, err := d.req.UploadArtifact(ctx, d.gcsClient, "manifest.yaml", &clouddeploy.GCSUploadContent{Data: manifestData})
+	mURI, err := d.req.UploadArtifact(ctx, d.gcsClient, d.params.manifestName, &clouddeploy.GCSUploadContent{Data: manifestData})
 	if err != nil {
 		return nil, fmt.Errorf("error uploading deploy artifact: %v", err)
 	}
@@ -88,21 +91,24 @@ func (d *deployer) deploy(ctx context.Context) (*clouddeploy.DeployResult, error
 	return &clouddeploy.DeployResult{
 		ResultStatus:  clouddeploy.DeploySucceeded,
 		ArtifactFiles: []string{mURI},
+		Metadata:      map[string]string{pipelineJobMetadataKey: jobName},
 	}, nil
 }
 
-// downloadManifest downloads the rendered manifest from Google Cloud Storage to the local manifest file path
-func (d *deployer) downloadManifest(ctx context.Context) error {
+// downloadManifest downloads the rendered manifest from Google Cloud Storage to a local file named after the
+// manifestName parameter, and returns the local file path.
+func (d *deployer) downloadManifest(ctx context.Context) (string, error) {
 	fmt.Printf("Downloading deploy input manifest from %q.\n", d.req.ManifestGCSPath)
 
+	localManifest := d.params.manifestName
 	downloadPath, err := d.req.DownloadManifest(ctx, d.gcsClient, localManifest)
 	if err != nil {
 		fmt.Printf("Unable to download deployed manifest from: %s.\n", d.req.ManifestGCSPath)
-		return fmt.Errorf("unable to download deploy input from %s: %v", d.req.ManifestGCSPath, err)
+		return "", fmt.Errorf("unable to download deploy input from %s: %v", d.req.ManifestGCSPath, err)
 	}
 
 	fmt.Printf("Downloaded deploy input manifest from: %s\n", downloadPath)
-	return nil
+	return localManifest, nil
 }
 
 // addCommonMetadata inserts metadata into the deploy result that should be present
@@ -116,18 +122,25 @@ func (d *deployer) addCommonMetadata(rs *clouddeploy.DeployResult) {
 }
 
 // applyModel deploys the CreatePipelineJobRequest parsed from `localManifest`
-// it returns the CreatePipelineJobRequest object that was used in yaml format.
-func (d *deployer) applyPipeline(ctx context.Context, localManifest string) ([]byte, error) {
+// it returns the CreatePipelineJobRequest object that was used in yaml format and
+// the resource name of the created pipeline job.
+func (d *deployer) applyPipeline(ctx context.Context, localManifest string) ([]byte, string, error) {
 
 	pipelineRequest, err := pipelineRequestFromManifest(localManifest)
 	if err != nil {
-		return nil, fmt.Errorf("unable to load CreatePipelineJobRequest from manifest: %v", err)
+		return nil, "", fmt.Errorf("unable to load CreatePipelineJobRequest from manifest: %v", err)
 	}
 
 	parent := fmt.Sprintf("projects/%s/locations/%s", d.params.project, d.params.location)
 
-	if err := deployPipeline(ctx, d.aiPlatformService, parent, pipelineRequest); err != nil {
-		return nil, fmt.Errorf("unable to deploy pipeline: %v", err)
+	job, err := deployPipeline(ctx, d.aiPlatformService, parent, pipelineRequest)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to deploy pipeline: %v", err)
+	}
+	fmt.Printf("Created pipeline job %s\n", job.Name)
+	out, err := yaml.Marshal(pipelineRequest)
+	if err != nil {
+		return nil, "", err
 	}
-	return yaml.Marshal(pipelineRequest)
+	return out, job.Name, nil
 }
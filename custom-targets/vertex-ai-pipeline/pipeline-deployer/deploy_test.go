@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"os"
 	"testing"
 
 	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
@@ -21,3 +23,45 @@ func TestDepAddCommonMetadata(t *testing.T) {
 		t.Errorf("Error: map missing %s key", clouddeploy.CustomTargetSourceSHAMetadataKey)
 	}
 }
+
+// Tests that the manifest uploaded by the render with a configured name is downloaded by the deploy with the same name
+func TestManifestNameRoundTrip(t *testing.T) {
+	s := clouddeploy.NewMemoryStorage()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("unable to get working directory: %v", err)
+	}
+	// The manifest is downloaded relative to the working directory.
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("unable to change working directory: %v", err)
+	}
+	defer os.Chdir(wd)
+
+	p := &params{manifestName: "pipeline-a.yaml"}
+	r := &renderer{params: p, req: &clouddeploy.RenderRequest{OutputGCSPath: "gs://bucket/render", Storage: s}}
+	mURI, err := r.uploadManifest(context.Background(), []byte("manifest"))
+	if err != nil {
+		t.Fatalf("uploadManifest() failed: %v", err)
+	}
+	if mURI != "gs://bucket/render/pipeline-a.yaml" {
+		t.Errorf("Expected: gs://bucket/render/pipeline-a.yaml, Actual: %s", mURI)
+	}
+
+	// Cloud Deploy provides the URI of the rendered manifest to the deploy.
+	d := &deployer{params: p, req: &clouddeploy.DeployRequest{ManifestGCSPath: mURI, Storage: s}}
+	localManifest, err := d.downloadManifest(context.Background())
+	if err != nil {
+		t.Fatalf("downloadManifest() failed: %v", err)
+	}
+	if localManifest != "pipeline-a.yaml" {
+		t.Errorf("Expected: pipeline-a.yaml, Actual: %s", localManifest)
+	}
+	data, err := os.ReadFile(localManifest)
+	if err != nil {
+		t.Fatalf("unable to read downloaded manifest: %v", err)
+	}
+	if string(data) != "manifest" {
+		t.Errorf("Expected: manifest, Actual: %s", data)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// diff.go contains logic to compare a rendered pipeline job with the pipeline job last deployed to the target.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+	"google.golang.org/api/aiplatform/v1"
+)
+
+const (
+	// Label set on the pipeline job with the Cloud Deploy delivery pipeline it's deployed by.
+	deliveryPipelineLabel = "clouddeploy-delivery-pipeline"
+	// Label set on the pipeline job with the Cloud Deploy target it's deployed to.
+	targetLabel = "clouddeploy-target"
+	// Name of the render artifact holding the diff against the last deployed pipeline job.
+	pipelineDiffArtifactName = "pipeline-diff.txt"
+	// Render metadata key for the URI of the diff against the last deployed pipeline job.
+	pipelineDiffMetadataKey = "vertex-ai-pipeline-diff"
+)
+
+// setTargetLabels labels the pipeline job with the Cloud Deploy delivery pipeline and target of the
+// request, so the pipeline job last deployed to the target can be found on later renders. Labels set in
+// the configuration are left unchanged.
+func setTargetLabels(pipelineJob *aiplatform.GoogleCloudAiplatformV1PipelineJob, req *clouddeploy.RenderRequest) {
+	if pipelineJob.Labels == nil {
+		pipelineJob.Labels = map[string]string{}
+	}
+	if _, ok := pipelineJob.Labels[deliveryPipelineLabel]; !ok {
+		pipelineJob.Labels[deliveryPipelineLabel] = req.Pipeline
+	}
+	if _, ok := pipelineJob.Labels[targetLabel]; !ok {
+		pipelineJob.Labels[targetLabel] = req.Target
+	}
+}
+
+// previousPipelineJob returns the most recently created pipeline job labeled with the delivery pipeline
+// and target of the request, or nil if there isn't one.
+func previousPipelineJob(ctx context.Context, service *aiplatform.Service, parent string, req *clouddeploy.RenderRequest) (*aiplatform.GoogleCloudAiplatformV1PipelineJob, error) {
+	filter := fmt.Sprintf("labels.%s=%q AND labels.%s=%q", deliveryPipelineLabel, req.Pipeline, targetLabel, req.Target)
+	resp, err := service.Projects.Locations.PipelineJobs.List(parent).Filter(filter).OrderBy("create_time desc").PageSize(1).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pipeline jobs: %v", err)
+	}
+	if len(resp.PipelineJobs) == 0 {
+		return nil, nil
+	}
+	return resp.PipelineJobs[0], nil
+}
+
+// diffPipelineJobs returns a human readable description of the differences between the previously deployed
+// pipeline job and the rendered one, covering the pipeline template, display name, service account, network
+// and pipeline parameters. If there's no previous pipeline job then the rendered one is the first deploy.
+func diffPipelineJobs(previous, current *aiplatform.GoogleCloudAiplatformV1PipelineJob) (string, error) {
+	if previous == nil {
+		return "No pipeline job was previously deployed to the target, this is the first deploy.\n", nil
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Changes from pipeline job %s:\n", previous.Name)
+
+	changes := 0
+	field := func(name, before, after string) {
+		if before != after {
+			fmt.Fprintf(&b, "~ %s: %q -> %q\n", name, before, after)
+			changes++
+		}
+	}
+	field("templateUri", previous.TemplateUri, current.TemplateUri)
+	field("displayName", previous.DisplayName, current.DisplayName)
+	field("serviceAccount", previous.ServiceAccount, current.ServiceAccount)
+	field("network", previous.Network, current.Network)
+
+	before, err := parameterValues(previous)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse parameters of previous pipeline job: %v", err)
+	}
+	after, err := parameterValues(current)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse parameters of rendered pipeline job: %v", err)
+	}
+	keys := map[string]bool{}
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+	var names []string
+	for k := range keys {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		v1, inBefore := before[k]
+		v2, inAfter := after[k]
+		switch {
+		case !inBefore:
+			fmt.Fprintf(&b, "+ parameter %s: %s\n", k, v2)
+			changes++
+		case !inAfter:
+			fmt.Fprintf(&b, "- parameter %s: %s\n", k, v1)
+			changes++
+		case v1 != v2:
+			fmt.Fprintf(&b, "~ parameter %s: %s -> %s\n", k, v1, v2)
+			changes++
+		}
+	}
+
+	if changes == 0 {
+		b.WriteString("No changes.\n")
+	}
+	return b.String(), nil
+}
+
+// parameterValues returns the runtime parameter values of the pipeline job, with each value in its JSON
+// encoding so values of any type can be compared.
+func parameterValues(pipelineJob *aiplatform.GoogleCloudAiplatformV1PipelineJob) (map[string]string, error) {
+	values := map[string]string{}
+	if pipelineJob.RuntimeConfig == nil || len(pipelineJob.RuntimeConfig.ParameterValues) == 0 {
+		return values, nil
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(pipelineJob.RuntimeConfig.ParameterValues, &raw); err != nil {
+		return nil, err
+	}
+	for k, v := range raw {
+		values[k] = string(v)
+	}
+	return values, nil
+}
+
+// renderPipelineDiff compares the rendered pipeline job with the pipeline job last deployed to the target
+// and returns the diff. Failing to fetch the previous pipeline job doesn't fail the render, it's noted in
+// the diff instead.
+func (r *renderer) renderPipelineDiff(ctx context.Context, pipelineJob *aiplatform.GoogleCloudAiplatformV1PipelineJob) ([]byte, error) {
+	parent := fmt.Sprintf("projects/%s/locations/%s", r.params.project, r.params.location)
+	previous, err := previousPipelineJob(ctx, r.aiPlatformService, parent, r.req)
+	if err != nil {
+		fmt.Printf("Unable to fetch the pipeline job last deployed to the target: %v\n", err)
+		return []byte(fmt.Sprintf("Unable to fetch the pipeline job last deployed to the target: %v\n", err)), nil
+	}
+	diff, err := diffPipelineJobs(previous, pipelineJob)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(diff), nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+	"google.golang.org/api/aiplatform/v1"
+)
+
+// Tests that diffPipelineJobs reports the changed fields and the added, removed and changed parameters.
+func TestDiffPipelineJobs(t *testing.T) {
+	previous := &aiplatform.GoogleCloudAiplatformV1PipelineJob{
+		Name:        "projects/my-project/locations/us-central1/pipelineJobs/job-1",
+		TemplateUri: "https://us-central1-kfp.pkg.dev/my-project/my-repo/my-pipeline/v1",
+		DisplayName: "my-pipeline",
+		RuntimeConfig: &aiplatform.GoogleCloudAiplatformV1PipelineJobRuntimeConfig{
+			ParameterValues: []byte(`{"epochs":"10","project_id":"my-project","removed":"x"}`),
+		},
+	}
+	current := &aiplatform.GoogleCloudAiplatformV1PipelineJob{
+		TemplateUri: "https://us-central1-kfp.pkg.dev/my-project/my-repo/my-pipeline/v2",
+		DisplayName: "my-pipeline",
+		RuntimeConfig: &aiplatform.GoogleCloudAiplatformV1PipelineJobRuntimeConfig{
+			ParameterValues: []byte(`{"added":"y","epochs":"20","project_id":"my-project"}`),
+		},
+	}
+	got, err := diffPipelineJobs(previous, current)
+	if err != nil {
+		t.Fatalf("Expected: success, Actual: %s", err)
+	}
+	want := `Changes from pipeline job projects/my-project/locations/us-central1/pipelineJobs/job-1:
+~ templateUri: "https://us-central1-kfp.pkg.dev/my-project/my-repo/my-pipeline/v1" -> "https://us-central1-kfp.pkg.dev/my-project/my-repo/my-pipeline/v2"
++ parameter added: "y"
+~ parameter epochs: "10" -> "20"
+- parameter removed: "x"
+`
+	if got != want {
+		t.Errorf("Expected: %s, Actual: %s", want, got)
+	}
+}
+
+// Tests that diffPipelineJobs reports no changes for identical pipeline jobs.
+func TestDiffPipelineJobsNoChanges(t *testing.T) {
+	job := &aiplatform.GoogleCloudAiplatformV1PipelineJob{
+		Name:        "job-1",
+		TemplateUri: "https://us-central1-kfp.pkg.dev/my-project/my-repo/my-pipeline/v1",
+		RuntimeConfig: &aiplatform.GoogleCloudAiplatformV1PipelineJobRuntimeConfig{
+			ParameterValues: []byte(`{"epochs":"10"}`),
+		},
+	}
+	got, err := diffPipelineJobs(job, job)
+	if err != nil {
+		t.Fatalf("Expected: success, Actual: %s", err)
+	}
+	if !strings.HasSuffix(got, "No changes.\n") {
+		t.Errorf("Expected: No changes, Actual: %s", got)
+	}
+}
+
+// Tests that diffPipelineJobs notes the first deploy when there's no previous pipeline job.
+func TestDiffPipelineJobsFirstDeploy(t *testing.T) {
+	got, err := diffPipelineJobs(nil, &aiplatform.GoogleCloudAiplatformV1PipelineJob{})
+	if err != nil {
+		t.Fatalf("Expected: success, Actual: %s", err)
+	}
+	if !strings.Contains(got, "first deploy") {
+		t.Errorf("Expected: first deploy note, Actual: %s", got)
+	}
+}
+
+// Tests that setTargetLabels labels the pipeline job without overriding configured labels.
+func TestSetTargetLabels(t *testing.T) {
+	job := &aiplatform.GoogleCloudAiplatformV1PipelineJob{Labels: map[string]string{targetLabel: "custom"}}
+	setTargetLabels(job, &clouddeploy.RenderRequest{Pipeline: "my-pipeline", Target: "prod"})
+	if got := job.Labels[deliveryPipelineLabel]; got != "my-pipeline" {
+		t.Errorf("Expected: my-pipeline, Actual: %s", got)
+	}
+	if got := job.Labels[targetLabel]; got != "custom" {
+		t.Errorf("Expected: custom, Actual: %s", got)
+	}
+}
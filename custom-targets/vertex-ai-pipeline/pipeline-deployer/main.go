@@ -40,6 +40,7 @@ func do() error {
 		return fmt.Errorf("unable to create gcs client: %v", err)
 	}
 
+	flag.BoolVar(&cancelPipelineMode, "cancel-pipeline-mode", false, "if enabled, cancels the pipeline job set in the vertexAIPipelineJobName environment variable")
 	flag.Parse()
 
 	req, err := clouddeploy.DetermineRequest(ctx, gcsClient, []string{"CANARY"})
@@ -47,6 +48,14 @@ func do() error {
 		return err
 	}
 
+	if cancelPipelineMode {
+		ch, err := newCancelHandler(ctx, req, gcsClient)
+		if err != nil {
+			return fmt.Errorf("unable to create cancel handler: %v", err)
+		}
+		return ch.process(ctx)
+	}
+
 	params, err := determineParams()
 	if err != nil {
 		return fmt.Errorf("unable to parse params: %v", err)
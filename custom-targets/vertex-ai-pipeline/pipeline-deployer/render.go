@@ -18,11 +18,17 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"regexp"
+	"strings"
+	"unicode"
 
 	"cloud.google.com/go/storage"
 	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/applysetters"
 	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+	"golang.org/x/oauth2/google"
 	"google.golang.org/api/aiplatform/v1"
 	"sigs.k8s.io/yaml"
 )
@@ -34,8 +40,17 @@ const (
 	srcArchivePath = "/workspace/archive.tgz"
 	// Path to use when unarchiving the source input.
 	srcPath = "/workspace/source"
+	// Render metadata key for the service account the pipeline job runs as.
+	serviceAccountMetadataKey = "vertex-ai-pipeline-service-account"
+	// Render metadata key for the VPC network the pipeline job is peered with.
+	networkMetadataKey = "vertex-ai-pipeline-network"
+	// Maximum length in characters of a Vertex AI pipeline job display name.
+	maxDisplayNameLength = 128
 )
 
+// placeholderRegex matches the placeholders in a display name template.
+var placeholderRegex = regexp.MustCompile(`\{[^{}]*\}`)
+
 // renderer implements the handler interface for performing a render.
 type renderer struct {
 	gcsClient         *storage.Client
@@ -83,28 +98,68 @@ func (r *renderer) render(ctx context.Context) (*clouddeploy.RenderResult, error
 	}
 	fmt.Printf("Downloaded render input archive from %s\n", inURI)
 
-	out, err := r.renderCreatePipelineRequest()
+	request, err := r.renderCreatePipelineRequest(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error rendering createPipelineJobRequest params: %v", err)
 	}
+	out, err := yaml.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal createPipelineJobRequest: %v", err)
+	}
 
-	fmt.Printf("Uploading deployed pipeline manifest.\n")
-
-	mURI, err := r.req.UploadArtifact(ctx, r.gcsClient, "manifest.yaml", &clouddeploy.GCSUploadContent{Data: out})
+	mURI, err := r.uploadManifest(ctx, out)
 	if err != nil {
-		return nil, fmt.Errorf("error uploading createPipelineJobRequest manifest: %v", err)
+		return nil, err
 	}
 
-	fmt.Printf("Uploaded createPipelineJobRequest manifest to %s\n", mURI)
+	diff, err := r.renderPipelineDiff(ctx, request.PipelineJob)
+	if err != nil {
+		return nil, fmt.Errorf("error comparing with the last deployed pipeline job: %v", err)
+	}
+	dURI, err := r.req.UploadArtifact(ctx, r.gcsClient, pipelineDiffArtifactName, &clouddeploy.GCSUploadContent{Data: diff})
+	if err != nil {
+		return nil, fmt.Errorf("error uploading pipeline diff: %v", err)
+	}
+	fmt.Printf("Uploaded pipeline diff to %s\n", dURI)
 
+	metadata := r.pipelineJobMetadata()
+	metadata[pipelineDiffMetadataKey] = dURI
 	return &clouddeploy.RenderResult{
 		ResultStatus: clouddeploy.RenderSucceeded,
 		ManifestFile: mURI,
+		Metadata:     metadata,
 	}, nil
 }
 
-// renderCreatePipelineRequest generates a CreatePipelineJobRequest object and returns its definition as a yaml-formatted string
-func (r *renderer) renderCreatePipelineRequest() ([]byte, error) {
+// uploadManifest uploads the rendered manifest as a render artifact named after the manifestName parameter,
+// which is the name it's downloaded with at deploy time. Returns the URI of the uploaded manifest.
+func (r *renderer) uploadManifest(ctx context.Context, manifest []byte) (string, error) {
+	fmt.Printf("Uploading deployed pipeline manifest.\n")
+
+	mURI, err := r.req.UploadArtifact(ctx, r.gcsClient, r.params.manifestName, &clouddeploy.GCSUploadContent{Data: manifest})
+	if err != nil {
+		return "", fmt.Errorf("error uploading createPipelineJobRequest manifest: %v", err)
+	}
+
+	fmt.Printf("Uploaded createPipelineJobRequest manifest to %s\n", mURI)
+	return mURI, nil
+}
+
+// pipelineJobMetadata returns the render metadata recording the service account and network
+// set on the pipeline job via deploy parameters.
+func (r *renderer) pipelineJobMetadata() map[string]string {
+	metadata := map[string]string{}
+	if r.params.serviceAccount != "" {
+		metadata[serviceAccountMetadataKey] = r.params.serviceAccount
+	}
+	if r.params.network != "" {
+		metadata[networkMetadataKey] = r.params.network
+	}
+	return metadata
+}
+
+// renderCreatePipelineRequest generates a CreatePipelineJobRequest object from the configuration and deploy parameters
+func (r *renderer) renderCreatePipelineRequest(ctx context.Context) (*aiplatform.GoogleCloudAiplatformV1CreatePipelineJobRequest, error) {
 	if err := applyDeployParams(r.params.configPath); err != nil {
 		return nil, fmt.Errorf("cannot apply deploy parameters to configuration file: %v", err)
 	}
@@ -114,32 +169,230 @@ func (r *renderer) renderCreatePipelineRequest() ([]byte, error) {
 		return nil, fmt.Errorf("unable to obtain configuration data: %v", err)
 	}
 
+	var displayName string
+	if r.params.displayNameTemplate != "" {
+		displayName, err = expandDisplayNameTemplate(r.params.displayNameTemplate, r.req)
+		if err != nil {
+			return nil, fmt.Errorf("invalid display name template: %v", err)
+		}
+	}
+
+	request, err := newCreatePipelineJobRequest(configuration, r.params, displayName)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.params.validateTemplate {
+		if err := r.validateTemplate(ctx, request.PipelineJob.TemplateUri); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.params.enableCaching != nil {
+		if err := r.applyCachingParam(ctx, request.PipelineJob); err != nil {
+			return nil, fmt.Errorf("unable to set caching options: %v", err)
+		}
+	}
+	setTargetLabels(request.PipelineJob, r.req)
+	return request, nil
+}
+
+// expandDisplayNameTemplate replaces the "{release}", "{target}" and "{pipeline}" placeholders in the
+// template with the Cloud Deploy release, target and delivery pipeline of the request, and returns the
+// sanitized display name.
+func expandDisplayNameTemplate(template string, req *clouddeploy.RenderRequest) (string, error) {
+	expanded := strings.NewReplacer(
+		"{release}", req.Release,
+		"{target}", req.Target,
+		"{pipeline}", req.Pipeline,
+	).Replace(template)
+	if p := placeholderRegex.FindString(expanded); p != "" {
+		return "", fmt.Errorf("unsupported placeholder %s, must be one of {release}, {target} or {pipeline}", p)
+	}
+	name := sanitizeDisplayName(expanded)
+	if name == "" {
+		return "", fmt.Errorf("template %q expands to an empty display name", template)
+	}
+	return name, nil
+}
+
+// sanitizeDisplayName removes control characters and surrounding whitespace from the display name and
+// truncates it to the maximum length Vertex AI accepts.
+func sanitizeDisplayName(name string) string {
+	name = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name))
+	if runes := []rune(name); len(runes) > maxDisplayNameLength {
+		name = strings.TrimSpace(string(runes[:maxDisplayNameLength]))
+	}
+	return name
+}
+
+// applyCachingParam sets the caching options of the pipeline job based on the vertexAIPipelineEnableCaching
+// deploy parameter. Caching is configured per task in the pipeline spec, so if the configuration only
+// references a template then the template is downloaded and set as the pipeline spec.
+func (r *renderer) applyCachingParam(ctx context.Context, pipelineJob *aiplatform.GoogleCloudAiplatformV1PipelineJob) error {
+	if len(pipelineJob.PipelineSpec) == 0 {
+		client, err := google.DefaultClient(ctx, aiplatform.CloudPlatformScope)
+		if err != nil {
+			return fmt.Errorf("unable to create authenticated client: %v", err)
+		}
+		fmt.Printf("Downloading pipeline template %s to set caching options\n", pipelineJob.TemplateUri)
+		spec, err := fetchPipelineTemplate(ctx, client, pipelineJob.TemplateUri)
+		if err != nil {
+			return err
+		}
+		pipelineJob.PipelineSpec = spec
+	}
+	spec, err := setPipelineCaching(pipelineJob.PipelineSpec, *r.params.enableCaching)
+	if err != nil {
+		return err
+	}
+	pipelineJob.PipelineSpec = spec
+	return nil
+}
+
+// fetchPipelineTemplate downloads the pipeline template from an Artifact Registry URL, e.g.
+// https://us-central1-kfp.pkg.dev/my-project/my-repo/my-pipeline/v1, and returns it as JSON.
+func fetchPipelineTemplate(ctx context.Context, client *http.Client, templateURI string) ([]byte, error) {
+	if !strings.HasPrefix(templateURI, "https://") {
+		return nil, fmt.Errorf("pipeline template %q must be an https URL", templateURI)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, templateURI, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request: %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download pipeline template: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pipeline template: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to download pipeline template, status: %v, body: %q", resp.StatusCode, data)
+	}
+	spec, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse pipeline template: %v", err)
+	}
+	return spec, nil
+}
+
+// validateTemplate verifies that the pipeline template exists and is readable with the credentials of the
+// render, based on the vertexAIValidateTemplate deploy parameter.
+func (r *renderer) validateTemplate(ctx context.Context, templateURI string) error {
+	client, err := google.DefaultClient(ctx, aiplatform.CloudPlatformScope)
+	if err != nil {
+		return fmt.Errorf("unable to create authenticated client: %v", err)
+	}
+	fmt.Printf("Verifying that pipeline template %s is accessible\n", templateURI)
+	if err := checkTemplateAccessible(ctx, client, r.gcsClient, templateURI); err != nil {
+		return fmt.Errorf("pipeline template %q is not accessible, verify the %s deploy parameter or the templateUri of the configuration: %v", templateURI, pipelineEnvKey, err)
+	}
+	return nil
+}
+
+// checkTemplateAccessible verifies that the pipeline template exists and is readable. Templates in Cloud
+// Storage, e.g. gs://my-bucket/pipeline.yaml, are looked up with the Cloud Storage client, and templates in
+// Artifact Registry, e.g. https://us-central1-kfp.pkg.dev/my-project/my-repo/my-pipeline/v1, are downloaded.
+func checkTemplateAccessible(ctx context.Context, client *http.Client, gcsClient *storage.Client, templateURI string) error {
+	if strings.HasPrefix(templateURI, "gs://") {
+		bucket, object, _ := strings.Cut(strings.TrimPrefix(templateURI, "gs://"), "/")
+		if bucket == "" || object == "" {
+			return fmt.Errorf("%q must have the form gs://{bucket}/{object}", templateURI)
+		}
+		if _, err := gcsClient.Bucket(bucket).Object(object).Attrs(ctx); err != nil {
+			return fmt.Errorf("unable to get Cloud Storage object: %v", err)
+		}
+		return nil
+	}
+	_, err := fetchPipelineTemplate(ctx, client, templateURI)
+	return err
+}
+
+// setPipelineCaching returns a copy of the pipeline spec with the caching option of every task, including
+// the tasks of nested pipelines, set to the provided value.
+func setPipelineCaching(pipelineSpec []byte, enable bool) ([]byte, error) {
+	var spec map[string]interface{}
+	if err := json.Unmarshal(pipelineSpec, &spec); err != nil {
+		return nil, fmt.Errorf("unable to parse pipeline spec: %v", err)
+	}
+	dags := []interface{}{spec["root"]}
+	if components, ok := spec["components"].(map[string]interface{}); ok {
+		for _, c := range components {
+			dags = append(dags, c)
+		}
+	}
+	for _, d := range dags {
+		component, _ := d.(map[string]interface{})
+		dag, _ := component["dag"].(map[string]interface{})
+		tasks, _ := dag["tasks"].(map[string]interface{})
+		for _, t := range tasks {
+			task, ok := t.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			options, ok := task["cachingOptions"].(map[string]interface{})
+			if !ok {
+				options = map[string]interface{}{}
+				task["cachingOptions"] = options
+			}
+			options["enableCache"] = enable
+		}
+	}
+	return json.Marshal(spec)
+}
+
+// newCreatePipelineJobRequest returns the CreatePipelineJobRequest for the pipelineJob configuration
+// with the values derived from the deploy parameters applied. The display name is used when the
+// configuration doesn't set one, falling back to the "model_display_name" pipeline parameter.
+func newCreatePipelineJobRequest(configuration []byte, params *params, displayName string) (*aiplatform.GoogleCloudAiplatformV1CreatePipelineJobRequest, error) {
 	// blank pipelineJob template
 	pipelineJob := &aiplatform.GoogleCloudAiplatformV1PipelineJob{}
 
-	if err = yaml.Unmarshal(configuration, pipelineJob); err != nil {
+	if err := yaml.Unmarshal(configuration, pipelineJob); err != nil {
 		return nil, fmt.Errorf("unable to parse configuration data into pipelineJob object: %v", err)
 	}
-	paramValues := r.params.pipelineParams
+	paramValues := params.pipelineParams
 
 	if pipelineJob.TemplateUri == "" {
-		pipelineJob.TemplateUri = r.params.pipeline
+		pipelineJob.TemplateUri = params.pipeline
+	}
+
+	if params.serviceAccount != "" {
+		pipelineJob.ServiceAccount = params.serviceAccount
+	}
+
+	if params.network != "" {
+		pipelineJob.Network = params.network
+	}
+
+	if pipelineJob.DisplayName == "" {
+		pipelineJob.DisplayName = displayName
 	}
 
 	if pipelineJob.DisplayName == "" {
 		pipelineJob.DisplayName = paramValues["model_display_name"]
 	}
 
-	paramValues["project_id"] = r.params.project
+	paramValues["project_id"] = params.project
 	paramString, err := json.Marshal(paramValues)
 	if err != nil {
 		fmt.Printf("Error marshalling JSON: %s", err)
 		return nil, fmt.Errorf("unable to marshal params json")
 	}
+	if pipelineJob.RuntimeConfig == nil {
+		pipelineJob.RuntimeConfig = &aiplatform.GoogleCloudAiplatformV1PipelineJobRuntimeConfig{}
+	}
 	pipelineJob.RuntimeConfig.ParameterValues = paramString
 
-	request := &aiplatform.GoogleCloudAiplatformV1CreatePipelineJobRequest{PipelineJob: pipelineJob}
-	return yaml.Marshal(request)
+	return &aiplatform.GoogleCloudAiplatformV1CreatePipelineJobRequest{PipelineJob: pipelineJob}, nil
 }
 
 // addCommonMetadata inserts metadata into the render result that should be present
@@ -180,7 +433,6 @@ func determineConfigFileLocation(configRelativePath string) (string, bool) {
 // loadConfigurationFile loads and returns the configuration file for the target if it exists.
 func loadConfigurationFile(configPath string) ([]byte, error) {
 	filePath, shouldErrOnMissingFile := determineConfigFileLocation(configPath)
-	fmt.Errorf("HERE: %s", filePath)
 	fileInfo, err := os.Stat(filePath)
 	if err != nil && shouldErrOnMissingFile {
 		return nil, err
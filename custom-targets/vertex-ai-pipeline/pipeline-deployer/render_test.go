@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 
 	"cloud.google.com/go/storage"
 	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+	"google.golang.org/api/option"
+	"sigs.k8s.io/yaml"
 )
 
 // Tests that render works as expected. Does not test valid renderer.
@@ -28,13 +34,13 @@ func TestRenderCreatePipelineRequest(t *testing.T) {
 	newRenderer := &renderer{
 		params: &params{},
 	}
-	_, err := newRenderer.renderCreatePipelineRequest()
+	_, err := newRenderer.renderCreatePipelineRequest(context.Background())
 	if in := strings.Contains(err.Error(), "cannot apply deploy parameters to configuration file"); !in {
 		t.Errorf("Expected: cannot apply deploy parameters to configuration file, Received: %s", err)
 	}
 
 	newRenderer.params.configPath = "configuration/test.yaml"
-	_, err = newRenderer.renderCreatePipelineRequest()
+	_, err = newRenderer.renderCreatePipelineRequest(context.Background())
 	if in := strings.Contains(err.Error(), "cannot apply deploy parameters to configuration file"); !in {
 		t.Errorf("Expected: cannot apply deploy parameters to configuration file, Received: %s", err)
 	}
@@ -116,3 +122,313 @@ func TestLoadConfigurationFile(t *testing.T) {
 	}
 
 }
+
+// Tests that newCreatePipelineJobRequest only sets the service account and network on the pipeline job when provided.
+func TestNewCreatePipelineJobRequest(t *testing.T) {
+	tests := []struct {
+		name               string
+		params             *params
+		wantServiceAccount string
+		wantNetwork        string
+	}{
+		{
+			name:   "defaults",
+			params: &params{pipelineParams: map[string]string{"param1": "value1"}},
+		},
+		{
+			name: "service account and network",
+			params: &params{
+				pipelineParams: map[string]string{"param1": "value1"},
+				serviceAccount: "sa@my-project.iam.gserviceaccount.com",
+				network:        "projects/12345/global/networks/my-network",
+			},
+			wantServiceAccount: "sa@my-project.iam.gserviceaccount.com",
+			wantNetwork:        "projects/12345/global/networks/my-network",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			request, err := newCreatePipelineJobRequest([]byte("displayName: my-job\n"), tc.params, "")
+			if err != nil {
+				t.Fatalf("Expected: success, Actual: %s", err)
+			}
+			if got := request.PipelineJob.ServiceAccount; got != tc.wantServiceAccount {
+				t.Errorf("Expected service account: %q, Actual: %q", tc.wantServiceAccount, got)
+			}
+			if got := request.PipelineJob.Network; got != tc.wantNetwork {
+				t.Errorf("Expected network: %q, Actual: %q", tc.wantNetwork, got)
+			}
+		})
+	}
+}
+
+// Tests that pipelineJobMetadata records the service account and network only when provided.
+func TestPipelineJobMetadata(t *testing.T) {
+	r := &renderer{params: &params{}}
+	if got := r.pipelineJobMetadata(); len(got) != 0 {
+		t.Errorf("Expected: empty metadata, Actual: %v", got)
+	}
+	r.params = &params{serviceAccount: "sa@my-project.iam.gserviceaccount.com", network: "projects/12345/global/networks/my-network"}
+	got := r.pipelineJobMetadata()
+	if got[serviceAccountMetadataKey] != r.params.serviceAccount || got[networkMetadataKey] != r.params.network {
+		t.Errorf("Expected service account and network in metadata, Actual: %v", got)
+	}
+}
+
+const testPipelineSpec = `{
+  "root": {"dag": {"tasks": {"train": {"cachingOptions": {"enableCache": true}}, "evaluate": {}}}},
+  "components": {
+    "comp-train": {"executorLabel": "exec-train"},
+    "comp-nested": {"dag": {"tasks": {"export": {}}}}
+  }
+}`
+
+// Tests that setPipelineCaching sets the caching option of every task, including the tasks of nested pipelines.
+func TestSetPipelineCaching(t *testing.T) {
+	for _, enable := range []bool{true, false} {
+		out, err := setPipelineCaching([]byte(testPipelineSpec), enable)
+		if err != nil {
+			t.Fatalf("Expected: success, Actual: %s", err)
+		}
+		var spec struct {
+			Root struct {
+				Dag struct {
+					Tasks map[string]struct {
+						CachingOptions struct {
+							EnableCache *bool `json:"enableCache"`
+						} `json:"cachingOptions"`
+					} `json:"tasks"`
+				} `json:"dag"`
+			} `json:"root"`
+			Components map[string]struct {
+				Dag struct {
+					Tasks map[string]struct {
+						CachingOptions struct {
+							EnableCache *bool `json:"enableCache"`
+						} `json:"cachingOptions"`
+					} `json:"tasks"`
+				} `json:"dag"`
+			} `json:"components"`
+		}
+		if err := json.Unmarshal(out, &spec); err != nil {
+			t.Fatalf("Expected: valid JSON, Actual: %s", err)
+		}
+		tasks := map[string]*bool{}
+		for name, task := range spec.Root.Dag.Tasks {
+			tasks[name] = task.CachingOptions.EnableCache
+		}
+		for name, task := range spec.Components["comp-nested"].Dag.Tasks {
+			tasks[name] = task.CachingOptions.EnableCache
+		}
+		if len(tasks) != 3 {
+			t.Errorf("Expected: 3 tasks, Actual: %d", len(tasks))
+		}
+		for name, got := range tasks {
+			if got == nil || *got != enable {
+				t.Errorf("Expected task %s enableCache: %t, Actual: %v", name, enable, got)
+			}
+		}
+	}
+}
+
+// Tests that the caching option lands on the tasks of an inline pipeline spec in the request.
+func TestApplyCachingParam(t *testing.T) {
+	enable := false
+	r := &renderer{params: &params{pipelineParams: map[string]string{"param1": "value1"}, enableCaching: &enable}}
+	config, err := yaml.JSONToYAML([]byte(`{"pipelineSpec": ` + testPipelineSpec + `}`))
+	if err != nil {
+		t.Fatalf("Expected: success, Actual: %s", err)
+	}
+	request, err := newCreatePipelineJobRequest(config, r.params, "")
+	if err != nil {
+		t.Fatalf("Expected: success, Actual: %s", err)
+	}
+	if err := r.applyCachingParam(context.Background(), request.PipelineJob); err != nil {
+		t.Fatalf("Expected: success, Actual: %s", err)
+	}
+	if got := strings.Count(string(request.PipelineJob.PipelineSpec), `"enableCache":false`); got != 3 {
+		t.Errorf("Expected: 3 tasks with caching disabled, Actual: %d in %s", got, request.PipelineJob.PipelineSpec)
+	}
+}
+
+// Tests that fetchPipelineTemplate downloads a YAML pipeline template and returns it as JSON.
+func TestFetchPipelineTemplate(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/my-project/my-repo/my-pipeline/v1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, "root:\n  dag:\n    tasks:\n      train: {}\n")
+	}))
+	defer srv.Close()
+
+	got, err := fetchPipelineTemplate(context.Background(), srv.Client(), srv.URL+"/my-project/my-repo/my-pipeline/v1")
+	if err != nil {
+		t.Fatalf("Expected: success, Actual: %s", err)
+	}
+	if want := `{"root":{"dag":{"tasks":{"train":{}}}}}`; string(got) != want {
+		t.Errorf("Expected: %s, Actual: %s", want, got)
+	}
+	if _, err := fetchPipelineTemplate(context.Background(), srv.Client(), srv.URL+"/missing"); err == nil {
+		t.Errorf("Expected: error for a missing template, Actual: nil")
+	}
+	if _, err := fetchPipelineTemplate(context.Background(), srv.Client(), "gs://bucket/pipeline.yaml"); err == nil {
+		t.Errorf("Expected: error for a non https template, Actual: nil")
+	}
+}
+
+// Tests that expandDisplayNameTemplate expands the placeholders from the request and sanitizes the result.
+func TestExpandDisplayNameTemplate(t *testing.T) {
+	req := &clouddeploy.RenderRequest{Release: "release-001", Target: "staging", Pipeline: "pipeline-cd"}
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "all placeholders",
+			template: "{pipeline}-{release}-{target}",
+			want:     "pipeline-cd-release-001-staging",
+		},
+		{
+			name:     "no placeholders",
+			template: "my-pipeline-job",
+			want:     "my-pipeline-job",
+		},
+		{
+			name:     "control characters and whitespace removed",
+			template: " {release}\n\tjob ",
+			want:     "release-001job",
+		},
+		{
+			name:     "truncated",
+			template: strings.Repeat("a", 120) + "-{release}",
+			want:     strings.Repeat("a", 120) + "-release",
+		},
+		{
+			name:     "unsupported placeholder",
+			template: "{release}-{phase}",
+			wantErr:  true,
+		},
+		{
+			name:     "empty",
+			template: "  ",
+			wantErr:  true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := expandDisplayNameTemplate(tc.template, req)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %t, Actual: %v", tc.wantErr, err)
+			}
+			if got != tc.want {
+				t.Errorf("Expected: %q, Actual: %q", tc.want, got)
+			}
+		})
+	}
+}
+
+// Tests that the display name is only used when the configuration doesn't set one.
+func TestNewCreatePipelineJobRequestDisplayName(t *testing.T) {
+	p := &params{pipelineParams: map[string]string{"model_display_name": "my-model"}}
+	tests := []struct {
+		name          string
+		configuration string
+		displayName   string
+		want          string
+	}{
+		{name: "configuration", configuration: "displayName: my-job\n", displayName: "templated", want: "my-job"},
+		{name: "template", displayName: "templated", want: "templated"},
+		{name: "model display name", want: "my-model"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			request, err := newCreatePipelineJobRequest([]byte(tc.configuration), p, tc.displayName)
+			if err != nil {
+				t.Fatalf("Expected: success, Actual: %s", err)
+			}
+			if got := request.PipelineJob.DisplayName; got != tc.want {
+				t.Errorf("Expected: %q, Actual: %q", tc.want, got)
+			}
+		})
+	}
+}
+
+// Tests that checkTemplateAccessible succeeds for reachable templates in Artifact Registry and Cloud Storage
+// and fails for unreachable ones.
+func TestCheckTemplateAccessible(t *testing.T) {
+	arSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/my-project/my-repo/my-pipeline/v1":
+			fmt.Fprint(w, "root:\n  dag:\n    tasks:\n      train: {}\n")
+		case "/my-project/my-repo/private-pipeline/v1":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer arSrv.Close()
+	gcsSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/storage/v1/b/my-bucket/o/pipeline.yaml" {
+			http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"bucket": "my-bucket", "name": "pipeline.yaml"}`)
+	}))
+	defer gcsSrv.Close()
+	gcsClient, err := storage.NewClient(context.Background(), option.WithEndpoint(gcsSrv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("unable to create storage client: %v", err)
+	}
+	defer gcsClient.Close()
+
+	tests := []struct {
+		name        string
+		templateURI string
+		wantErr     bool
+	}{
+		{
+			name:        "Artifact Registry template",
+			templateURI: arSrv.URL + "/my-project/my-repo/my-pipeline/v1",
+		},
+		{
+			name:        "missing Artifact Registry template",
+			templateURI: arSrv.URL + "/my-project/my-repo/my-pipelin/v1",
+			wantErr:     true,
+		},
+		{
+			name:        "unreadable Artifact Registry template",
+			templateURI: arSrv.URL + "/my-project/my-repo/private-pipeline/v1",
+			wantErr:     true,
+		},
+		{
+			name:        "Cloud Storage template",
+			templateURI: "gs://my-bucket/pipeline.yaml",
+		},
+		{
+			name:        "missing Cloud Storage template",
+			templateURI: "gs://my-bucket/pipelin.yaml",
+			wantErr:     true,
+		},
+		{
+			name:        "Cloud Storage bucket",
+			templateURI: "gs://my-bucket",
+			wantErr:     true,
+		},
+		{
+			name:        "unsupported scheme",
+			templateURI: "http://example.com/pipeline.yaml",
+			wantErr:     true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkTemplateAccessible(context.Background(), arSrv.Client(), gcsClient, tc.templateURI)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Expected: error %t, Actual: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
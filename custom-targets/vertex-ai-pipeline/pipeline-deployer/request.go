@@ -19,6 +19,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"regexp"
+	"strconv"
 
 	"cloud.google.com/go/storage"
 	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
@@ -33,8 +35,28 @@ const (
 	paramValsKey   = "CLOUD_DEPLOY_customTarget_vertexAIPipelineJobParameterValues"
 	locValsKey     = "CLOUD_DEPLOY_customTarget_location"
 	projectValsKey = "CLOUD_DEPLOY_customTarget_projectID"
+	serviceAcctKey = "CLOUD_DEPLOY_customTarget_vertexAIPipelineServiceAccount"
+	networkKey     = "CLOUD_DEPLOY_customTarget_vertexAIPipelineNetwork"
+	cachingKey     = "CLOUD_DEPLOY_customTarget_vertexAIPipelineEnableCaching"
+	displayNameKey = "CLOUD_DEPLOY_customTarget_vertexAIPipelineDisplayNameTemplate"
+	jobNameKey     = "CLOUD_DEPLOY_customTarget_vertexAIPipelineJobName"
+	manifestKey    = "CLOUD_DEPLOY_customTarget_vertexAIManifestName"
+	validateTplKey = "CLOUD_DEPLOY_customTarget_vertexAIValidateTemplate"
 )
 
+var (
+	// serviceAccountRegex matches the email of a service account, e.g. "sa@my-project.iam.gserviceaccount.com".
+	serviceAccountRegex = regexp.MustCompile(`^[^@/\s]+@[^@/\s]+\.gserviceaccount\.com$`)
+	// networkRegex matches the full name of a VPC network, e.g. "projects/12345/global/networks/my-network".
+	networkRegex = regexp.MustCompile(`^projects/[^/\s]+/global/networks/[^/\s]+$`)
+	// Valid manifest names: a single file name that doesn't start with a dot.
+	manifestNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+)
+
+// Name of the manifest uploaded at render time and downloaded at deploy time when the vertexAIManifestName
+// deploy parameter isn't provided.
+const defaultManifestName = "manifest.yaml"
+
 // requestHandler interface provides methods for handling the Cloud Deploy params.
 type requestHandler interface {
 	// Process processes the Cloud Deploy params.
@@ -84,6 +106,31 @@ type params struct {
 	// Pipeline parameters obtained via deploy parameters. Hold parameters necessary
 	// for the createPipelineJobRequest, such as the prompt dataset
 	pipelineParams map[string]string
+
+	// The email of the service account the pipeline job runs as. If not provided then the job
+	// runs as the Compute Engine default service account.
+	serviceAccount string
+
+	// The full name of the VPC network the pipeline job is peered with, e.g.
+	// "projects/12345/global/networks/my-network". If not provided then the job isn't peered with
+	// any network.
+	network string
+
+	// Whether execution caching is enabled for the tasks of the pipeline job. If not provided then
+	// the caching options of the pipeline template are used, which enable caching by default.
+	enableCaching *bool
+
+	// Template for the display name of the pipeline job, used when the configuration doesn't set one.
+	// Supports the "{release}", "{target}" and "{pipeline}" placeholders.
+	displayNameTemplate string
+
+	// The name of the manifest object uploaded under the render output path, also used as the local
+	// file name the manifest is downloaded to at deploy time. Defaults to "manifest.yaml".
+	manifestName string
+
+	// Whether the render verifies that the pipeline template exists and is readable, so a wrong template
+	// URI fails the render instead of the deploy. Disabled by default.
+	validateTemplate bool
 }
 
 // determineParams returns the supported params provided in the execution environment via environment variables.
@@ -134,11 +181,62 @@ func determineParams() (*params, error) {
 		return nil, fmt.Errorf("environment variable %s contains empty string", configPathKey)
 	}
 
+	serviceAccount := os.Getenv(serviceAcctKey)
+	if serviceAccount != "" && !serviceAccountRegex.MatchString(serviceAccount) {
+		return nil, fmt.Errorf("environment variable %s must be a service account email, e.g. sa@my-project.iam.gserviceaccount.com, got %q", serviceAcctKey, serviceAccount)
+	}
+
+	network := os.Getenv(networkKey)
+	if network != "" && !networkRegex.MatchString(network) {
+		return nil, fmt.Errorf("environment variable %s must have the form projects/{project}/global/networks/{network}, got %q", networkKey, network)
+	}
+
+	var enableCaching *bool
+	if ec, found := os.LookupEnv(cachingKey); found {
+		b, err := strconv.ParseBool(ec)
+		if err != nil {
+			return nil, fmt.Errorf("environment variable %s must be a boolean, got %q", cachingKey, ec)
+		}
+		enableCaching = &b
+	}
+
+	manifestName, err := parseManifestName(os.Getenv(manifestKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid environment variable %s: %v", manifestKey, err)
+	}
+
+	validateTemplate := false
+	if vt, found := os.LookupEnv(validateTplKey); found {
+		validateTemplate, err = strconv.ParseBool(vt)
+		if err != nil {
+			return nil, fmt.Errorf("environment variable %s must be a boolean, got %q", validateTplKey, vt)
+		}
+	}
+
 	return &params{
 		project:        project,
 		pipeline:       pipeline,
 		configPath:     config,
 		location:       location,
 		pipelineParams: pipelineParams,
+		serviceAccount: serviceAccount,
+		network:        network,
+		enableCaching:  enableCaching,
+		// The template is validated once the placeholders are expanded at render time.
+		displayNameTemplate: os.Getenv(displayNameKey),
+		manifestName:        manifestName,
+		validateTemplate:    validateTemplate,
 	}, nil
 }
+
+// parseManifestName parses the value of the manifestName deploy parameter. An empty value returns the
+// default manifest name.
+func parseManifestName(value string) (string, error) {
+	if len(value) == 0 {
+		return defaultManifestName, nil
+	}
+	if !manifestNameRegexp.MatchString(value) {
+		return "", fmt.Errorf("%q must be a file name made of letters, digits, '.', '_' and '-' that doesn't start with '.'", value)
+	}
+	return value, nil
+}
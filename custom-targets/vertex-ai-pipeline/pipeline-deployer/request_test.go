@@ -225,4 +225,139 @@ func TestDetermineParams(t *testing.T) {
 		}
 		os.Setenv(locValsKey, "us-central1")
 	})
+
+	t.Run("ServiceAccountAndNetwork", func(t *testing.T) {
+		os.Setenv(serviceAcctKey, "sa@my-project.iam.gserviceaccount.com")
+		os.Setenv(networkKey, "projects/12345/global/networks/my-network")
+		defer os.Unsetenv(serviceAcctKey)
+		defer os.Unsetenv(networkKey)
+
+		params, err := determineParams()
+		if err != nil {
+			t.Fatalf("determineParams() returned an error: %v", err)
+		}
+		if params.serviceAccount != "sa@my-project.iam.gserviceaccount.com" {
+			t.Errorf("Expected serviceAccount to be 'sa@my-project.iam.gserviceaccount.com', got: %s", params.serviceAccount)
+		}
+		if params.network != "projects/12345/global/networks/my-network" {
+			t.Errorf("Expected network to be 'projects/12345/global/networks/my-network', got: %s", params.network)
+		}
+	})
+
+	t.Run("InvalidServiceAccount", func(t *testing.T) {
+		os.Setenv(serviceAcctKey, "projects/my-project/serviceAccounts/sa")
+		defer os.Unsetenv(serviceAcctKey)
+
+		if _, err := determineParams(); err == nil {
+			t.Errorf("determineParams() should have returned an error, but it didn't")
+		}
+	})
+
+	t.Run("EnableCaching", func(t *testing.T) {
+		params, err := determineParams()
+		if err != nil {
+			t.Fatalf("determineParams() returned an error: %v", err)
+		}
+		if params.enableCaching != nil {
+			t.Errorf("Expected enableCaching to be unset, got: %t", *params.enableCaching)
+		}
+
+		os.Setenv(cachingKey, "false")
+		defer os.Unsetenv(cachingKey)
+		params, err = determineParams()
+		if err != nil {
+			t.Fatalf("determineParams() returned an error: %v", err)
+		}
+		if params.enableCaching == nil || *params.enableCaching {
+			t.Errorf("Expected enableCaching to be false, got: %v", params.enableCaching)
+		}
+
+		os.Setenv(cachingKey, "sometimes")
+		if _, err := determineParams(); err == nil {
+			t.Errorf("determineParams() should have returned an error, but it didn't")
+		}
+	})
+
+	t.Run("InvalidNetwork", func(t *testing.T) {
+		os.Setenv(networkKey, "my-network")
+		defer os.Unsetenv(networkKey)
+
+		if _, err := determineParams(); err == nil {
+			t.Errorf("determineParams() should have returned an error, but it didn't")
+		}
+	})
+
+	t.Run("ManifestName", func(t *testing.T) {
+		params, err := determineParams()
+		if err != nil {
+			t.Fatalf("determineParams() returned an error: %v", err)
+		}
+		if params.manifestName != "manifest.yaml" {
+			t.Errorf("Expected manifestName to be 'manifest.yaml', got: %s", params.manifestName)
+		}
+
+		os.Setenv(manifestKey, "pipeline-a.yaml")
+		defer os.Unsetenv(manifestKey)
+		params, err = determineParams()
+		if err != nil {
+			t.Fatalf("determineParams() returned an error: %v", err)
+		}
+		if params.manifestName != "pipeline-a.yaml" {
+			t.Errorf("Expected manifestName to be 'pipeline-a.yaml', got: %s", params.manifestName)
+		}
+
+		os.Setenv(manifestKey, "../pipeline-a.yaml")
+		if _, err := determineParams(); err == nil {
+			t.Errorf("determineParams() should have returned an error, but it didn't")
+		}
+	})
+
+	t.Run("ValidateTemplate", func(t *testing.T) {
+		params, err := determineParams()
+		if err != nil {
+			t.Fatalf("determineParams() returned an error: %v", err)
+		}
+		if params.validateTemplate {
+			t.Errorf("Expected validateTemplate to be false, got: true")
+		}
+
+		os.Setenv(validateTplKey, "true")
+		defer os.Unsetenv(validateTplKey)
+		params, err = determineParams()
+		if err != nil {
+			t.Fatalf("determineParams() returned an error: %v", err)
+		}
+		if !params.validateTemplate {
+			t.Errorf("Expected validateTemplate to be true, got: false")
+		}
+
+		os.Setenv(validateTplKey, "maybe")
+		if _, err := determineParams(); err == nil {
+			t.Errorf("determineParams() should have returned an error, but it didn't")
+		}
+	})
+}
+
+// Tests that parseManifestName defaults to manifest.yaml and rejects names that aren't a single file name
+func TestParseManifestName(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "", want: "manifest.yaml"},
+		{value: "pipeline-a.yaml", want: "pipeline-a.yaml"},
+		{value: "dir/pipeline-a.yaml", wantErr: true},
+		{value: "..", wantErr: true},
+		{value: ".manifest.yaml", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := parseManifestName(tc.value)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseManifestName(%q) returned error %v, want error %t", tc.value, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("parseManifestName(%q) = %q, want %q", tc.value, got, tc.want)
+		}
+	}
 }
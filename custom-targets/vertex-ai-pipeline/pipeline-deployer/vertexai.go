@@ -50,12 +50,12 @@ func newAIPlatformService(ctx context.Context, region string) (*aiplatform.Servi
 	return regionalService, nil
 }
 
-// deployPipeline performs the deployPipeline request and awaits the resulting operation until it completes, it times out or an error occurs.
-func deployPipeline(ctx context.Context, aiPlatformService *aiplatform.Service, parent string, request *aiplatform.GoogleCloudAiplatformV1CreatePipelineJobRequest) error {
+// deployPipeline performs the deployPipeline request and returns the created pipeline job.
+func deployPipeline(ctx context.Context, aiPlatformService *aiplatform.Service, parent string, request *aiplatform.GoogleCloudAiplatformV1CreatePipelineJobRequest) (*aiplatform.GoogleCloudAiplatformV1PipelineJob, error) {
 	fmt.Printf("PARENT: %s; REQUEST: %v", parent, request.PipelineJob)
-	_, err := aiPlatformService.Projects.Locations.PipelineJobs.Create(parent, request.PipelineJob).Do()
+	job, err := aiPlatformService.Projects.Locations.PipelineJobs.Create(parent, request.PipelineJob).Do()
 	if err != nil {
-		return fmt.Errorf("unable to deploy pipeline: %v", err)
+		return nil, fmt.Errorf("unable to deploy pipeline: %v", err)
 	}
-	return nil
+	return job, nil
 }
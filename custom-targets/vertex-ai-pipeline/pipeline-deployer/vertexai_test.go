@@ -28,7 +28,7 @@ func TestPipelineRequestFromManifest(t *testing.T) {
 // Tests that deployPipeline fails as expected. Does not test actual deployment
 func TestDeployPipeline(t *testing.T) {
 	aiService, _ := newAIPlatformService(context.Background(), "us-central1")
-	err := deployPipeline(context.Background(), aiService, "projects/scortabarria-internship/locations/us-central1", &aiplatform.GoogleCloudAiplatformV1CreatePipelineJobRequest{})
+	_, err := deployPipeline(context.Background(), aiService, "projects/scortabarria-internship/locations/us-central1", &aiplatform.GoogleCloudAiplatformV1CreatePipelineJobRequest{})
 	if err == nil {
 		t.Errorf("Expected: error, Actual: %s", err)
 	}
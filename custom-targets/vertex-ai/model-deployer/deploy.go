@@ -16,18 +16,28 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
 	"google.golang.org/api/aiplatform/v1"
 	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
 
 	"cloud.google.com/go/storage"
 )
 
 const aiDeployerSampleName = "clouddeploy-vertex-ai-sample"
 
-const localManifest = "manifest.yaml"
+// Deploy metadata key for the comma-separated names of the DeployModel operations started by an asynchronous deploy.
+const deployOperationsMetadataKey = "vertex-ai-deploy-model-operations"
+
+// Deploy metadata key for the JSON list of the deployed models that couldn't be undeployed, along with the endpoint,
+// the UndeployModel operation and the error of each.
+const undeployFailuresMetadataKey = "vertex-ai-undeploy-failures"
 
 // deployer implements the handler interface to deploy a model using the vertex AI API.
 type deployer struct {
@@ -35,6 +45,12 @@ type deployer struct {
 	aiPlatformService *aiplatform.Service
 	params            *params
 	req               *clouddeploy.DeployRequest
+
+	// names of the DeployModel operations started when deploying asynchronously, one per endpoint.
+	operations []string
+
+	// deployed models that couldn't be undeployed after the deploy, across all endpoints.
+	undeployFailures []undeployFailure
 }
 
 // process processes the Deploy request, and performs the vertex AI model deployment.
@@ -49,6 +65,13 @@ func (d *deployer) process(ctx context.Context) error {
 			FailureMessage: err.Error(),
 		}
 		d.addCommonMetadata(dr)
+		if len(d.undeployFailures) != 0 {
+			failures, err := json.Marshal(d.undeployFailures)
+			if err != nil {
+				return fmt.Errorf("unable to marshal undeploy failures: %v", err)
+			}
+			dr.Metadata[undeployFailuresMetadataKey] = string(failures)
+		}
 		fmt.Println("Uploading failed deploy results")
 		rURI, err := d.req.UploadResult(ctx, d.gcsClient, dr)
 		if err != nil {
@@ -71,8 +94,12 @@ func (d *deployer) process(ctx context.Context) error {
 
 // deploy performs the Vertex AI model deployment
 func (d *deployer) deploy(ctx context.Context) (*clouddeploy.DeployResult, error) {
+	if d.params.validateOnly {
+		return nil, fmt.Errorf("the release was rendered with %s enabled and cannot be deployed", validateOnlyEnvKey)
+	}
 
-	if err := d.downloadManifest(ctx); err != nil {
+	localManifest, err := d.downloadManifest(ctx)
+	if err != nil {
 		return nil, err
 	}
 
@@ -81,30 +108,36 @@ func (d *deployer) deploy(ctx context.Context) (*clouddeploy.DeployResult, error
 		return nil, fmt.Errorf("failed to deploy model: %v", err)
 	}
 
-	mURI, err := d.req.UploadArtifact(ctx, d.gcsClient, "manifest.yaml", &clouddeploy.GCSUploadContent{Data: manifestData})
+	mURI, err := d.req.UploadArtifact(ctx, d.gcsClient, d.params.manifestName, &clouddeploy.GCSUploadContent{Data: manifestData})
 	if err != nil {
 		return nil, fmt.Errorf("error uploading deploy artifact: %v", err)
 	}
 
-	return &clouddeploy.DeployResult{
+	res := &clouddeploy.DeployResult{
 		ResultStatus:  clouddeploy.DeploySucceeded,
 		ArtifactFiles: []string{mURI},
-	}, nil
+	}
+	if d.params.asyncDeploy {
+		res.Metadata = map[string]string{deployOperationsMetadataKey: strings.Join(d.operations, ",")}
+	}
+	return res, nil
 }
 
-// downloadManifest downloads the rendered manifest from Google Cloud Storage to the local manifest file path
-func (d *deployer) downloadManifest(ctx context.Context) error {
+// downloadManifest downloads the rendered manifest from Google Cloud Storage to a local file named after the
+// manifestName parameter, and returns the local file path.
+func (d *deployer) downloadManifest(ctx context.Context) (string, error) {
 	fmt.Printf("Downloading deploy input manifest from %q.\n", d.req.ManifestGCSPath)
 
+	localManifest := d.params.manifestName
 	downloadPath, err := d.req.DownloadManifest(ctx, d.gcsClient, localManifest)
 	if err != nil {
 		fmt.Printf("Unable to download deployed manifest from: %s.\n", d.req.ManifestGCSPath)
-		return fmt.Errorf("unable to download deploy input from %s: %v", d.req.ManifestGCSPath, err)
+		return "", fmt.Errorf("unable to download deploy input from %s: %v", d.req.ManifestGCSPath, err)
 	}
 
 	fmt.Printf("Downloaded deploy input manifest from: %s\n", downloadPath)
 
-	return nil
+	return localManifest, nil
 }
 
 // addCommonMetadata inserts metadata into the deploy result that should be present
@@ -117,45 +150,218 @@ func (d *deployer) addCommonMetadata(rs *clouddeploy.DeployResult) {
 	rs.Metadata[clouddeploy.CustomTargetSourceSHAMetadataKey] = clouddeploy.GitCommit
 }
 
-// applyModel deploys the DeployModelRequest parsed from `localManifest`
-// it returns the DeployedModelRequest object that was used in yaml format.
+// recordUndeployFailures records the deployed models that couldn't be undeployed, if the provided error is an
+// *undeployError, so they are reported in the deploy result metadata.
+func (d *deployer) recordUndeployFailures(err error) {
+	var ue *undeployError
+	if errors.As(err, &ue) {
+		d.undeployFailures = append(d.undeployFailures, ue.failures...)
+	}
+}
+
+// applyModel deploys the DeployModelRequest parsed from `localManifest` to every endpoint. It returns
+// the DeployedModelRequest objects that were used in yaml format, one document per endpoint.
 func (d *deployer) applyModel(ctx context.Context, localManifest string) ([]byte, error) {
+	return deployToEndpoints(d.params.endpoints, func(endpoint string) ([]byte, error) {
+		return d.applyModelToEndpoint(ctx, localManifest, endpoint)
+	})
+}
+
+// deployToEndpoints calls deployFn for each endpoint and joins the returned manifests into a multi-document
+// yaml. Every endpoint is attempted, and if any deployment fails the returned error lists the failed endpoints.
+func deployToEndpoints(endpoints []string, deployFn func(endpoint string) ([]byte, error)) ([]byte, error) {
+	var manifests [][]byte
+	var failures []string
+	for _, endpoint := range endpoints {
+		fmt.Printf("Deploying model to endpoint %s\n", endpoint)
+		manifest, err := deployFn(endpoint)
+		if err != nil {
+			fmt.Printf("Deploying model to endpoint %s failed: %v\n", endpoint, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", endpoint, err))
+			continue
+		}
+		fmt.Printf("Deployed model to endpoint %s\n", endpoint)
+		manifests = append(manifests, manifest)
+	}
+
+	if len(failures) != 0 {
+		return nil, fmt.Errorf("deployment failed for %d of %d endpoints: %s", len(failures), len(endpoints), strings.Join(failures, "; "))
+	}
+	return bytes.Join(manifests, []byte("---\n")), nil
+}
 
+// applyModelToEndpoint deploys the DeployModelRequest parsed from `localManifest` to the provided endpoint
+// it returns the DeployedModelRequest object that was used in yaml format.
+func (d *deployer) applyModelToEndpoint(ctx context.Context, localManifest, endpoint string) ([]byte, error) {
+
+	// The request is loaded for each endpoint since canary changes are specific to the endpoint.
 	deployModelRequest, err := deployModelFromManifest(localManifest)
 	if err != nil {
 		return nil, fmt.Errorf("unable to load DeployModelRequest from manifest: %v", err)
 	}
 
+	service, err := d.endpointService(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	target := int64(d.req.Percentage)
+	if stages := stagesBelow(d.params.trafficMigrationStages, target); len(stages) != 0 {
+		m, err := newEndpointTrafficMigration(service, endpoint, deployModelRequest, d.params.roundingBias)
+		if err != nil {
+			return nil, err
+		}
+		if m.hasTraffic() {
+			return d.migrateTrafficToEndpoint(ctx, m, stages, target)
+		}
+		fmt.Printf("Endpoint %s doesn't route any traffic yet, deploying without traffic migration stages\n", endpoint)
+	}
+
 	if d.req.Percentage != 100 {
-		if err := d.makeManifestChangesForCanary(deployModelRequest); err != nil {
+		if err := makeManifestChangesForCanary(service, endpoint, deployModelRequest, d.params.roundingBias); err != nil {
 			return nil, fmt.Errorf("unable to make canary changes to the manifest: %v", err)
 		}
 	}
 
-	if err := deployModel(ctx, d.aiPlatformService, d.params.endpoint, deployModelRequest); err != nil {
+	if d.params.asyncDeploy {
+		op, err := startDeployModel(service, endpoint, deployModelRequest)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Started DeployModel operation %s, not waiting for it to complete since asynchronous deploy is enabled\n", op.Name)
+		d.operations = append(d.operations, op.Name)
+		return yaml.Marshal(deployModelRequest)
+	}
+
+	if err := deployModel(ctx, service, endpoint, deployModelRequest); err != nil {
 		return nil, fmt.Errorf("unable to deploy model: %v", err)
 	}
 
-	if err := undeployNoTrafficModels(ctx, d.aiPlatformService, d.params.endpoint); err != nil {
+	if err := undeployNoTrafficModels(ctx, service, endpoint, d.params.retainPreviousModels, d.params.undeployConcurrency); err != nil {
+		d.recordUndeployFailures(err)
 		return nil, fmt.Errorf("unable to undeploy models from endpoint: %v", err)
 	}
 
 	return yaml.Marshal(deployModelRequest)
 }
 
-// makeManifestChangesForCanary generates a traffic split configuration such that traffic is routed to exactly two models:
-// the new model being introduced, and the model that was previously deployed.
-func (d *deployer) makeManifestChangesForCanary(deployModelRequest *aiplatform.GoogleCloudAiplatformV1DeployModelRequest) error {
-	previousModel, err := fetchPreviousModel(d.aiPlatformService, d.params.endpoint, deployModelRequest.DeployedModel.Model)
+// migrateTrafficToEndpoint deploys the model to the endpoint by shifting the traffic through the migration stages
+// up to the target percentage. It returns the DeployModelRequest with the final traffic split in yaml format.
+func (d *deployer) migrateTrafficToEndpoint(ctx context.Context, m *endpointTrafficMigration, stages []trafficStage, target int64) ([]byte, error) {
+	if err := migrateTraffic(ctx, m, stages, target, d.params.trafficMigrationRollback); err != nil {
+		return nil, err
+	}
+
+	if err := undeployNoTrafficModels(ctx, m.service, m.endpoint, d.params.retainPreviousModels, d.params.undeployConcurrency); err != nil {
+		d.recordUndeployFailures(err)
+		return nil, fmt.Errorf("unable to undeploy models from endpoint: %v", err)
+	}
+
+	split, err := m.split(target)
+	if err != nil {
+		return nil, err
+	}
+	m.request.TrafficSplit = split
+	return yaml.Marshal(m.request)
+}
+
+// makeManifestChangesForCanary generates a traffic split configuration such that the new model being introduced
+// receives the canary percentage, and the models previously deployed to the endpoint share the rest of the traffic in
+// proportion to their current traffic split.
+func makeManifestChangesForCanary(service *aiplatform.Service, endpoint string, deployModelRequest *aiplatform.GoogleCloudAiplatformV1DeployModelRequest, roundingBias string) error {
+	previous, err := fetchPreviousTrafficSplit(service, endpoint, deployModelRequest.DeployedModel.Model)
 	if err != nil {
-		return fmt.Errorf("unable to get previous model to canary against: %v", err)
+		return fmt.Errorf("unable to get previous models to canary against: %v", err)
 	}
-	previousPercentage, ok := deployModelRequest.TrafficSplit["previous-model"]
-	if !ok {
+	if _, ok := deployModelRequest.TrafficSplit["previous-model"]; !ok {
 		return fmt.Errorf("expected input manifest trafficSplit stanza to have a 'previous-model' entry but did not find it")
 	}
-	delete(deployModelRequest.TrafficSplit, "previous-model")
-	deployModelRequest.TrafficSplit[previousModel] = previousPercentage
+	split, err := splitTraffic(deployModelRequest.TrafficSplit["0"], previous, roundingBias)
+	if err != nil {
+		return fmt.Errorf("unable to generate traffic split: %v", err)
+	}
+	deployModelRequest.TrafficSplit = split
 
 	return nil
 }
+
+// splitTraffic routes newPercentage of the traffic to the model being deployed, referred to as "0", and scales the
+// traffic of the previously deployed models so they share the rest. Integer percentages may not sum to 100 after
+// scaling, so the remainder is assigned based on the rounding bias: to the largest bucket, to the new model, or to
+// the largest previously deployed model. Ties between buckets are broken by model ID.
+func splitTraffic(newPercentage int64, previous map[string]int64, roundingBias string) (map[string]int64, error) {
+	if newPercentage < 0 || newPercentage > 100 {
+		return nil, fmt.Errorf("percentage must be between 0 and 100, got %d", newPercentage)
+	}
+	var previousTotal int64
+	for id, p := range previous {
+		if p < 0 {
+			return nil, fmt.Errorf("traffic for model %s must not be negative, got %d", id, p)
+		}
+		previousTotal += p
+	}
+	if newPercentage != 100 && previousTotal == 0 {
+		return nil, fmt.Errorf("no traffic is routed to the previously deployed models to share the remaining %d%% of traffic", 100-newPercentage)
+	}
+
+	split := map[string]int64{"0": newPercentage}
+	sum := newPercentage
+	if newPercentage != 100 {
+		for id, p := range previous {
+			split[id] = p * (100 - newPercentage) / previousTotal
+			sum += split[id]
+		}
+	}
+	if remainder := 100 - sum; remainder != 0 {
+		bucket := "0"
+		switch roundingBias {
+		case roundingBiasNew:
+		case roundingBiasPrevious:
+			bucket = largestBucket(split, func(id string) bool { return id != "0" })
+		default:
+			bucket = largestBucket(split, func(string) bool { return true })
+		}
+		split[bucket] += remainder
+	}
+	return split, nil
+}
+
+// largestBucket returns the ID of the traffic split bucket with the most traffic among the ones accepted by the
+// filter. Ties are broken by picking the lowest ID.
+func largestBucket(split map[string]int64, filter func(id string) bool) string {
+	ids := make([]string, 0, len(split))
+	for id := range split {
+		if filter(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	largest := ids[0]
+	for _, id := range ids[1:] {
+		if split[id] > split[largest] {
+			largest = id
+		}
+	}
+	return largest
+}
+
+// endpointService returns a Service that makes API calls in the region of the provided endpoint. The
+// Service created for the model region is reused unless the endpoint is in a different region.
+func (d *deployer) endpointService(ctx context.Context, endpointName string) (*aiplatform.Service, error) {
+	endpointRegion, err := regionFromEndpoint(endpointName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse region from endpoint: %v", err)
+	}
+	modelRegion, err := regionFromModel(d.params.model)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse region from model: %v", err)
+	}
+	if endpointRegion == modelRegion {
+		return d.aiPlatformService, nil
+	}
+	service, err := newAIPlatformService(ctx, endpointRegion, d.params.apiEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create aiplatform.Service object for region %s: %v", endpointRegion, err)
+	}
+	return service, nil
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/aiplatform/v1"
+	"google.golang.org/api/option"
+)
+
+//Tests that deployToEndpoints deploys to every endpoint and joins the manifests
+func TestDeployToEndpoints(t *testing.T) {
+	endpoints := []string{"endpoint-a", "endpoint-b"}
+	var deployed []string
+	out, err := deployToEndpoints(endpoints, func(endpoint string) ([]byte, error) {
+		deployed = append(deployed, endpoint)
+		return []byte(fmt.Sprintf("endpoint: %s\n", endpoint)), nil
+	})
+	if err != nil {
+		t.Fatalf("Expected: no error, Actual: %v", err)
+	}
+	if diff := cmp.Diff(endpoints, deployed); diff != "" {
+		t.Errorf("Unexpected endpoints deployed (-want +got):\n%s", diff)
+	}
+	want := "endpoint: endpoint-a\n---\nendpoint: endpoint-b\n"
+	if string(out) != want {
+		t.Errorf("Expected: %q, Actual: %q", want, string(out))
+	}
+}
+
+//Tests that deployToEndpoints attempts every endpoint and reports the ones that failed
+func TestDeployToEndpointsPartialFailure(t *testing.T) {
+	endpoints := []string{"endpoint-a", "endpoint-b", "endpoint-c"}
+	var deployed []string
+	_, err := deployToEndpoints(endpoints, func(endpoint string) ([]byte, error) {
+		deployed = append(deployed, endpoint)
+		if endpoint == "endpoint-b" {
+			return nil, fmt.Errorf("quota exceeded")
+		}
+		return []byte("ok\n"), nil
+	})
+	if err == nil {
+		t.Fatalf("Expected: error, Actual: %v", err)
+	}
+	if diff := cmp.Diff(endpoints, deployed); diff != "" {
+		t.Errorf("Unexpected endpoints deployed (-want +got):\n%s", diff)
+	}
+	if !strings.Contains(err.Error(), "endpoint-b: quota exceeded") || strings.Contains(err.Error(), "endpoint-a") || strings.Contains(err.Error(), "endpoint-c") {
+		t.Errorf("Expected: error naming only endpoint-b, Actual: %v", err)
+	}
+}
+
+//Tests that parseEndpoints splits the endpoint deploy parameter
+func TestParseEndpoints(t *testing.T) {
+	got := parseEndpoints(" projects/p/locations/l1/endpoints/a, ,projects/p/locations/l2/endpoints/b ")
+	want := []string{"projects/p/locations/l1/endpoints/a", "projects/p/locations/l2/endpoints/b"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected endpoints (-want +got):\n%s", diff)
+	}
+	if got := parseEndpoints(""); len(got) != 0 {
+		t.Errorf("Expected: no endpoints, Actual: %v", got)
+	}
+}
+
+//Tests that splitTraffic always sums to 100 and assigns the rounding remainder based on the bias
+func TestSplitTraffic(t *testing.T) {
+	tests := []struct {
+		name          string
+		newPercentage int64
+		previous      map[string]int64
+		bias          string
+		want          map[string]int64
+	}{
+		{
+			name:          "single previous model",
+			newPercentage: 25,
+			previous:      map[string]int64{"a": 100},
+			bias:          roundingBiasLargest,
+			want:          map[string]int64{"0": 25, "a": 75},
+		},
+		{
+			name:          "no remainder",
+			newPercentage: 50,
+			previous:      map[string]int64{"a": 60, "b": 40},
+			bias:          roundingBiasNew,
+			want:          map[string]int64{"0": 50, "a": 30, "b": 20},
+		},
+		{
+			name:          "remainder to largest bucket",
+			newPercentage: 25,
+			previous:      map[string]int64{"a": 50, "b": 30, "c": 20},
+			bias:          roundingBiasLargest,
+			want:          map[string]int64{"0": 25, "a": 38, "b": 22, "c": 15},
+		},
+		{
+			name:          "remainder to new model",
+			newPercentage: 25,
+			previous:      map[string]int64{"a": 50, "b": 30, "c": 20},
+			bias:          roundingBiasNew,
+			want:          map[string]int64{"0": 26, "a": 37, "b": 22, "c": 15},
+		},
+		{
+			name:          "remainder to largest previous model",
+			newPercentage: 60,
+			previous:      map[string]int64{"a": 1, "b": 1, "c": 1},
+			bias:          roundingBiasPrevious,
+			want:          map[string]int64{"0": 60, "a": 14, "b": 13, "c": 13},
+		},
+		{
+			name:          "largest bucket is the new model",
+			newPercentage: 60,
+			previous:      map[string]int64{"a": 1, "b": 1, "c": 1},
+			bias:          roundingBiasLargest,
+			want:          map[string]int64{"0": 61, "a": 13, "b": 13, "c": 13},
+		},
+		{
+			name:          "full rollout",
+			newPercentage: 100,
+			previous:      map[string]int64{"a": 100},
+			bias:          roundingBiasPrevious,
+			want:          map[string]int64{"0": 100},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := splitTraffic(tc.newPercentage, tc.previous, tc.bias)
+			if err != nil {
+				t.Fatalf("Expected: no error, Actual: %v", err)
+			}
+			var sum int64
+			for _, p := range got {
+				sum += p
+			}
+			if sum != 100 {
+				t.Errorf("Expected: traffic split to sum to 100, Actual: %d", sum)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Unexpected traffic split (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+//Tests that splitTraffic rejects invalid percentages
+func TestSplitTrafficFails(t *testing.T) {
+	if _, err := splitTraffic(101, map[string]int64{"a": 100}, roundingBiasLargest); err == nil {
+		t.Errorf("Expected: error for percentage over 100, Actual: %v", err)
+	}
+	if _, err := splitTraffic(50, map[string]int64{}, roundingBiasLargest); err == nil {
+		t.Errorf("Expected: error without previous models, Actual: %v", err)
+	}
+}
+
+//Tests that a canary shares the remaining traffic among all the previously deployed models in proportion to their
+//current traffic split
+func TestMakeManifestChangesForCanaryMultipleModels(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/v1/projects/p/locations/us-central1/endpoints/e" {
+			http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(&aiplatform.GoogleCloudAiplatformV1Endpoint{
+			DeployedModels: []*aiplatform.GoogleCloudAiplatformV1DeployedModel{
+				{Id: "a", Model: "projects/p/locations/us-central1/models/m", ModelVersionId: "1"},
+				{Id: "b", Model: "projects/p/locations/us-central1/models/m", ModelVersionId: "2"},
+				{Id: "c", Model: "projects/p/locations/us-central1/models/n", ModelVersionId: "1"},
+				{Id: "idle", Model: "projects/p/locations/us-central1/models/n", ModelVersionId: "2"},
+				{Id: "current", Model: "projects/p/locations/us-central1/models/m", ModelVersionId: "3"},
+			},
+			TrafficSplit: map[string]int64{"a": 50, "b": 30, "c": 10, "current": 10},
+		})
+	}))
+	defer srv.Close()
+	service, err := aiplatform.NewService(context.Background(), option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("unable to create service: %v", err)
+	}
+
+	req := &aiplatform.GoogleCloudAiplatformV1DeployModelRequest{
+		DeployedModel: &aiplatform.GoogleCloudAiplatformV1DeployedModel{Model: "projects/p/locations/us-central1/models/m@3"},
+		TrafficSplit:  map[string]int64{"0": 25, "previous-model": 75},
+	}
+	if err := makeManifestChangesForCanary(service, "projects/p/locations/us-central1/endpoints/e", req, roundingBiasLargest); err != nil {
+		t.Fatalf("Expected: no error, Actual: %v", err)
+	}
+	// The 75% left by the canary is split 5:3:1 between the previously deployed models that receive traffic, the
+	// current model's traffic isn't kept and the rounding remainder goes to the largest bucket.
+	want := map[string]int64{"0": 25, "a": 42, "b": 25, "c": 8}
+	if diff := cmp.Diff(want, req.TrafficSplit); diff != "" {
+		t.Errorf("Unexpected traffic split (-want +got):\n%s", diff)
+	}
+}
+
+//Tests that parseMinReplicaCount only reports an error when the deploy parameter is set to an invalid value
+func TestParseMinReplicaCount(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		ok      bool
+		want    int
+		wantErr bool
+	}{
+		{name: "unset", want: 0},
+		{name: "empty", value: "", ok: true, want: 0},
+		{name: "valid", value: "3", ok: true, want: 3},
+		{name: "not an integer", value: "three", ok: true, want: 0, wantErr: true},
+		{name: "negative", value: "-1", ok: true, want: 0, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseMinReplicaCount(tc.value, tc.ok)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("parseMinReplicaCount() got err: %v, want err: %t", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("parseMinReplicaCount() got: %d, want: %d", got, tc.want)
+			}
+		})
+	}
+}
+
+//Tests that determineParams defers to the configuration file when the minReplicaCount deploy parameter is unset or invalid
+func TestDetermineParamsMinReplicaCount(t *testing.T) {
+	t.Setenv(modelEnvKey, "projects/p/locations/us-central1/models/m")
+	t.Setenv(endpointEnvKey, "projects/p/locations/us-central1/endpoints/e")
+
+	p, err := determineParams()
+	if err != nil {
+		t.Fatalf("determineParams() failed: %v", err)
+	}
+	if p.minReplicaCount != 0 {
+		t.Errorf("Expected: minReplicaCount 0 when unset, Actual: %d", p.minReplicaCount)
+	}
+
+	t.Setenv(minReplicaCountEnvKey, "invalid")
+	p, err = determineParams()
+	if err != nil {
+		t.Fatalf("determineParams() failed: %v", err)
+	}
+	if p.minReplicaCount != 0 {
+		t.Errorf("Expected: minReplicaCount 0 when invalid, Actual: %d", p.minReplicaCount)
+	}
+
+	t.Setenv(minReplicaCountEnvKey, "2")
+	p, err = determineParams()
+	if err != nil {
+		t.Fatalf("determineParams() failed: %v", err)
+	}
+	if p.minReplicaCount != 2 {
+		t.Errorf("Expected: minReplicaCount 2, Actual: %d", p.minReplicaCount)
+	}
+}
+
+//Tests that determineParams rejects an invalid number of previous models to retain
+func TestDetermineParamsRetainPreviousModels(t *testing.T) {
+	t.Setenv(modelEnvKey, "projects/p/locations/us-central1/models/m")
+	t.Setenv(endpointEnvKey, "projects/p/locations/us-central1/endpoints/e")
+
+	for _, v := range []string{"two", "-1"} {
+		t.Setenv(retainModelsEnvKey, v)
+		if _, err := determineParams(); err == nil {
+			t.Errorf("Expected: error for %q, Actual: %v", v, err)
+		}
+	}
+
+	t.Setenv(retainModelsEnvKey, "2")
+	p, err := determineParams()
+	if err != nil {
+		t.Fatalf("determineParams() failed: %v", err)
+	}
+	if p.retainPreviousModels != 2 {
+		t.Errorf("Expected: retainPreviousModels 2, Actual: %d", p.retainPreviousModels)
+	}
+}
+
+//Tests that an asynchronous deploy starts the DeployModel operation without waiting and captures its name
+func TestApplyModelToEndpointAsync(t *testing.T) {
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		if r.Method == http.MethodPost && r.URL.Path == "/v1/projects/p/locations/us-central1/endpoints/e:deployModel" {
+			w.Write([]byte(`{"name": "projects/p/locations/us-central1/endpoints/e/operations/op-1"}`))
+			return
+		}
+		http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+	}))
+	defer srv.Close()
+	service, err := aiplatform.NewService(context.Background(), option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("unable to create service: %v", err)
+	}
+
+	manifest := filepath.Join(t.TempDir(), "manifest.yaml")
+	if err := os.WriteFile(manifest, []byte("deployedModel:\n  model: projects/p/locations/us-central1/models/m@1\ntrafficSplit:\n  \"0\": 100\n"), 0644); err != nil {
+		t.Fatalf("unable to write manifest: %v", err)
+	}
+	d := &deployer{
+		aiPlatformService: service,
+		params:            &params{model: "projects/p/locations/us-central1/models/m@1", asyncDeploy: true},
+		req:               &clouddeploy.DeployRequest{Percentage: 100},
+	}
+	if _, err := d.applyModelToEndpoint(context.Background(), manifest, "projects/p/locations/us-central1/endpoints/e"); err != nil {
+		t.Fatalf("Expected: no error, Actual: %v", err)
+	}
+	if diff := cmp.Diff([]string{"projects/p/locations/us-central1/endpoints/e/operations/op-1"}, d.operations); diff != "" {
+		t.Errorf("Unexpected operations (-want +got):\n%s", diff)
+	}
+	// Neither the operation nor the endpoint are fetched, since the deploy doesn't wait or undeploy models.
+	if diff := cmp.Diff([]string{"POST /v1/projects/p/locations/us-central1/endpoints/e:deployModel"}, calls); diff != "" {
+		t.Errorf("Unexpected API calls (-want +got):\n%s", diff)
+	}
+}
+
+//Tests that determineParams rejects an asynchronous deploy with traffic migration stages
+func TestDetermineParamsAsyncDeploy(t *testing.T) {
+	t.Setenv(modelEnvKey, "projects/p/locations/us-central1/models/m")
+	t.Setenv(endpointEnvKey, "projects/p/locations/us-central1/endpoints/e")
+	t.Setenv(asyncDeployEnvKey, "true")
+
+	p, err := determineParams()
+	if err != nil {
+		t.Fatalf("determineParams() failed: %v", err)
+	}
+	if !p.asyncDeploy {
+		t.Errorf("Expected: asyncDeploy true, Actual: false")
+	}
+
+	t.Setenv(migrationStagesEnvKey, "10:5m")
+	if _, err := determineParams(); err == nil {
+		t.Errorf("Expected: error with traffic migration stages, Actual: %v", err)
+	}
+}
+
+//Tests that parseManifestName defaults to manifest.yaml and rejects names that aren't a single file name
+func TestParseManifestName(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "", want: "manifest.yaml"},
+		{value: "model-a.yaml", want: "model-a.yaml"},
+		{value: "dir/model-a.yaml", wantErr: true},
+		{value: "..", wantErr: true},
+		{value: ".manifest.yaml", wantErr: true},
+		{value: "model a.yaml", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := parseManifestName(tc.value)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseManifestName(%q) Expected: error %t, Actual: %v", tc.value, tc.wantErr, err)
+		}
+		if got != tc.want {
+			t.Errorf("parseManifestName(%q) Expected: %q, Actual: %q", tc.value, tc.want, got)
+		}
+	}
+}
+
+//Tests that the manifest uploaded by the render with a configured name is downloaded by the deploy with the same name
+func TestManifestNameRoundTrip(t *testing.T) {
+	s := clouddeploy.NewMemoryStorage()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("unable to get working directory: %v", err)
+	}
+	// The manifest is downloaded relative to the working directory.
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("unable to change working directory: %v", err)
+	}
+	defer os.Chdir(wd)
+
+	p := &params{manifestName: "model-a.yaml"}
+	r := &renderer{params: p, req: &clouddeploy.RenderRequest{OutputGCSPath: "gs://bucket/render", Storage: s}}
+	mURI, err := r.uploadManifest(context.Background(), []byte("manifest"))
+	if err != nil {
+		t.Fatalf("uploadManifest() failed: %v", err)
+	}
+	if mURI != "gs://bucket/render/model-a.yaml" {
+		t.Errorf("Expected: gs://bucket/render/model-a.yaml, Actual: %s", mURI)
+	}
+
+	// Cloud Deploy provides the URI of the rendered manifest to the deploy.
+	d := &deployer{params: p, req: &clouddeploy.DeployRequest{ManifestGCSPath: mURI, Storage: s}}
+	localManifest, err := d.downloadManifest(context.Background())
+	if err != nil {
+		t.Fatalf("downloadManifest() failed: %v", err)
+	}
+	if localManifest != "model-a.yaml" {
+		t.Errorf("Expected: model-a.yaml, Actual: %s", localManifest)
+	}
+	data, err := os.ReadFile(localManifest)
+	if err != nil {
+		t.Fatalf("unable to read downloaded manifest: %v", err)
+	}
+	if string(data) != "manifest" {
+		t.Errorf("Expected: manifest, Actual: %s", data)
+	}
+}
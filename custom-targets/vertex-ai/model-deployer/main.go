@@ -65,7 +65,7 @@ func do() error {
 		return fmt.Errorf("unable to parse region from model resource name: %v", err)
 	}
 
-	aiPlatformService, err := newAIPlatformService(ctx, aiPlatformRegion)
+	aiPlatformService, err := newAIPlatformService(ctx, aiPlatformRegion, params.apiEndpoint)
 	if err != nil {
 		return fmt.Errorf("unable to create aiplatform.Service object : %v", err)
 	}
@@ -0,0 +1,268 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// migration.go contains logic to progressively migrate traffic to a model being deployed to a Vertex AI endpoint.
+package main
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/api/aiplatform/v1"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// trafficStage is a step of a staged traffic migration.
+type trafficStage struct {
+	// percentage of traffic routed to the model being deployed.
+	percentage int64
+	// how long to wait after routing the traffic before moving on to the next stage.
+	wait time.Duration
+}
+
+// parseTrafficMigrationStages parses the comma-separated vertexAITrafficMigrationStages deploy parameter,
+// where each stage has the form "{percentage}[:{wait}]", e.g. "10:5m,50:10m". Percentages must be strictly
+// increasing and between 1 and 100.
+func parseTrafficMigrationStages(value string) ([]trafficStage, error) {
+	var stages []trafficStage
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, w, hasWait := strings.Cut(s, ":")
+		percentage, err := strconv.ParseInt(strings.TrimSpace(p), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("stage %q: invalid percentage: %v", s, err)
+		}
+		if percentage < 1 || percentage > 100 {
+			return nil, fmt.Errorf("stage %q: percentage must be between 1 and 100", s)
+		}
+		if len(stages) != 0 && percentage <= stages[len(stages)-1].percentage {
+			return nil, fmt.Errorf("stage %q: percentages must be strictly increasing", s)
+		}
+		var wait time.Duration
+		if hasWait {
+			wait, err = time.ParseDuration(strings.TrimSpace(w))
+			if err != nil {
+				return nil, fmt.Errorf("stage %q: invalid wait: %v", s, err)
+			}
+			if wait < 0 {
+				return nil, fmt.Errorf("stage %q: wait must not be negative", s)
+			}
+		}
+		stages = append(stages, trafficStage{percentage: percentage, wait: wait})
+	}
+	return stages, nil
+}
+
+// stagesBelow returns the stages that route less than the target percentage of traffic. Stages at or above the
+// target are reached by a later canary phase, if at all.
+func stagesBelow(stages []trafficStage, target int64) []trafficStage {
+	var below []trafficStage
+	for _, s := range stages {
+		if s.percentage < target {
+			below = append(below, s)
+		}
+	}
+	return below
+}
+
+// trafficMigration applies the traffic splits of a staged migration to an endpoint.
+type trafficMigration interface {
+	// deploy deploys the model, routing the provided percentage of traffic to it.
+	deploy(ctx context.Context, percentage int64) error
+	// shift routes the provided percentage of traffic to the deployed model.
+	shift(ctx context.Context, percentage int64) error
+	// check verifies the endpoint still routes the traffic applied for the stage with the provided percentage to the
+	// deployed model.
+	check(ctx context.Context, percentage int64) error
+	// rollback restores the traffic split from before the migration and undeploys the model.
+	rollback(ctx context.Context) error
+}
+
+// migrateTraffic deploys the model with the percentage of the first stage, then shifts the traffic through the
+// remaining stages and finally to the target percentage. After each stage it waits for the stage's duration and
+// checks the traffic split is still in place before moving on. If a stage fails after the model was deployed and
+// rollback is enabled then the traffic split from before the migration is restored.
+func migrateTraffic(ctx context.Context, m trafficMigration, stages []trafficStage, target int64, rollback bool) error {
+	for i, stage := range stages {
+		fmt.Printf("Traffic migration stage %d of %d: routing %d%% of traffic to the model\n", i+1, len(stages), stage.percentage)
+		if i == 0 {
+			if err := m.deploy(ctx, stage.percentage); err != nil {
+				return fmt.Errorf("traffic migration failed at stage 1 (%d%%): %v", stage.percentage, err)
+			}
+		} else if err := m.shift(ctx, stage.percentage); err != nil {
+			return failMigration(ctx, m, rollback, fmt.Errorf("traffic migration failed at stage %d (%d%%): %v", i+1, stage.percentage, err))
+		}
+		if err := waitStage(ctx, m, stage); err != nil {
+			return failMigration(ctx, m, rollback, fmt.Errorf("traffic migration failed at stage %d (%d%%): %v", i+1, stage.percentage, err))
+		}
+	}
+
+	fmt.Printf("Traffic migration stages complete, routing the target %d%% of traffic to the model\n", target)
+	if err := m.shift(ctx, target); err != nil {
+		return failMigration(ctx, m, rollback, fmt.Errorf("traffic migration failed routing the target %d%% of traffic: %v", target, err))
+	}
+	return nil
+}
+
+// waitStage waits for the stage's duration and then checks the endpoint still routes the stage's percentage of
+// traffic to the model.
+func waitStage(ctx context.Context, m trafficMigration, stage trafficStage) error {
+	if stage.wait > 0 {
+		fmt.Printf("Waiting %v before the next traffic migration stage\n", stage.wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(stage.wait):
+		}
+	}
+	return m.check(ctx, stage.percentage)
+}
+
+// failMigration returns the migration error, rolling back the migration first if rollback is enabled.
+func failMigration(ctx context.Context, m trafficMigration, rollback bool, err error) error {
+	if !rollback {
+		return err
+	}
+	fmt.Println("Rolling back the traffic migration")
+	if rbErr := m.rollback(ctx); rbErr != nil {
+		return fmt.Errorf("%v; rollback failed: %v", err, rbErr)
+	}
+	return fmt.Errorf("%v; rolled back to the traffic split from before the migration", err)
+}
+
+// endpointTrafficMigration implements trafficMigration for a Vertex AI endpoint.
+type endpointTrafficMigration struct {
+	service      *aiplatform.Service
+	endpoint     string
+	request      *aiplatform.GoogleCloudAiplatformV1DeployModelRequest
+	roundingBias string
+
+	// traffic split and deployed model IDs of the endpoint before the migration.
+	original    map[string]int64
+	originalIDs map[string]bool
+	// ID of the deployed model, set once it's deployed.
+	deployedModelID string
+	// percentage of traffic the last applied split routes to the deployed model. It may differ from the stage
+	// percentage since splitTraffic can assign the rounding remainder to the deployed model.
+	applied int64
+}
+
+// newEndpointTrafficMigration returns a trafficMigration for the endpoint that records the endpoint's traffic
+// split before the migration.
+func newEndpointTrafficMigration(service *aiplatform.Service, endpointName string, request *aiplatform.GoogleCloudAiplatformV1DeployModelRequest, roundingBias string) (*endpointTrafficMigration, error) {
+	endpoint, err := service.Projects.Locations.Endpoints.Get(endpointName).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch endpoint: %v", err)
+	}
+	m := &endpointTrafficMigration{
+		service:      service,
+		endpoint:     endpointName,
+		request:      request,
+		roundingBias: roundingBias,
+		original:     map[string]int64{},
+		originalIDs:  map[string]bool{},
+	}
+	for id, p := range endpoint.TrafficSplit {
+		m.original[id] = p
+	}
+	for _, dm := range endpoint.DeployedModels {
+		m.originalIDs[dm.Id] = true
+	}
+	return m, nil
+}
+
+// hasTraffic returns whether the endpoint routed any traffic before the migration, i.e. whether there's
+// traffic to migrate away from.
+func (m *endpointTrafficMigration) hasTraffic() bool {
+	for _, p := range m.original {
+		if p != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// split returns the traffic split routing percentage of the traffic to the model, referred to as "0", with the
+// models from before the migration sharing the rest.
+func (m *endpointTrafficMigration) split(percentage int64) (map[string]int64, error) {
+	return splitTraffic(percentage, m.original, m.roundingBias)
+}
+
+func (m *endpointTrafficMigration) deploy(ctx context.Context, percentage int64) error {
+	split, err := m.split(percentage)
+	if err != nil {
+		return err
+	}
+	request := *m.request
+	request.TrafficSplit = split
+	if err := deployModel(ctx, m.service, m.endpoint, &request); err != nil {
+		return err
+	}
+	m.applied = split["0"]
+	endpoint, err := m.service.Projects.Locations.Endpoints.Get(m.endpoint).Do()
+	if err != nil {
+		return fmt.Errorf("unable to fetch endpoint: %v", err)
+	}
+	for _, dm := range endpoint.DeployedModels {
+		if !m.originalIDs[dm.Id] {
+			m.deployedModelID = dm.Id
+			return nil
+		}
+	}
+	return fmt.Errorf("unable to find the deployed model on endpoint %s", m.endpoint)
+}
+
+func (m *endpointTrafficMigration) shift(ctx context.Context, percentage int64) error {
+	split, err := m.split(percentage)
+	if err != nil {
+		return err
+	}
+	split[m.deployedModelID] = split["0"]
+	delete(split, "0")
+	if err := m.patchTrafficSplit(split); err != nil {
+		return err
+	}
+	m.applied = split[m.deployedModelID]
+	return nil
+}
+
+func (m *endpointTrafficMigration) check(ctx context.Context, percentage int64) error {
+	endpoint, err := m.service.Projects.Locations.Endpoints.Get(m.endpoint).Do()
+	if err != nil {
+		return fmt.Errorf("unable to fetch endpoint: %v", err)
+	}
+	if got := endpoint.TrafficSplit[m.deployedModelID]; got != m.applied {
+		return fmt.Errorf("expected the endpoint to route %d%% of traffic to deployed model %s for the %d%% stage, but it routes %d%%", m.applied, m.deployedModelID, percentage, got)
+	}
+	return nil
+}
+
+func (m *endpointTrafficMigration) rollback(ctx context.Context) error {
+	if err := m.patchTrafficSplit(m.original); err != nil {
+		return err
+	}
+	return undeployModels(ctx, m.service, m.endpoint, []string{m.deployedModelID}, 0)
+}
+
+// patchTrafficSplit updates the traffic split of the endpoint.
+func (m *endpointTrafficMigration) patchTrafficSplit(split map[string]int64) error {
+	_, err := m.service.Projects.Locations.Endpoints.Patch(m.endpoint, &aiplatform.GoogleCloudAiplatformV1Endpoint{TrafficSplit: split}).UpdateMask("trafficSplit").Do()
+	if err != nil {
+		return fmt.Errorf("unable to update endpoint traffic split: %v", err)
+	}
+	return nil
+}
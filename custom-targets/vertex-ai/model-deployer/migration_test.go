@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/aiplatform/v1"
+	"google.golang.org/api/option"
+)
+
+// fakeMigration records the calls made during a traffic migration, failing the call listed in failOn.
+type fakeMigration struct {
+	calls  []string
+	failOn string
+}
+
+func (f *fakeMigration) record(call string) error {
+	f.calls = append(f.calls, call)
+	if call == f.failOn {
+		return errors.New("injected failure")
+	}
+	return nil
+}
+
+func (f *fakeMigration) deploy(ctx context.Context, percentage int64) error {
+	return f.record(fmt.Sprintf("deploy %d", percentage))
+}
+
+func (f *fakeMigration) shift(ctx context.Context, percentage int64) error {
+	return f.record(fmt.Sprintf("shift %d", percentage))
+}
+
+func (f *fakeMigration) check(ctx context.Context, percentage int64) error {
+	return f.record(fmt.Sprintf("check %d", percentage))
+}
+
+func (f *fakeMigration) rollback(ctx context.Context) error {
+	return f.record("rollback")
+}
+
+//Tests that migrateTraffic applies the stages in order and rolls back failed stages when enabled
+func TestMigrateTraffic(t *testing.T) {
+	stages := []trafficStage{{percentage: 10}, {percentage: 25, wait: time.Millisecond}}
+	tests := []struct {
+		name      string
+		failOn    string
+		rollback  bool
+		wantCalls []string
+		wantErr   string
+	}{
+		{
+			name:      "all stages succeed",
+			wantCalls: []string{"deploy 10", "check 10", "shift 25", "check 25", "shift 50"},
+		},
+		{
+			name:      "first deploy fails without rollback",
+			failOn:    "deploy 10",
+			rollback:  true,
+			wantCalls: []string{"deploy 10"},
+			wantErr:   "stage 1 (10%)",
+		},
+		{
+			name:      "intermediate stage fails without rollback",
+			failOn:    "shift 25",
+			wantCalls: []string{"deploy 10", "check 10", "shift 25"},
+			wantErr:   "stage 2 (25%)",
+		},
+		{
+			name:      "intermediate stage fails with rollback",
+			failOn:    "shift 25",
+			rollback:  true,
+			wantCalls: []string{"deploy 10", "check 10", "shift 25", "rollback"},
+			wantErr:   "rolled back",
+		},
+		{
+			name:      "first stage check fails with rollback",
+			failOn:    "check 10",
+			rollback:  true,
+			wantCalls: []string{"deploy 10", "check 10", "rollback"},
+			wantErr:   "stage 1 (10%)",
+		},
+		{
+			name:      "target fails with rollback",
+			failOn:    "shift 50",
+			rollback:  true,
+			wantCalls: []string{"deploy 10", "check 10", "shift 25", "check 25", "shift 50", "rollback"},
+			wantErr:   "target 50%",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &fakeMigration{failOn: tc.failOn}
+			err := migrateTraffic(context.Background(), m, stages, 50, tc.rollback)
+			if diff := cmp.Diff(tc.wantCalls, m.calls); diff != "" {
+				t.Errorf("Unexpected calls (-want +got):\n%s", diff)
+			}
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("Expected: no error, Actual: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Expected: error containing %q, Actual: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+//Tests that migrateTraffic stops waiting when the context is canceled
+func TestMigrateTrafficCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m := &fakeMigration{}
+	err := migrateTraffic(ctx, m, []trafficStage{{percentage: 10, wait: time.Hour}}, 100, false)
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("Expected: context canceled error, Actual: %v", err)
+	}
+	if diff := cmp.Diff([]string{"deploy 10"}, m.calls); diff != "" {
+		t.Errorf("Unexpected calls (-want +got):\n%s", diff)
+	}
+}
+
+//Tests that parseTrafficMigrationStages parses the stages and rejects invalid ones
+func TestParseTrafficMigrationStages(t *testing.T) {
+	got, err := parseTrafficMigrationStages(" 10:5m, 50 ,100:1h")
+	if err != nil {
+		t.Fatalf("Expected: no error, Actual: %v", err)
+	}
+	want := []trafficStage{{percentage: 10, wait: 5 * time.Minute}, {percentage: 50}, {percentage: 100, wait: time.Hour}}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(trafficStage{})); diff != "" {
+		t.Errorf("Unexpected stages (-want +got):\n%s", diff)
+	}
+	if got, err := parseTrafficMigrationStages(""); err != nil || len(got) != 0 {
+		t.Errorf("Expected: no stages, Actual: %v, %v", got, err)
+	}
+	for _, v := range []string{"ten", "0", "101", "50,10", "10,10", "10:soon", "10:-1m"} {
+		if _, err := parseTrafficMigrationStages(v); err == nil {
+			t.Errorf("Expected: error for %q, Actual: nil", v)
+		}
+	}
+}
+
+//Tests that stagesBelow only keeps the stages below the target percentage
+func TestStagesBelow(t *testing.T) {
+	stages := []trafficStage{{percentage: 10}, {percentage: 25}, {percentage: 50}, {percentage: 100}}
+	got := stagesBelow(stages, 50)
+	want := []trafficStage{{percentage: 10}, {percentage: 25}}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(trafficStage{})); diff != "" {
+		t.Errorf("Unexpected stages (-want +got):\n%s", diff)
+	}
+}
+
+//Tests that check accepts the split applied by shift when splitTraffic gives the rounding remainder to the model
+func TestEndpointTrafficMigrationShiftCheck(t *testing.T) {
+	endpointName := "projects/p/locations/us-central1/endpoints/e"
+	trafficSplit := map[string]int64{"a": 50, "b": 50}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/"+endpointName {
+			http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodPatch {
+			var e aiplatform.GoogleCloudAiplatformV1Endpoint
+			if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			trafficSplit = e.TrafficSplit
+		}
+		json.NewEncoder(w).Encode(&aiplatform.GoogleCloudAiplatformV1Endpoint{Name: endpointName, TrafficSplit: trafficSplit})
+	}))
+	defer srv.Close()
+	service, err := aiplatform.NewService(context.Background(), option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("unable to create service: %v", err)
+	}
+
+	m := &endpointTrafficMigration{
+		service:         service,
+		endpoint:        endpointName,
+		original:        map[string]int64{"a": 50, "b": 50},
+		deployedModelID: "new",
+	}
+	if err := m.shift(context.Background(), 33); err != nil {
+		t.Fatalf("Expected: no error, Actual: %v", err)
+	}
+	if diff := cmp.Diff(map[string]int64{"new": 34, "a": 33, "b": 33}, trafficSplit); diff != "" {
+		t.Errorf("Unexpected traffic split (-want +got):\n%s", diff)
+	}
+	if err := m.check(context.Background(), 33); err != nil {
+		t.Errorf("Expected: no error, Actual: %v", err)
+	}
+
+	// A split changed outside of the migration fails the check.
+	trafficSplit = map[string]int64{"new": 33, "a": 34, "b": 33}
+	if err := m.check(context.Background(), 33); err == nil {
+		t.Errorf("Expected: error for a changed traffic split, Actual: nil")
+	}
+}
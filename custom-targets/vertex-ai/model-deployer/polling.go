@@ -38,7 +38,7 @@ func poll(ctx context.Context, service *aiplatform.Service, op *aiplatform.Googl
 
 	_, err := opService.Get(op.Name).Do()
 	if err != nil {
-		return fmt.Errorf("unable to get operation")
+		return fmt.Errorf("unable to get operation: %v", err)
 	}
 
 	pollFunc := getWaitFunc(opService, op.Name, ctx)
@@ -60,6 +60,9 @@ func getWaitFunc(service *aiplatform.ProjectsLocationsOperationsService, name st
 		}
 
 		if op.Done {
+			if op.Error != nil {
+				return true, fmt.Errorf("operation failed with code %d: %s", op.Error.Code, op.Error.Message)
+			}
 			return true, nil
 		}
 
@@ -67,19 +70,32 @@ func getWaitFunc(service *aiplatform.ProjectsLocationsOperationsService, name st
 	}
 }
 
+// modelOperation is a long running operation along with the ID of the deployed model it acts on, so the
+// result of the operation can be attributed to the model.
+type modelOperation struct {
+	deployedModelID string
+	lro             *aiplatform.GoogleLongrunningOperation
+}
+
+// modelOperationResult is the result of polling a modelOperation, err is nil if the operation succeeded.
+type modelOperationResult struct {
+	modelOperation
+	err error
+}
+
 // pollChan is a helper function that facilitates polling multiple long running operations in parallel
-func pollChan(ctx context.Context, service *aiplatform.Service, lros ...*aiplatform.GoogleLongrunningOperation) <-chan error {
+func pollChan(ctx context.Context, service *aiplatform.Service, ops ...modelOperation) <-chan modelOperationResult {
 	var wg sync.WaitGroup
-	out := make(chan error)
-	wg.Add(len(lros))
+	out := make(chan modelOperationResult)
+	wg.Add(len(ops))
 
-	output := func(lro *aiplatform.GoogleLongrunningOperation) {
-		out <- poll(ctx, service, lro)
+	output := func(op modelOperation) {
+		out <- modelOperationResult{modelOperation: op, err: poll(ctx, service, op.lro)}
 		wg.Done()
 	}
 
-	for _, lro := range lros {
-		go output(lro)
+	for _, op := range ops {
+		go output(op)
 	}
 
 	go func() {
@@ -25,6 +25,7 @@ import (
 	"os"
 	"regexp"
 	"sigs.k8s.io/yaml"
+	"strings"
 )
 
 const (
@@ -34,11 +35,26 @@ const (
 	srcArchivePath = "/workspace/archive.tgz"
 	// Path to use when unarchiving the source input.
 	srcPath = "/workspace/source"
+	// Metadata key set on the render result when the release was rendered in validate only mode.
+	validateOnlyMetadataKey = "vertex-ai-validate-only"
+	// Metadata key set on the render result when the model and endpoint are in different regions
+	// and cross region deployments are allowed.
+	crossRegionWarningMetadataKey = "vertex-ai-cross-region-warning"
 )
 
+// defaultMachineType is the machine type used when the DeployedModel configuration doesn't set one.
+// It can be overridden at build time with -ldflags="-X main.defaultMachineType={machine-type}", or
+// at runtime through the VERTEX_AI_DEFAULT_MACHINE_TYPE environment variable.
+var defaultMachineType = "n1-standard-2"
+
+// defaultMachineTypeEnvKey is the environment variable that overrides defaultMachineType.
+const defaultMachineTypeEnvKey = "VERTEX_AI_DEFAULT_MACHINE_TYPE"
+
 var (
 	modelRegex    = regexp.MustCompile("^projects/([^/]+)/locations/([^/]+)/models/([^/]+)$")
 	endpointRegex = regexp.MustCompile("^projects/([^/]+)/locations/([^/]+)/endpoints/([^/]+)$")
+	// apiEndpointRegex matches a hostname with an optional port, e.g. "restricted.googleapis.com:443".
+	apiEndpointRegex = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*(:[0-9]{1,5})?$`)
 )
 
 // renderer implements the handler interface for performing a render.
@@ -88,57 +104,93 @@ func (r *renderer) render(ctx context.Context) (*clouddeploy.RenderResult, error
 	}
 	fmt.Printf("Downloaded render input archive from %s\n", inURI)
 
-	out, err := r.renderDeployModelRequest()
+	out, metadata, err := r.renderDeployModelRequest()
 	if err != nil {
 		return nil, fmt.Errorf("error rendering deploy model params: %v", err)
 	}
 
+	if r.params.validateOnly {
+		fmt.Println("Validate only mode is enabled, skipping the deployed model manifest upload")
+		res := validateOnlyRenderResult()
+		for k, v := range metadata {
+			res.Metadata[k] = v
+		}
+		return res, nil
+	}
+
+	mURI, err := r.uploadManifest(ctx, out)
+	if err != nil {
+		return nil, err
+	}
+
+	return &clouddeploy.RenderResult{
+		ResultStatus: clouddeploy.RenderSucceeded,
+		ManifestFile: mURI,
+		Metadata:     metadata,
+	}, nil
+}
+
+// uploadManifest uploads the rendered manifest as a render artifact named after the manifestName parameter,
+// which is the name it's downloaded with at deploy time. Returns the URI of the uploaded manifest.
+func (r *renderer) uploadManifest(ctx context.Context, manifest []byte) (string, error) {
 	fmt.Printf("Uploading deployed model manifest.\n")
 
-	mURI, err := r.req.UploadArtifact(ctx, r.gcsClient, "manifest.yaml", &clouddeploy.GCSUploadContent{Data: out})
+	mURI, err := r.req.UploadArtifact(ctx, r.gcsClient, r.params.manifestName, &clouddeploy.GCSUploadContent{Data: manifest})
 	if err != nil {
-		return nil, fmt.Errorf("error uploading deployed model manifest: %v", err)
+		return "", fmt.Errorf("error uploading deployed model manifest: %v", err)
 	}
 
 	fmt.Printf("Uploaded deployed model manifest to %s\n", mURI)
+	return mURI, nil
+}
 
+// validateOnlyRenderResult returns the render result for a release rendered in validate only mode.
+// No manifest is included so the release cannot be deployed.
+func validateOnlyRenderResult() *clouddeploy.RenderResult {
 	return &clouddeploy.RenderResult{
 		ResultStatus: clouddeploy.RenderSucceeded,
-		ManifestFile: mURI,
-	}, nil
+		Metadata:     map[string]string{validateOnlyMetadataKey: "true"},
+	}
 }
 
 // renderDeployModelRequest generates a DeployModelRequest object and returns its definition as a yaml-formatted string
-func (r *renderer) renderDeployModelRequest() ([]byte, error) {
+// along with any metadata to include in the render result.
+func (r *renderer) renderDeployModelRequest() ([]byte, map[string]string, error) {
 
 	if err := applyDeployParams(r.params.configPath); err != nil {
-		return nil, fmt.Errorf("cannot apply deploy parameters to configuration file: %v", err)
+		return nil, nil, fmt.Errorf("cannot apply deploy parameters to configuration file: %v", err)
 	}
 
 	configuration, err := loadConfigurationFile(r.params.configPath)
 	if err != nil {
-		return nil, fmt.Errorf("unable to obtain configuration data: %v", err)
+		return nil, nil, fmt.Errorf("unable to obtain configuration data: %v", err)
 	}
 
 	// blank deployed model template
 	deployedModel := &aiplatform.GoogleCloudAiplatformV1DeployedModel{}
 
 	if err = yaml.Unmarshal(configuration, deployedModel); err != nil {
-		return nil, fmt.Errorf("unable to parse configuration data into DeployModel object: %v", err)
+		return nil, nil, fmt.Errorf("unable to parse configuration data into DeployModel object: %v", err)
 	}
 
-	model, err := fetchModel(r.aiPlatformService, r.params.model)
+	// Resolve aliases to a concrete version so the manifest pins an immutable model version.
+	model, modelNameWithVersionId, err := resolveModelVersion(r.aiPlatformService, r.params.model)
 	if err != nil {
-		return nil, fmt.Errorf("unable to fetch model: %v", err)
+		return nil, nil, fmt.Errorf("unable to resolve model version: %v", err)
 	}
 
-	modelNameWithVersionId := resolveModelWithVersion(model)
-	if err != nil {
-		return nil, fmt.Errorf("unable to resolve model version: %v", err)
+	if err := verifyExplanationSpec(deployedModel, model); err != nil {
+		return nil, nil, fmt.Errorf("invalid explanation spec: %v", err)
 	}
 
-	if err := validateRequest(modelNameWithVersionId, r.params.endpoint, r.params.minReplicaCount, deployedModel); err != nil {
-		return nil, fmt.Errorf("manifest validation failed: %v", err)
+	regionWarning, err := validateRequest(modelNameWithVersionId, r.params.endpoints, r.params.minReplicaCount, deployedModel, r.params.allowCrossRegion)
+	if err != nil {
+		return nil, nil, fmt.Errorf("manifest validation failed: %v", err)
+	}
+	metadata := map[string]string{}
+	if regionWarning != "" {
+		fmt.Printf("Warning: %s\n", regionWarning)
+		metadata[crossRegionWarningMetadataKey] = regionWarning
 	}
 	deployedModel.Model = modelNameWithVersionId
 
@@ -150,15 +202,9 @@ func (r *renderer) renderDeployModelRequest() ([]byte, error) {
 		deployedModel.DedicatedResources.MinReplicaCount = r.params.minReplicaCount
 	}
 
-	// deploy model params requires this field to be non-nil. Setting to the default "n1-standard-2"
+	// deploy model params requires this field to be non-nil. Setting to the default machine type
 	// if it's not already set
-	if deployedModel.DedicatedResources.MachineSpec == nil {
-		deployedModel.DedicatedResources.MachineSpec = &aiplatform.GoogleCloudAiplatformV1MachineSpec{MachineType: "n1-standard-2"}
-	}
-
-	if deployedModel.DedicatedResources.MachineSpec.MachineType == "" {
-		deployedModel.DedicatedResources.MachineSpec.MachineType = "n1-standard-2"
-	}
+	applyDefaultMachineType(deployedModel.DedicatedResources)
 
 	percentage := int64(r.req.Percentage)
 	trafficSplit := map[string]int64{}
@@ -171,7 +217,28 @@ func (r *renderer) renderDeployModelRequest() ([]byte, error) {
 
 	request := &aiplatform.GoogleCloudAiplatformV1DeployModelRequest{DeployedModel: deployedModel, TrafficSplit: trafficSplit}
 
-	return yaml.Marshal(request)
+	out, err := yaml.Marshal(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, metadata, nil
+}
+
+// applyDefaultMachineType sets the machine type of the dedicated resources to the default
+// machine type if it's not already set.
+func applyDefaultMachineType(resources *aiplatform.GoogleCloudAiplatformV1DedicatedResources) {
+	machineType := defaultMachineType
+	if mt := os.Getenv(defaultMachineTypeEnvKey); mt != "" {
+		machineType = mt
+	}
+
+	if resources.MachineSpec == nil {
+		resources.MachineSpec = &aiplatform.GoogleCloudAiplatformV1MachineSpec{}
+	}
+
+	if resources.MachineSpec.MachineType == "" {
+		resources.MachineSpec.MachineType = machineType
+	}
 }
 
 // addCommonMetadata inserts metadata into the render result that should be present
@@ -226,30 +293,101 @@ func loadConfigurationFile(configPath string) ([]byte, error) {
 	return nil, nil
 }
 
-// validateRequest performs validation on the request.
-func validateRequest(modelNameFromDeployParameter, endpointName string, minReplicaCountParameter int64, deployedModel *aiplatform.GoogleCloudAiplatformV1DeployedModel) error {
-	modelRegion, err := regionFromModel(modelNameFromDeployParameter)
+// validateRequest performs validation on the request. If allowCrossRegion is set, a model and endpoint
+// in different regions doesn't fail validation and a warning message is returned instead.
+func validateRequest(modelNameFromDeployParameter string, endpointNames []string, minReplicaCountParameter int64, deployedModel *aiplatform.GoogleCloudAiplatformV1DeployedModel, allowCrossRegion bool) (string, error) {
+	if len(endpointNames) == 0 {
+		return "", fmt.Errorf("at least one endpoint must be provided")
+	}
+
+	var regionWarnings []string
+	for _, endpointName := range endpointNames {
+		warning, err := validateEndpointRegion(modelNameFromDeployParameter, endpointName, allowCrossRegion)
+		if err != nil {
+			return "", fmt.Errorf("invalid endpoint %q: %v", endpointName, err)
+		}
+		if warning != "" {
+			regionWarnings = append(regionWarnings, warning)
+		}
+	}
+	regionWarning := strings.Join(regionWarnings, "; ")
+
+	if err := verifyModelNameNotDefinedInConfig(deployedModel); err != nil {
+		return "", err
+	}
+
+	if err := verifyMinReplicaCountHasNoConflicts(deployedModel, minReplicaCountParameter); err != nil {
+		return "", err
+	}
+
+	return regionWarning, nil
+}
+
+// validateEndpointRegion verifies that the model and the endpoint are in the same region. When they
+// differ and allowCrossRegion is set, a warning message is returned instead of an error.
+func validateEndpointRegion(modelName, endpointName string, allowCrossRegion bool) (string, error) {
+	modelRegion, err := regionFromModel(modelName)
 	if err != nil {
-		return fmt.Errorf("unable to parse region from model: %v", err)
+		return "", fmt.Errorf("unable to parse region from model: %v", err)
 	}
 
 	endpointRegion, err := regionFromEndpoint(endpointName)
 	if err != nil {
-		return fmt.Errorf("unable to parse region from endpoint: %v", err)
+		return "", fmt.Errorf("unable to parse region from endpoint: %v", err)
 	}
 
-	if endpointRegion != modelRegion {
-		return fmt.Errorf("The model to be deployed must be in the same region as the endpoint. Copy the model to the region the  endpoint is located, or make an endpoint in the same region as the model")
+	if endpointRegion == modelRegion {
+		return "", nil
 	}
-
-	if err = verifyModelNameNotDefinedInConfig(deployedModel); err != nil {
-		return err
+	if !allowCrossRegion {
+		return "", fmt.Errorf("The model to be deployed must be in the same region as the endpoint. Copy the model to the region the  endpoint is located, make an endpoint in the same region as the model, or set %s to allow cross region deployments", allowCrossRegionDPKey)
 	}
+	return fmt.Sprintf("model region %q differs from endpoint %s region %q", modelRegion, endpointName, endpointRegion), nil
+}
 
-	if err = verifyMinReplicaCountHasNoConflicts(deployedModel, minReplicaCountParameter); err != nil {
-		return err
+// verifyExplanationSpec validates the explanation spec provided in the `deployedModel.yaml` file, if any. The
+// explanation parameters must configure exactly one explanation method, and the explanation metadata must
+// describe the inputs and outputs unless the model was uploaded with explanation metadata that can be used
+// instead. Models without explanation metadata don't support explanations unless the metadata is provided.
+func verifyExplanationSpec(deployedModel *aiplatform.GoogleCloudAiplatformV1DeployedModel, model *aiplatform.GoogleCloudAiplatformV1Model) error {
+	spec := deployedModel.ExplanationSpec
+	if spec == nil {
+		return nil
+	}
+	if spec.Parameters == nil {
+		return fmt.Errorf("explanationSpec.parameters is required")
+	}
+	methods := 0
+	for _, set := range []bool{
+		spec.Parameters.SampledShapleyAttribution != nil,
+		spec.Parameters.IntegratedGradientsAttribution != nil,
+		spec.Parameters.XraiAttribution != nil,
+		spec.Parameters.Examples != nil,
+	} {
+		if set {
+			methods++
+		}
+	}
+	if methods != 1 {
+		return fmt.Errorf("explanationSpec.parameters must configure exactly one of sampledShapleyAttribution, integratedGradientsAttribution, xraiAttribution or examples, found %d", methods)
 	}
 
+	if spec.Metadata == nil {
+		if model == nil || model.ExplanationSpec == nil || model.ExplanationSpec.Metadata == nil {
+			modelName := ""
+			if model != nil {
+				modelName = model.Name
+			}
+			return fmt.Errorf("model %s has no explanation metadata and doesn't support explanations, provide explanationSpec.metadata to enable explanations", modelName)
+		}
+		return nil
+	}
+	if len(spec.Metadata.Inputs) == 0 {
+		return fmt.Errorf("explanationSpec.metadata.inputs must not be empty")
+	}
+	if len(spec.Metadata.Outputs) == 0 {
+		return fmt.Errorf("explanationSpec.metadata.outputs must not be empty")
+	}
 	return nil
 }
 
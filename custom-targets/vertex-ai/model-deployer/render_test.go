@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"strings"
 	"testing"
+	"sigs.k8s.io/yaml"
 	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
 	"google.golang.org/api/aiplatform/v1"
 )
@@ -12,7 +15,7 @@ func TestRenderDeployModelRequest(t *testing.T) {
 	newRenderer := &renderer{
 		params:            params,
 	}
-	if _, err := newRenderer.renderDeployModelRequest(); err == nil{
+	if _, _, err := newRenderer.renderDeployModelRequest(); err == nil{
 		t.Errorf("Error expected, received: %s", err)
 	}
 }
@@ -96,26 +99,26 @@ func TestLoadConfigurationFile(t *testing.T) {
 //succeeds.
 func TestValidateRequest(t *testing.T) {
 	deployedModel := &aiplatform.GoogleCloudAiplatformV1DeployedModel{}
-	err := validateRequest("", "", int64(0), deployedModel)
+	_, err := validateRequest("", []string{""}, int64(0), deployedModel, false)
 	if err == nil{
 		t.Errorf("Expected: error from invalid model, Received: %s", err)
 	}
 
 	path := "projects/scortabarria-internship/locations/test-location1/models/test-model"
-	err = validateRequest(path, "", int64(0), deployedModel)
+	_, err = validateRequest(path, []string{""}, int64(0), deployedModel, false)
 	if err == nil{
 		t.Errorf("Expected: error from invalid endpointName, Received: %s", err)
 	}
 
 	endpoint := "projects/scortabarria-internship/locations/test-location2/endpoints/test-endpoint"
-	err = validateRequest(path, endpoint, int64(0), deployedModel)
+	_, err = validateRequest(path, []string{endpoint}, int64(0), deployedModel, false)
 	if err == nil{
 		t.Errorf("Expected: error from conflicting regions, Received: %s", err)
 	}
 
 	endpoint = "projects/scortabarria-internship/locations/test-location1/endpoints/test-endpoint"
 	deployedModel.Model = "testName"
-	err = validateRequest(path, endpoint, int64(0), deployedModel)
+	_, err = validateRequest(path, []string{endpoint}, int64(0), deployedModel, false)
 	if err == nil{
 		t.Errorf("Expected: error from model name in config, Received: %s", err)
 	}
@@ -124,12 +127,12 @@ func TestValidateRequest(t *testing.T) {
 	deployedModel.DedicatedResources = &aiplatform.GoogleCloudAiplatformV1DedicatedResources{
 		MinReplicaCount: 5,
 	}
-	err = validateRequest(path, endpoint, int64(2), deployedModel)
+	_, err = validateRequest(path, []string{endpoint}, int64(2), deployedModel, false)
 	if err == nil{
 		t.Errorf("Expected: error from conflicting minReplicaCount, Received: %s", err)
 	}
 
-	err = validateRequest(path, endpoint, int64(0), deployedModel)
+	_, err = validateRequest(path, []string{endpoint}, int64(0), deployedModel, false)
 	if err != nil{
 		t.Errorf("ERROR: %s", err)
 	}
@@ -137,6 +140,43 @@ func TestValidateRequest(t *testing.T) {
 }
 
 
+//This test checks that a region mismatch between model and endpoint fails by default and is
+//reported as a warning when cross region deployments are allowed.
+func TestValidateEndpointRegion(t *testing.T) {
+	model := "projects/test-project/locations/us-central1/models/test-model@1"
+	sameRegion := "projects/test-project/locations/us-central1/endpoints/test-endpoint"
+	otherRegion := "projects/test-project/locations/europe-west4/endpoints/test-endpoint"
+
+	for _, allow := range []bool{false, true} {
+		warning, err := validateEndpointRegion(model, sameRegion, allow)
+		if err != nil || warning != "" {
+			t.Errorf("Expected: no error and no warning for matching regions, Actual: %q and %v", warning, err)
+		}
+	}
+
+	warning, err := validateEndpointRegion(model, otherRegion, false)
+	if err == nil {
+		t.Errorf("Expected: error from conflicting regions, Actual: %v", err)
+	}
+	if warning != "" {
+		t.Errorf("Expected: no warning, Actual: %q", warning)
+	}
+
+	warning, err = validateEndpointRegion(model, otherRegion, true)
+	if err != nil {
+		t.Errorf("Expected: no error when cross region is allowed, Actual: %v", err)
+	}
+	if !strings.Contains(warning, "europe-west4") || !strings.Contains(warning, "us-central1") {
+		t.Errorf("Expected: warning naming both regions, Actual: %q", warning)
+	}
+
+	deployedModel := &aiplatform.GoogleCloudAiplatformV1DeployedModel{}
+	warning, err = validateRequest(model, []string{sameRegion, otherRegion}, int64(1), deployedModel, true)
+	if err != nil || warning == "" {
+		t.Errorf("Expected: warning and no error from validateRequest, Actual: %q and %v", warning, err)
+	}
+}
+
 //This test verifies that minReplicaCount is defined somewhere. We test how verifyMinReplicaHasNoConflicts
 //handles it being defined nowhere, in one place and in conflicting places
 func TestVerifyMinReplicaHasNoConflicts(t *testing.T) {
@@ -196,4 +236,111 @@ func TestVerifyModelNameNotDefinedInConfig(t *testing.T) {
 	if err := verifyModelNameNotDefinedInConfig(deployedModel); err == nil{
 		t.Errorf("Expected: error, Received: %v", err)
 	}	
-}
\ No newline at end of file
+}
+//Tests that the validate only render result succeeds without a deployable manifest
+func TestValidateOnlyRenderResult(t *testing.T) {
+	res := validateOnlyRenderResult()
+	if res.ResultStatus != clouddeploy.RenderSucceeded {
+		t.Errorf("Expected: %s, Actual: %s", clouddeploy.RenderSucceeded, res.ResultStatus)
+	}
+	if res.ManifestFile != "" {
+		t.Errorf("Expected no manifest file, Actual: %s", res.ManifestFile)
+	}
+	if res.Metadata[validateOnlyMetadataKey] != "true" {
+		t.Errorf("Expected metadata %s to be true, Actual: %s", validateOnlyMetadataKey, res.Metadata[validateOnlyMetadataKey])
+	}
+}
+
+//Tests that a release rendered in validate only mode cannot be deployed
+func TestDeployValidateOnlyFails(t *testing.T) {
+	d := &deployer{params: &params{validateOnly: true}}
+	if _, err := d.deploy(context.Background()); err == nil {
+		t.Errorf("Expected: error, Actual: %s", err)
+	}
+}
+
+//Tests that applyDefaultMachineType honors the override and keeps machine types set in the config
+func TestApplyDefaultMachineType(t *testing.T) {
+	resources := &aiplatform.GoogleCloudAiplatformV1DedicatedResources{}
+	applyDefaultMachineType(resources)
+	if resources.MachineSpec.MachineType != "n1-standard-2" {
+		t.Errorf("Expected: n1-standard-2, Actual: %s", resources.MachineSpec.MachineType)
+	}
+
+	t.Setenv(defaultMachineTypeEnvKey, "n1-standard-4")
+	resources = &aiplatform.GoogleCloudAiplatformV1DedicatedResources{}
+	applyDefaultMachineType(resources)
+	if resources.MachineSpec.MachineType != "n1-standard-4" {
+		t.Errorf("Expected: n1-standard-4, Actual: %s", resources.MachineSpec.MachineType)
+	}
+
+	resources = &aiplatform.GoogleCloudAiplatformV1DedicatedResources{MachineSpec: &aiplatform.GoogleCloudAiplatformV1MachineSpec{MachineType: "e2-standard-8"}}
+	applyDefaultMachineType(resources)
+	if resources.MachineSpec.MachineType != "e2-standard-8" {
+		t.Errorf("Expected: e2-standard-8, Actual: %s", resources.MachineSpec.MachineType)
+	}
+}
+
+//Tests that an explanation spec from the deployedModel.yaml config is preserved and validated
+func TestVerifyExplanationSpec(t *testing.T) {
+	config := `
+dedicatedResources:
+  minReplicaCount: 1
+explanationSpec:
+  parameters:
+    sampledShapleyAttribution:
+      pathCount: 10
+  metadata:
+    inputs:
+      features:
+        inputTensorName: dense_input
+    outputs:
+      prediction:
+        outputTensorName: dense_2
+`
+	deployedModel := &aiplatform.GoogleCloudAiplatformV1DeployedModel{}
+	if err := yaml.Unmarshal([]byte(config), deployedModel); err != nil {
+		t.Fatalf("unable to parse config: %v", err)
+	}
+	if deployedModel.ExplanationSpec == nil || deployedModel.ExplanationSpec.Parameters.SampledShapleyAttribution.PathCount != 10 {
+		t.Fatalf("Expected: explanation spec to be parsed from config, Actual: %v", deployedModel.ExplanationSpec)
+	}
+	model := &aiplatform.GoogleCloudAiplatformV1Model{Name: "projects/p/locations/l/models/m"}
+	if err := verifyExplanationSpec(deployedModel, model); err != nil {
+		t.Errorf("Expected: no error, Actual: %v", err)
+	}
+
+	// Metadata can be omitted when the model was uploaded with explanation metadata.
+	metadata := deployedModel.ExplanationSpec.Metadata
+	deployedModel.ExplanationSpec.Metadata = nil
+	if err := verifyExplanationSpec(deployedModel, model); err == nil {
+		t.Errorf("Expected: error for model without explanation metadata, Actual: %v", err)
+	}
+	modelWithExplanations := &aiplatform.GoogleCloudAiplatformV1Model{
+		Name:            "projects/p/locations/l/models/m",
+		ExplanationSpec: &aiplatform.GoogleCloudAiplatformV1ExplanationSpec{Metadata: metadata},
+	}
+	if err := verifyExplanationSpec(deployedModel, modelWithExplanations); err != nil {
+		t.Errorf("Expected: no error, Actual: %v", err)
+	}
+
+	deployedModel.ExplanationSpec.Metadata = &aiplatform.GoogleCloudAiplatformV1ExplanationMetadata{Inputs: metadata.Inputs}
+	if err := verifyExplanationSpec(deployedModel, model); err == nil {
+		t.Errorf("Expected: error for metadata without outputs, Actual: %v", err)
+	}
+
+	deployedModel.ExplanationSpec.Metadata = metadata
+	deployedModel.ExplanationSpec.Parameters.XraiAttribution = &aiplatform.GoogleCloudAiplatformV1XraiAttribution{StepCount: 50}
+	if err := verifyExplanationSpec(deployedModel, model); err == nil {
+		t.Errorf("Expected: error for multiple explanation methods, Actual: %v", err)
+	}
+
+	deployedModel.ExplanationSpec.Parameters = nil
+	if err := verifyExplanationSpec(deployedModel, model); err == nil {
+		t.Errorf("Expected: error for missing parameters, Actual: %v", err)
+	}
+
+	if err := verifyExplanationSpec(&aiplatform.GoogleCloudAiplatformV1DeployedModel{}, model); err != nil {
+		t.Errorf("Expected: no error without explanation spec, Actual: %v", err)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
 	"google.golang.org/api/aiplatform/v1"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -34,15 +35,45 @@ const (
 	endpointEnvKey        = "CLOUD_DEPLOY_customTarget_vertexAIEndpoint"
 	aliasEnvKey           = "CLOUD_DEPLOY_customTarget_vertexAIAliases"
 	configPathKey         = "CLOUD_DEPLOY_customTarget_vertexAIConfigurationPath"
+	validateOnlyEnvKey    = "CLOUD_DEPLOY_customTarget_vertexAIValidateOnly"
+	allowCrossRegionKey   = "CLOUD_DEPLOY_customTarget_vertexAIAllowCrossRegion"
+	roundingBiasEnvKey    = "CLOUD_DEPLOY_customTarget_vertexAIRoundingBias"
+	apiEndpointEnvKey     = "CLOUD_DEPLOY_customTarget_vertexAIApiEndpoint"
+	migrationStagesEnvKey = "CLOUD_DEPLOY_customTarget_vertexAITrafficMigrationStages"
+	migrationRollbackKey  = "CLOUD_DEPLOY_customTarget_vertexAITrafficMigrationRollback"
+	retainModelsEnvKey    = "CLOUD_DEPLOY_customTarget_vertexAIRetainPreviousModels"
+	asyncDeployEnvKey     = "CLOUD_DEPLOY_customTarget_vertexAIAsyncDeploy"
+	manifestNameEnvKey    = "CLOUD_DEPLOY_customTarget_vertexAIManifestName"
+	undeployConcurrentKey = "CLOUD_DEPLOY_customTarget_vertexAIUndeployConcurrency"
 )
 
 // deploy parameters that the custom target requires to be present and provided during render and deploy operations.
 const (
-	modelDPKey    = "customTarget/vertexAIModel"
-	endpointDPKey = "customTarget/vertexAIEndpoint"
-	aliasDPKey    = "customTarget/vertexAIAliases"
+	modelDPKey           = "customTarget/vertexAIModel"
+	endpointDPKey        = "customTarget/vertexAIEndpoint"
+	aliasDPKey           = "customTarget/vertexAIAliases"
+	minReplicaCountDPKey = "customTarget/vertexAIMinReplicaCount"
+
+	allowCrossRegionDPKey = "customTarget/vertexAIAllowCrossRegion"
+)
+
+// Supported values for the vertexAIRoundingBias deploy parameter.
+const (
+	// The rounding remainder of a traffic split is assigned to the largest bucket.
+	roundingBiasLargest = "largest"
+	// The rounding remainder of a traffic split is assigned to the model being deployed.
+	roundingBiasNew = "new"
+	// The rounding remainder of a traffic split is assigned to the largest previously deployed model.
+	roundingBiasPrevious = "previous"
 )
 
+// Name of the manifest uploaded at render time and downloaded at deploy time when the vertexAIManifestName
+// deploy parameter isn't provided.
+const defaultManifestName = "manifest.yaml"
+
+// Valid manifest names: a single file name that doesn't start with a dot.
+var manifestNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
 var addAliasesMode bool
 
 // requestHandler interface provides methods for handling the Cloud Deploy params.
@@ -85,22 +116,62 @@ type params struct {
 	// format is "projects/{project}/locations/{location}/models/{modelId}[@versionId|alias].
 	model string
 
-	// The endpoint where the model will be deployed
+	// The endpoints where the model will be deployed, obtained from a comma-separated deploy parameter.
 	// format is "projects/{project}/locations/{location}/endpoints/{endpointId}.
-	endpoint string
+	endpoints []string
 
 	// directory path where the renderer should look for target-specific configuration
 	// for this deployment, if not provided the renderer will check for a deployModel.yaml
 	// fie in the root working directory.
 	configPath string
+
+	// if enabled, the renderer validates the configuration without uploading a deployable
+	// manifest. Releases rendered in this mode cannot be deployed.
+	validateOnly bool
+
+	// if enabled, a model and endpoint in different regions is reported as a warning instead
+	// of failing the render.
+	allowCrossRegion bool
+
+	// which traffic split bucket receives the remainder when the canary traffic split doesn't sum to 100
+	// after rounding. One of "largest", "new" or "previous", defaults to "largest".
+	roundingBias string
+
+	// host used for the Vertex AI API calls instead of the default regional host, e.g. for
+	// VPC Service Controls or testing. May contain a "{region}" placeholder.
+	apiEndpoint string
+
+	// stages the traffic routed to the model is shifted through before reaching the percentage of the
+	// rollout phase, applied progressively within the deploy.
+	trafficMigrationStages []trafficStage
+
+	// if enabled, a failed traffic migration stage restores the traffic split from before the migration.
+	trafficMigrationRollback bool
+
+	// number of most recently deployed models without traffic that are kept deployed on the endpoint
+	// after a deploy, older models without traffic are undeployed. Defaults to 0.
+	retainPreviousModels int
+
+	// maximum number of UndeployModel operations run at the same time when undeploying models without traffic.
+	// Defaults to 0, which runs all of them at the same time.
+	undeployConcurrency int
+
+	// if enabled, the deploy starts the DeployModel operation and succeeds without waiting for it to complete,
+	// recording the operation name in the deploy result. Models without traffic aren't undeployed.
+	asyncDeploy bool
+
+	// name of the manifest object uploaded under the render output path, also used as the local file name
+	// the manifest is downloaded to at deploy time. Defaults to "manifest.yaml".
+	manifestName string
 }
 
 // determineParams returns the supported params provided in the execution environment via environment variables.
 func determineParams() (*params, error) {
 
-	replicaCount, err := strconv.Atoi(os.Getenv(minReplicaCountEnvKey))
+	mrc, ok := os.LookupEnv(minReplicaCountEnvKey)
+	replicaCount, err := parseMinReplicaCount(mrc, ok)
 	if err != nil {
-		replicaCount = 0
+		fmt.Printf("Warning: ignoring deploy parameter %s, the minReplicaCount in the configuration file is used instead: %v\n", minReplicaCountDPKey, err)
 	}
 
 	model, found := os.LookupEnv(modelEnvKey)
@@ -118,19 +189,159 @@ func determineParams() (*params, error) {
 		fmt.Printf("Required environment variable %s not found. This variable is derived from deploy parameter: %s, please verify that a valid Vertex AI model resource name was provided through this deploy parameter.\n", endpointEnvKey, endpointDPKey)
 		return nil, fmt.Errorf("required environment variable %s not found", modelEnvKey)
 	}
-	if model == "" {
+	endpoints := parseEndpoints(endpoint)
+	if len(endpoints) == 0 {
 		fmt.Printf("environment variable %s is empty. This variable is derived from deploy parameter: %s, please verify that a valid Vertex AI model resource name was provided through this deploy parameter.\n", endpointEnvKey, endpointDPKey)
-		return nil, fmt.Errorf("environment variable %s contains empty string", modelEnvKey)
+		return nil, fmt.Errorf("environment variable %s contains empty string", endpointEnvKey)
+	}
+
+	validateOnly := false
+	vo, ok := os.LookupEnv(validateOnlyEnvKey)
+	if ok {
+		validateOnly, err = strconv.ParseBool(vo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", validateOnlyEnvKey, err)
+		}
+	}
+
+	allowCrossRegion := false
+	acr, ok := os.LookupEnv(allowCrossRegionKey)
+	if ok {
+		allowCrossRegion, err = strconv.ParseBool(acr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", allowCrossRegionKey, err)
+		}
+	}
+
+	roundingBias := os.Getenv(roundingBiasEnvKey)
+	switch roundingBias {
+	case "":
+		roundingBias = roundingBiasLargest
+	case roundingBiasLargest, roundingBiasNew, roundingBiasPrevious:
+	default:
+		return nil, fmt.Errorf("invalid value %q for parameter %q, must be one of %q, %q or %q", roundingBias, roundingBiasEnvKey, roundingBiasLargest, roundingBiasNew, roundingBiasPrevious)
+	}
+
+	apiEndpoint := os.Getenv(apiEndpointEnvKey)
+	if len(apiEndpoint) != 0 {
+		if err := validateAPIEndpoint(apiEndpoint); err != nil {
+			return nil, fmt.Errorf("invalid parameter %q: %v", apiEndpointEnvKey, err)
+		}
+	}
+
+	migrationStages, err := parseTrafficMigrationStages(os.Getenv(migrationStagesEnvKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameter %q: %v", migrationStagesEnvKey, err)
+	}
+
+	migrationRollback := false
+	mr, ok := os.LookupEnv(migrationRollbackKey)
+	if ok {
+		migrationRollback, err = strconv.ParseBool(mr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", migrationRollbackKey, err)
+		}
+	}
+
+	retainPreviousModels := 0
+	if rpm, ok := os.LookupEnv(retainModelsEnvKey); ok && len(rpm) != 0 {
+		retainPreviousModels, err = strconv.Atoi(rpm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", retainModelsEnvKey, err)
+		}
+		if retainPreviousModels < 0 {
+			return nil, fmt.Errorf("invalid parameter %q: must not be negative", retainModelsEnvKey)
+		}
+	}
+
+	undeployConcurrency := 0
+	if uc, ok := os.LookupEnv(undeployConcurrentKey); ok && len(uc) != 0 {
+		undeployConcurrency, err = strconv.Atoi(uc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", undeployConcurrentKey, err)
+		}
+		if undeployConcurrency < 0 {
+			return nil, fmt.Errorf("invalid parameter %q: must not be negative", undeployConcurrentKey)
+		}
+	}
+
+	asyncDeploy := false
+	ad, ok := os.LookupEnv(asyncDeployEnvKey)
+	if ok {
+		asyncDeploy, err = strconv.ParseBool(ad)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameter %q: %v", asyncDeployEnvKey, err)
+		}
+	}
+	if asyncDeploy && len(migrationStages) != 0 {
+		return nil, fmt.Errorf("parameter %q can't be enabled together with %q, traffic migration stages wait for the model deployment", asyncDeployEnvKey, migrationStagesEnvKey)
+	}
+
+	manifestName, err := parseManifestName(os.Getenv(manifestNameEnvKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameter %q: %v", manifestNameEnvKey, err)
 	}
 
 	return &params{
-		model:           model,
-		endpoint:        endpoint,
-		minReplicaCount: int64(replicaCount),
-		configPath:      os.Getenv(configPathKey),
+		model:            model,
+		endpoints:        endpoints,
+		minReplicaCount:  int64(replicaCount),
+		configPath:       os.Getenv(configPathKey),
+		validateOnly:     validateOnly,
+		allowCrossRegion: allowCrossRegion,
+		roundingBias:     roundingBias,
+		apiEndpoint:      apiEndpoint,
+
+		trafficMigrationStages:   migrationStages,
+		trafficMigrationRollback: migrationRollback,
+		retainPreviousModels:     retainPreviousModels,
+		undeployConcurrency:      undeployConcurrency,
+		asyncDeploy:              asyncDeploy,
+		manifestName:             manifestName,
 	}, nil
 }
 
+// parseManifestName parses the value of the manifestName deploy parameter. An empty value returns the
+// default manifest name.
+func parseManifestName(value string) (string, error) {
+	if len(value) == 0 {
+		return defaultManifestName, nil
+	}
+	if !manifestNameRegexp.MatchString(value) {
+		return "", fmt.Errorf("%q must be a file name made of letters, digits, '.', '_' and '-' that doesn't start with '.'", value)
+	}
+	return value, nil
+}
+
+// parseMinReplicaCount parses the value of the minReplicaCount deploy parameter. An unset or empty
+// value returns 0 with no error so the value from the configuration file is used, while a value that
+// isn't a non-negative integer returns 0 with an error describing why it was ignored.
+func parseMinReplicaCount(value string, ok bool) (int, error) {
+	if !ok || len(value) == 0 {
+		return 0, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an integer", value)
+	}
+	if count < 0 {
+		return 0, fmt.Errorf("%d must not be negative", count)
+	}
+	return count, nil
+}
+
+// parseEndpoints splits the comma-separated endpoint deploy parameter into endpoint resource names,
+// ignoring surrounding whitespace and empty entries.
+func parseEndpoints(value string) []string {
+	var endpoints []string
+	for _, e := range strings.Split(value, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			endpoints = append(endpoints, e)
+		}
+	}
+	return endpoints
+}
+
 // addAliasesRequest contains information needed to assign aliases to a model during a post deploy hook
 type addAliasesRequest struct {
 	// new aliases to apply to the model
@@ -148,6 +359,8 @@ type addAliasesRequest struct {
 	release string
 	// phase
 	phase string
+	// host used for the Vertex AI API calls instead of the default regional host.
+	apiEndpoint string
 }
 
 // newAliasHandler returns a handler for processing alias assignment requests.
@@ -160,14 +373,22 @@ func newAliasHandler(gcsClient *storage.Client) (requestHandler, error) {
 
 	aliases := strings.Split(aliasParameter, ",")
 
+	apiEndpoint := os.Getenv(apiEndpointEnvKey)
+	if len(apiEndpoint) != 0 {
+		if err := validateAPIEndpoint(apiEndpoint); err != nil {
+			return nil, fmt.Errorf("invalid parameter %q: %v", apiEndpointEnvKey, err)
+		}
+	}
+
 	request := &addAliasesRequest{
-		project:  os.Getenv(clouddeploy.ProjectEnvKey),
-		location: os.Getenv(clouddeploy.LocationEnvKey),
-		pipeline: os.Getenv(clouddeploy.PipelineEnvKey),
-		release:  os.Getenv(clouddeploy.ReleaseEnvKey),
-		target:   os.Getenv(clouddeploy.TargetEnvKey),
-		phase:    os.Getenv(clouddeploy.PhaseEnvKey),
-		aliases:  aliases,
+		project:     os.Getenv(clouddeploy.ProjectEnvKey),
+		location:    os.Getenv(clouddeploy.LocationEnvKey),
+		pipeline:    os.Getenv(clouddeploy.PipelineEnvKey),
+		release:     os.Getenv(clouddeploy.ReleaseEnvKey),
+		target:      os.Getenv(clouddeploy.TargetEnvKey),
+		phase:       os.Getenv(clouddeploy.PhaseEnvKey),
+		aliases:     aliases,
+		apiEndpoint: apiEndpoint,
 	}
 	return &aliasAssigner{gcsClient: gcsClient, request: request}, nil
 }
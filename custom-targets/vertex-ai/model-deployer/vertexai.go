@@ -21,7 +21,9 @@ import (
 	"google.golang.org/api/option"
 	"os"
 	"sigs.k8s.io/yaml"
+	"sort"
 	"strings"
+	"time"
 )
 
 // deployModelFromManifest loads the file provided in `path` and returns the parsed DeployModelRequest
@@ -41,33 +43,28 @@ func deployModelFromManifest(path string) (*aiplatform.GoogleCloudAiplatformV1De
 	return deployModelRequest, nil
 }
 
-// fetchPreviousModel queries the provided Vertex AI endpoint to determine the model that was previously
-// deployed.
-func fetchPreviousModel(service *aiplatform.Service, endpointName, currentModel string) (string, error) {
+// fetchPreviousTrafficSplit queries the provided Vertex AI endpoint to determine the traffic split of the models
+// that were previously deployed, excluding the deployed models of the current model.
+func fetchPreviousTrafficSplit(service *aiplatform.Service, endpointName, currentModel string) (map[string]int64, error) {
 	endpoint, err := service.Projects.Locations.Endpoints.Get(endpointName).Do()
 	if err != nil {
-		return "", fmt.Errorf("unable to fetch endpoint: %v", err)
+		return nil, fmt.Errorf("unable to fetch endpoint: %v", err)
 	}
 
-	deployedModels := map[string]*aiplatform.GoogleCloudAiplatformV1DeployedModel{}
-
+	split := map[string]int64{}
 	for _, dm := range endpoint.DeployedModels {
-		modelNameWithVersion := resolveDeployedModelNameWithVersion(dm)
-		deployedModels[modelNameWithVersion] = dm
-	}
-
-	delete(deployedModels, currentModel)
-
-	if len(deployedModels) != 1 {
-		return "", fmt.Errorf("unable to resolve previous deployed currentModel to canary against. Not including the current currentModel to be deployed, the endpoint has %d deployed models but expected only one", len(deployedModels))
+		if resolveDeployedModelNameWithVersion(dm) == currentModel {
+			continue
+		}
+		if p := endpoint.TrafficSplit[dm.Id]; p != 0 {
+			split[dm.Id] = p
+		}
 	}
 
-	var firstModel []*aiplatform.GoogleCloudAiplatformV1DeployedModel
-
-	for _, dm := range deployedModels {
-		firstModel = append(firstModel, dm)
+	if len(split) == 0 {
+		return nil, fmt.Errorf("unable to resolve previous deployed models to canary against. Not including the current model to be deployed, none of the %d deployed models receive traffic", len(endpoint.DeployedModels))
 	}
-	return firstModel[0].Id, nil
+	return split, nil
 }
 
 // resolveDeployedModelNameWithVersion returns the model resource name associated with the  provided DeployedModel
@@ -79,12 +76,33 @@ func resolveDeployedModelNameWithVersion(deployedModel *aiplatform.GoogleCloudAi
 	return fmt.Sprintf("%s@%s", deployedModel.Model, deployedModel.ModelVersionId)
 }
 
-// resolveModelWithVersion returns the model resource name its version ID attached.
-func resolveModelWithVersion(model *aiplatform.GoogleCloudAiplatformV1Model) string {
-	if strings.Contains(model.Name, "@") {
-		return model.Name
+// resolveModelWithVersion returns the model resource name with its version ID attached. Any version
+// or alias already attached to the resource name is replaced by the version ID, so the result always
+// refers to an immutable model version.
+func resolveModelWithVersion(model *aiplatform.GoogleCloudAiplatformV1Model) (string, error) {
+	if model.VersionId == "" {
+		return "", fmt.Errorf("model %s has no version ID", model.Name)
+	}
+	name, _, _ := strings.Cut(model.Name, "@")
+	return fmt.Sprintf("%s@%s", name, model.VersionId), nil
+}
+
+// resolveModelVersion fetches the provided model, which may refer to a version, an alias or the
+// default version of the model, and returns the model along with its resource name pinned to the
+// concrete version ID.
+func resolveModelVersion(service *aiplatform.Service, modelName string) (*aiplatform.GoogleCloudAiplatformV1Model, string, error) {
+	model, err := fetchModel(service, modelName)
+	if err != nil {
+		return nil, "", err
+	}
+	modelNameWithVersion, err := resolveModelWithVersion(model)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to resolve %s to a model version: %v", modelName, err)
+	}
+	if modelName != modelNameWithVersion {
+		fmt.Printf("Resolved model %s to version %s\n", modelName, modelNameWithVersion)
 	}
-	return fmt.Sprintf("%s@%s", model.Name, model.VersionId)
+	return model, modelNameWithVersion, nil
 }
 
 // regionFromModel extracts the region from the model region name.
@@ -107,10 +125,30 @@ func regionFromEndpoint(endpointName string) (string, error) {
 	return matches[2], nil
 }
 
-// newAIPlatformService generates a Service that can make API calls in the specified region.
-func newAIPlatformService(ctx context.Context, region string) (*aiplatform.Service, error) {
-	endPointOption := option.WithEndpoint(fmt.Sprintf("%s-aiplatform.googleapis.com", region))
-	regionalService, err := aiplatform.NewService(ctx, endPointOption)
+// aiPlatformEndpoint returns the host used to make API calls in the specified region. If an API
+// endpoint override is provided it's used instead of the default regional host, with any "{region}"
+// placeholder replaced by the region.
+func aiPlatformEndpoint(region, apiEndpoint string) string {
+	if len(apiEndpoint) != 0 {
+		return strings.ReplaceAll(apiEndpoint, "{region}", region)
+	}
+	return fmt.Sprintf("%s-aiplatform.googleapis.com", region)
+}
+
+// validateAPIEndpoint returns an error if the API endpoint override isn't a plausible hostname with
+// an optional port.
+func validateAPIEndpoint(apiEndpoint string) error {
+	if !apiEndpointRegex.MatchString(aiPlatformEndpoint("us-central1", apiEndpoint)) {
+		return fmt.Errorf("%q is not a valid hostname, e.g. \"restricted.googleapis.com\" or \"{region}-aiplatform.googleapis.com\"", apiEndpoint)
+	}
+	return nil
+}
+
+// newAIPlatformService generates a Service that can make API calls in the specified region. If an
+// API endpoint override is provided it's used instead of the default regional host.
+func newAIPlatformService(ctx context.Context, region, apiEndpoint string, opts ...option.ClientOption) (*aiplatform.Service, error) {
+	endPointOption := option.WithEndpoint(aiPlatformEndpoint(region, apiEndpoint))
+	regionalService, err := aiplatform.NewService(ctx, append([]option.ClientOption{endPointOption}, opts...)...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to authenticate")
 	}
@@ -137,55 +175,132 @@ func minReplicaCountFromConfig(deployedModel *aiplatform.GoogleCloudAiplatformV1
 
 // deployModel performs the DeployModel request and awaits the resulting operation until it completes, it times out or an error occurs.
 func deployModel(ctx context.Context, aiPlatformService *aiplatform.Service, endpoint string, request *aiplatform.GoogleCloudAiplatformV1DeployModelRequest) error {
-	op, err := aiPlatformService.Projects.Locations.Endpoints.DeployModel(endpoint, request).Do()
-
+	op, err := startDeployModel(aiPlatformService, endpoint, request)
 	if err != nil {
-		return fmt.Errorf("unable to deploy model: %v", err)
+		return err
 	}
 
 	return poll(ctx, aiPlatformService, op)
 }
 
-// undeployNoTrafficModels fetches the Vertex AI endpoint and und-deploys all the models that have no traffic routed to them.
-func undeployNoTrafficModels(ctx context.Context, aiPlatformService *aiplatform.Service, endpointName string) error {
-	endpoint, err := aiPlatformService.Projects.Locations.Endpoints.Get(endpointName).Do()
+// startDeployModel performs the DeployModel request and returns the resulting operation without waiting for it to complete.
+func startDeployModel(aiPlatformService *aiplatform.Service, endpoint string, request *aiplatform.GoogleCloudAiplatformV1DeployModelRequest) (*aiplatform.GoogleLongrunningOperation, error) {
+	op, err := aiPlatformService.Projects.Locations.Endpoints.DeployModel(endpoint, request).Do()
 	if err != nil {
-		return fmt.Errorf("unable to fetch endpoint where model was deployed: %v", err)
+		return nil, fmt.Errorf("unable to deploy model: %v", err)
 	}
+	return op, nil
+}
 
-	var modelsToUndeploy = map[string]bool{}
-	for _, dm := range endpoint.DeployedModels {
-		modelsToUndeploy[dm.Id] = true
+// undeployNoTrafficModels fetches the Vertex AI endpoint and und-deploys the models that have no traffic routed to them,
+// except for the `retain` most recently deployed ones. At most `concurrency` models are undeployed at the same time,
+// all of them if it's 0.
+func undeployNoTrafficModels(ctx context.Context, aiPlatformService *aiplatform.Service, endpointName string, retain, concurrency int) error {
+	endpoint, err := aiPlatformService.Projects.Locations.Endpoints.Get(endpointName).Do()
+	if err != nil {
+		return fmt.Errorf("unable to fetch endpoint where model was deployed: %v", err)
 	}
 
-	for id, split := range endpoint.TrafficSplit {
+	return undeployModels(ctx, aiPlatformService, endpointName, noTrafficModelsToUndeploy(endpoint, retain), concurrency)
+}
 
+// noTrafficModelsToUndeploy returns the IDs of the deployed models of the endpoint that have no traffic routed to
+// them, excluding the `retain` most recently deployed ones. Models without a parsable deploy time are considered
+// the oldest.
+func noTrafficModelsToUndeploy(endpoint *aiplatform.GoogleCloudAiplatformV1Endpoint, retain int) []string {
+	var noTraffic []*aiplatform.GoogleCloudAiplatformV1DeployedModel
+	for _, dm := range endpoint.DeployedModels {
 		// model does not get un-deployed if its configured to receive  traffic
-		if split != 0 {
-			delete(modelsToUndeploy, id)
+		if endpoint.TrafficSplit[dm.Id] != 0 {
+			continue
 		}
+		noTraffic = append(noTraffic, dm)
 	}
 
-	undeployedCount := 0
-	err = nil
-	var lros []*aiplatform.GoogleLongrunningOperation
-	for id, _ := range modelsToUndeploy {
-		undeployRequest := &aiplatform.GoogleCloudAiplatformV1UndeployModelRequest{DeployedModelId: id}
-		lro, lroErr := aiPlatformService.Projects.Locations.Endpoints.UndeployModel(endpointName, undeployRequest).Do()
+	deployTime := func(dm *aiplatform.GoogleCloudAiplatformV1DeployedModel) time.Time {
+		t, err := time.Parse(time.RFC3339Nano, dm.CreateTime)
 		if err != nil {
-			fmt.Printf("error undeploying model: %v\n", err)
-			err = lroErr
-			undeployedCount += 1
-		} else {
-			lros = append(lros, lro)
+			return time.Time{}
+		}
+		return t
+	}
+	sort.SliceStable(noTraffic, func(i, j int) bool {
+		return deployTime(noTraffic[i]).After(deployTime(noTraffic[j]))
+	})
+
+	var ids []string
+	for i, dm := range noTraffic {
+		if i < retain {
+			fmt.Printf("Retaining deployed model %s without traffic, deployed at %s\n", dm.Id, dm.CreateTime)
+			continue
+		}
+		ids = append(ids, dm.Id)
+	}
+	return ids
+}
+
+// undeployFailure records a deployed model that couldn't be undeployed from an endpoint.
+type undeployFailure struct {
+	Endpoint        string `json:"endpoint"`
+	DeployedModelID string `json:"deployedModelId"`
+	// name of the UndeployModel operation, empty if the operation couldn't be started.
+	Operation string `json:"operation,omitempty"`
+	Error     string `json:"error"`
+}
+
+// undeployError is returned by undeployModels when one or more deployed models couldn't be undeployed.
+type undeployError struct {
+	failures []undeployFailure
+}
+
+func (e *undeployError) Error() string {
+	var msgs []string
+	for _, f := range e.failures {
+		if len(f.Operation) == 0 {
+			msgs = append(msgs, fmt.Sprintf("deployed model %s: %s", f.DeployedModelID, f.Error))
+			continue
 		}
+		msgs = append(msgs, fmt.Sprintf("deployed model %s (operation %s): %s", f.DeployedModelID, f.Operation, f.Error))
 	}
+	return fmt.Sprintf("failed to undeploy %d deployed model(s): %s", len(e.failures), strings.Join(msgs, "; "))
+}
+
+// undeployModels un-deploys the provided deployed models from the endpoint and awaits the resulting operations. At
+// most `concurrency` operations run at the same time, all of them if it's 0. The models that couldn't be undeployed
+// are returned in an *undeployError.
+func undeployModels(ctx context.Context, aiPlatformService *aiplatform.Service, endpointName string, ids []string, concurrency int) error {
+	if concurrency <= 0 || concurrency > len(ids) {
+		concurrency = len(ids)
+	}
+	var failures []undeployFailure
+	for start := 0; start < len(ids); start += concurrency {
+		end := start + concurrency
+		if end > len(ids) {
+			end = len(ids)
+		}
+		var ops []modelOperation
+		for _, id := range ids[start:end] {
+			undeployRequest := &aiplatform.GoogleCloudAiplatformV1UndeployModelRequest{DeployedModelId: id}
+			lro, lroErr := aiPlatformService.Projects.Locations.Endpoints.UndeployModel(endpointName, undeployRequest).Do()
+			if lroErr != nil {
+				fmt.Printf("Error undeploying deployed model %s: %v\n", id, lroErr)
+				failures = append(failures, undeployFailure{Endpoint: endpointName, DeployedModelID: id, Error: lroErr.Error()})
+				continue
+			}
+			ops = append(ops, modelOperation{deployedModelID: id, lro: lro})
+		}
 
-	for pollErr := range pollChan(ctx, aiPlatformService, lros...) {
-		if pollErr != nil {
-			fmt.Printf("Error in undeploy model operation: %v", err)
-			err = pollErr
+		for res := range pollChan(ctx, aiPlatformService, ops...) {
+			if res.err != nil {
+				fmt.Printf("Error in undeploy model operation %s for deployed model %s: %v\n", res.lro.Name, res.deployedModelID, res.err)
+				failures = append(failures, undeployFailure{Endpoint: endpointName, DeployedModelID: res.deployedModelID, Operation: res.lro.Name, Error: res.err.Error()})
+			}
 		}
 	}
-	return err
+	if len(failures) == 0 {
+		return nil
+	}
+	// The operations complete in any order, so the failures are sorted for a consistent error.
+	sort.Slice(failures, func(i, j int) bool { return failures[i].DeployedModelID < failures[j].DeployedModelID })
+	return &undeployError{failures: failures}
 }
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"google.golang.org/api/aiplatform/v1"
+	"google.golang.org/api/option"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -107,4 +115,256 @@ func TestMinReplicaCountFromConfig(t *testing.T) {
 	if num := minReplicaCountFromConfig(deployedModel); num != 5{
 		t.Errorf("Error: num was expected to be 5, Actual %v", num)
 	}
-}
\ No newline at end of file
+}
+
+//Tests that resolveModelVersion pins bare model names, versions and aliases to the version ID
+func TestResolveModelVersion(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/v1/") {
+		case "projects/p/locations/us-central1/models/m", "projects/p/locations/us-central1/models/m@production":
+			w.Write([]byte(`{"name": "projects/p/locations/us-central1/models/m", "versionId": "3"}`))
+		case "projects/p/locations/us-central1/models/m@2":
+			w.Write([]byte(`{"name": "projects/p/locations/us-central1/models/m", "versionId": "2"}`))
+		default:
+			http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	service, err := aiplatform.NewService(context.Background(), option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("unable to create service: %v", err)
+	}
+
+	tests := map[string]string{
+		"projects/p/locations/us-central1/models/m":            "projects/p/locations/us-central1/models/m@3",
+		"projects/p/locations/us-central1/models/m@2":          "projects/p/locations/us-central1/models/m@2",
+		"projects/p/locations/us-central1/models/m@production": "projects/p/locations/us-central1/models/m@3",
+	}
+	for input, want := range tests {
+		_, got, err := resolveModelVersion(service, input)
+		if err != nil {
+			t.Errorf("Expected no error for %s, Actual: %v", input, err)
+		}
+		if got != want {
+			t.Errorf("Expected: %s, Actual: %s", want, got)
+		}
+	}
+
+	if _, _, err := resolveModelVersion(service, "projects/p/locations/us-central1/models/m@missing"); err == nil {
+		t.Errorf("Expected: error for unresolvable alias, Actual: %s", err)
+	}
+}
+
+//Tests that resolveModelWithVersion fails when the model has no version ID
+func TestResolveModelWithVersionFails(t *testing.T) {
+	if _, err := resolveModelWithVersion(&aiplatform.GoogleCloudAiplatformV1Model{Name: "projects/p/locations/l/models/m"}); err == nil {
+		t.Errorf("Expected: error, Actual: %s", err)
+	}
+}
+
+//Tests that newAIPlatformService uses the default regional host unless an API endpoint override is provided
+func TestNewAIPlatformServiceEndpoint(t *testing.T) {
+	tests := []struct {
+		name        string
+		apiEndpoint string
+		want        string
+	}{
+		{name: "default", want: "https://us-central1-aiplatform.googleapis.com/"},
+		{name: "override", apiEndpoint: "restricted.googleapis.com", want: "https://restricted.googleapis.com/"},
+		{name: "override with region", apiEndpoint: "{region}-aiplatform.example.com:8443", want: "https://us-central1-aiplatform.example.com:8443/"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			service, err := newAIPlatformService(context.Background(), "us-central1", tc.apiEndpoint, option.WithoutAuthentication())
+			if err != nil {
+				t.Fatalf("newAIPlatformService() failed: %v", err)
+			}
+			if service.BasePath != tc.want {
+				t.Errorf("newAIPlatformService() got base path: %s, want: %s", service.BasePath, tc.want)
+			}
+		})
+	}
+}
+
+//Tests that API calls are sent to the API endpoint override
+func TestNewAIPlatformServiceEndpointOverrideUsed(t *testing.T) {
+	var gotPath string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Write([]byte(`{"name": "projects/p/locations/us-central1/models/m"}`))
+	}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "https://")
+	service, err := newAIPlatformService(context.Background(), "us-central1", host, option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatalf("newAIPlatformService() failed: %v", err)
+	}
+	if _, err := fetchModel(service, "projects/p/locations/us-central1/models/m"); err != nil {
+		t.Fatalf("fetchModel() failed: %v", err)
+	}
+	if want := "/v1/projects/p/locations/us-central1/models/m"; gotPath != want {
+		t.Errorf("request path got: %s, want: %s", gotPath, want)
+	}
+}
+
+//Tests that validateAPIEndpoint only accepts hostnames with an optional port
+func TestValidateAPIEndpoint(t *testing.T) {
+	for _, e := range []string{"restricted.googleapis.com", "private.googleapis.com:443", "{region}-aiplatform.googleapis.com", "localhost:8080"} {
+		if err := validateAPIEndpoint(e); err != nil {
+			t.Errorf("validateAPIEndpoint(%q) failed: %v", e, err)
+		}
+	}
+	for _, e := range []string{"https://restricted.googleapis.com", "restricted.googleapis.com/v1", "-bad.example.com", "host:port", "a b"} {
+		if err := validateAPIEndpoint(e); err == nil {
+			t.Errorf("validateAPIEndpoint(%q) succeeded, want error", e)
+		}
+	}
+}
+
+//Tests that noTrafficModelsToUndeploy keeps the most recently deployed models without traffic
+func TestNoTrafficModelsToUndeploy(t *testing.T) {
+	endpoint := &aiplatform.GoogleCloudAiplatformV1Endpoint{
+		DeployedModels: []*aiplatform.GoogleCloudAiplatformV1DeployedModel{
+			{Id: "oldest", CreateTime: "2024-01-01T10:00:00Z"},
+			{Id: "serving", CreateTime: "2024-01-05T10:00:00Z"},
+			{Id: "newest", CreateTime: "2024-01-04T10:00:00.123456Z"},
+			{Id: "middle", CreateTime: "2024-01-02T10:00:00Z"},
+			{Id: "unknown"},
+		},
+		TrafficSplit: map[string]int64{"serving": 100, "oldest": 0},
+	}
+	tests := []struct {
+		name   string
+		retain int
+		want   []string
+	}{
+		{name: "retain none", retain: 0, want: []string{"newest", "middle", "oldest", "unknown"}},
+		{name: "retain one", retain: 1, want: []string{"middle", "oldest", "unknown"}},
+		{name: "retain two", retain: 2, want: []string{"oldest", "unknown"}},
+		{name: "retain all", retain: 10, want: nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := noTrafficModelsToUndeploy(endpoint, tc.retain)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Unexpected models to undeploy (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// fakeUndeployServer is a fake of the Vertex AI API where the UndeployModel operation of each deployed model either
+// succeeds, fails to start or completes with an error. It records the maximum number of operations in flight.
+type fakeUndeployServer struct {
+	mu sync.Mutex
+	// deployed model IDs whose UndeployModel request is rejected.
+	rejected map[string]bool
+	// deployed model IDs whose UndeployModel operation completes with an error.
+	failed      map[string]bool
+	inFlight    map[string]bool
+	maxInFlight int
+}
+
+func (f *fakeUndeployServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if strings.HasSuffix(r.URL.Path, ":undeployModel") {
+		var req aiplatform.GoogleCloudAiplatformV1UndeployModelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id := req.DeployedModelId
+		if f.rejected[id] {
+			http.Error(w, `{"error": {"code": 400, "message": "deployed model is serving traffic"}}`, http.StatusBadRequest)
+			return
+		}
+		f.inFlight[id] = true
+		if len(f.inFlight) > f.maxInFlight {
+			f.maxInFlight = len(f.inFlight)
+		}
+		fmt.Fprintf(w, `{"name": "projects/p/locations/us-central1/operations/undeploy-%s"}`, id)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/v1/projects/p/locations/us-central1/operations/undeploy-")
+	delete(f.inFlight, id)
+	if f.failed[id] {
+		fmt.Fprintf(w, `{"name": "projects/p/locations/us-central1/operations/undeploy-%s", "done": true, "error": {"code": 13, "message": "internal error"}}`, id)
+		return
+	}
+	fmt.Fprintf(w, `{"name": "projects/p/locations/us-central1/operations/undeploy-%s", "done": true}`, id)
+}
+
+//Tests that undeployModels attributes each failure to the deployed model and operation, and limits the number of
+//operations in flight
+func TestUndeployModels(t *testing.T) {
+	endpoint := "projects/p/locations/us-central1/endpoints/e"
+	tests := []struct {
+		name            string
+		concurrency     int
+		wantMaxInFlight int
+	}{
+		{name: "all at once", concurrency: 0, wantMaxInFlight: 2},
+		{name: "one at a time", concurrency: 1, wantMaxInFlight: 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &fakeUndeployServer{
+				rejected: map[string]bool{"2": true},
+				failed:   map[string]bool{"3": true},
+				inFlight: map[string]bool{},
+			}
+			srv := httptest.NewServer(f)
+			defer srv.Close()
+			service, err := aiplatform.NewService(context.Background(), option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+			if err != nil {
+				t.Fatalf("unable to create service: %v", err)
+			}
+
+			err = undeployModels(context.Background(), service, endpoint, []string{"3", "1", "2"}, tc.concurrency)
+			ue, ok := err.(*undeployError)
+			if !ok {
+				t.Fatalf("Expected: *undeployError, Actual: %v", err)
+			}
+			want := []undeployFailure{
+				{Endpoint: endpoint, DeployedModelID: "2", Error: ue.failures[0].Error},
+				{Endpoint: endpoint, DeployedModelID: "3", Operation: "projects/p/locations/us-central1/operations/undeploy-3", Error: "operation failed with code 13: internal error"},
+			}
+			if diff := cmp.Diff(want, ue.failures); diff != "" {
+				t.Errorf("Unexpected undeploy failures (-want +got):\n%s", diff)
+			}
+			if !strings.Contains(ue.failures[0].Error, "deployed model is serving traffic") {
+				t.Errorf("Expected: error of deployed model 2 to contain the API error, Actual: %s", ue.failures[0].Error)
+			}
+			msg := err.Error()
+			for _, s := range []string{"failed to undeploy 2 deployed model(s)", "deployed model 2:", "deployed model 3 (operation projects/p/locations/us-central1/operations/undeploy-3): operation failed"} {
+				if !strings.Contains(msg, s) {
+					t.Errorf("Expected: error containing %q, Actual: %s", s, msg)
+				}
+			}
+			if strings.Contains(msg, "deployed model 1") {
+				t.Errorf("Expected: error not mentioning deployed model 1, Actual: %s", msg)
+			}
+			if f.maxInFlight != tc.wantMaxInFlight {
+				t.Errorf("Expected: %d operations in flight at most, Actual: %d", tc.wantMaxInFlight, f.maxInFlight)
+			}
+		})
+	}
+}
+
+//Tests that recordUndeployFailures keeps the failures of every endpoint for the deploy result metadata
+func TestRecordUndeployFailures(t *testing.T) {
+	d := &deployer{}
+	d.recordUndeployFailures(&undeployError{failures: []undeployFailure{{Endpoint: "e1", DeployedModelID: "1", Error: "failed"}}})
+	d.recordUndeployFailures(fmt.Errorf("unable to fetch endpoint"))
+	d.recordUndeployFailures(&undeployError{failures: []undeployFailure{{Endpoint: "e2", DeployedModelID: "2", Operation: "op", Error: "failed"}}})
+	got, err := json.Marshal(d.undeployFailures)
+	if err != nil {
+		t.Fatalf("unable to marshal undeploy failures: %v", err)
+	}
+	want := `[{"endpoint":"e1","deployedModelId":"1","error":"failed"},{"endpoint":"e2","deployedModelId":"2","operation":"op","error":"failed"}]`
+	if string(got) != want {
+		t.Errorf("Expected: %s, Actual: %s", want, got)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is the verification configuration loaded from the file passed with -config. Values that are
+// set in the config override the flags.
+type config struct {
+	Project         *string        `yaml:"project"`
+	TimeToMonitor   *time.Duration `yaml:"timeToMonitor"`
+	RefreshPeriod   *time.Duration `yaml:"refreshPeriod"`
+	AnchorToRollout *bool          `yaml:"anchorToRollout"`
+	OnBreach        *string        `yaml:"onBreach"`
+	OnInconclusive  *string        `yaml:"onInconclusive"`
+	Warmup          *time.Duration `yaml:"warmup"`
+	// Checks are the error conditions to evaluate, the verification fails if any of them is triggered.
+	// If no checks are configured then the error condition configured by the flags is evaluated.
+	Checks []check `yaml:"checks"`
+}
+
+// check configures a single error condition to evaluate. Values that aren't set default to the flags.
+type check struct {
+	// Name of the check, used in the logs. Required when there are multiple checks.
+	Name               string         `yaml:"name"`
+	TableName          *string        `yaml:"tableName"`
+	MetricType         *string        `yaml:"metricType"`
+	Predicates         *string        `yaml:"predicates"`
+	ResponseCodeClass  *string        `yaml:"responseCodeClass"`
+	MaxErrorPercentage *float64       `yaml:"maxErrorPercentage"`
+	SlidingWindow      *time.Duration `yaml:"slidingWindow"`
+	TriggerDuration    *time.Duration `yaml:"triggerDuration"`
+	CustomQuery        *string        `yaml:"customQuery"`
+	Aggregate          *bool          `yaml:"aggregate"`
+	MinDataPoints      *int           `yaml:"minDataPoints"`
+}
+
+// loadConfig reads and validates the config at the provided path. Unknown fields are an error.
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config %q: %w", path, err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	cfg := &config{}
+	if err := dec.Decode(cfg); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("config %q is empty", path)
+		}
+		return nil, fmt.Errorf("unable to parse config %q: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %q: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// validate returns an error if any of the values set in the config are invalid.
+func (c *config) validate() error {
+	if c.OnBreach != nil && *c.OnBreach != onBreachFail && *c.OnBreach != onBreachWarn {
+		return fmt.Errorf("onBreach must be %q or %q, got %q", onBreachFail, onBreachWarn, *c.OnBreach)
+	}
+	if c.OnInconclusive != nil && *c.OnInconclusive != onInconclusiveSucceed && *c.OnInconclusive != onInconclusiveFail {
+		return fmt.Errorf("onInconclusive must be %q or %q, got %q", onInconclusiveSucceed, onInconclusiveFail, *c.OnInconclusive)
+	}
+	if err := validatePositive("timeToMonitor", c.TimeToMonitor); err != nil {
+		return err
+	}
+	if err := validatePositive("refreshPeriod", c.RefreshPeriod); err != nil {
+		return err
+	}
+	if c.Warmup != nil && *c.Warmup < 0 {
+		return fmt.Errorf("warmup must not be negative, got %v", *c.Warmup)
+	}
+	names := map[string]bool{}
+	for i, ch := range c.Checks {
+		if len(ch.Name) == 0 && len(c.Checks) > 1 {
+			return fmt.Errorf("checks[%d]: name is required when there are multiple checks", i)
+		}
+		if names[ch.Name] {
+			return fmt.Errorf("checks[%d]: duplicate check name %q", i, ch.Name)
+		}
+		if strings.Contains(ch.Name, "/") {
+			// The name is part of the snapshot object names.
+			return fmt.Errorf("checks[%d]: check name %q must not contain \"/\"", i, ch.Name)
+		}
+		names[ch.Name] = true
+		if p := ch.MaxErrorPercentage; p != nil && (*p < 0 || *p > 100) {
+			return fmt.Errorf("checks[%d]: maxErrorPercentage must be between 0 and 100, got %v", i, *p)
+		}
+		if err := validatePositive("slidingWindow", ch.SlidingWindow); err != nil {
+			return fmt.Errorf("checks[%d]: %w", i, err)
+		}
+		if err := validatePositive("triggerDuration", ch.TriggerDuration); err != nil {
+			return fmt.Errorf("checks[%d]: %w", i, err)
+		}
+		if n := ch.MinDataPoints; n != nil && *n < 0 {
+			return fmt.Errorf("checks[%d]: minDataPoints must not be negative, got %d", i, *n)
+		}
+	}
+	return nil
+}
+
+// validatePositive returns an error if the duration is set and isn't positive.
+func validatePositive(field string, d *time.Duration) error {
+	if d != nil && *d <= 0 {
+		return fmt.Errorf("%s must be positive, got %v", field, *d)
+	}
+	return nil
+}
+
+// applyGlobals overrides the flags that aren't specific to a check with the values set in the config.
+func (c *config) applyGlobals() {
+	if c.Project != nil {
+		project = replaceEnvVars(*c.Project)
+	}
+	if c.TimeToMonitor != nil {
+		timeToMonitor = *c.TimeToMonitor
+	}
+	if c.RefreshPeriod != nil {
+		refreshPeriod = *c.RefreshPeriod
+	}
+	if c.AnchorToRollout != nil {
+		anchorToRollout = *c.AnchorToRollout
+	}
+	if c.OnBreach != nil {
+		onBreach = *c.OnBreach
+	}
+	if c.OnInconclusive != nil {
+		onInconclusive = *c.OnInconclusive
+	}
+	if c.Warmup != nil {
+		warmup = *c.Warmup
+	}
+}
+
+// checkFromFlags returns a check with every value set to a copy of the flag's value, since applying a
+// check overwrites the flag values.
+func checkFromFlags() check {
+	tn, mt, p, rcc, cq := tableName, metricType, predicates, responseCodeClass, customQuery
+	mep, sw, td, a, mdp := maxErrorPercentage, slidingWindow, triggerDuration, aggregate, minDataPoints
+	return check{
+		TableName:          &tn,
+		MetricType:         &mt,
+		Predicates:         &p,
+		ResponseCodeClass:  &rcc,
+		MaxErrorPercentage: &mep,
+		SlidingWindow:      &sw,
+		TriggerDuration:    &td,
+		CustomQuery:        &cq,
+		Aggregate:          &a,
+		MinDataPoints:      &mdp,
+	}
+}
+
+// withDefaults returns a copy of the check where the values that aren't set are taken from the provided check.
+func (c check) withDefaults(d check) check {
+	if c.TableName == nil {
+		c.TableName = d.TableName
+	}
+	if c.MetricType == nil {
+		c.MetricType = d.MetricType
+	}
+	if c.Predicates == nil {
+		c.Predicates = d.Predicates
+	}
+	if c.ResponseCodeClass == nil {
+		c.ResponseCodeClass = d.ResponseCodeClass
+	}
+	if c.MaxErrorPercentage == nil {
+		c.MaxErrorPercentage = d.MaxErrorPercentage
+	}
+	if c.SlidingWindow == nil {
+		c.SlidingWindow = d.SlidingWindow
+	}
+	if c.TriggerDuration == nil {
+		c.TriggerDuration = d.TriggerDuration
+	}
+	if c.CustomQuery == nil {
+		c.CustomQuery = d.CustomQuery
+	}
+	if c.Aggregate == nil {
+		c.Aggregate = d.Aggregate
+	}
+	if c.MinDataPoints == nil {
+		c.MinDataPoints = d.MinDataPoints
+	}
+	return c
+}
+
+// apply sets the values of the check, which must all be set, as the current error condition to evaluate.
+func (c check) apply() {
+	tableName = replaceEnvVars(*c.TableName)
+	metricType = replaceEnvVars(*c.MetricType)
+	predicates = replaceEnvVars(*c.Predicates)
+	responseCodeClass = replaceEnvVars(*c.ResponseCodeClass)
+	maxErrorPercentage = *c.MaxErrorPercentage
+	slidingWindow = *c.SlidingWindow
+	triggerDuration = *c.TriggerDuration
+	customQuery = *c.CustomQuery
+	aggregate = *c.Aggregate
+	minDataPoints = *c.MinDataPoints
+}
+
+// determineChecks returns the checks to evaluate, with every value set. If a config path is provided the
+// config is loaded and its values override the flags, otherwise the flags define a single check.
+func determineChecks(configPath string) ([]check, error) {
+	flags := checkFromFlags()
+	if len(configPath) == 0 {
+		return []check{flags}, nil
+	}
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	cfg.applyGlobals()
+	if len(cfg.Checks) == 0 {
+		return []check{flags}, nil
+	}
+	var checks []check
+	for _, c := range cfg.Checks {
+		checks = append(checks, c.withDefaults(flags))
+	}
+	return checks, nil
+}
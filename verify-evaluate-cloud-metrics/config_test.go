@@ -0,0 +1,180 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes the config content to a file in a temporary directory and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "verify.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestDetermineChecksFromConfig(t *testing.T) {
+	tableName = "cloud_run_revision"
+	metricType = "run.googleapis.com/request_count"
+	predicates = ""
+	responseCodeClass = "5xx"
+	maxErrorPercentage = 10
+	slidingWindow = time.Minute
+	triggerDuration = 5 * time.Minute
+	customQuery = ""
+	aggregate = false
+	timeToMonitor = 20 * time.Minute
+	onBreach = onBreachFail
+
+	path := writeConfig(t, `
+timeToMonitor: 10m
+onBreach: warn
+checks:
+- name: server-errors
+  predicates: resource.service_name == 'my-service'
+  maxErrorPercentage: 5
+- name: client-errors
+  responseCodeClass: 4xx
+  triggerDuration: 2m
+  aggregate: true
+`)
+	checks, err := determineChecks(path)
+	if err != nil {
+		t.Fatalf("determineChecks() failed: %v", err)
+	}
+	if timeToMonitor != 10*time.Minute || onBreach != onBreachWarn {
+		t.Errorf("globals not applied, got: %v, %q, want: %v, %q", timeToMonitor, onBreach, 10*time.Minute, onBreachWarn)
+	}
+	if len(checks) != 2 {
+		t.Fatalf("determineChecks() returned %d checks, want 2", len(checks))
+	}
+
+	checks[0].apply()
+	if predicates != "resource.service_name == 'my-service'" || maxErrorPercentage != 5 || responseCodeClass != "5xx" || triggerDuration != 5*time.Minute {
+		t.Errorf("unexpected values for check %q, got: %q, %v, %q, %v", checks[0].Name, predicates, maxErrorPercentage, responseCodeClass, triggerDuration)
+	}
+	// Values from the first check must not leak into the second.
+	checks[1].apply()
+	if predicates != "" || maxErrorPercentage != 10 || responseCodeClass != "4xx" || triggerDuration != 2*time.Minute || !aggregate {
+		t.Errorf("unexpected values for check %q, got: %q, %v, %q, %v, %v", checks[1].Name, predicates, maxErrorPercentage, responseCodeClass, triggerDuration, aggregate)
+	}
+	if tableName != "cloud_run_revision" || metricType != "run.googleapis.com/request_count" {
+		t.Errorf("flag values not used for unset values, got: %q, %q", tableName, metricType)
+	}
+	aggregate = false
+}
+
+func TestDetermineChecksWithoutConfig(t *testing.T) {
+	maxErrorPercentage = 15
+	checks, err := determineChecks("")
+	if err != nil {
+		t.Fatalf("determineChecks() failed: %v", err)
+	}
+	if len(checks) != 1 || *checks[0].MaxErrorPercentage != 15 {
+		t.Errorf("expected a single check from the flags, got: %+v", checks)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "empty",
+			content: "",
+			wantErr: "is empty",
+		},
+		{
+			name:    "unknown field",
+			content: "timeToMonitor: 10m\nthreshold: 5\n",
+			wantErr: "field threshold not found",
+		},
+		{
+			name:    "unknown check field",
+			content: "checks:\n- name: a\n  maxErrorPercent: 5\n",
+			wantErr: "field maxErrorPercent not found",
+		},
+		{
+			name:    "invalid duration",
+			content: "refreshPeriod: often\n",
+			wantErr: "unable to parse",
+		},
+		{
+			name:    "negative duration",
+			content: "checks:\n- slidingWindow: -1m\n",
+			wantErr: "slidingWindow must be positive",
+		},
+		{
+			name:    "check name with slash",
+			content: "checks:\n- name: errors/5xx\n",
+			wantErr: "must not contain",
+		},
+		{
+			name:    "negative warmup",
+			content: "warmup: -30s\n",
+			wantErr: "warmup must not be negative",
+		},
+		{
+			name:    "invalid on breach",
+			content: "onBreach: ignore\n",
+			wantErr: "onBreach must be",
+		},
+		{
+			name:    "invalid on inconclusive",
+			content: "onInconclusive: ignore\n",
+			wantErr: "onInconclusive must be",
+		},
+		{
+			name:    "percentage out of range",
+			content: "checks:\n- maxErrorPercentage: 150\n",
+			wantErr: "maxErrorPercentage must be between 0 and 100",
+		},
+		{
+			name:    "negative min data points",
+			content: "checks:\n- minDataPoints: -1\n",
+			wantErr: "minDataPoints must not be negative",
+		},
+		{
+			name:    "missing check name",
+			content: "checks:\n- name: a\n- responseCodeClass: 4xx\n",
+			wantErr: "name is required",
+		},
+		{
+			name:    "duplicate check name",
+			content: "checks:\n- name: a\n- name: a\n",
+			wantErr: "duplicate check name",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := loadConfig(writeConfig(t, tc.content))
+			if err == nil {
+				t.Fatalf("loadConfig() expected error containing %q", tc.wantErr)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("loadConfig() error = %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -17,15 +17,24 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
 	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"cloud.google.com/go/storage"
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+	deployapi "google.golang.org/api/clouddeploy/v1"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
 var (
@@ -43,8 +52,104 @@ var (
 
 	// Custom Query. If this is specified, then the query will not be crafted by the program.
 	customQuery string
+
+	// Whether to compute the error ratio across all the time series instead of for each time series.
+	aggregate bool
+
+	// Minimum number of points required before evaluating the error condition of a time series, or of
+	// the aggregate when aggregating. Fewer points are inconclusive and evaluated again after a refresh.
+	minDataPoints int
+
+	// Whether to anchor the query window to the rollout start time instead of the tool start time.
+	anchorToRollout bool
+
+	// What to do when the error condition is triggered, either "fail" or "warn".
+	onBreach string
+
+	// What to do when a check never had enough data points to be evaluated, either "succeed" or "fail".
+	onInconclusive string
+
+	// Path to a YAML config whose values override the flags, optionally defining multiple checks.
+	configPath string
+
+	// Whether to print the final result as a single JSON line to stdout.
+	jsonOutput bool
+
+	// Whether to upload a snapshot of the evaluated windows to Cloud Storage each refresh.
+	snapshotEnabled bool
+	// Cloud Storage path the snapshots are uploaded under.
+	snapshotPath string
+
+	// Cloud Storage path the final result is uploaded under, not uploaded when empty.
+	resultsPath string
+
+	// Duration after the start of the query window during which breaches are logged but don't count
+	// toward the trigger duration.
+	warmup time.Duration
+	// The end of the warmup period, set once the query window start is known.
+	warmupEnd time.Time
+
+	// Cloud Monitoring API endpoint to send the queries to instead of the global endpoint, e.g. a
+	// regional or VPC Service Controls restricted endpoint.
+	monitoringEndpoint string
 )
 
+const (
+	// onBreachFail fails the verification when the error condition is triggered.
+	onBreachFail = "fail"
+	// onBreachWarn logs the triggered error condition and lets the verification succeed.
+	onBreachWarn = "warn"
+)
+
+const (
+	// onInconclusiveSucceed lets the verification succeed when a check was never evaluated.
+	onInconclusiveSucceed = "succeed"
+	// onInconclusiveFail fails the verification when a check was never evaluated.
+	onInconclusiveFail = "fail"
+)
+
+// rolloutName returns the resource name of the rollout being verified, read from the environment Cloud Deploy
+// provides to the verification container. Returns an empty string if it's not running under Cloud Deploy.
+func rolloutName() string {
+	var parts []string
+	for _, k := range []string{clouddeploy.ProjectEnvKey, clouddeploy.LocationEnvKey, clouddeploy.PipelineEnvKey, clouddeploy.ReleaseEnvKey, clouddeploy.RolloutEnvKey} {
+		v := os.Getenv(k)
+		if len(v) == 0 {
+			return ""
+		}
+		parts = append(parts, v)
+	}
+	return fmt.Sprintf("projects/%s/locations/%s/deliveryPipelines/%s/releases/%s/rollouts/%s", parts[0], parts[1], parts[2], parts[3], parts[4])
+}
+
+// queryAnchorTime returns the time the query window starts from. When anchoring to the rollout, the time the
+// rollout started deploying is read from the rollout with the Cloud Deploy API, since it isn't provided in the
+// environment. Falls back to the tool start time if the rollout isn't known or hasn't recorded its start.
+func queryAnchorTime(ctx context.Context, anchorToRollout bool, toolStart time.Time, service *deployapi.Service) (time.Time, error) {
+	if !anchorToRollout {
+		return toolStart, nil
+	}
+	name := rolloutName()
+	if len(name) == 0 {
+		fmt.Printf("The rollout is unknown since %s is not set, anchoring the query window to the tool start time\n", clouddeploy.RolloutEnvKey)
+		return toolStart, nil
+	}
+	rollout, err := service.Projects.Locations.DeliveryPipelines.Releases.Rollouts.Get(name).Context(ctx).Do()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to get rollout %s: %w", name, err)
+	}
+	if len(rollout.DeployStartTime) == 0 {
+		fmt.Printf("Rollout %s has no deploy start time, anchoring the query window to the tool start time\n", name)
+		return toolStart, nil
+	}
+	rolloutStart, err := time.Parse(time.RFC3339, rollout.DeployStartTime)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to parse the deploy start time %q of rollout %s: %w", rollout.DeployStartTime, name, err)
+	}
+	fmt.Printf("Anchoring the query window to the deploy start time of rollout %s: %v\n", name, rolloutStart)
+	return rolloutStart, nil
+}
+
 func getQueryText(timeOfStart time.Time) string {
 	if len(customQuery) != 0 {
 		return customQuery
@@ -69,6 +174,13 @@ func getQueryText(timeOfStart time.Time) string {
 	sb.WriteString(" | ")
 	dateTime := strings.ReplaceAll(timeOfStart.UTC().Format(time.DateTime), "-", "/")
 	sb.WriteString(fmt.Sprintf("within d'%s'", dateTime))
+	if aggregate {
+		// Sum the error and total counts of each time series per sliding window, the ratio is computed
+		// after summing the counts across all time series.
+		sb.WriteString(" | ")
+		sb.WriteString(fmt.Sprintf("group_by sliding(%v), [errors: sum(if(response_code_class == '%s', val(), 0)), total: sum(val())]", slidingWindow, responseCodeClass))
+		return sb.String()
+	}
 	// Group by the specified sliding window
 	sb.WriteString(" | ")
 	sb.WriteString(fmt.Sprintf("group_by sliding(%v)", slidingWindow))
@@ -97,8 +209,23 @@ func replaceEnvVars(input string) string {
 	return input
 }
 
+// redactEnvVars replaces the values of sensitive environment variables in the string, since env var refs
+// in the flags are replaced with their values before they are logged.
+func redactEnvVars(input string) string {
+	for _, e := range os.Environ() {
+		pair := strings.SplitN(e, "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		if r := clouddeploy.RedactSensitive(pair[0], pair[1]); r != pair[1] {
+			input = strings.ReplaceAll(input, pair[1], r)
+		}
+	}
+	return input
+}
+
 func init() {
-	// Initializing of the flag and print out the values for visibility.
+	// Initializing of the flags.
 	flag.StringVar(&project, "project", os.Getenv("CLOUD_DEPLOY_PROJECT"), "The ID of the project that has the metrics defined, defaulted to the CLOUD_DEPLOY_PROJECT environmental variable")
 	flag.StringVar(&tableName, "table-name", "", "The [tablename](https://cloud.google.com/monitoring/mql/reference#fetch-tabop) to fetch from")
 	flag.StringVar(&metricType, "metric-type", "", "The [metric type](https://cloud.google.com/monitoring/mql/reference#metric-tabop) to get from the table-name")
@@ -110,68 +237,303 @@ func init() {
 	flag.DurationVar(&timeToMonitor, "time-to-monitor", 20*time.Minute, "The time to monitor for response failures before the verification is marked successful")
 	flag.DurationVar(&refreshPeriod, "refresh-period", 5*time.Minute, "The time to wait before refreshing the data set with new data")
 	flag.StringVar(&customQuery, "custom-query", "", "Customized query following [MQL](https://cloud.google.com/monitoring/mql/reference) to use for query instead. By specifying this, the query will not be crafted by the program")
+	flag.IntVar(&minDataPoints, "min-data-points", 0, "The minimum number of points, one per sliding window, required before evaluating the error condition. With fewer points the evaluation is deferred until the next refresh")
+	flag.BoolVar(&aggregate, "aggregate", false, "Compute the error ratio per sliding window across all the time series instead of for each time series. A custom query must return the error count and the total count for each point")
+	flag.StringVar(&onBreach, "on-breach", onBreachFail, fmt.Sprintf("What to do when the error condition is triggered: %q fails the verification, %q logs the breach and lets the verification succeed", onBreachFail, onBreachWarn))
+	flag.StringVar(&onInconclusive, "on-inconclusive", onInconclusiveSucceed, fmt.Sprintf("What to do when the time to monitor expires before a check had the minimum data points to be evaluated: %q lets the verification succeed, %q fails it", onInconclusiveSucceed, onInconclusiveFail))
+	flag.StringVar(&configPath, "config", "", "Path to a YAML config defining the verification, the values set in the config override the flags. The config can define multiple checks, the verification fails if any of them is triggered")
+	flag.DurationVar(&warmup, "warmup", 0, "The duration after the start of the query window during which the error condition is logged but doesn't count toward the trigger duration, to ignore errors caused by cold starts")
+	flag.BoolVar(&snapshotEnabled, "snapshot", false, "Upload a timestamped JSON snapshot of the sliding windows evaluated for each check to Cloud Storage every refresh, for post-hoc analysis")
+	flag.StringVar(&snapshotPath, "snapshot-path", os.Getenv(outputGCSPathEnvKey), fmt.Sprintf("The Cloud Storage path, e.g. gs://{bucket}/{prefix}, the snapshots are uploaded under, defaulted to the %s environmental variable", outputGCSPathEnvKey))
+	flag.StringVar(&resultsPath, "results-path", os.Getenv(outputGCSPathEnvKey), fmt.Sprintf("The Cloud Storage path, e.g. gs://{bucket}/{prefix}, the final result of the verification is uploaded under as %s, defaulted to the %s environmental variable. The result isn't uploaded when empty", resultObjectName, outputGCSPathEnvKey))
+	flag.BoolVar(&jsonOutput, "json", false, "Print the final result of the verification as a single JSON line to stdout, in addition to the logs")
+	flag.StringVar(&monitoringEndpoint, "monitoring-endpoint", "", "The Cloud Monitoring API endpoint, host with an optional port defaulted to 443, to send the queries to instead of the global monitoring.googleapis.com endpoint, e.g. a VPC Service Controls restricted endpoint")
+	flag.BoolVar(&anchorToRollout, "anchor-to-rollout", false, "Anchor the query window to the time the rollout started deploying, read from the rollout with the Cloud Deploy API, instead of the time the verification started")
+}
 
+// parseFlags parses the flags and prints out the values for visibility.
+func parseFlags() {
 	flag.Parse()
 	project = replaceEnvVars(project)
 	tableName = replaceEnvVars(tableName)
 	metricType = replaceEnvVars(metricType)
 	predicates = replaceEnvVars(predicates)
 	responseCodeClass = replaceEnvVars(responseCodeClass)
+	snapshotPath = replaceEnvVars(snapshotPath)
+	resultsPath = replaceEnvVars(resultsPath)
 
 	fmt.Println("---")
 	fmt.Println("Verification configured as follows:")
-	fmt.Printf("Project: %q\n", project)
-	fmt.Println(formatMsg(fmt.Sprintf("Table Name: %q", tableName)))
-	fmt.Println(formatMsg(fmt.Sprintf("Metric Type: %q", metricType)))
-	fmt.Println(formatMsg(fmt.Sprintf("Predicates: %q", predicates)))
-	fmt.Println(formatMsg(fmt.Sprintf("Response Code Class: %q", responseCodeClass)))
+	fmt.Printf("Project: %q\n", redactEnvVars(project))
+	fmt.Println(formatMsg(fmt.Sprintf("Table Name: %q", redactEnvVars(tableName))))
+	fmt.Println(formatMsg(fmt.Sprintf("Metric Type: %q", redactEnvVars(metricType))))
+	fmt.Println(formatMsg(fmt.Sprintf("Predicates: %q", redactEnvVars(predicates))))
+	fmt.Println(formatMsg(fmt.Sprintf("Response Code Class: %q", redactEnvVars(responseCodeClass))))
 	fmt.Printf("Max Error Percentage: %v\n", maxErrorPercentage)
 	fmt.Println(formatMsg(fmt.Sprintf("Sliding Window: %v", slidingWindow)))
 	fmt.Printf("Trigger Duration: %v\n", triggerDuration)
 	fmt.Printf("Time To Monitor: %v\n", timeToMonitor)
 	fmt.Printf("Refresh Period: %v\n", refreshPeriod)
+	fmt.Printf("Aggregate: %v\n", aggregate)
+	fmt.Printf("Min Data Points: %d\n", minDataPoints)
+	fmt.Printf("On Breach: %q\n", onBreach)
+	fmt.Printf("On Inconclusive: %q\n", onInconclusive)
+	fmt.Println(formatMsg(fmt.Sprintf("Anchor To Rollout: %v", anchorToRollout)))
+	fmt.Printf("Config: %q\n", configPath)
+	fmt.Printf("Warmup: %v\n", warmup)
+	fmt.Printf("JSON: %v\n", jsonOutput)
+	if len(resultsPath) != 0 {
+		fmt.Printf("Results Path: %q\n", redactEnvVars(resultsPath))
+	}
+	if len(monitoringEndpoint) != 0 {
+		fmt.Printf("Monitoring Endpoint: %q\n", monitoringEndpoint)
+	}
+	fmt.Printf("Snapshot: %v\n", snapshotEnabled)
+	if snapshotEnabled {
+		fmt.Printf("Snapshot Path: %q\n", redactEnvVars(snapshotPath))
+	}
 	fmt.Println("---")
 }
 
 func main() {
-	if err := do(); err != nil {
-		fmt.Printf("err: %v", err)
+	parseFlags()
+	res := &result{}
+	err := do(res)
+	if err != nil {
+		fmt.Printf("err: %v\n", err)
+	} else {
+		fmt.Println("Done")
+	}
+	res.complete(err)
+	if jsonOutput {
+		if err := writeJSONResult(os.Stdout, res); err != nil {
+			fmt.Printf("unable to write the JSON result: %v\n", err)
+		}
+	}
+	if len(resultsPath) != 0 {
+		// The result is uploaded regardless of the outcome, so a breach in warn mode is recorded even
+		// though the verification succeeds.
+		if uri, err := uploadResultToGCS(context.Background(), resultsPath, res); err != nil {
+			fmt.Printf("unable to upload the result: %v\n", err)
+		} else {
+			fmt.Printf("Uploaded the result to %s\n", uri)
+		}
+	}
+	if err != nil {
 		os.Exit(1)
 	}
-	fmt.Println("Done")
 }
 
-func do() error {
+// uploadResultToGCS uploads the result under the Cloud Storage path with a new Cloud Storage client.
+func uploadResultToGCS(ctx context.Context, gcsPath string, res *result) (string, error) {
+	gcsClient, err := storage.NewClient(ctx)
+	if err != nil {
+		return "", fmt.Errorf("unable to create cloud storage client: %w", err)
+	}
+	defer gcsClient.Close()
+	return uploadResult(ctx, clouddeploy.NewGCSStorage(gcsClient), gcsPath, res)
+}
+
+// do runs the verification, recording its outcome in the provided result.
+func do(res *result) error {
+	checks, err := determineChecks(configPath)
+	if err != nil {
+		return err
+	}
+	if len(configPath) != 0 {
+		fmt.Printf("Loaded %d check(s) from config %q, project: %q, time to monitor: %v, refresh period: %v, on breach: %q, anchor to rollout: %v\n",
+			len(checks), configPath, project, timeToMonitor, refreshPeriod, onBreach, anchorToRollout)
+	}
+	if onBreach != onBreachFail && onBreach != onBreachWarn {
+		return fmt.Errorf("invalid -on-breach value %q, must be %q or %q", onBreach, onBreachFail, onBreachWarn)
+	}
+	if onInconclusive != onInconclusiveSucceed && onInconclusive != onInconclusiveFail {
+		return fmt.Errorf("invalid -on-inconclusive value %q, must be %q or %q", onInconclusive, onInconclusiveSucceed, onInconclusiveFail)
+	}
+
 	ctx := context.Background()
-	client, err := monitoring.NewQueryClient(ctx)
+	client, err := newQueryClient(ctx, monitoringEndpoint)
 	if err != nil {
-		return fmt.Errorf("unable to create NewQueryClient: %w", err)
+		return err
 	}
 	defer client.Close()
 
+	var snapshotStorage clouddeploy.Storage
+	if snapshotEnabled {
+		if _, _, err := parseGCSPath(snapshotPath); err != nil {
+			return fmt.Errorf("invalid -snapshot-path: %w", err)
+		}
+		gcsClient, err := storage.NewClient(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to create cloud storage client: %w", err)
+		}
+		defer gcsClient.Close()
+		snapshotStorage = clouddeploy.NewGCSStorage(gcsClient)
+	}
+
 	timeToStart := time.Now()
 	timeToEnd := timeToStart.Add(timeToMonitor)
+	res.Window = &timeWindow{Start: timeToStart}
+	defer func() { res.Window.End = time.Now() }()
 
-	queryToUse := getQueryText(timeToStart)
-	fmt.Printf("The query is %q\n", queryToUse)
+	var deployService *deployapi.Service
+	if anchorToRollout {
+		deployService, err = deployapi.NewService(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to create cloud deploy service: %w", err)
+		}
+	}
+	anchor, err := queryAnchorTime(ctx, anchorToRollout, timeToStart, deployService)
+	if err != nil {
+		return err
+	}
+	if warmup < 0 {
+		return fmt.Errorf("invalid -warmup value %v, must not be negative", warmup)
+	}
+	if minDataPoints < 0 {
+		return fmt.Errorf("invalid -min-data-points value %d, must not be negative", minDataPoints)
+	}
+	warmupEnd = anchor.Add(warmup)
+	warmupEnded := !time.Now().Before(warmupEnd)
+	if warmup > 0 && !warmupEnded {
+		fmt.Printf("Warmup period ends at %v\n", warmupEnd)
+	}
+	queries := make([]string, len(checks))
+	for i, c := range checks {
+		c.apply()
+		queries[i] = getQueryText(anchor)
+		fmt.Printf("The query%s is %q\n", checkLabel(c.Name), redactEnvVars(queries[i]))
+	}
 
+	// Whether each check had enough data points to be evaluated in any refresh.
+	evaluated := make([]bool, len(checks))
 	refreshCount := 1
 	for time.Now().Before(timeToEnd) {
-		triggered, err := errorConditionTriggered(ctx, client, refreshCount, queryToUse)
-		if err != nil {
-			return fmt.Errorf("failed to determine whether error condition triggered: %w", err)
+		res.RefreshCount = refreshCount
+		if !warmupEnded && !time.Now().Before(warmupEnd) {
+			fmt.Println("Warmup period ended, the error condition counts toward the trigger duration")
+			warmupEnded = true
 		}
-		if triggered {
-			return fmt.Errorf("verify failed, error condition triggered for more than duration")
+		for i, c := range checks {
+			c.apply()
+			var snap *snapshot
+			if snapshotEnabled {
+				snap = newSnapshot(time.Now(), refreshCount, c.Name, queries[i])
+			}
+			b, conclusive, err := errorConditionTriggered(ctx, client, refreshCount, queries[i], snap)
+			evaluated[i] = evaluated[i] || conclusive
+			if err != nil {
+				return fmt.Errorf("failed to determine whether error condition%s triggered: %w", checkLabel(c.Name), err)
+			}
+			if snap != nil {
+				// A failed upload doesn't affect the outcome of the verification.
+				if uri, err := uploadSnapshot(ctx, snapshotStorage, snapshotPath, snap); err != nil {
+					fmt.Printf("unable to upload the snapshot%s: %v\n", checkLabel(c.Name), err)
+				} else {
+					fmt.Printf("Uploaded the snapshot%s to %s\n", checkLabel(c.Name), uri)
+				}
+			}
+			if b != nil {
+				breachErr := fmt.Errorf("verify failed, error condition%s triggered for more than duration", checkLabel(c.Name))
+				res.setBreach(c.Name, queries[i], b, breachErr)
+				if err := handleBreach(onBreach, breachErr); err != nil {
+					res.Verdict = verdictFailed
+					return err
+				}
+				res.Verdict = verdictWarned
+				return nil
+			}
 		}
 		time.Sleep(refreshPeriod)
 		refreshCount++
 	}
+	return handleInconclusive(res, checks, evaluated)
+}
+
+// handleInconclusive records the verdict once the time to monitor expired without a breach. The verification
+// is inconclusive if any check never had the minimum data points to be evaluated, which fails it if
+// -on-inconclusive is "fail".
+func handleInconclusive(res *result, checks []check, evaluated []bool) error {
+	var names []string
+	for i, c := range checks {
+		if evaluated[i] {
+			continue
+		}
+		c.apply()
+		fmt.Printf("WARNING: the error condition%s was never evaluated, fewer than %d data points were observed during the time to monitor\n", checkLabel(c.Name), minDataPoints)
+		names = append(names, c.Name)
+	}
+	if len(names) == 0 {
+		res.Verdict = verdictSucceeded
+		return nil
+	}
+	res.Verdict = verdictInconclusive
+	res.Message = fmt.Sprintf("verification inconclusive, %d of %d check(s) never had enough data points to be evaluated", len(names), len(checks))
+	if onInconclusive == onInconclusiveFail {
+		return errors.New(res.Message)
+	}
+	fmt.Printf("WARNING: %s. Succeeding since -on-inconclusive is %q\n", res.Message, onInconclusiveSucceed)
 	return nil
 }
 
-// Validates that the error condition was not exceeded for trigger_duration on the sliding window.
-func errorConditionTriggered(ctx context.Context, client *monitoring.QueryClient, refreshCount int, query string) (bool, error) {
+// checkLabel returns the suffix identifying the check in log and error messages, empty for an unnamed check.
+func checkLabel(name string) string {
+	if len(name) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" for check %q", name)
+}
+
+// handleBreach returns the breach error when the verification should fail. In warn mode the breach
+// is only logged and recorded in the uploaded result, so the verification succeeds and the rollout proceeds.
+func handleBreach(mode string, breach error) error {
+	if mode == onBreachWarn {
+		fmt.Printf("WARNING: %v. Ignoring since -on-breach is %q, the breach is recorded in the result\n", breach, onBreachWarn)
+		return nil
+	}
+	return breach
+}
+
+// endpointHostRegexp matches a hostname made of dot separated DNS labels, e.g. "monitoring.googleapis.com".
+var endpointHostRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+
+// parseMonitoringEndpoint validates the provided Cloud Monitoring API endpoint, a hostname with an optional
+// port, and returns it with the port defaulted to 443.
+func parseMonitoringEndpoint(endpoint string) (string, error) {
+	host, port := endpoint, "443"
+	if h, p, err := net.SplitHostPort(endpoint); err == nil {
+		host, port = h, p
+	}
+	if !endpointHostRegexp.MatchString(host) {
+		return "", fmt.Errorf("invalid -monitoring-endpoint %q, must be a hostname with an optional port, e.g. monitoring.googleapis.com:443", endpoint)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid -monitoring-endpoint %q, the port must be a number between 1 and 65535", endpoint)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// newQueryClient creates the Cloud Monitoring query client, sending the queries to the provided endpoint if
+// it's set or to the global endpoint otherwise. The provided options are applied after the endpoint.
+func newQueryClient(ctx context.Context, endpoint string, opts ...option.ClientOption) (*monitoring.QueryClient, error) {
+	if len(endpoint) != 0 {
+		e, err := parseMonitoringEndpoint(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		opts = append([]option.ClientOption{option.WithEndpoint(e)}, opts...)
+	}
+	client, err := monitoring.NewQueryClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create NewQueryClient: %w", err)
+	}
+	return client, nil
+}
+
+// Validates that the error condition was not exceeded for trigger_duration on the sliding window. Returns
+// the breach if it was, otherwise nil, and whether any time series, or the aggregate, had enough data points
+// to be evaluated. The evaluated windows are recorded in the snapshot if it isn't nil.
+func errorConditionTriggered(ctx context.Context, client *monitoring.QueryClient, refreshCount int, query string, snap *snapshot) (*breach, bool, error) {
 	req := &monitoringpb.QueryTimeSeriesRequest{
 		Name:  fmt.Sprintf("projects/%s", project),
 		Query: query,
@@ -179,58 +541,166 @@ func errorConditionTriggered(ctx context.Context, client *monitoring.QueryClient
 
 	it := client.QueryTimeSeries(ctx, req)
 	fmt.Printf("querying the time series, refresh count: %d\n", refreshCount)
+	var series []*monitoringpb.TimeSeriesData
+	evaluated := false
 	for {
 		resp, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			return false, fmt.Errorf("could not read time series value: %w", err)
-		}
-		// The sliding window calculation are based on the points of a singular time series.
-		startTimeOfErrorCondition := time.Time{}
-		endTimeOfErrorCondition := time.Time{}
-		var dataPoints []*monitoringpb.TimeSeriesData_PointData
-		for _, p := range resp.GetPointData() {
-			errorRatio := p.GetValues()[0].GetDoubleValue() * 100
-			fmt.Printf("error ratio: %f\n", errorRatio)
-			fmt.Printf("Start time: %v\n", p.GetTimeInterval().StartTime.AsTime())
-			fmt.Printf("End time: %v\n", p.GetTimeInterval().EndTime.AsTime())
-
-			if calculateDuration(startTimeOfErrorCondition, endTimeOfErrorCondition) >= triggerDuration {
-				// We check to see if the sliding windows that we have set from previous iterations exceed the trigger duration.
-				// If it has, then we stop reading point data.
-				break
+			return nil, evaluated, fmt.Errorf("could not read time series value: %w", err)
+		}
+		if !aggregate {
+			// The sliding window calculation are based on the points of a singular time series.
+			snap.addSeries(resp.GetPointData())
+			b, conclusive, err := evaluatePoints(resp.GetPointData())
+			evaluated = evaluated || conclusive
+			if err != nil || b != nil {
+				return b, evaluated, err
 			}
-			// Time series list data points from newest data to oldest data.
-			if len(p.GetValues()) != 1 {
-				// Assuming that the point data is a ratio.
-				return false, fmt.Errorf("expected 1 rate value for the total interval, instead got: %d", len(p.GetValues()))
+			continue
+		}
+		series = append(series, resp)
+	}
+	if !aggregate {
+		return nil, evaluated, nil
+	}
+
+	// The sliding window calculation are based on the error ratio across all the time series.
+	points, err := aggregatePoints(series)
+	if err != nil {
+		return nil, false, err
+	}
+	snap.addSeries(points)
+	return evaluatePoints(points)
+}
+
+// evaluatePoints returns the breach of the points, ordered from newest to oldest, and whether the evaluation
+// was conclusive. With fewer than the minimum data points the evaluation is inconclusive and deferred until
+// the next refresh.
+func evaluatePoints(points []*monitoringpb.TimeSeriesData_PointData) (*breach, bool, error) {
+	if len(points) < minDataPoints {
+		fmt.Printf("evaluation inconclusive, deferring until the next refresh, got %d data points but at least %d are required\n", len(points), minDataPoints)
+		return nil, false, nil
+	}
+	b, err := findBreach(points)
+	return b, true, err
+}
+
+// findBreach returns the breach if the error ratio of the points, ordered from newest to oldest, exceeded
+// the max error percentage for the trigger duration, otherwise nil.
+func findBreach(points []*monitoringpb.TimeSeriesData_PointData) (*breach, error) {
+	startTimeOfErrorCondition := time.Time{}
+	endTimeOfErrorCondition := time.Time{}
+	var dataPoints []*monitoringpb.TimeSeriesData_PointData
+	for _, p := range points {
+		if calculateDuration(startTimeOfErrorCondition, endTimeOfErrorCondition) >= triggerDuration {
+			// We check to see if the sliding windows that we have set from previous iterations exceed the trigger duration.
+			// If it has, then we stop reading point data.
+			break
+		}
+		// Time series list data points from newest data to oldest data.
+		if len(p.GetValues()) != 1 {
+			// Assuming that the point data is a ratio.
+			return nil, fmt.Errorf("expected 1 rate value for the total interval, instead got: %d", len(p.GetValues()))
+		}
+
+		errorRatio := p.GetValues()[0].GetDoubleValue() * 100
+		fmt.Printf("error ratio: %f\n", errorRatio)
+		fmt.Printf("Start time: %v\n", p.GetTimeInterval().StartTime.AsTime())
+		fmt.Printf("End time: %v\n", p.GetTimeInterval().EndTime.AsTime())
+
+		if errorRatio >= maxErrorPercentage && inWarmup(p) {
+			fmt.Printf("error ratio %f exceeded max error percentage %f during the warmup period, not counting toward the trigger duration\n", errorRatio, maxErrorPercentage)
+		}
+		if errorRatio >= maxErrorPercentage && !inWarmup(p) {
+			if endTimeOfErrorCondition.IsZero() {
+				// initialization
+				endTimeOfErrorCondition = p.GetTimeInterval().EndTime.AsTime()
 			}
+			// Always replace the start as we iterate; it gets earlier and earlier.
+			dataPoints = append([]*monitoringpb.TimeSeriesData_PointData{p}, dataPoints...)
+			startTimeOfErrorCondition = p.GetTimeInterval().StartTime.AsTime()
+		} else {
+			// We found a sliding window which does not violate percentage, or is in the warmup period.
+			startTimeOfErrorCondition = time.Time{}
+			endTimeOfErrorCondition = time.Time{}
+			dataPoints = nil // reset the points
+		}
+	}
+	// We check to see if the sliding windows that we have set from previous iterations exceed the trigger duration.
+	if errorDuration := calculateDuration(startTimeOfErrorCondition, endTimeOfErrorCondition); errorDuration >= triggerDuration {
+		fmt.Printf("found duration in which max error percentage %f exceeded trigger duration, duration condition triggered for: %v\n", maxErrorPercentage, errorDuration)
+		fmt.Printf("data: %v\n", dataPoints)
+		b := &breach{
+			Start:    startTimeOfErrorCondition,
+			End:      endTimeOfErrorCondition,
+			Duration: errorDuration.String(),
+		}
+		for _, p := range dataPoints {
+			if errorRatio := p.GetValues()[0].GetDoubleValue() * 100; errorRatio > b.PeakErrorPercentage {
+				b.PeakErrorPercentage = errorRatio
+			}
+		}
+		return b, nil
+	}
+	return nil, nil
+}
 
-			if errorRatio := p.GetValues()[0].GetDoubleValue() * 100; errorRatio >= maxErrorPercentage {
-				if endTimeOfErrorCondition.IsZero() {
-					// initialization
-					endTimeOfErrorCondition = p.GetTimeInterval().EndTime.AsTime()
-				}
-				// Always replace the start as we iterate; it gets earlier and earlier.
-				dataPoints = append([]*monitoringpb.TimeSeriesData_PointData{p}, dataPoints...)
-				startTimeOfErrorCondition = p.GetTimeInterval().StartTime.AsTime()
-			} else {
-				// We found a sliding window which does not violate percentage.
-				startTimeOfErrorCondition = time.Time{}
-				endTimeOfErrorCondition = time.Time{}
-				dataPoints = nil // reset the points
+// inWarmup returns whether the point's sliding window started before the end of the warmup period.
+func inWarmup(p *monitoringpb.TimeSeriesData_PointData) bool {
+	return p.GetTimeInterval().GetStartTime().AsTime().Before(warmupEnd)
+}
+
+// aggregatePoints sums the error and total counts of each sliding window across all the time series and
+// returns a point with the aggregate error ratio for each window, ordered from newest to oldest. Each
+// point of the time series is expected to have the error count and the total count as its values.
+func aggregatePoints(series []*monitoringpb.TimeSeriesData) ([]*monitoringpb.TimeSeriesData_PointData, error) {
+	type window struct {
+		interval      *monitoringpb.TimeInterval
+		errors, total float64
+	}
+	windows := map[time.Time]*window{}
+	for _, ts := range series {
+		for _, p := range ts.GetPointData() {
+			if len(p.GetValues()) != 2 {
+				return nil, fmt.Errorf("expected 2 values, the error count and the total count, for the total interval, instead got: %d", len(p.GetValues()))
 			}
+			end := p.GetTimeInterval().GetEndTime().AsTime()
+			w, ok := windows[end]
+			if !ok {
+				w = &window{interval: p.GetTimeInterval()}
+				windows[end] = w
+			}
+			w.errors += numericValue(p.GetValues()[0])
+			w.total += numericValue(p.GetValues()[1])
 		}
-		// We check to see if the sliding windows that we have set from previous iterations exceed the trigger duration.
-		if errorDuration := calculateDuration(startTimeOfErrorCondition, endTimeOfErrorCondition); errorDuration >= triggerDuration {
-			fmt.Printf("found duration in which max error percentage %f exceeded trigger duration, duration condition triggered for: %v\n", maxErrorPercentage, errorDuration)
-			fmt.Printf("data: %v\n", dataPoints)
-			return true, nil
+	}
+
+	var points []*monitoringpb.TimeSeriesData_PointData
+	for _, w := range windows {
+		ratio := 0.0
+		if w.total > 0 {
+			ratio = w.errors / w.total
 		}
+		points = append(points, &monitoringpb.TimeSeriesData_PointData{
+			Values:       []*monitoringpb.TypedValue{{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: ratio}}},
+			TimeInterval: w.interval,
+		})
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].GetTimeInterval().GetEndTime().AsTime().After(points[j].GetTimeInterval().GetEndTime().AsTime())
+	})
+	return points, nil
+}
+
+// numericValue returns the value of an int64 or double typed value.
+func numericValue(v *monitoringpb.TypedValue) float64 {
+	if _, ok := v.GetValue().(*monitoringpb.TypedValue_Int64Value); ok {
+		return float64(v.GetInt64Value())
 	}
-	return false, nil
+	return v.GetDoubleValue()
 }
 
 func calculateDuration(start time.Time, end time.Time) time.Duration {
@@ -0,0 +1,510 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+	deployapi "google.golang.org/api/clouddeploy/v1"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestGetQueryText(t *testing.T) {
+	tableName = "cloud_run_revision"
+	metricType = "run.googleapis.com/request_count"
+	predicates = "resource.service_name == 'my-service',resource.location == 'us-central1'"
+	slidingWindow = time.Minute
+	responseCodeClass = "5xx"
+	customQuery = ""
+	aggregate = false
+
+	anchor := time.Date(2024, 3, 4, 5, 6, 7, 0, time.FixedZone("PST", -8*60*60))
+	got := getQueryText(anchor)
+	want := "fetch cloud_run_revision::run.googleapis.com/request_count" +
+		" | (resource.service_name == 'my-service' && resource.location == 'us-central1')" +
+		" | within d'2024/03/04 13:06:07'" +
+		" | group_by sliding(1m0s)" +
+		" | filter_ratio response_code_class == '5xx'"
+	if got != want {
+		t.Errorf("getQueryText() = %q, want %q", got, want)
+	}
+}
+
+func TestQueryAnchorTime(t *testing.T) {
+	toolStart := time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC)
+	rolloutStart := time.Date(2024, 3, 4, 4, 50, 0, 0, time.UTC)
+	releases := "projects/p/locations/us-central1/deliveryPipelines/dp/releases/rel-1/rollouts/"
+	rollouts := map[string]*deployapi.Rollout{
+		releases + "started":     {DeployStartTime: rolloutStart.Format(time.RFC3339)},
+		releases + "not-started": {},
+		releases + "invalid":     {DeployStartTime: "yesterday"},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rollout, ok := rollouts[strings.TrimPrefix(r.URL.Path, "/v1/")]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(rollout)
+	}))
+	defer srv.Close()
+	service, err := deployapi.NewService(context.Background(), option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("failed to create cloud deploy service: %v", err)
+	}
+
+	tests := []struct {
+		name            string
+		anchorToRollout bool
+		rollout         string
+		want            time.Time
+		wantErr         bool
+	}{
+		{
+			name:    "anchor to tool start",
+			rollout: "started",
+			want:    toolStart,
+		},
+		{
+			name:            "anchor to rollout",
+			anchorToRollout: true,
+			rollout:         "started",
+			want:            rolloutStart,
+		},
+		{
+			name:            "rollout unknown",
+			anchorToRollout: true,
+			want:            toolStart,
+		},
+		{
+			name:            "rollout not started",
+			anchorToRollout: true,
+			rollout:         "not-started",
+			want:            toolStart,
+		},
+		{
+			name:            "invalid rollout start time",
+			anchorToRollout: true,
+			rollout:         "invalid",
+			wantErr:         true,
+		},
+		{
+			name:            "rollout not found",
+			anchorToRollout: true,
+			rollout:         "deleted",
+			wantErr:         true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(clouddeploy.ProjectEnvKey, "p")
+			t.Setenv(clouddeploy.LocationEnvKey, "us-central1")
+			t.Setenv(clouddeploy.PipelineEnvKey, "dp")
+			t.Setenv(clouddeploy.ReleaseEnvKey, "rel-1")
+			t.Setenv(clouddeploy.RolloutEnvKey, tc.rollout)
+			got, err := queryAnchorTime(context.Background(), tc.anchorToRollout, toolStart, service)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("queryAnchorTime() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if !got.Equal(tc.want) {
+				t.Errorf("queryAnchorTime() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetQueryTextAggregate(t *testing.T) {
+	tableName = "cloud_run_revision"
+	metricType = "run.googleapis.com/request_count"
+	predicates = "resource.service_name == 'my-service'"
+	slidingWindow = time.Minute
+	responseCodeClass = "5xx"
+	customQuery = ""
+	aggregate = true
+	defer func() { aggregate = false }()
+
+	got := getQueryText(time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC))
+	want := "fetch cloud_run_revision::run.googleapis.com/request_count" +
+		" | (resource.service_name == 'my-service')" +
+		" | within d'2024/03/04 05:06:07'" +
+		" | group_by sliding(1m0s), [errors: sum(if(response_code_class == '5xx', val(), 0)), total: sum(val())]"
+	if got != want {
+		t.Errorf("getQueryText() = %q, want %q", got, want)
+	}
+}
+
+// countsSeries returns a time series with a point holding the error and total counts for each
+// one minute window, ordered from newest to oldest.
+func countsSeries(end time.Time, counts ...[2]int64) *monitoringpb.TimeSeriesData {
+	ts := &monitoringpb.TimeSeriesData{}
+	for i, c := range counts {
+		e := end.Add(-time.Duration(i) * time.Minute)
+		ts.PointData = append(ts.PointData, &monitoringpb.TimeSeriesData_PointData{
+			Values: []*monitoringpb.TypedValue{
+				{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: c[0]}},
+				{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: c[1]}},
+			},
+			TimeInterval: &monitoringpb.TimeInterval{
+				StartTime: timestamppb.New(e.Add(-time.Minute)),
+				EndTime:   timestamppb.New(e),
+			},
+		})
+	}
+	return ts
+}
+
+func TestAggregatePoints(t *testing.T) {
+	end := time.Date(2024, 3, 4, 5, 6, 0, 0, time.UTC)
+	series := []*monitoringpb.TimeSeriesData{
+		// A low traffic instance that only serves errors.
+		countsSeries(end, [2]int64{2, 2}, [2]int64{1, 1}, [2]int64{0, 1}),
+		// A high traffic instance that rarely serves errors.
+		countsSeries(end, [2]int64{0, 98}, [2]int64{9, 99}, [2]int64{0, 0}),
+	}
+	points, err := aggregatePoints(series)
+	if err != nil {
+		t.Fatalf("aggregatePoints() failed: %v", err)
+	}
+	wantRatios := []float64{0.02, 0.1, 0}
+	if len(points) != len(wantRatios) {
+		t.Fatalf("aggregatePoints() returned %d points, want %d", len(points), len(wantRatios))
+	}
+	for i, p := range points {
+		if got := p.GetValues()[0].GetDoubleValue(); math.Abs(got-wantRatios[i]) > 1e-9 {
+			t.Errorf("point %d ratio = %v, want %v", i, got, wantRatios[i])
+		}
+		if wantEnd := end.Add(-time.Duration(i) * time.Minute); !p.GetTimeInterval().GetEndTime().AsTime().Equal(wantEnd) {
+			t.Errorf("point %d end time = %v, want %v", i, p.GetTimeInterval().GetEndTime().AsTime(), wantEnd)
+		}
+	}
+
+	if _, err := aggregatePoints([]*monitoringpb.TimeSeriesData{{PointData: []*monitoringpb.TimeSeriesData_PointData{{Values: []*monitoringpb.TypedValue{{}}}}}}); err == nil {
+		t.Errorf("aggregatePoints() expected error for a point with a single value")
+	}
+}
+
+func TestAggregateTriggered(t *testing.T) {
+	maxErrorPercentage = 10
+	triggerDuration = 2 * time.Minute
+	end := time.Date(2024, 3, 4, 5, 6, 0, 0, time.UTC)
+	lowTraffic := countsSeries(end, [2]int64{1, 1}, [2]int64{1, 1}, [2]int64{1, 1})
+
+	tests := []struct {
+		name   string
+		series []*monitoringpb.TimeSeriesData
+		want   bool
+	}{
+		{
+			name:   "errors diluted by other series",
+			series: []*monitoringpb.TimeSeriesData{lowTraffic, countsSeries(end, [2]int64{0, 99}, [2]int64{0, 99}, [2]int64{0, 99})},
+			want:   false,
+		},
+		{
+			name:   "errors across series",
+			series: []*monitoringpb.TimeSeriesData{lowTraffic, countsSeries(end, [2]int64{10, 99}, [2]int64{10, 99}, [2]int64{0, 99})},
+			want:   true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			points, err := aggregatePoints(tc.series)
+			if err != nil {
+				t.Fatalf("aggregatePoints() failed: %v", err)
+			}
+			b, err := findBreach(points)
+			if err != nil {
+				t.Fatalf("findBreach() failed: %v", err)
+			}
+			if got := b != nil; got != tc.want {
+				t.Errorf("findBreach() returned breach %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandleBreach(t *testing.T) {
+	breach := errors.New("error condition triggered")
+	if err := handleBreach(onBreachFail, breach); err != breach {
+		t.Errorf("handleBreach(%q) = %v, want %v", onBreachFail, err, breach)
+	}
+	if err := handleBreach(onBreachWarn, breach); err != nil {
+		t.Errorf("handleBreach(%q) = %v, want nil", onBreachWarn, err)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	maxErrorPercentage = 10
+	triggerDuration = 2 * time.Minute
+	end := time.Date(2024, 3, 4, 5, 10, 0, 0, time.UTC)
+	defer func() { warmupEnd = time.Time{} }()
+
+	tests := []struct {
+		name      string
+		warmupEnd time.Time
+		ratios    []float64
+		want      bool
+	}{
+		{
+			name:   "no warmup",
+			ratios: []float64{0.5, 0.5, 0.5},
+			want:   true,
+		},
+		{
+			name:      "breach during warmup",
+			warmupEnd: end.Add(-time.Minute),
+			ratios:    []float64{0.01, 0.5, 0.5},
+			want:      false,
+		},
+		{
+			name:      "breach continues past warmup",
+			warmupEnd: end.Add(-2 * time.Minute),
+			ratios:    []float64{0.5, 0.5, 0.5},
+			want:      true,
+		},
+		{
+			name:      "breach only partially past warmup",
+			warmupEnd: end.Add(-time.Minute),
+			ratios:    []float64{0.5, 0.5, 0.5},
+			want:      false,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			warmupEnd = tc.warmupEnd
+			b, err := findBreach(ratioPoints(end, tc.ratios...))
+			if err != nil {
+				t.Fatalf("findBreach() failed: %v", err)
+			}
+			if got := b != nil; got != tc.want {
+				t.Errorf("findBreach() returned breach %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMinDataPoints(t *testing.T) {
+	maxErrorPercentage = 10
+	triggerDuration = 2 * time.Minute
+	end := time.Date(2024, 3, 4, 5, 10, 0, 0, time.UTC)
+	defer func() { minDataPoints = 0 }()
+
+	tests := []struct {
+		name           string
+		minDataPoints  int
+		points         []*monitoringpb.TimeSeriesData_PointData
+		want           bool
+		wantConclusive bool
+	}{
+		{
+			name:           "no minimum",
+			points:         ratioPoints(end, 0.5, 0.5),
+			want:           true,
+			wantConclusive: true,
+		},
+		{
+			name:           "breach deferred for lack of data",
+			minDataPoints:  3,
+			points:         ratioPoints(end, 0.5, 0.5),
+			want:           false,
+			wantConclusive: false,
+		},
+		{
+			name:           "breach with enough data",
+			minDataPoints:  3,
+			points:         ratioPoints(end, 0.5, 0.5, 0.5),
+			want:           true,
+			wantConclusive: true,
+		},
+		{
+			name:           "aggregate deferred for lack of data",
+			minDataPoints:  3,
+			points:         mustAggregatePoints(t, countsSeries(end, [2]int64{5, 10}, [2]int64{5, 10}), countsSeries(end, [2]int64{5, 10}, [2]int64{5, 10})),
+			want:           false,
+			wantConclusive: false,
+		},
+		{
+			name:           "aggregate with enough data",
+			minDataPoints:  3,
+			points:         mustAggregatePoints(t, countsSeries(end, [2]int64{5, 10}, [2]int64{5, 10}), countsSeries(end, [2]int64{5, 10}, [2]int64{5, 10}, [2]int64{0, 10})),
+			want:           true,
+			wantConclusive: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			minDataPoints = tc.minDataPoints
+			b, conclusive, err := evaluatePoints(tc.points)
+			if err != nil {
+				t.Fatalf("evaluatePoints() failed: %v", err)
+			}
+			if got := b != nil; got != tc.want {
+				t.Errorf("evaluatePoints() returned breach %v, want %v", got, tc.want)
+			}
+			if conclusive != tc.wantConclusive {
+				t.Errorf("evaluatePoints() conclusive = %v, want %v", conclusive, tc.wantConclusive)
+			}
+		})
+	}
+}
+
+func TestHandleInconclusive(t *testing.T) {
+	defer func() { onInconclusive = onInconclusiveSucceed }()
+	a, b := checkFromFlags(), checkFromFlags()
+	a.Name, b.Name = "server-errors", "client-errors"
+	checks := []check{a, b}
+
+	tests := []struct {
+		name           string
+		onInconclusive string
+		evaluated      []bool
+		wantVerdict    string
+		wantErr        bool
+	}{
+		{name: "all evaluated", onInconclusive: onInconclusiveFail, evaluated: []bool{true, true}, wantVerdict: verdictSucceeded},
+		{name: "inconclusive succeeds", onInconclusive: onInconclusiveSucceed, evaluated: []bool{true, false}, wantVerdict: verdictInconclusive},
+		{name: "inconclusive fails", onInconclusive: onInconclusiveFail, evaluated: []bool{false, true}, wantVerdict: verdictInconclusive, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			onInconclusive = tc.onInconclusive
+			res := &result{}
+			err := handleInconclusive(res, checks, tc.evaluated)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("handleInconclusive() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if res.Verdict != tc.wantVerdict {
+				t.Errorf("got verdict: %q, want: %q", res.Verdict, tc.wantVerdict)
+			}
+		})
+	}
+}
+
+// mustAggregatePoints returns the aggregate points of the time series, failing the test on error.
+func mustAggregatePoints(t *testing.T, series ...*monitoringpb.TimeSeriesData) []*monitoringpb.TimeSeriesData_PointData {
+	t.Helper()
+	points, err := aggregatePoints(series)
+	if err != nil {
+		t.Fatalf("aggregatePoints() failed: %v", err)
+	}
+	return points
+}
+
+func TestRedactEnvVars(t *testing.T) {
+	t.Setenv("VERIFY_AUTH_TOKEN", "s3cr3t-value")
+	t.Setenv("VERIFY_SERVICE_NAME", "my-service")
+
+	query := replaceEnvVars("filter resource.service_name == '$VERIFY_SERVICE_NAME' && metric.token == '$VERIFY_AUTH_TOKEN'")
+	got := redactEnvVars(query)
+	want := "filter resource.service_name == 'my-service' && metric.token == '" + clouddeploy.RedactedValue + "'"
+	if got != want {
+		t.Errorf("redactEnvVars() got: %q, want: %q", got, want)
+	}
+}
+
+func TestParseMonitoringEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+		wantErr  bool
+	}{
+		{endpoint: "monitoring.googleapis.com", want: "monitoring.googleapis.com:443"},
+		{endpoint: "monitoring.googleapis.com:443", want: "monitoring.googleapis.com:443"},
+		{endpoint: "restricted.googleapis.com:8443", want: "restricted.googleapis.com:8443"},
+		{endpoint: "https://monitoring.googleapis.com", wantErr: true},
+		{endpoint: "monitoring.googleapis.com/v3", wantErr: true},
+		{endpoint: "-monitoring.googleapis.com", wantErr: true},
+		{endpoint: "monitoring..googleapis.com", wantErr: true},
+		{endpoint: "monitoring.googleapis.com:https", wantErr: true},
+		{endpoint: "monitoring.googleapis.com:0", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.endpoint, func(t *testing.T) {
+			got, err := parseMonitoringEndpoint(tc.endpoint)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("parseMonitoringEndpoint(%q) got: %q, want an error", tc.endpoint, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMonitoringEndpoint(%q) unexpected error: %v", tc.endpoint, err)
+			}
+			if got != tc.want {
+				t.Errorf("parseMonitoringEndpoint(%q) got: %q, want: %q", tc.endpoint, got, tc.want)
+			}
+		})
+	}
+}
+
+// fakeQueryServer records the time series queries it receives.
+type fakeQueryServer struct {
+	monitoringpb.UnimplementedQueryServiceServer
+	queries []string
+}
+
+func (s *fakeQueryServer) QueryTimeSeries(_ context.Context, req *monitoringpb.QueryTimeSeriesRequest) (*monitoringpb.QueryTimeSeriesResponse, error) {
+	s.queries = append(s.queries, req.GetQuery())
+	return &monitoringpb.QueryTimeSeriesResponse{}, nil
+}
+
+func TestNewQueryClientEndpoint(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	fake := &fakeQueryServer{}
+	srv := grpc.NewServer()
+	monitoringpb.RegisterQueryServiceServer(srv, fake)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	ctx := context.Background()
+	client, err := newQueryClient(ctx, "localhost:"+port,
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	)
+	if err != nil {
+		t.Fatalf("newQueryClient() unexpected error: %v", err)
+	}
+	defer client.Close()
+
+	it := client.QueryTimeSeries(ctx, &monitoringpb.QueryTimeSeriesRequest{Name: "projects/my-project", Query: "fetch test"})
+	if _, err := it.Next(); err != iterator.Done {
+		t.Fatalf("QueryTimeSeries() got: %v, want: %v", err, iterator.Done)
+	}
+	if len(fake.queries) != 1 || fake.queries[0] != "fetch test" {
+		t.Errorf("queries received by the endpoint got: %v, want: [fetch test]", fake.queries)
+	}
+
+	if _, err := newQueryClient(ctx, "https://monitoring.googleapis.com"); err == nil {
+		t.Errorf("newQueryClient() with an invalid endpoint got no error, want an error")
+	}
+}
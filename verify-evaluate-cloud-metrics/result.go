@@ -0,0 +1,120 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+)
+
+// resultObjectName is the name of the result object uploaded under the results path.
+const resultObjectName = "verify-result.json"
+
+// Verdicts of the verification reported in the JSON result.
+const (
+	verdictSucceeded = "SUCCEEDED"
+	verdictFailed    = "FAILED"
+	// verdictWarned is reported when the error condition was triggered but -on-breach is "warn".
+	verdictWarned = "WARNED"
+	// verdictInconclusive is reported when a check never had the minimum data points to be evaluated.
+	verdictInconclusive = "INCONCLUSIVE"
+	// verdictError is reported when the verification couldn't be completed.
+	verdictError = "ERROR"
+)
+
+// result is the final result of the verification, printed as a single JSON line with -json.
+type result struct {
+	Verdict string `json:"verdict"`
+	Message string `json:"message,omitempty"`
+	// Check, Query, MaxErrorPercentage and TriggerDuration describe the error condition that was triggered.
+	Check              string  `json:"check,omitempty"`
+	Query              string  `json:"query,omitempty"`
+	MaxErrorPercentage float64 `json:"maxErrorPercentage,omitempty"`
+	TriggerDuration    string  `json:"triggerDuration,omitempty"`
+	// Breach describes the observed error condition, only set when it was triggered.
+	Breach *breach `json:"breach,omitempty"`
+	// Window is the period the verification monitored for.
+	Window       *timeWindow `json:"window,omitempty"`
+	RefreshCount int         `json:"refreshCount"`
+}
+
+// breach describes the contiguous sliding windows in which the max error percentage was exceeded.
+type breach struct {
+	Start               time.Time `json:"start"`
+	End                 time.Time `json:"end"`
+	Duration            string    `json:"duration"`
+	PeakErrorPercentage float64   `json:"peakErrorPercentage"`
+}
+
+// timeWindow is a period of time.
+type timeWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// setBreach records the triggered error condition of the check that is currently applied.
+func (r *result) setBreach(checkName, query string, b *breach, breachErr error) {
+	r.Check = checkName
+	r.Query = redactEnvVars(query)
+	r.MaxErrorPercentage = maxErrorPercentage
+	r.TriggerDuration = triggerDuration.String()
+	r.Breach = b
+	r.Message = breachErr.Error()
+}
+
+// complete records the error the verification returned, if any. A verification that returned an error
+// without a verdict couldn't be completed.
+func (r *result) complete(err error) {
+	if err == nil {
+		return
+	}
+	r.Message = err.Error()
+	if len(r.Verdict) == 0 {
+		r.Verdict = verdictError
+	}
+}
+
+// writeJSONResult writes the result as a single JSON line.
+func writeJSONResult(w io.Writer, r *result) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// uploadResult uploads the result as a JSON object under the Cloud Storage path and returns its URI.
+func uploadResult(ctx context.Context, s clouddeploy.Storage, gcsPath string, r *result) (string, error) {
+	bucket, prefix, err := parseGCSPath(gcsPath)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal result: %w", err)
+	}
+	uri := fmt.Sprintf("gs://%s/%s", bucket, path.Join(prefix, resultObjectName))
+	if err := s.Upload(ctx, uri, &clouddeploy.GCSUploadContent{Data: data, ContentType: "application/json"}); err != nil {
+		return "", fmt.Errorf("unable to upload result: %w", err)
+	}
+	return uri, nil
+}
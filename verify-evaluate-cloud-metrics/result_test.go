@@ -0,0 +1,175 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ratioPoints returns a point with the error ratio for each one minute window, ordered from newest to oldest.
+func ratioPoints(end time.Time, ratios ...float64) []*monitoringpb.TimeSeriesData_PointData {
+	var points []*monitoringpb.TimeSeriesData_PointData
+	for i, r := range ratios {
+		e := end.Add(-time.Duration(i) * time.Minute)
+		points = append(points, &monitoringpb.TimeSeriesData_PointData{
+			Values: []*monitoringpb.TypedValue{{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: r}}},
+			TimeInterval: &monitoringpb.TimeInterval{
+				StartTime: timestamppb.New(e.Add(-time.Minute)),
+				EndTime:   timestamppb.New(e),
+			},
+		})
+	}
+	return points
+}
+
+func TestFindBreach(t *testing.T) {
+	maxErrorPercentage = 10
+	triggerDuration = 2 * time.Minute
+	end := time.Date(2024, 3, 4, 5, 6, 0, 0, time.UTC)
+
+	b, err := findBreach(ratioPoints(end, 0.2, 0.5, 0.01))
+	if err != nil {
+		t.Fatalf("findBreach() failed: %v", err)
+	}
+	want := &breach{
+		Start:               end.Add(-2 * time.Minute),
+		End:                 end,
+		Duration:            "2m0s",
+		PeakErrorPercentage: 50,
+	}
+	if !reflect.DeepEqual(b, want) {
+		t.Errorf("findBreach() = %+v, want %+v", b, want)
+	}
+
+	if b, err := findBreach(ratioPoints(end, 0.2, 0.01, 0.5)); err != nil || b != nil {
+		t.Errorf("findBreach() = %+v, %v, want no breach", b, err)
+	}
+}
+
+func TestWriteJSONResult(t *testing.T) {
+	maxErrorPercentage = 10
+	triggerDuration = 2 * time.Minute
+	start := time.Date(2024, 3, 4, 5, 0, 0, 0, time.UTC)
+	res := &result{
+		Window:       &timeWindow{Start: start, End: start.Add(6 * time.Minute)},
+		RefreshCount: 3,
+	}
+	res.setBreach("server-errors", "fetch x", &breach{
+		Start:               start.Add(3 * time.Minute),
+		End:                 start.Add(5 * time.Minute),
+		Duration:            "2m0s",
+		PeakErrorPercentage: 50,
+	}, errors.New("verify failed"))
+	res.Verdict = verdictFailed
+	res.complete(errors.New("verify failed"))
+
+	var buf bytes.Buffer
+	if err := writeJSONResult(&buf, res); err != nil {
+		t.Fatalf("writeJSONResult() failed: %v", err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 1 || !strings.HasSuffix(buf.String(), "\n") {
+		t.Errorf("writeJSONResult() wrote %d lines, want a single line: %q", lines, buf.String())
+	}
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("unable to unmarshal the JSON result: %v", err)
+	}
+	want := map[string]any{
+		"verdict":            "FAILED",
+		"message":            "verify failed",
+		"check":              "server-errors",
+		"query":              "fetch x",
+		"maxErrorPercentage": 10.0,
+		"triggerDuration":    "2m0s",
+		"breach": map[string]any{
+			"start":               "2024-03-04T05:03:00Z",
+			"end":                 "2024-03-04T05:05:00Z",
+			"duration":            "2m0s",
+			"peakErrorPercentage": 50.0,
+		},
+		"window": map[string]any{
+			"start": "2024-03-04T05:00:00Z",
+			"end":   "2024-03-04T05:06:00Z",
+		},
+		"refreshCount": 3.0,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected JSON result, got: %v, want: %v", got, want)
+	}
+}
+
+func TestResultComplete(t *testing.T) {
+	tests := []struct {
+		name        string
+		verdict     string
+		err         error
+		wantVerdict string
+	}{
+		{name: "succeeded", verdict: verdictSucceeded, wantVerdict: verdictSucceeded},
+		{name: "warned", verdict: verdictWarned, wantVerdict: verdictWarned},
+		{name: "failed", verdict: verdictFailed, err: errors.New("verify failed"), wantVerdict: verdictFailed},
+		{name: "error", err: errors.New("unable to create NewQueryClient"), wantVerdict: verdictError},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res := &result{Verdict: tc.verdict}
+			res.complete(tc.err)
+			if res.Verdict != tc.wantVerdict {
+				t.Errorf("got: %q, want: %q", res.Verdict, tc.wantVerdict)
+			}
+		})
+	}
+}
+
+func TestUploadResultWarnedBreach(t *testing.T) {
+	maxErrorPercentage = 10
+	triggerDuration = 2 * time.Minute
+	start := time.Date(2024, 3, 4, 5, 0, 0, 0, time.UTC)
+	res := &result{Verdict: verdictWarned, RefreshCount: 1}
+	b := &breach{Start: start, End: start.Add(2 * time.Minute), Duration: "2m0s", PeakErrorPercentage: 50}
+	res.setBreach("server-errors", "fetch x", b, errors.New("verify failed, error condition triggered"))
+	res.complete(handleBreach(onBreachWarn, errors.New("verify failed, error condition triggered")))
+
+	s := clouddeploy.NewMemoryStorage()
+	uri, err := uploadResult(context.Background(), s, "gs://bucket/out/verify", res)
+	if err != nil {
+		t.Fatalf("uploadResult() failed: %v", err)
+	}
+	if want := "gs://bucket/out/verify/verify-result.json"; uri != want {
+		t.Errorf("uploadResult() = %q, want %q", uri, want)
+	}
+	data, ok := s.Get(uri)
+	if !ok {
+		t.Fatalf("result %s not uploaded", uri)
+	}
+	got := &result{}
+	if err := json.Unmarshal(data, got); err != nil {
+		t.Fatalf("unable to unmarshal the result: %v", err)
+	}
+	if got.Verdict != verdictWarned || got.Check != "server-errors" || !reflect.DeepEqual(got.Breach, b) {
+		t.Errorf("the uploaded result doesn't record the breach: %s", data)
+	}
+}
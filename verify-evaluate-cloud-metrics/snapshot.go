@@ -0,0 +1,120 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+)
+
+// outputGCSPathEnvKey is the environment variable holding the Cloud Storage path Cloud Deploy provides for
+// the container's output, used as the default location of the snapshots.
+const outputGCSPathEnvKey = "CLOUD_DEPLOY_OUTPUT_GCS_PATH"
+
+// snapshot records the sliding windows evaluated for a check in a single refresh, uploaded with -snapshot.
+type snapshot struct {
+	Time         time.Time `json:"time"`
+	RefreshCount int       `json:"refreshCount"`
+	Check        string    `json:"check,omitempty"`
+	Query        string    `json:"query"`
+	// Series holds the evaluated windows of each time series, or a single series of the aggregate
+	// windows when aggregating, ordered from newest to oldest.
+	Series [][]snapshotWindow `json:"series"`
+}
+
+// snapshotWindow is the error percentage observed in a sliding window.
+type snapshotWindow struct {
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	ErrorPercentage float64   `json:"errorPercentage"`
+}
+
+// newSnapshot returns an empty snapshot of the check that is currently applied.
+func newSnapshot(now time.Time, refreshCount int, checkName, query string) *snapshot {
+	return &snapshot{
+		Time:         now.UTC(),
+		RefreshCount: refreshCount,
+		Check:        checkName,
+		Query:        redactEnvVars(query),
+		Series:       [][]snapshotWindow{},
+	}
+}
+
+// addSeries records the error percentage of the points of a time series. It's a no-op on a nil snapshot,
+// so the evaluation doesn't need to check whether snapshots are enabled.
+func (s *snapshot) addSeries(points []*monitoringpb.TimeSeriesData_PointData) {
+	if s == nil {
+		return
+	}
+	windows := []snapshotWindow{}
+	for _, p := range points {
+		w := snapshotWindow{
+			Start: p.GetTimeInterval().GetStartTime().AsTime(),
+			End:   p.GetTimeInterval().GetEndTime().AsTime(),
+		}
+		if len(p.GetValues()) != 0 {
+			w.ErrorPercentage = p.GetValues()[0].GetDoubleValue() * 100
+		}
+		windows = append(windows, w)
+	}
+	s.Series = append(s.Series, windows)
+}
+
+// objectName returns the name of the snapshot object under the provided prefix. The name is timestamped
+// and includes the refresh count and check, so the snapshots of a verification sort chronologically.
+func (s *snapshot) objectName(prefix string) string {
+	name := fmt.Sprintf("snapshot-%s-refresh-%03d", s.Time.Format("20060102T150405Z"), s.RefreshCount)
+	if len(s.Check) != 0 {
+		name += "-" + s.Check
+	}
+	return path.Join(prefix, "snapshots", name+".json")
+}
+
+// parseGCSPath splits a Cloud Storage path of the form "gs://{bucket}/{prefix}" into the bucket and prefix.
+func parseGCSPath(gcsPath string) (string, string, error) {
+	trimmed, ok := strings.CutPrefix(gcsPath, "gs://")
+	if !ok {
+		return "", "", fmt.Errorf("%q is not a Cloud Storage path, must start with gs://", gcsPath)
+	}
+	bucket, prefix, _ := strings.Cut(trimmed, "/")
+	if len(bucket) == 0 {
+		return "", "", fmt.Errorf("%q has no bucket", gcsPath)
+	}
+	return bucket, strings.Trim(prefix, "/"), nil
+}
+
+// uploadSnapshot uploads the snapshot as a JSON object under the Cloud Storage path and returns its URI.
+func uploadSnapshot(ctx context.Context, s clouddeploy.Storage, gcsPath string, snap *snapshot) (string, error) {
+	bucket, prefix, err := parseGCSPath(gcsPath)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal snapshot: %w", err)
+	}
+	uri := fmt.Sprintf("gs://%s/%s", bucket, snap.objectName(prefix))
+	if err := s.Upload(ctx, uri, &clouddeploy.GCSUploadContent{Data: data, ContentType: "application/json"}); err != nil {
+		return "", fmt.Errorf("unable to upload snapshot: %w", err)
+	}
+	return uri, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-deploy-samples/custom-targets/util/clouddeploy"
+)
+
+func TestSnapshotJSON(t *testing.T) {
+	t.Setenv("VERIFY_TEST_API_TOKEN", "s3cr3t")
+	end := time.Date(2024, 3, 4, 5, 6, 0, 0, time.UTC)
+	s := newSnapshot(time.Date(2024, 3, 4, 5, 7, 8, 0, time.FixedZone("PST", -8*60*60)), 2, "server-errors", "fetch t::m | filter token == 's3cr3t'")
+	s.addSeries(ratioPoints(end, 0.25, 0.5))
+	s.addSeries(nil)
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("json.Marshal() failed: %v", err)
+	}
+	want := `{"time":"2024-03-04T13:07:08Z","refreshCount":2,"check":"server-errors","query":"fetch t::m | filter token == '[REDACTED]'",` +
+		`"series":[[{"start":"2024-03-04T05:05:00Z","end":"2024-03-04T05:06:00Z","errorPercentage":25},` +
+		`{"start":"2024-03-04T05:04:00Z","end":"2024-03-04T05:05:00Z","errorPercentage":50}],[]]}`
+	if string(data) != want {
+		t.Errorf("json.Marshal() got:\n%s\nwant:\n%s", data, want)
+	}
+
+	if got, want := s.objectName("out/verify"), "out/verify/snapshots/snapshot-20240304T130708Z-refresh-002-server-errors.json"; got != want {
+		t.Errorf("objectName() = %q, want %q", got, want)
+	}
+}
+
+func TestUploadSnapshot(t *testing.T) {
+	s := clouddeploy.NewMemoryStorage()
+	snap := newSnapshot(time.Date(2024, 3, 4, 5, 7, 8, 0, time.UTC), 1, "server-errors", "fetch t::m")
+	snap.addSeries(ratioPoints(time.Date(2024, 3, 4, 5, 6, 0, 0, time.UTC), 0.25))
+
+	uri, err := uploadSnapshot(context.Background(), s, "gs://bucket/out/verify/", snap)
+	if err != nil {
+		t.Fatalf("uploadSnapshot() failed: %v", err)
+	}
+	if want := "gs://bucket/out/verify/snapshots/snapshot-20240304T050708Z-refresh-001-server-errors.json"; uri != want {
+		t.Errorf("uploadSnapshot() = %q, want %q", uri, want)
+	}
+	data, ok := s.Get(uri)
+	if !ok {
+		t.Fatalf("snapshot %s not uploaded", uri)
+	}
+	got := &snapshot{}
+	if err := json.Unmarshal(data, got); err != nil {
+		t.Fatalf("unable to unmarshal the snapshot: %v", err)
+	}
+	if got.Check != snap.Check || len(got.Series) != 1 || len(got.Series[0]) != 1 {
+		t.Errorf("unexpected snapshot uploaded: %s", data)
+	}
+
+	if _, err := uploadSnapshot(context.Background(), s, "bucket/out", snap); err == nil {
+		t.Errorf("uploadSnapshot() with an invalid path succeeded, want error")
+	}
+}
+
+func TestSnapshotNil(t *testing.T) {
+	var s *snapshot
+	// Recording on a nil snapshot, when snapshots are disabled, is a no-op.
+	s.addSeries(ratioPoints(time.Now(), 0.5))
+}
+
+func TestParseGCSPath(t *testing.T) {
+	tests := []struct {
+		path       string
+		wantBucket string
+		wantPrefix string
+		wantErr    bool
+	}{
+		{path: "gs://bucket", wantBucket: "bucket"},
+		{path: "gs://bucket/", wantBucket: "bucket"},
+		{path: "gs://bucket/a/b/", wantBucket: "bucket", wantPrefix: "a/b"},
+		{path: "bucket/a", wantErr: true},
+		{path: "gs:///a", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			bucket, prefix, err := parseGCSPath(tc.path)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseGCSPath() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if bucket != tc.wantBucket || prefix != tc.wantPrefix {
+				t.Errorf("parseGCSPath() = %q, %q, want %q, %q", bucket, prefix, tc.wantBucket, tc.wantPrefix)
+			}
+		})
+	}
+}